@@ -11,6 +11,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/VictorLowther/jsonpatch2/utils"
@@ -396,6 +397,14 @@ func (a *MachineAgent) WaitRunnable() {
 // * AGENT_EXIT if the task signalled that the agent should stop.
 //
 // * AGENT_WAIT_FOR_RUNNABLE if no other conditions were met.
+//
+// If the Job is for a Task in a task group, RunTask gets the Jobs for
+// the rest of the Tasks in the group and runs them all at the same
+// time, and only moves to the next state once all of them are done.
+//
+// If a Job is cancelled while its Task is running, the script it is
+// running is killed, and RunTask waits for the Machine to be runnable
+// again.
 func (a *MachineAgent) RunTask() {
 	runner, err := NewTaskRunner(a.client, a.machine, a.runnerDir, a.chrootDir, a.logger)
 	if err != nil {
@@ -430,28 +439,92 @@ func (a *MachineAgent) RunTask() {
 		runner.Close()
 		return
 	}
-	if err := runner.Run(); err != nil {
-		a.err = err
-		a.initOrExit()
-		return
+	runners := []*TaskRunner{runner}
+	if len(runner.j.Group) > 0 {
+		// The Job is for one of the Tasks in a task group.  Get the
+		// Jobs for the rest of the group, and run them all at once.
+		seen := map[string]bool{runner.j.Key(): true}
+		for {
+			next, err := NewTaskRunner(a.client, a.machine, a.runnerDir, a.chrootDir, a.logger)
+			if err != nil {
+				a.err = err
+				a.initOrExit()
+				return
+			}
+			if next == nil || seen[next.j.Key()] {
+				break
+			}
+			seen[next.j.Key()] = true
+			a.Logf("Runner created for task %s:%s:%s in the same group\n",
+				next.j.Workflow,
+				next.j.Stage,
+				next.j.Task)
+			runners = append(runners, next)
+		}
+	}
+	// Kill the Tasks if their Jobs get cancelled while they run.
+	byJob := map[string]*TaskRunner{}
+	cancelEvents := []string{}
+	for _, runner := range runners {
+		byJob[runner.j.Key()] = runner
+		cancelEvents = append(cancelEvents, "jobs.cancel."+runner.j.Key())
+	}
+	handle, cancels, err := a.events.Register(cancelEvents...)
+	watching := err == nil
+	if !watching {
+		a.Logf("Unable to watch for cancelled jobs: %v\n", err)
+	} else {
+		go func() {
+			for evt := range cancels {
+				if runner, ok := byJob[evt.E.Key]; ok {
+					runner.Cancel()
+				}
+			}
+		}()
+	}
+	errs := make([]error, len(runners))
+	wg := &sync.WaitGroup{}
+	for i := range runners {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = runners[i].Run()
+		}(i)
+	}
+	wg.Wait()
+	if watching {
+		a.events.Deregister(handle)
+	}
+	for _, err := range errs {
+		if err != nil {
+			a.err = err
+			a.initOrExit()
+			return
+		}
 	}
 	a.state = AGENT_WAIT_FOR_RUNNABLE
-	if runner.t != nil {
+	var reboot, poweroff, stop, failed bool
+	for _, runner := range runners {
+		if runner.t == nil {
+			continue
+		}
 		defer runner.Close()
+		if runner.isCancelled() {
+			runner.Log("Task was cancelled")
+			continue
+		}
 		if runner.reboot {
 			runner.Log("Task signalled runner to reboot")
-			a.rebootOrExit(false)
+			reboot = true
 		} else if runner.poweroff {
 			runner.Log("Task signalled runner to poweroff")
-			a.state = AGENT_POWEROFF
+			poweroff = true
 		} else if runner.stop {
 			runner.Log("Task signalled runner to stop")
-			a.state = AGENT_EXIT
+			stop = true
 		} else if runner.failed {
 			runner.Log("Task signalled that it failed")
-			if a.exitOnFailure {
-				a.state = AGENT_EXIT
-			}
+			failed = true
 		}
 		if runner.incomplete {
 			runner.Log("Task signalled that it was incomplete")
@@ -459,6 +532,20 @@ func (a *MachineAgent) RunTask() {
 			runner.Log("Task signalled that it finished normally")
 		}
 	}
+	// When Tasks in a group disagree, the most drastic thing any of
+	// them asked for wins.
+	switch {
+	case reboot:
+		a.rebootOrExit(false)
+	case poweroff:
+		a.state = AGENT_POWEROFF
+	case stop:
+		a.state = AGENT_EXIT
+	case failed:
+		if a.exitOnFailure {
+			a.state = AGENT_EXIT
+		}
+	}
 }
 
 // WaitChangeStage has waitOn wait for any of the following on the
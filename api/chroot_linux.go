@@ -6,9 +6,19 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"sync"
 	"syscall"
 )
 
+// chrootMounts counts the TaskRunners using the bind mounts in each
+// chroot, so that the Tasks in a group can run in the same chroot at
+// the same time without the first one to finish unmounting everything
+// from under the rest.
+var chrootMounts = struct {
+	sync.Mutex
+	refs map[string]int
+}{refs: map[string]int{}}
+
 func bindMount(newRoots string, srcFS ...string) error {
 	if len(srcFS) == 0 {
 		return nil
@@ -35,9 +45,14 @@ func (r *TaskRunner) enterChroot(cmd *exec.Cmd) error {
 	if r.chrootDir == "" {
 		return nil
 	}
-	if err := bindMount(r.chrootDir, r.bindFSes()...); err != nil {
-		return err
+	chrootMounts.Lock()
+	defer chrootMounts.Unlock()
+	if chrootMounts.refs[r.chrootDir] == 0 {
+		if err := bindMount(r.chrootDir, r.bindFSes()...); err != nil {
+			return err
+		}
 	}
+	chrootMounts.refs[r.chrootDir]++
 	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: r.chrootDir}
 	return nil
 }
@@ -46,6 +61,12 @@ func (r *TaskRunner) exitChroot() {
 	if r.chrootDir == "" {
 		return
 	}
+	chrootMounts.Lock()
+	defer chrootMounts.Unlock()
+	if chrootMounts.refs[r.chrootDir]--; chrootMounts.refs[r.chrootDir] > 0 {
+		return
+	}
+	delete(chrootMounts.refs, r.chrootDir)
 	fses := r.bindFSes()
 	for i := len(fses) - 1; i > -1; i-- {
 		syscall.Unmount(path.Join(r.chrootDir, fses[i]), 0)
@@ -112,6 +112,7 @@ func TestInfo(t *testing.T) {
 				"jobs": {
 					"action":  {},
 					"actions": {},
+					"cancel":  {},
 					"create":  {},
 					"delete":  {},
 					"get":     {},
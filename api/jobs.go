@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -37,11 +38,28 @@ func (c *Client) JobActions(j *models.Job, targetOS string) (models.JobActions,
 	return res, req.Do(&res)
 }
 
+// JobHeartbeat lets the server know that the agent running the Job
+// with the passed UUID is still alive.
+func (c *Client) JobHeartbeat(job string) error {
+	return c.Req().Post(nil).UrlFor("jobs", job, "heartbeat").Do(nil)
+}
+
+// jobHeartbeatInterval is how often the TaskRunner sends heartbeats
+// for the Job it is running.
+const jobHeartbeatInterval = 30 * time.Second
+
 // TaskRunner is responsible for expanding templates and running
 // scripts for a single task.
 type TaskRunner struct {
 	// Status codes that may be returned when a script exits.
 	failed, incomplete, reboot, poweroff, stop, wantChroot bool
+	// The exit code of the last script that was run.
+	exitCode int
+	// Whether the Job was cancelled, and the process that is running
+	// the current script so that it can be killed when that happens.
+	cancelled bool
+	proc      *os.Process
+	mux       *sync.Mutex
 	// Client that the TaskRunner will use to communicate with the API
 	c *Client
 	// The Job that the TaskRunner will log to and update the status of.
@@ -73,6 +91,7 @@ func NewTaskRunner(c *Client, m *models.Machine, agentDir, chrootDir string, log
 		m:        m,
 		agentDir: agentDir,
 		logger:   logger,
+		mux:      &sync.Mutex{},
 	}
 	job := &models.Job{Machine: m.Uuid}
 	if err := c.CreateModel(job); err != nil && err != io.EOF {
@@ -120,6 +139,28 @@ func (r *TaskRunner) Close() {
 	}
 }
 
+// Cancel stops the TaskRunner, killing the script it is running (and
+// anything that script started) if there is one.  The Job will not
+// run any more actions, and will report that it was cancelled.
+func (r *TaskRunner) Cancel() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.cancelled {
+		return
+	}
+	r.cancelled = true
+	if r.proc != nil {
+		r.Log("Job cancelled, killing process %d", r.proc.Pid)
+		killProcessGroup(r.proc)
+	}
+}
+
+func (r *TaskRunner) isCancelled() bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.cancelled
+}
+
 // Log writes the string (with a timestamp) to stderr and to the
 // server-side log for the current job.
 func (r *TaskRunner) Log(s string, items ...interface{}) {
@@ -179,17 +220,29 @@ func (r *TaskRunner) Perform(action *models.JobAction, taskDir string) error {
 		r.Log("Command failed to set up chroot: %v", err)
 		return err
 	}
+	defer r.exitChroot()
+	newProcessGroup(cmd)
 	r.Log("Starting command %s\n\n", cmd.Path)
+	r.mux.Lock()
+	if r.cancelled {
+		r.mux.Unlock()
+		return nil
+	}
 	if err := cmd.Start(); err != nil {
+		r.mux.Unlock()
 		r.Log("Command failed to start: %v", err)
 		return err
 	}
+	r.proc = cmd.Process
+	r.mux.Unlock()
 	// Wait on the process, not the command to exit.
 	// We don't want to auto-close stdout and stderr,
 	// as we will continue to use them.
 	r.Log("Command running")
 	pState, _ := cmd.Process.Wait()
-	r.exitChroot()
+	r.mux.Lock()
+	r.proc = nil
+	r.mux.Unlock()
 	status := pState.Sys().(syscall.WaitStatus)
 	sane := r.t.HasFeature("sane-exit-codes")
 	if !sane {
@@ -197,6 +250,7 @@ func (r *TaskRunner) Perform(action *models.JobAction, taskDir string) error {
 		sane = err == nil && st.Mode().IsRegular()
 	}
 	code := uint(status.ExitStatus())
+	r.exitCode = int(code)
 	r.Log("Command exited with status %d", code)
 	if sane {
 		switch code {
@@ -339,6 +393,15 @@ func (r *TaskRunner) Run() error {
 			{Op: "test", Path: "/State", Value: "running"},
 			{Op: "replace", Path: "/State", Value: finalState},
 			{Op: "replace", Path: "/ExitState", Value: exitState},
+			{Op: "add", Path: "/ExitCode", Value: r.exitCode},
+		}
+		if r.isCancelled() {
+			// The server has already marked the Job as cancelled,
+			// so all that is left is how the script ended.
+			finalPatch = jsonpatch2.Patch{
+				{Op: "test", Path: "/ExitState", Value: "cancelled"},
+				{Op: "add", Path: "/ExitCode", Value: r.exitCode},
+			}
 		}
 		if err := r.c.Req().Patch(finalPatch).UrlForM(r.j).Do(&r.j); err != nil {
 			r.Log("Failed to update job %s:%s:%s to its final state %s", r.j.Workflow, r.j.Stage, r.j.Task, finalState)
@@ -352,6 +415,13 @@ func (r *TaskRunner) Run() error {
 		return finalErr
 	}
 	r.j = obj.(*models.Job)
+	// Send heartbeats until we are done with the Job, so that the
+	// server can tell the difference between a slow Task and a dead
+	// machine.  This is deferred after the final state patch, so it
+	// stops before that happens.
+	heartbeatDone := make(chan struct{})
+	defer close(heartbeatDone)
+	go r.heartbeat(jKey, heartbeatDone)
 	r.Log("Starting task %s:%s:%s on %s", r.j.Workflow, r.j.Stage, r.j.Task, r.m.Name)
 	// At this point, we are running.
 	var actions models.JobActions
@@ -363,6 +433,9 @@ func (r *TaskRunner) Run() error {
 		actions = allActions.FilterOS(runtime.GOOS)
 	}
 	for i, action := range actions {
+		if r.isCancelled() {
+			break
+		}
 		final := len(actions)-1 == i
 		r.failed = false
 		r.incomplete = false
@@ -384,6 +457,9 @@ func (r *TaskRunner) Run() error {
 			err = r.Perform(action, taskDir)
 			// Contents is a script to run, run it.
 		}
+		if r.isCancelled() {
+			break
+		}
 		if err != nil {
 			r.failed = true
 			finalState = "failed"
@@ -411,6 +487,13 @@ func (r *TaskRunner) Run() error {
 			break
 		}
 	}
+	if r.isCancelled() {
+		// Whatever the script said on its way out does not matter.
+		r.failed, r.incomplete, r.reboot, r.poweroff, r.stop = false, false, false, false, false
+		finalState = "failed"
+		r.Log("Task %s cancelled", r.j.Task)
+		return nil
+	}
 	if !r.failed && !r.incomplete {
 		finalState = "finished"
 	}
@@ -418,6 +501,23 @@ func (r *TaskRunner) Run() error {
 	return nil
 }
 
+// heartbeat sends a heartbeat for the Job every jobHeartbeatInterval
+// until done is closed.
+func (r *TaskRunner) heartbeat(job string, done chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		// A missed heartbeat is not worth failing the Task over, the
+		// server will only give up on us after missing a lot of them.
+		r.c.JobHeartbeat(job)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 // Agent runs the machine Agent on the current machine.
 // It assumes there is only one Agent, which is not actually a safe assumption.
 // We should make it safe someday.
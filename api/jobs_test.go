@@ -443,3 +443,194 @@ Tasks:
 	}
 
 }
+
+func TestJobGroups(t *testing.T) {
+	tjd, err := ioutil.TempDir("", "jobGroupTest-")
+	if err != nil {
+		t.Errorf("Failed to create tmpdir for job group tester")
+		return
+	}
+	defer os.RemoveAll(tjd)
+	os.Setenv("JT", tjd)
+	// Each task waits for the other one to start, so the group can
+	// only finish if both tasks run at the same time.
+	gtask1 := mustDecode(&models.Task{}, `
+Name: gtask1
+Endpoint: ""
+Meta:
+  feature-flags: sane-exit-codes
+Templates:
+  - Name: wait
+    Contents: |
+      #!/usr/bin/env bash
+      touch "$JT"/gtask1.txt
+      for i in $(seq 1 100); do
+        [[ -e "$JT"/gtask2.txt ]] && exit 0
+        sleep 0.1
+      done
+      exit 1
+    Meta: {}
+`).(*models.Task)
+	gtask2 := mustDecode(&models.Task{}, `
+Name: gtask2
+Endpoint: ""
+Meta:
+  feature-flags: sane-exit-codes
+Templates:
+  - Name: wait
+    Contents: |
+      #!/usr/bin/env bash
+      touch "$JT"/gtask2.txt
+      for i in $(seq 1 100); do
+        [[ -e "$JT"/gtask1.txt ]] && exit 0
+        sleep 0.1
+      done
+      exit 1
+    Meta: {}
+`).(*models.Task)
+	gstage := mustDecode(&models.Stage{}, `
+Name: gstage
+Endpoint: ""
+Tasks:
+- group:gtask1,gtask2
+`).(*models.Stage)
+	machine := mustDecode(&models.Machine{}, `
+Address: 192.168.100.111
+BootEnv: local
+Endpoint: ""
+Meta:
+  feature-flags: change-stage-v2
+Name: paul
+Uuid: 5a9fb2a6-1ef5-4a80-a2a5-5fa0a0a3d6c4
+Validated: true
+`).(*models.Machine)
+	for _, obj := range []models.Model{gtask1, gtask2, gstage, machine} {
+		if err := session.CreateModel(obj); err != nil {
+			t.Fatalf("Failed to create %s %s: %v", obj.Prefix(), obj.Key(), err)
+		}
+	}
+	mc := models.Clone(machine).(*models.Machine)
+	mc.Stage = "gstage"
+	res, err := session.PatchTo(machine, mc)
+	if err != nil {
+		t.Fatalf("Failed to set machine to gstage: %v", err)
+	}
+	machine = runAgent(t, res.(*models.Machine), "group:gtask1,gtask2", "finished", "complete")
+	if machine.CurrentTask != len(machine.Tasks) {
+		t.Errorf("ERROR: Machine: currentTask %d, tasks %v:%d", machine.CurrentTask, machine.Tasks, len(machine.Tasks))
+	}
+	j := []*models.Job{}
+	if err := session.Req().Filter("jobs",
+		"Group", "Eq", machine.CurrentJob.String()).
+		Do(&j); err != nil {
+		t.Errorf("Error getting jobs: %v", err)
+	} else if len(j) != 2 {
+		t.Errorf("Expected 2 jobs in the group, not %d", len(j))
+	} else {
+		for _, job := range j {
+			if job.State != "finished" {
+				t.Errorf("Job %s for task %s is %s, not finished", job.Key(), job.Task, job.State)
+			}
+		}
+	}
+	session.Req().Delete(machine)
+	session.Req().Delete(gstage)
+	session.Req().Delete(gtask1)
+	session.Req().Delete(gtask2)
+	j = []*models.Job{}
+	if err := session.Req().UrlFor("jobs").Do(&j); err != nil {
+		t.Errorf("Error getting jobs: %v", err)
+	} else {
+		for _, job := range j {
+			session.Req().Delete(job)
+		}
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	tjd, err := ioutil.TempDir("", "jobCancelTest-")
+	if err != nil {
+		t.Errorf("Failed to create tmpdir for job cancel tester")
+		return
+	}
+	defer os.RemoveAll(tjd)
+	os.Setenv("JT", tjd)
+	ctask := mustDecode(&models.Task{}, `
+Name: ctask
+Endpoint: ""
+Meta:
+  feature-flags: sane-exit-codes
+Templates:
+  - Name: hang
+    Contents: |
+      #!/usr/bin/env bash
+      touch "$JT"/ctask.txt
+      sleep 60 &
+      wait
+    Meta: {}
+`).(*models.Task)
+	cstage := mustDecode(&models.Stage{}, `
+Name: cstage
+Endpoint: ""
+Tasks:
+- ctask
+`).(*models.Stage)
+	machine := mustDecode(&models.Machine{}, `
+Address: 192.168.100.112
+BootEnv: local
+Endpoint: ""
+Meta:
+  feature-flags: change-stage-v2
+Name: ringo
+Uuid: 0c3a4a8e-5a4f-4d7b-9a0e-7d3c2f9a6b51
+Validated: true
+`).(*models.Machine)
+	for _, obj := range []models.Model{ctask, cstage, machine} {
+		if err := session.CreateModel(obj); err != nil {
+			t.Fatalf("Failed to create %s %s: %v", obj.Prefix(), obj.Key(), err)
+		}
+	}
+	mc := models.Clone(machine).(*models.Machine)
+	mc.Stage = "cstage"
+	res, err := session.PatchTo(machine, mc)
+	if err != nil {
+		t.Fatalf("Failed to set machine to cstage: %v", err)
+	}
+	// Cancel the Job once the task has started.
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(tjd + "/ctask.txt"); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		m := &models.Machine{}
+		if err := session.FillModel(m, machine.Key()); err != nil {
+			t.Errorf("Failed to fetch machine: %v", err)
+			return
+		}
+		job := &models.Job{}
+		if err := session.Req().Post(nil).UrlFor("jobs", m.CurrentJob.String(), "cancel").Do(job); err != nil {
+			t.Errorf("Failed to cancel job: %v", err)
+		}
+	}()
+	start := time.Now()
+	machine = runAgent(t, res.(*models.Machine), "ctask", "failed", "cancelled")
+	if time.Since(start) > 30*time.Second {
+		t.Errorf("Task was not killed when its job was cancelled")
+	}
+	if machine.Runnable {
+		t.Errorf("Machine %s is still runnable after its job was cancelled", machine.Name)
+	}
+	session.Req().Delete(machine)
+	session.Req().Delete(cstage)
+	session.Req().Delete(ctask)
+	j := []*models.Job{}
+	if err := session.Req().UrlFor("jobs").Do(&j); err != nil {
+		t.Errorf("Error getting jobs: %v", err)
+	} else {
+		for _, job := range j {
+			session.Req().Delete(job)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+// +build !windows
+
+package api
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// newProcessGroup arranges for cmd to run in a process group of its
+// own, so that killProcessGroup can get rid of anything it starts.
+func newProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills p and everything else in its process group.
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,16 @@
+// +build windows
+
+package api
+
+import (
+	"os"
+	"os/exec"
+)
+
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills p.  Windows has no process groups to kill
+// along with it.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"net"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// bootFetchLimit is how many BootFetches are kept for each Machine.
+const bootFetchLimit = 50
+
+// bootFetches remembers the files each Machine fetched most recently.
+// They are only kept in memory, since they are only useful while a
+// Machine is booting.
+type bootFetches struct {
+	mux    *sync.Mutex
+	recent map[string][]*models.BootFetch
+}
+
+func newBootFetches() *bootFetches {
+	return &bootFetches{
+		mux:    &sync.Mutex{},
+		recent: map[string][]*models.BootFetch{},
+	}
+}
+
+func (b *bootFetches) add(f *models.BootFetch) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	res := append(b.recent[f.Machine], f)
+	if len(res) > bootFetchLimit {
+		res = res[len(res)-bootFetchLimit:]
+	}
+	b.recent[f.Machine] = res
+}
+
+func (b *bootFetches) get(uuid string) []*models.BootFetch {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	res := make([]*models.BootFetch, len(b.recent[uuid]))
+	copy(res, b.recent[uuid])
+	return res
+}
+
+func (b *bootFetches) forget(uuid string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.recent, uuid)
+}
+
+// machineForAddress returns the Machine whose Address is addr, or
+// that has an unexpired MAC lease on it.
+func machineForAddress(rt *RequestTracker, addr net.IP) *Machine {
+	idx := (&Machine{Machine: &models.Machine{}}).Indexes()["Address"]
+	if m := rt.FindByIndex("machines", idx, addr.String()); m != nil {
+		return AsMachine(m)
+	}
+	if found := rt.Find("leases", models.Hexaddr(addr)); found != nil {
+		if l := AsLease(found); l.Strategy == "MAC" && !l.Expired() {
+			return rt.MachineForMac(l.Token)
+		}
+	}
+	return nil
+}
+
+// fetchStage works out which part of the boot process the file at p
+// belongs to for the Machine.
+func (n *Machine) fetchStage(rt *RequestTracker, p string) string {
+	p = path.Clean("/" + p)
+	if strings.HasPrefix(p, "/"+n.Path()+"/") {
+		return "config"
+	}
+	if found := rt.Find("bootenvs", n.BootEnv); found != nil {
+		env := AsBootEnv(found)
+		if arch := env.ArchFor(n.Arch); arch != "" && env.OS.Name != "" {
+			if kernel := env.KernelFor(arch); kernel != "" && p == env.PathFor(kernel, arch) {
+				return "kernel"
+			}
+			for _, initrd := range env.InitrdsFor(arch) {
+				if p == env.PathFor(initrd, arch) {
+					return "initrd"
+				}
+			}
+			if strings.HasPrefix(p, env.PathFor("", arch)+"/") {
+				return "repo"
+			}
+		}
+	}
+	if strings.HasPrefix(p, "/pxelinux.cfg/") || strings.HasPrefix(p, "/grub/") {
+		return "bootloader"
+	}
+	switch path.Ext(p) {
+	case ".efi", ".0", ".ipxe", ".pxe", ".kpxe", ".lkrn":
+		return "bootloader"
+	}
+	return "other"
+}
+
+// RecordBootFetch finds the Machine that fetched a file from addr, and
+// adds f to the files it fetched recently after filling in its
+// Machine, BootEnv, and Stage.  It returns nil if no Machine has that
+// address.
+func RecordBootFetch(rt *RequestTracker, addr net.IP, f *models.BootFetch) *Machine {
+	var m *Machine
+	rt.Do(func(d Stores) {
+		if m = machineForAddress(rt, addr); m == nil {
+			return
+		}
+		f.Machine = m.UUID()
+		f.BootEnv = m.BootEnv
+		f.Stage = m.fetchStage(rt, f.Path)
+	})
+	if m != nil {
+		rt.dt.bootFetches.add(f)
+	}
+	return m
+}
+
+// BootFetches returns the files the Machine with the passed UUID
+// fetched most recently, oldest first.
+func BootFetches(rt *RequestTracker, uuid string) ([]*models.BootFetch, error) {
+	var found models.Model
+	rt.Do(func(d Stores) {
+		found = d("machines").Find(uuid)
+	})
+	if found == nil {
+		return nil, &models.Error{
+			Type:     "GET",
+			Code:     404,
+			Model:    "machines",
+			Key:      uuid,
+			Messages: []string{"Not Found"},
+		}
+	}
+	return rt.dt.bootFetches.get(uuid), nil
+}
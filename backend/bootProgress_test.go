@@ -0,0 +1,64 @@
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestBootFetches(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "machines", "bootenvs", "leases", "stages", "profiles", "workflows", "tasks", "templates")
+	byAddr := uuid.NewRandom()
+	byLease := uuid.NewRandom()
+	for _, obj := range []crudTest{
+		{"Machine with Address", rt.Create, &models.Machine{Uuid: byAddr, Name: "addr.fqdn", Address: net.ParseIP("10.5.0.5")}, true},
+		{"Machine with a lease", rt.Create, &models.Machine{Uuid: byLease, Name: "lease.fqdn", HardwareAddrs: []string{"52:54:00:aa:bb:05"}}, true},
+		{"Active Lease", rt.Create, &models.Lease{Addr: net.ParseIP("10.5.0.6"), Token: "52:54:00:aa:bb:05", Strategy: "MAC", State: "ACK", ExpireTime: time.Now().Add(time.Hour)}, true},
+	} {
+		obj.Test(t, rt)
+	}
+	for _, test := range []struct {
+		addr, path, machine, stage string
+	}{
+		{"10.5.0.5", "/ipxe.efi", byAddr.String(), "bootloader"},
+		{"10.5.0.5", "/pxelinux.cfg/default", byAddr.String(), "bootloader"},
+		{"10.5.0.5", "/machines/" + byAddr.String() + "/ipxe", byAddr.String(), "config"},
+		{"10.5.0.6", "/files/thing", byLease.String(), "other"},
+		{"10.5.0.7", "/ipxe.efi", "", ""},
+	} {
+		f := &models.BootFetch{Path: test.path}
+		m := RecordBootFetch(rt, net.ParseIP(test.addr), f)
+		if test.machine == "" {
+			if m != nil {
+				t.Errorf("%s: expected no Machine, got %s", test.addr, m.UUID())
+			}
+			continue
+		}
+		if m == nil || f.Machine != test.machine {
+			t.Errorf("%s: expected Machine %s, got %s", test.addr, test.machine, f.Machine)
+		}
+		if f.Stage != test.stage {
+			t.Errorf("%s: expected stage %s for %s, got %s", test.addr, test.stage, test.path, f.Stage)
+		}
+	}
+	res, err := BootFetches(rt, byAddr.String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(res) != 3 || res[0].Path != "/ipxe.efi" {
+		t.Errorf("Expected 3 fetches starting with /ipxe.efi, got %d", len(res))
+	}
+	for i := 0; i < bootFetchLimit+5; i++ {
+		RecordBootFetch(rt, net.ParseIP("10.5.0.6"), &models.BootFetch{Path: "/files/thing"})
+	}
+	if res, _ := BootFetches(rt, byLease.String()); len(res) != bootFetchLimit {
+		t.Errorf("Expected %d fetches, got %d", bootFetchLimit, len(res))
+	}
+	if _, err := BootFetches(rt, uuid.NewRandom().String()); err == nil {
+		t.Errorf("Expected an error getting fetches for a missing machine")
+	}
+}
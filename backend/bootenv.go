@@ -2,15 +2,12 @@ package backend
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
@@ -303,8 +300,10 @@ func (b *BootEnv) fillInstallRepos() {
 		fileRoot := b.rt.dt.FileRoot
 		l := b.rt.Logger
 		b.pathLookasides[realArch] = func(p string) (io.Reader, error) {
-			// Always use local copy if available
-			if _, err := os.Stat(path.Join(fileRoot, b.PathFor("", arch))); err == nil || b.installRepos[realArch] == nil {
+			// Always use local copy if available.  Only the kernel and
+			// initrds may have been extracted from the ISO, so check for
+			// the file itself.
+			if _, err := os.Stat(path.Join(fileRoot, p)); err == nil || b.installRepos[realArch] == nil {
 				return nil, nil
 			}
 			tgtUri := strings.TrimSuffix(b.installRepos[realArch].URL, "/") + strings.TrimPrefix(p, pf)
@@ -359,40 +358,6 @@ func (b *BootEnv) genRoot(commonRoot *template.Template, e models.ErrorAdder) *t
 	return res
 }
 
-func explodeISO(rt *RequestTracker, envName, osName, fileRoot, isoFile, dest, shaSum string) {
-	p := rt.dt
-	explodeMux.Lock()
-	defer explodeMux.Unlock()
-	// Only check the has if we have one.
-	if shaSum != "" {
-		f, err := os.Open(isoFile)
-		if err != nil {
-			rt.Errorf("Explode ISO: failed to open iso file %s: %v", p.reportPath(isoFile), err)
-			return
-		}
-		defer f.Close()
-		hasher := sha256.New()
-		if _, err := io.Copy(hasher, f); err != nil {
-			rt.Errorf("Explode ISO: failed to read iso file %s: %v", p.reportPath(isoFile), err)
-			return
-		}
-		hash := hex.EncodeToString(hasher.Sum(nil))
-		if hash != shaSum {
-			rt.Errorf("Explode ISO: SHA256 bad. actual: %v expected: %v", hash, shaSum)
-			return
-		}
-	}
-	// Call extract script
-	// /explode_iso.sh b.OS.Name fileRoot isoPath path.Dir(canaryPath)
-	cmdName := path.Join(fileRoot, "explode_iso.sh")
-	cmdArgs := []string{osName, fileRoot, isoFile, dest, shaSum}
-	out, err := exec.Command(cmdName, cmdArgs...).CombinedOutput()
-	if err != nil {
-		rt.Errorf("Explode ISO: explode_iso.sh failed for %s: %s", envName, err)
-		rt.Errorf("Command output:\n%s", string(out))
-	}
-}
-
 func (b *BootEnv) sledgeExploder(rt *RequestTracker, arch string, archInfo models.ArchInfo) func(*RequestTracker) {
 	lp := b.localPathFor(rt, "", arch)
 	isoPath := filepath.Join(rt.dt.FileRoot, "isos", archInfo.IsoFile)
@@ -428,21 +393,31 @@ func (b *BootEnv) sledgeExploder(rt *RequestTracker, arch string, archInfo model
 
 func (b *BootEnv) realExploder(rt *RequestTracker, arch string, archInfo models.ArchInfo) func(*RequestTracker) {
 	// Have we already exploded this?  If file exists, then good!
+	// If we install from a package repository, we only need the kernel
+	// and initrds out of the ISO.
+	partial := b.installRepos[arch] != nil
 	canaryPath := b.localPathFor(rt, "."+strings.Replace(b.OS.Name, "/", "_", -1)+".rebar_canary", arch)
 	buf, err := ioutil.ReadFile(canaryPath)
-	if err == nil && string(bytes.TrimSpace(buf)) == archInfo.Sha256 {
-		rt.Infof("Explode ISO: canary file %s, in place and has proper SHA256\n", rt.dt.reportPath(canaryPath))
-		return nil
+	if err == nil {
+		canary := string(bytes.TrimSpace(buf))
+		if canary == archInfo.Sha256 || (partial && canary == canaryText(archInfo.Sha256, true)) {
+			rt.Infof("Explode ISO: canary file %s, in place and has proper SHA256\n", rt.dt.reportPath(canaryPath))
+			return nil
+		}
 	}
 	isoPath := filepath.Join(rt.dt.FileRoot, "isos", archInfo.IsoFile)
 	lPath := b.localPathFor(rt, "", arch)
+	var want []string
+	if partial {
+		want = append([]string{archInfo.Kernel}, archInfo.Initrds...)
+	}
 	return func(rt *RequestTracker) {
 		name := b.Name
 		osName := b.OS.Name
 		iPath := isoPath
 		localPath := lPath
 		sha256 := archInfo.Sha256
-		explodeISO(rt, name, osName, rt.dt.FileRoot, iPath, localPath, sha256)
+		explodeISO(rt, name, osName, rt.dt.FileRoot, iPath, localPath, sha256, want)
 	}
 }
 
@@ -463,6 +438,10 @@ func (b *BootEnv) IsoExploders(rt *RequestTracker) []func(*RequestTracker) {
 		if _, err := os.Stat(filepath.Join(rt.dt.FileRoot, "isos", isoFile)); err != nil {
 			if b.installRepos[arch] != nil {
 				rt.Infof("BootEnv: Explode ISO: ISO does not exist, falling back to install repo at %s", b.installRepos[arch].URL)
+			} else if archInfo.IsoUrl != "" && rt.sandbox == nil {
+				rt.Infof("BootEnv %s : Explode ISO: Iso %s does not exist, downloading it from %s",
+					b.Name, isoFile, archInfo.IsoUrl)
+				rt.dt.queueIsoDownload(isoFile, archInfo.IsoUrl, archInfo.Sha256)
 			} else {
 				rt.Infof("BootEnv %s : Explode ISO: Iso %s does not exist. Will not be able to PXE boot arch %s",
 					b.Name, isoFile, arch)
@@ -655,15 +634,21 @@ func (b *BootEnv) templates() *template.Template {
 }
 
 func (b *BootEnv) render(rt *RequestTracker, m *Machine, e models.ErrorAdder) renderers {
-	r := newRenderData(rt, m, b)
-	if m == nil {
+	return b.renderWith(newRenderData(rt, m, b), e)
+}
+
+// renderWith builds the renderers for the BootEnv from already made
+// RenderData.  Templates whose paths depend on the Machine's MAC
+// address get a renderer for each of its MAC addresses.
+func (b *BootEnv) renderWith(r *RenderData, e models.ErrorAdder) renderers {
+	if r.Machine == nil {
 		return r.makeRenderers(e)
 	}
 	res := renderers([]renderer{})
 	toRender := r.validateRequiredParams(e)
 	for i := range toRender {
 		if strings.Contains(toRender[i].Path, `{{.Machine.MacAddr `) {
-			for _, mac := range m.HardwareAddrs {
+			for _, mac := range r.Machine.HardwareAddrs {
 				r.Machine.currMac = mac
 				res = r.addRenderer(e, &toRender[i], res)
 			}
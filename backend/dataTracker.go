@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/digitalrebar/logger"
@@ -460,6 +462,12 @@ type DataTracker struct {
 	macAddrMap          map[string]string
 	macAddrMux          *sync.RWMutex
 	licenses            models.LicenseBundle
+	failover            *Failover
+	LeaseHistory        *LeaseHistory
+	subnetUsage         *subnetUsage
+	bootFetches         *bootFetches
+	isoDownloads        *isoDownloads
+	jobHeartbeats       *jobHeartbeats
 }
 
 func (p *DataTracker) LogFor(s string) logger.Logger {
@@ -887,6 +895,11 @@ func NewDataTracker(backend *DataStack,
 		macAddrMap:        map[string]string{},
 		macAddrMux:        &sync.RWMutex{},
 		secretsMux:        &sync.Mutex{},
+		LeaseHistory:      NewLeaseHistory(filepath.Join(logRoot, "lease-history"), 1000, 30*24*time.Hour),
+		subnetUsage:       newSubnetUsage(),
+		bootFetches:       newBootFetches(),
+		isoDownloads:      newIsoDownloads(),
+		jobHeartbeats:     newJobHeartbeats(),
 	}
 
 	// Make sure incoming writable backend has all stores created
@@ -1013,6 +1026,12 @@ func NewDataTracker(backend *DataStack,
 			logger.Fatalf("Failed to render unknown bootenv: %v", err)
 		}
 	})
+	// Retries only live in timers, so start the ones that were
+	// pending when we last stopped.
+	rt = res.Request(res.Logger, "jobs", "tasks", "machines")
+	rt.Do(func(d Stores) {
+		rearmRetries(rt)
+	})
 	return res
 }
 
@@ -1127,7 +1146,9 @@ func (p *DataTracker) SetPrefs(rt *RequestTracker, prefs map[string]string) erro
 				err.AddError(p.RenderUnknown(rt))
 			}
 		case "unknownTokenTimeout",
-			"knownTokenTimeout":
+			"knownTokenTimeout",
+			"jobTimeout",
+			"jobHeartbeatTimeout":
 			if intCheck(name, val) {
 				savePref(name, val)
 			}
@@ -0,0 +1,480 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/models"
+	"github.com/miekg/dns"
+)
+
+// ddnsConfig is the dynamic DNS configuration that applies to an
+// object, taken from the ddns/* params.
+type ddnsConfig struct {
+	Server      string
+	Zone        string
+	ReverseZone string
+	KeyName     string
+	Algorithm   string
+	Secret      string
+	TTL         uint32
+}
+
+// ddnsConfigFor returns the dynamic DNS configuration for obj, or nil
+// if dynamic DNS updates are not configured for it.  Params are
+// aggregated, so they can be set on the object itself, any of its
+// profiles, or the global profile.
+func ddnsConfigFor(rt *RequestTracker, obj models.Paramer) *ddnsConfig {
+	str := func(key string) string {
+		v, _ := rt.GetParam(obj, key, true, true)
+		s, _ := v.(string)
+		return s
+	}
+	c := &ddnsConfig{
+		Server:      str("ddns/server"),
+		Zone:        str("ddns/zone"),
+		ReverseZone: str("ddns/reverse-zone"),
+		KeyName:     str("ddns/tsig-key-name"),
+		Algorithm:   str("ddns/tsig-algorithm"),
+		Secret:      str("ddns/tsig-secret"),
+		TTL:         300,
+	}
+	if c.Server == "" || c.Zone == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		c.Server = net.JoinHostPort(c.Server, "53")
+	}
+	if c.Algorithm == "" {
+		c.Algorithm = "hmac-sha256"
+	}
+	if v, ok := rt.GetParam(obj, "ddns/ttl", true, false); ok {
+		if ttl, ok := v.(float64); ok && ttl > 0 {
+			c.TTL = uint32(ttl)
+		}
+	}
+	return c
+}
+
+// fqdn qualifies name with the forward zone.  Names that are already
+// in the zone are left alone, and names in some other domain are
+// reduced to their first label.
+func (c *ddnsConfig) fqdn(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	zone := strings.TrimSuffix(c.Zone, ".")
+	if name == zone || strings.HasSuffix(name, "."+zone) {
+		return dns.Fqdn(name)
+	}
+	return dns.Fqdn(strings.SplitN(name, ".", 2)[0] + "." + zone)
+}
+
+// reverseZone returns the zone the PTR record for addr should be
+// updated in.  If ddns/reverse-zone is not set, it defaults to the
+// /24 for IPv4 addresses and the /64 for IPv6 addresses.
+func (c *ddnsConfig) reverseZone(addr net.IP) string {
+	if c.ReverseZone != "" {
+		return dns.Fqdn(c.ReverseZone)
+	}
+	arpa, err := dns.ReverseAddr(addr.String())
+	if err != nil {
+		return ""
+	}
+	labels := dns.SplitDomainName(arpa)
+	if addr.To4() != nil {
+		return dns.Fqdn(strings.Join(labels[1:], "."))
+	}
+	return dns.Fqdn(strings.Join(labels[16:], "."))
+}
+
+// messages builds the RFC 2136 updates that add or remove the A or
+// AAAA record for name, and the PTR record for addr.  Adding replaces
+// any records the name and address had before.
+func (c *ddnsConfig) messages(add bool, name string, addr net.IP) []*dns.Msg {
+	fqdn := c.fqdn(name)
+	hdr := dns.RR_Header{Name: fqdn, Class: dns.ClassINET, Ttl: c.TTL}
+	var rr dns.RR
+	if v4 := addr.To4(); v4 != nil {
+		hdr.Rrtype = dns.TypeA
+		rr = &dns.A{Hdr: hdr, A: v4}
+	} else {
+		hdr.Rrtype = dns.TypeAAAA
+		rr = &dns.AAAA{Hdr: hdr, AAAA: addr}
+	}
+	fwd := &dns.Msg{}
+	fwd.SetUpdate(dns.Fqdn(c.Zone))
+	res := []*dns.Msg{fwd}
+	if add {
+		fwd.RemoveRRset([]dns.RR{rr})
+		fwd.Insert([]dns.RR{rr})
+	} else {
+		fwd.Remove([]dns.RR{rr})
+	}
+	arpa, err := dns.ReverseAddr(addr.String())
+	rzone := c.reverseZone(addr)
+	if err != nil || rzone == "" || !dns.IsSubDomain(rzone, arpa) {
+		return res
+	}
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{Name: arpa, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: c.TTL},
+		Ptr: fqdn,
+	}
+	rev := &dns.Msg{}
+	rev.SetUpdate(rzone)
+	if add {
+		rev.RemoveRRset([]dns.RR{ptr})
+		rev.Insert([]dns.RR{ptr})
+	} else {
+		rev.Remove([]dns.RR{ptr})
+	}
+	return append(res, rev)
+}
+
+// send sends an update to the DNS server, signing it with TSIG if a
+// key is configured.
+func (c *ddnsConfig) send(m *dns.Msg) error {
+	client := &dns.Client{Timeout: 5 * time.Second}
+	if c.KeyName != "" {
+		key := dns.Fqdn(c.KeyName)
+		client.TsigSecret = map[string]string{key: c.Secret}
+		m.SetTsig(key, dns.Fqdn(c.Algorithm), 300, time.Now().Unix())
+	}
+	r, _, err := client.Exchange(m, c.Server)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("Server refused update: %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+type ddnsOp struct {
+	cfg    *ddnsConfig
+	add    bool
+	name   string
+	addr   net.IP
+	reason string
+}
+
+type ddnsLease struct {
+	cfg    *ddnsConfig
+	name   string
+	addr   net.IP
+	expire time.Time
+}
+
+func ddnsUsable(name string, addr net.IP) bool {
+	return name != "" && addr != nil && !addr.IsUnspecified()
+}
+
+// DDNS sends dynamic DNS updates (RFC 2136) when leases are bound or
+// expire, and when machines are created, renamed, readdressed, or
+// deleted.  Updates are driven by the ddns/* params, and the result
+// of every update is published as a "ddns" event.
+type DDNS struct {
+	logger.Logger
+	dt       *DataTracker
+	pubs     *Publishers
+	pending  chan *models.Event
+	dropped  int32
+	bound    map[string]*ddnsLease
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// Publish queues lease and machine events for processing.  It never
+// blocks and never logs.
+func (p *DDNS) Publish(e *models.Event) error {
+	if e.Type != "leases" && e.Type != "machines" {
+		return nil
+	}
+	switch e.Action {
+	case "create", "save", "update", "delete":
+	default:
+		return nil
+	}
+	select {
+	case p.pending <- e:
+	default:
+		atomic.AddInt32(&p.dropped, 1)
+	}
+	return nil
+}
+
+func (p *DDNS) Reserve() error { return nil }
+func (p *DDNS) Release()       {}
+func (p *DDNS) Unload()        {}
+
+func (p *DDNS) rt() *RequestTracker {
+	return p.dt.Request(p.Logger, "machines", "profiles", "stages", "params", "leases", "reservations", "subnets")
+}
+
+// machineOwns returns true if a Machine still has the name and
+// address that a lease registered.
+func (p *DDNS) machineOwns(d Stores, b *ddnsLease) bool {
+	for _, i := range d("machines").Items() {
+		m := AsMachine(i)
+		if m.Address.Equal(b.addr) && b.cfg.fqdn(m.Name) == b.cfg.fqdn(b.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseName finds the name to register for a lease, and the dynamic
+// DNS configuration to use.  The name of the Machine the lease belongs
+// to wins, followed by the hostname option (12) of the Reservation for
+// the address.  Leases without a Machine use the params of the Profile
+// named after their Subnet, if there is one.
+func (p *DDNS) leaseName(rt *RequestTracker, d Stores, l *Lease) (string, *ddnsConfig) {
+	var m *Machine
+	if strings.ToUpper(l.Strategy) == "MAC" {
+		m = rt.MachineForMac(l.Token)
+	}
+	if m == nil {
+		for _, i := range d("machines").Items() {
+			if AsMachine(i).Address.Equal(l.Addr) {
+				m = AsMachine(i)
+				break
+			}
+		}
+	}
+	if m != nil {
+		return m.Name, ddnsConfigFor(rt, m)
+	}
+	name := ""
+	if r := l.Reservation(rt); r != nil {
+		for _, opt := range r.Options {
+			if opt.Code == 12 && !strings.Contains(opt.Value, "{{") {
+				name = opt.Value
+			}
+		}
+	}
+	if name == "" {
+		return "", nil
+	}
+	profile := rt.dt.GlobalProfileName
+	if s := l.Subnet(rt); s != nil && d("profiles").Find(s.Name) != nil {
+		profile = s.Name
+	}
+	if pobj := d("profiles").Find(profile); pobj != nil {
+		return name, ddnsConfigFor(rt, AsProfile(pobj))
+	}
+	return "", nil
+}
+
+func (p *DDNS) leaseOps(rt *RequestTracker, d Stores, e *models.Event) []*ddnsOp {
+	l := &Lease{Lease: &models.Lease{}}
+	if err := models.Remarshal(e.Object, l.Lease); err != nil {
+		p.Errorf("DDNS: cannot decode lease %s: %v", e.Key, err)
+		return nil
+	}
+	key := l.Key()
+	reason := "leases:" + key
+	prev := p.bound[key]
+	if e.Action == "delete" || l.State != "ACK" || l.Expired() {
+		if prev == nil {
+			return nil
+		}
+		delete(p.bound, key)
+		if p.machineOwns(d, prev) {
+			return nil
+		}
+		return []*ddnsOp{{prev.cfg, false, prev.name, prev.addr, reason}}
+	}
+	name, cfg := p.leaseName(rt, d, l)
+	if prev != nil && cfg != nil &&
+		*prev.cfg == *cfg &&
+		prev.name == name &&
+		prev.addr.Equal(l.Addr) {
+		// Just a renewal
+		prev.expire = l.ExpireTime
+		return nil
+	}
+	res := []*ddnsOp{}
+	if prev != nil {
+		delete(p.bound, key)
+		res = append(res, &ddnsOp{prev.cfg, false, prev.name, prev.addr, reason})
+	}
+	if cfg == nil || !ddnsUsable(name, l.Addr) {
+		return res
+	}
+	p.bound[key] = &ddnsLease{cfg, name, l.Addr, l.ExpireTime}
+	return append(res, &ddnsOp{cfg, true, name, l.Addr, reason})
+}
+
+func (p *DDNS) machineOps(rt *RequestTracker, e *models.Event) []*ddnsOp {
+	m := &models.Machine{}
+	if err := models.Remarshal(e.Object, m); err != nil {
+		p.Errorf("DDNS: cannot decode machine %s: %v", e.Key, err)
+		return nil
+	}
+	cfg := ddnsConfigFor(rt, m)
+	if cfg == nil {
+		return nil
+	}
+	reason := "machines:" + m.Key()
+	if e.Action == "delete" {
+		if !ddnsUsable(m.Name, m.Address) {
+			return nil
+		}
+		return []*ddnsOp{{cfg, false, m.Name, m.Address, reason}}
+	}
+	old := &models.Machine{}
+	if e.Original != nil {
+		if err := models.Remarshal(e.Original, old); err != nil {
+			p.Errorf("DDNS: cannot decode machine %s: %v", e.Key, err)
+			return nil
+		}
+	}
+	if old.Name == m.Name && old.Address.Equal(m.Address) {
+		return nil
+	}
+	res := []*ddnsOp{}
+	if ddnsUsable(old.Name, old.Address) {
+		res = append(res, &ddnsOp{cfg, false, old.Name, old.Address, reason})
+	}
+	if ddnsUsable(m.Name, m.Address) {
+		res = append(res, &ddnsOp{cfg, true, m.Name, m.Address, reason})
+	}
+	return res
+}
+
+// apply sends the updates for op, and publishes the result.
+func (p *DDNS) apply(op *ddnsOp) {
+	res := &models.DdnsResult{
+		Action:  "remove",
+		Name:    op.cfg.fqdn(op.name),
+		Address: op.addr,
+		Server:  op.cfg.Server,
+		Zone:    dns.Fqdn(op.cfg.Zone),
+		Reason:  op.reason,
+	}
+	if op.add {
+		res.Action = "add"
+	}
+	for i, m := range op.cfg.messages(op.add, op.name, op.addr) {
+		if i > 0 {
+			res.ReverseZone = m.Question[0].Name
+		}
+		if err := op.cfg.send(m); err != nil {
+			res.Error = err.Error()
+			break
+		}
+	}
+	if res.Error != "" {
+		p.Errorf("DDNS: %s %s %s for %s failed: %s", res.Action, res.Name, res.Address, res.Reason, res.Error)
+	} else {
+		p.Infof("DDNS: %s %s %s for %s", res.Action, res.Name, res.Address, res.Reason)
+	}
+	p.pubs.Publish("ddns", res.Action, res.Name, "ddns", res)
+}
+
+func (p *DDNS) handle(e *models.Event) {
+	ops := []*ddnsOp{}
+	rt := p.rt()
+	rt.Do(func(d Stores) {
+		switch e.Type {
+		case "leases":
+			ops = p.leaseOps(rt, d, e)
+		case "machines":
+			ops = p.machineOps(rt, e)
+		}
+	})
+	for _, op := range ops {
+		p.apply(op)
+	}
+}
+
+// seed records the names of the leases that are already bound, so
+// that they can be removed when the leases expire.
+func (p *DDNS) seed() {
+	rt := p.rt()
+	rt.Do(func(d Stores) {
+		for _, i := range d("leases").Items() {
+			l := AsLease(i)
+			if l.State != "ACK" || l.Expired() {
+				continue
+			}
+			if name, cfg := p.leaseName(rt, d, l); cfg != nil && ddnsUsable(name, l.Addr) {
+				p.bound[l.Key()] = &ddnsLease{cfg, name, l.Addr, l.ExpireTime}
+			}
+		}
+	})
+}
+
+// expire removes the names of leases that have expired without being
+// renewed.
+func (p *DDNS) expire() {
+	ops := []*ddnsOp{}
+	rt := p.rt()
+	rt.Do(func(d Stores) {
+		now := time.Now()
+		for key, b := range p.bound {
+			if b.expire.After(now) {
+				continue
+			}
+			delete(p.bound, key)
+			if !p.machineOwns(d, b) {
+				ops = append(ops, &ddnsOp{b.cfg, false, b.name, b.addr, "leases:" + key})
+			}
+		}
+	})
+	for _, op := range ops {
+		p.apply(op)
+	}
+	if n := atomic.SwapInt32(&p.dropped, 0); n > 0 {
+		p.Warnf("DDNS: dropped %d events, DNS may be out of date", n)
+	}
+}
+
+func (p *DDNS) run() {
+	defer close(p.finished)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	p.seed()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.expire()
+		case e := <-p.pending:
+			p.handle(e)
+		}
+	}
+}
+
+// Shutdown stops sending dynamic DNS updates.
+func (p *DDNS) Shutdown(ctx context.Context) error {
+	p.pubs.Remove(p)
+	close(p.done)
+	select {
+	case <-p.finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// StartDDNS starts sending dynamic DNS updates for the leases and
+// machines in the DataTracker.
+func StartDDNS(dt *DataTracker, log logger.Logger, pubs *Publishers) *DDNS {
+	p := &DDNS{
+		Logger:   log,
+		dt:       dt,
+		pubs:     pubs,
+		pending:  make(chan *models.Event, 1000),
+		bound:    map[string]*ddnsLease{},
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	pubs.Add(p)
+	go p.run()
+	return p
+}
@@ -0,0 +1,95 @@
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDdnsMessages(t *testing.T) {
+	c := &ddnsConfig{Zone: "lab.example.com", TTL: 300}
+	for name, want := range map[string]string{
+		"node1":                  "node1.lab.example.com.",
+		"node1.lab.example.com":  "node1.lab.example.com.",
+		"node1.lab.example.com.": "node1.lab.example.com.",
+		"node1.other.com":        "node1.lab.example.com.",
+	} {
+		if got := c.fqdn(name); got != want {
+			t.Errorf("fqdn(%s): expected %s, got %s", name, want, got)
+		}
+	}
+	if z := c.reverseZone(net.ParseIP("192.168.124.10")); z != "124.168.192.in-addr.arpa." {
+		t.Errorf("Wrong default IPv4 reverse zone %s", z)
+	}
+	if z := c.reverseZone(net.ParseIP("fd00:1:2:3::10")); z != "3.0.0.0.2.0.0.0.1.0.0.0.0.0.d.f.ip6.arpa." {
+		t.Errorf("Wrong default IPv6 reverse zone %s", z)
+	}
+	msgs := c.messages(true, "node1", net.ParseIP("192.168.124.10"))
+	if len(msgs) != 2 {
+		t.Fatalf("Expected forward and reverse updates, got %d", len(msgs))
+	}
+	if msgs[0].Question[0].Name != "lab.example.com." || len(msgs[0].Ns) != 2 {
+		t.Errorf("Bad forward update:\n%s", msgs[0])
+	}
+	if a, ok := msgs[0].Ns[1].(*dns.A); !ok || !a.A.Equal(net.ParseIP("192.168.124.10")) {
+		t.Errorf("Forward update does not insert the A record:\n%s", msgs[0])
+	}
+	if ptr, ok := msgs[1].Ns[1].(*dns.PTR); !ok || ptr.Hdr.Name != "10.124.168.192.in-addr.arpa." || ptr.Ptr != "node1.lab.example.com." {
+		t.Errorf("Reverse update does not insert the PTR record:\n%s", msgs[1])
+	}
+	c.ReverseZone = "10.in-addr.arpa"
+	if msgs := c.messages(false, "node1", net.ParseIP("192.168.124.10")); len(msgs) != 1 {
+		t.Errorf("PTR records outside the reverse zone should be skipped")
+	}
+	if msgs := c.messages(false, "node1", net.ParseIP("fd00::10")); len(msgs) != 1 {
+		t.Errorf("Expected only a forward update")
+	} else if _, ok := msgs[0].Ns[0].(*dns.AAAA); !ok || msgs[0].Ns[0].Header().Class != dns.ClassNONE {
+		t.Errorf("Forward update does not remove the AAAA record:\n%s", msgs[0])
+	}
+}
+
+func TestDdnsSend(t *testing.T) {
+	secret := "c2VjcmV0IGtleSBmb3IgdGVzdGluZw=="
+	got := make(chan *dns.Msg, 1)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	srv := &dns.Server{
+		PacketConn: conn,
+		TsigSecret: map[string]string{"drp.": secret},
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := &dns.Msg{}
+			m.SetReply(r)
+			if r.IsTsig() == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeNotAuth
+			} else {
+				got <- r
+			}
+			m.SetTsig("drp.", dns.HmacSHA256, 300, time.Now().Unix())
+			w.WriteMsg(m)
+		}),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	c := &ddnsConfig{
+		Server:    conn.LocalAddr().String(),
+		Zone:      "lab.example.com",
+		KeyName:   "drp",
+		Algorithm: "hmac-sha256",
+		Secret:    secret,
+		TTL:       300,
+	}
+	if err := c.send(c.messages(true, "node1", net.ParseIP("192.168.124.10"))[0]); err != nil {
+		t.Fatalf("Signed update failed: %v", err)
+	}
+	if r := <-got; r.Question[0].Name != "lab.example.com." {
+		t.Errorf("Server got the wrong update:\n%s", r)
+	}
+	c.Secret = "d3Jvbmcgc2VjcmV0"
+	if err := c.send(c.messages(true, "node1", net.ParseIP("192.168.124.10"))[0]); err == nil {
+		t.Errorf("Update signed with the wrong key should fail")
+	}
+}
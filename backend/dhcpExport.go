@@ -0,0 +1,398 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// exportStringOptions are the options whose values are text rather
+// than addresses or numbers.
+var exportStringOptions = map[byte]bool{12: true, 15: true, 17: true, 40: true, 66: true, 67: true}
+
+// exportBootFile is a boot file handed out to the clients of some
+// architectures, or to clients running iPXE if arches is nil.
+type exportBootFile struct {
+	name, file string
+	http       bool
+	arches     []uint16
+}
+
+// bootFiles returns the boot files dr-provision would hand out on
+// the Subnet, iPXE first and then one for each of the PxeLoaders.
+// HTTP Boot clients get a URL on our static file server, so they are
+// left out if there is no next server to point them at.
+func (es *exportSubnet) bootFiles(staticPort int) []exportBootFile {
+	res := []exportBootFile{{name: "ipxe", file: "default.ipxe"}}
+	for _, l := range PxeLoaders {
+		bf := exportBootFile{name: l.Name, file: l.File, http: l.Http, arches: l.Arches}
+		if l.Http {
+			if es.nextServer == nil {
+				continue
+			}
+			bf.file = fmt.Sprintf("http://%s:%d/%s", es.nextServer, staticPort, l.File)
+		}
+		res = append(res, bf)
+	}
+	return res
+}
+
+// exportSubnet is a Subnet along with everything needed to write it
+// out for another DHCP server.
+type exportSubnet struct {
+	*Subnet
+	cidr         *net.IPNet
+	ranges       []models.SubnetRange
+	nextServer   net.IP
+	options      []models.DhcpOption
+	reservations []*Reservation
+}
+
+// pxeBoot returns true if the other server should pick boot files by
+// client architecture the way dr-provision would.
+func (es *exportSubnet) pxeBoot() bool {
+	if es.Unmanaged {
+		return false
+	}
+	for _, o := range es.options {
+		if o.Code == 67 {
+			return false
+		}
+	}
+	return true
+}
+
+// dhcpExporter collects the Subnets and Reservations being exported
+// and anything that could not be expressed in the target format.
+type dhcpExporter struct {
+	subnets    []*exportSubnet
+	staticPort int
+	warnings   []string
+}
+
+func (de *dhcpExporter) warnf(f string, args ...interface{}) {
+	de.warnings = append(de.warnings, fmt.Sprintf(f, args...))
+}
+
+// exportOptionName returns the ISC dhcpd and Kea name of an option
+// code, or "" if it cannot be exported.
+func exportOptionName(code byte) string {
+	for name, c := range importOptionCodes {
+		if c == code {
+			return name
+		}
+	}
+	return ""
+}
+
+// options returns the options in opts that can be exported, warning
+// about the rest.
+func (de *dhcpExporter) options(owner string, opts []models.DhcpOption) []models.DhcpOption {
+	res := []models.DhcpOption{}
+	for _, o := range opts {
+		switch {
+		case strings.Contains(o.Value, "{{"):
+			de.warnf("%s: option %d is a template, skipping it", owner, o.Code)
+		case exportOptionName(o.Code) == "":
+			de.warnf("%s: option %d is not supported, skipping it", owner, o.Code)
+		default:
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// collect gathers the named IPv4 Subnets, or all of them if names is
+// empty, along with the Reservations in each one.
+func (de *dhcpExporter) collect(rt *RequestTracker, d Stores, names []string) error {
+	subnets := []*Subnet{}
+	if len(names) == 0 {
+		for _, i := range d("subnets").Items() {
+			subnets = append(subnets, AsSubnet(i))
+		}
+	}
+	for _, name := range names {
+		found := d("subnets").Find(name)
+		if found == nil {
+			return &models.Error{
+				Type:     "GET",
+				Code:     404,
+				Model:    "subnets",
+				Key:      name,
+				Messages: []string{"Not Found"},
+			}
+		}
+		subnets = append(subnets, AsSubnet(found))
+	}
+	for _, s := range subnets {
+		cidr := s.subnet()
+		if cidr.IP.To4() == nil {
+			de.warnf("Subnet %s is not an IPv4 subnet, skipping it", s.Name)
+			continue
+		}
+		if len(s.ClientClasses) > 0 {
+			de.warnf("Subnet %s: client classes are not exported", s.Name)
+		}
+		es := &exportSubnet{
+			Subnet:       s,
+			cidr:         cidr,
+			options:      de.options("Subnet "+s.Name, s.Options),
+			reservations: []*Reservation{},
+		}
+		if !s.OnlyReservations {
+			es.ranges = s.leasableRanges()
+		}
+		if !s.Unmanaged {
+			if s.NextServer.IsGlobalUnicast() {
+				es.nextServer = s.NextServer
+			} else {
+				es.nextServer = net.ParseIP(rt.dt.LocalIP(cidr.IP)).To4()
+			}
+		}
+		de.subnets = append(de.subnets, es)
+	}
+	for _, i := range d("reservations").Items() {
+		r := AsReservation(i)
+		for _, es := range de.subnets {
+			if !es.cidr.Contains(r.Addr) {
+				continue
+			}
+			if r.Strategy != "MAC" && r.Strategy != "ClientID" {
+				de.warnf("Reservation %s uses the %s strategy, skipping it", r.Key(), r.Strategy)
+			} else {
+				es.reservations = append(es.reservations, r)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// iscOptionValue formats an option value the way dhcpd.conf expects.
+func iscOptionValue(o models.DhcpOption) string {
+	if exportStringOptions[o.Code] {
+		return fmt.Sprintf("%q", o.Value)
+	}
+	vals := strings.Split(o.Value, ",")
+	for i := range vals {
+		vals[i] = strings.TrimSpace(vals[i])
+	}
+	return strings.Join(vals, ", ")
+}
+
+// iscOptions writes the option statements for opts, with option 67
+// written as the filename.
+func iscOptions(buf *bytes.Buffer, indent string, opts []models.DhcpOption) {
+	for _, o := range opts {
+		if o.Code == 67 {
+			fmt.Fprintf(buf, "%sfilename %s;\n", indent, iscOptionValue(o))
+		} else {
+			fmt.Fprintf(buf, "%soption %s %s;\n", indent, exportOptionName(o.Code), iscOptionValue(o))
+		}
+	}
+}
+
+func (de *dhcpExporter) isc(buf *bytes.Buffer) {
+	boot := false
+	for _, es := range de.subnets {
+		boot = boot || es.pxeBoot()
+	}
+	if boot {
+		buf.WriteString("option arch code 93 = unsigned integer 16;\n")
+	}
+	for _, es := range de.subnets {
+		buf.WriteString("\n")
+		if es.Description != "" {
+			fmt.Fprintf(buf, "# %s: %s\n", es.Name, es.Description)
+		} else {
+			fmt.Fprintf(buf, "# %s\n", es.Name)
+		}
+		fmt.Fprintf(buf, "subnet %s netmask %s {\n", es.cidr.IP, net.IP(es.cidr.Mask))
+		for _, r := range es.ranges {
+			fmt.Fprintf(buf, "  range %s %s;\n", r.Start, r.End)
+		}
+		maxLease := es.ActiveLeaseTime
+		if es.ReservedLeaseTime > maxLease {
+			maxLease = es.ReservedLeaseTime
+		}
+		fmt.Fprintf(buf, "  default-lease-time %d;\n", es.ActiveLeaseTime)
+		fmt.Fprintf(buf, "  max-lease-time %d;\n", maxLease)
+		if es.nextServer != nil {
+			fmt.Fprintf(buf, "  next-server %s;\n", es.nextServer)
+		}
+		iscOptions(buf, "  ", es.options)
+		if es.pxeBoot() {
+			for i, bf := range es.bootFiles(de.staticPort) {
+				tests := []string{}
+				for _, arch := range bf.arches {
+					if arch == 0 {
+						tests = append(tests, "not exists arch")
+					}
+					tests = append(tests, fmt.Sprintf("option arch = %02x:%02x", arch>>8, arch&0xff))
+				}
+				if i == 0 {
+					buf.WriteString("  if exists user-class and option user-class = \"iPXE\" {\n")
+				} else {
+					fmt.Fprintf(buf, "  } elsif %s {\n", strings.Join(tests, " or "))
+				}
+				if bf.http {
+					buf.WriteString("    option vendor-class-identifier \"HTTPClient\";\n")
+				}
+				fmt.Fprintf(buf, "    filename %q;\n", bf.file)
+			}
+			buf.WriteString("  }\n")
+		}
+		for _, r := range es.reservations {
+			fmt.Fprintf(buf, "  host %s {\n", strings.Replace(r.Addr.String(), ".", "-", -1))
+			if r.Strategy == "MAC" {
+				fmt.Fprintf(buf, "    hardware ethernet %s;\n", r.Token)
+			} else {
+				fmt.Fprintf(buf, "    option dhcp-client-identifier %s;\n", r.Token)
+			}
+			fmt.Fprintf(buf, "    fixed-address %s;\n", r.Addr)
+			if r.NextServer.IsGlobalUnicast() {
+				fmt.Fprintf(buf, "    next-server %s;\n", r.NextServer)
+			}
+			iscOptions(buf, "    ", de.options("Reservation "+r.Key(), r.Options))
+			buf.WriteString("  }\n")
+		}
+		buf.WriteString("}\n")
+	}
+}
+
+// keaOptionData converts opts into Kea option-data, returning option
+// 67 separately as the boot file name.
+func keaOptionData(opts []models.DhcpOption) ([]keaOption, string) {
+	res, file := []keaOption{}, ""
+	for _, o := range opts {
+		if o.Code == 67 {
+			file = o.Value
+			continue
+		}
+		data := o.Value
+		if exportStringOptions[o.Code] {
+			data = strings.Replace(data, ",", "\\,", -1)
+		} else {
+			vals := strings.Split(data, ",")
+			for i := range vals {
+				vals[i] = strings.TrimSpace(vals[i])
+			}
+			data = strings.Join(vals, ", ")
+		}
+		res = append(res, keaOption{Name: exportOptionName(o.Code), Code: int(o.Code), Data: data})
+	}
+	return res, file
+}
+
+func (de *dhcpExporter) kea(buf *bytes.Buffer) error {
+	cfg := &keaConfig{Dhcp4: &keaDhcp4{Subnet4: []keaSubnet{}}}
+	defined := map[string]bool{}
+	notIpxe := "not (option[77].text == 'iPXE')"
+	for i, es := range de.subnets {
+		ks := keaSubnet{ID: i + 1, Subnet: es.cidr.String()}
+		ks.OptionData, ks.BootFileName = keaOptionData(es.options)
+		ks.ValidLifetime = es.ActiveLeaseTime
+		ks.MaxValidLifetime = es.ReservedLeaseTime
+		if ks.MaxValidLifetime < ks.ValidLifetime {
+			ks.MaxValidLifetime = ks.ValidLifetime
+		}
+		if es.nextServer != nil {
+			ks.NextServer = es.nextServer.String()
+		}
+		for _, r := range es.ranges {
+			ks.Pools = append(ks.Pools, keaPool{Pool: r.String()})
+		}
+		for _, r := range es.reservations {
+			kr := keaReservation{IPAddress: r.Addr.String()}
+			if r.Strategy == "MAC" {
+				kr.HwAddress = r.Token
+			} else {
+				kr.ClientID = r.Token
+			}
+			if r.NextServer.IsGlobalUnicast() {
+				kr.NextServer = r.NextServer.String()
+			}
+			kr.OptionData, kr.BootFileName = keaOptionData(de.options("Reservation "+r.Key(), r.Options))
+			ks.Reservations = append(ks.Reservations, kr)
+		}
+		if es.pxeBoot() {
+			for j, bf := range es.bootFiles(de.staticPort) {
+				name := "drp-" + bf.name
+				if bf.http {
+					// The URL points at this subnet's next server.
+					name = fmt.Sprintf("%s-%d", name, ks.ID)
+				}
+				ks.RequireClientClasses = append(ks.RequireClientClasses, name)
+				if defined[name] {
+					continue
+				}
+				defined[name] = true
+				tests := []string{}
+				for _, arch := range bf.arches {
+					if arch == 0 {
+						tests = append(tests, "not option[93].exists")
+					}
+					tests = append(tests, fmt.Sprintf("option[93].hex == 0x%04x", arch))
+				}
+				kc := keaClass{Name: name, OnlyIfRequired: true, BootFileName: bf.file}
+				if j == 0 {
+					kc.Test = "option[77].text == 'iPXE'"
+				} else {
+					kc.Test = fmt.Sprintf("%s and (%s)", notIpxe, strings.Join(tests, " or "))
+				}
+				if bf.http {
+					kc.OptionData = []keaOption{{Name: "vendor-class-identifier", Code: 60, Data: "HTTPClient"}}
+				}
+				cfg.Dhcp4.ClientClasses = append(cfg.Dhcp4.ClientClasses, kc)
+			}
+		}
+		cfg.Dhcp4.Subnet4 = append(cfg.Dhcp4.Subnet4, ks)
+	}
+	out, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf.Write(out)
+	buf.WriteString("\n")
+	return nil
+}
+
+// ExportDhcp renders the named Subnets, or all of them if no names are
+// passed, and the Reservations in them as an ISC dhcpd ("dhcpd" or
+// "isc") or Kea ("kea") DHCPv4 configuration.  Boot files are picked
+// by client architecture the same way dr-provision picks them.
+// Anything that cannot be expressed in the target format is listed in
+// comments at the top of the output.
+func ExportDhcp(rt *RequestTracker, format string, names ...string) (string, error) {
+	switch format {
+	case "dhcpd", "isc", "kea":
+	default:
+		return "", fmt.Errorf("Unknown export format %q: must be dhcpd or kea", format)
+	}
+	de := &dhcpExporter{staticPort: rt.dt.StaticPort}
+	buf := &bytes.Buffer{}
+	var err error
+	rt.Do(func(d Stores) {
+		if err = de.collect(rt, d, names); err != nil {
+			return
+		}
+		if format == "kea" {
+			err = de.kea(buf)
+		} else {
+			de.isc(buf)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	head := &bytes.Buffer{}
+	head.WriteString("# Exported from dr-provision.  Make changes there and export again.\n")
+	for _, w := range de.warnings {
+		fmt.Fprintf(head, "# %s\n", w)
+	}
+	return head.String() + buf.String(), nil
+}
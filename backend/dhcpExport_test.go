@@ -0,0 +1,201 @@
+package backend
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+func TestDhcpExport(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "reservations")
+	for _, obj := range []crudTest{
+		{
+			"Export Subnet",
+			rt.Create,
+			&models.Subnet{
+				Name:              "export",
+				Subnet:            "10.1.0.0/24",
+				ActiveStart:       net.ParseIP("10.1.0.10"),
+				ActiveEnd:         net.ParseIP("10.1.0.100"),
+				Exclusions:        []models.SubnetRange{{Start: net.ParseIP("10.1.0.50"), End: net.ParseIP("10.1.0.60")}},
+				NextServer:        net.ParseIP("10.1.0.2"),
+				ActiveLeaseTime:   60,
+				ReservedLeaseTime: 7200,
+				Strategy:          "MAC",
+				Options: []models.DhcpOption{
+					{Code: 3, Value: "10.1.0.1"},
+					{Code: 15, Value: "example.com"},
+					{Code: 6, Value: "{{.Param \"dns\"}}"},
+				},
+			},
+			true,
+		},
+		{
+			"Export Reservation",
+			rt.Create,
+			&models.Reservation{
+				Addr:     net.ParseIP("10.1.0.200"),
+				Token:    "52:54:00:aa:bb:01",
+				Strategy: "MAC",
+				Options:  []models.DhcpOption{{Code: 67, Value: "custom.efi"}},
+			},
+			true,
+		},
+	} {
+		obj.Test(t, rt)
+	}
+	if _, err := ExportDhcp(rt, "bind"); err == nil {
+		t.Errorf("Expected an error exporting an unknown format")
+	}
+	if _, err := ExportDhcp(rt, "kea", "missing"); err == nil {
+		t.Errorf("Expected an error exporting a missing subnet")
+	}
+	isc, err := ExportDhcp(rt, "dhcpd", "export")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Log(isc)
+	for _, want := range []string{
+		"option arch code 93 = unsigned integer 16;",
+		"subnet 10.1.0.0 netmask 255.255.255.0 {",
+		"range 10.1.0.10 10.1.0.49;",
+		"range 10.1.0.61 10.1.0.100;",
+		"default-lease-time 60;",
+		"max-lease-time 7200;",
+		"next-server 10.1.0.2;",
+		"option routers 10.1.0.1;",
+		"option domain-name \"example.com\";",
+		"# Subnet export: option 6 is a template, skipping it",
+		"filename \"ipxe.efi\";",
+		"} elsif not exists arch or option arch = 00:00 {",
+		"} elsif option arch = 00:10 {\n    option vendor-class-identifier \"HTTPClient\";\n    filename \"http://10.1.0.2:8091/ipxe.efi\";",
+		"hardware ethernet 52:54:00:aa:bb:01;",
+		"fixed-address 10.1.0.200;",
+		"filename \"custom.efi\";",
+	} {
+		if !strings.Contains(isc, want) {
+			t.Errorf("dhcpd config is missing %q", want)
+		}
+	}
+	if strings.Contains(isc, "} else {") {
+		t.Errorf("dhcpd config should only hand boot files to architectures we can boot")
+	}
+	out, err := ExportDhcp(rt, "kea")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Log(out)
+	cfg := &keaConfig{}
+	if err := json.Unmarshal([]byte(keaStripComments(out)), cfg); err != nil {
+		t.Fatalf("Kea config does not parse: %v", err)
+	}
+	if len(cfg.Dhcp4.Subnet4) != 1 {
+		t.Fatalf("Expected 1 Kea subnet, got %d", len(cfg.Dhcp4.Subnet4))
+	}
+	ks := cfg.Dhcp4.Subnet4[0]
+	if len(ks.Pools) != 2 || ks.Pools[0].Pool != "10.1.0.10-10.1.0.49" {
+		t.Errorf("Unexpected Kea pools: %v", ks.Pools)
+	}
+	if ks.NextServer != "10.1.0.2" || ks.ValidLifetime != 60 || ks.MaxValidLifetime != 7200 {
+		t.Errorf("Unexpected Kea subnet parameters: %v", ks.keaParams)
+	}
+	if len(ks.Reservations) != 1 || ks.Reservations[0].BootFileName != "custom.efi" {
+		t.Errorf("Unexpected Kea reservations: %v", ks.Reservations)
+	}
+	if len(ks.RequireClientClasses) != len(PxeLoaders)+1 || len(cfg.Dhcp4.ClientClasses) != len(PxeLoaders)+1 {
+		t.Errorf("Expected the boot file client classes to be required")
+	}
+	for _, kc := range cfg.Dhcp4.ClientClasses {
+		if kc.Name == "drp-efi64-http-1" &&
+			(kc.BootFileName != "http://10.1.0.2:8091/ipxe.efi" || len(kc.OptionData) != 1 || kc.OptionData[0].Data != "HTTPClient") {
+			t.Errorf("Unexpected Kea HTTP Boot class: %v", kc)
+		}
+	}
+	// Round trip the Kea config through the importer.
+	imp := &models.DhcpImport{Format: "kea", Config: out}
+	if err := ParseDhcpImport(imp); err != nil {
+		t.Fatalf("Unexpected error importing the export: %v", err)
+	}
+	if len(imp.Subnets) != 1 || len(imp.Subnets[0].Pools) != 1 || len(imp.Reservations) != 1 {
+		t.Errorf("Export did not import cleanly: %v", imp)
+	}
+}
+
+func TestDhcpExportProxy(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "reservations")
+	for _, obj := range []crudTest{
+		{
+			"Proxy Subnet",
+			rt.Create,
+			&models.Subnet{
+				Name:              "proxy",
+				Subnet:            "10.3.0.0/24",
+				Proxy:             true,
+				ActiveStart:       net.ParseIP("10.3.0.10"),
+				ActiveEnd:         net.ParseIP("10.3.0.100"),
+				NextServer:        net.ParseIP("10.3.0.2"),
+				ActiveLeaseTime:   60,
+				ReservedLeaseTime: 7200,
+				Strategy:          "MAC",
+				Options:           []models.DhcpOption{{Code: 3, Value: "10.3.0.1"}},
+			},
+			true,
+		},
+		{
+			"Proxy Reservation",
+			rt.Create,
+			&models.Reservation{
+				Addr:     net.ParseIP("10.3.0.200"),
+				Token:    "52:54:00:aa:bb:03",
+				Strategy: "MAC",
+			},
+			true,
+		},
+	} {
+		obj.Test(t, rt)
+	}
+	isc, err := ExportDhcp(rt, "dhcpd", "proxy")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Log(isc)
+	for _, want := range []string{
+		"subnet 10.3.0.0 netmask 255.255.255.0 {",
+		"range 10.3.0.10 10.3.0.100;",
+		"next-server 10.3.0.2;",
+		"option routers 10.3.0.1;",
+		"if exists user-class and option user-class = \"iPXE\" {\n    filename \"default.ipxe\";",
+		"} elsif option arch = 00:07 or option arch = 00:09 {\n    filename \"ipxe.efi\";",
+		"} elsif option arch = 00:0b {\n    filename \"ipxe-arm64.efi\";",
+		"hardware ethernet 52:54:00:aa:bb:03;",
+		"fixed-address 10.3.0.200;",
+	} {
+		if !strings.Contains(isc, want) {
+			t.Errorf("dhcpd config is missing %q", want)
+		}
+	}
+	if strings.Contains(isc, "proxy DHCP") {
+		t.Errorf("Proxy subnets should be exported without warnings")
+	}
+	out, err := ExportDhcp(rt, "kea", "proxy")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cfg := &keaConfig{}
+	if err := json.Unmarshal([]byte(keaStripComments(out)), cfg); err != nil {
+		t.Fatalf("Kea config does not parse: %v", err)
+	}
+	if len(cfg.Dhcp4.Subnet4) != 1 {
+		t.Fatalf("Expected 1 Kea subnet, got %d", len(cfg.Dhcp4.Subnet4))
+	}
+	ks := cfg.Dhcp4.Subnet4[0]
+	if len(ks.Pools) != 1 || ks.NextServer != "10.3.0.2" || len(ks.Reservations) != 1 ||
+		len(ks.RequireClientClasses) != len(PxeLoaders)+1 {
+		t.Errorf("Unexpected Kea subnet for a proxy subnet: %v", ks)
+	}
+}
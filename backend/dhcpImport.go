@@ -0,0 +1,359 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// importOptionCodes maps the option names used by ISC dhcpd and Kea to
+// option codes.  Only options whose values can be expressed as a
+// DhcpOption Value are listed.
+var importOptionCodes = map[string]byte{
+	"subnet-mask":          1,
+	"time-offset":          2,
+	"routers":              3,
+	"time-servers":         4,
+	"domain-name-servers":  6,
+	"log-servers":          7,
+	"host-name":            12,
+	"domain-name":          15,
+	"root-path":            17,
+	"interface-mtu":        26,
+	"broadcast-address":    28,
+	"nis-domain":           40,
+	"nis-servers":          41,
+	"ntp-servers":          42,
+	"netbios-name-servers": 44,
+	"tftp-server-name":     66,
+	"bootfile-name":        67,
+}
+
+// dhcpImporter accumulates the objects found while parsing the files
+// of a DhcpImport.
+type dhcpImporter struct {
+	*models.DhcpImport
+	subnets map[string]*models.Subnet
+	ranges  map[string][]models.SubnetRange
+}
+
+func (di *dhcpImporter) warnf(f string, args ...interface{}) {
+	di.Warnings = append(di.Warnings, fmt.Sprintf(f, args...))
+}
+
+// setOption sets code to val in opts, replacing any existing value.
+func setOption(opts []models.DhcpOption, code byte, val string) []models.DhcpOption {
+	for i := range opts {
+		if opts[i].Code == code {
+			opts[i].Value = val
+			return opts
+		}
+	}
+	return append(opts, models.DhcpOption{Code: code, Value: val})
+}
+
+// mergeImportOptions returns a copy of base with the options in over
+// layered on top.
+func mergeImportOptions(base, over []models.DhcpOption) []models.DhcpOption {
+	res := append([]models.DhcpOption{}, base...)
+	for _, o := range over {
+		res = setOption(res, o.Code, o.Value)
+	}
+	return res
+}
+
+// importMac normalizes a hardware address into a MAC strategy token.
+func importMac(s string) (string, error) {
+	mac, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	}
+	return mac.String(), nil
+}
+
+// subnet returns the Subnet for cidr, adding it if it is new.
+func (di *dhcpImporter) subnet(cidr *net.IPNet) *models.Subnet {
+	key := cidr.String()
+	if s, ok := di.subnets[key]; ok {
+		return s
+	}
+	ones, _ := cidr.Mask.Size()
+	s := &models.Subnet{
+		Name:     fmt.Sprintf("subnet-%s-%d", cidr.IP, ones),
+		Subnet:   key,
+		Strategy: "MAC",
+		Options:  []models.DhcpOption{{Code: 1, Value: net.IP(cidr.Mask).String()}},
+	}
+	di.subnets[key] = s
+	di.Subnets = append(di.Subnets, s)
+	return s
+}
+
+// addRange adds an address range to the Subnet for cidr.
+func (di *dhcpImporter) addRange(cidr *net.IPNet, start, end net.IP) {
+	if !cidr.Contains(start) || !cidr.Contains(end) {
+		di.warnf("Range %s - %s is not in subnet %s", start, end, cidr)
+		return
+	}
+	if bytes.Compare(start.To16(), end.To16()) > 0 {
+		start, end = end, start
+	}
+	di.subnet(cidr)
+	di.ranges[cidr.String()] = append(di.ranges[cidr.String()], models.SubnetRange{Start: start, End: end})
+}
+
+// reserve adds a Reservation, unless the address is already reserved.
+func (di *dhcpImporter) reserve(r *models.Reservation) {
+	if r.Addr == nil || r.Addr.To4() == nil {
+		di.warnf("Reservation for %s:%s has no IPv4 address", r.Strategy, r.Token)
+		return
+	}
+	for _, other := range di.Reservations {
+		if other.Addr.Equal(r.Addr) {
+			di.warnf("Address %s is reserved more than once, keeping %s:%s", r.Addr, other.Strategy, other.Token)
+			return
+		}
+	}
+	di.Reservations = append(di.Reservations, r)
+}
+
+// lease adds a Lease, replacing any earlier Lease for the same address.
+// Leases that have already expired are dropped.
+func (di *dhcpImporter) lease(l *models.Lease, now time.Time) {
+	for i, other := range di.Leases {
+		if other.Addr.Equal(l.Addr) {
+			di.Leases = append(di.Leases[:i], di.Leases[i+1:]...)
+			break
+		}
+	}
+	if l.ExpireTime.After(now) {
+		di.Leases = append(di.Leases, l)
+	}
+}
+
+// finish turns the collected ranges into the Active range and Pools
+// of each Subnet, and marks Reservations in an imported Subnet as
+// Scoped.
+func (di *dhcpImporter) finish() {
+	for _, s := range di.Subnets {
+		s.Enabled = di.Enabled
+		ranges := di.ranges[s.Subnet]
+		sort.Slice(ranges, func(i, j int) bool {
+			return bytes.Compare(ranges[i].Start.To16(), ranges[j].Start.To16()) < 0
+		})
+		if len(ranges) == 0 {
+			s.OnlyReservations = true
+			continue
+		}
+		s.ActiveStart, s.ActiveEnd = ranges[0].Start, ranges[0].End
+		kept := []models.SubnetRange{ranges[0]}
+		for _, r := range ranges[1:] {
+			ok := true
+			for _, k := range kept {
+				if ok && r.Overlaps(k) {
+					di.warnf("Range %s in subnet %s overlaps range %s, skipping it", r.String(), s.Subnet, k.String())
+					ok = false
+				}
+			}
+			if ok {
+				kept = append(kept, r)
+			}
+		}
+		s.Pools = kept[1:]
+	}
+	for _, r := range di.Reservations {
+		for _, s := range di.Subnets {
+			if _, cidr, _ := net.ParseCIDR(s.Subnet); cidr.Contains(r.Addr) {
+				r.Scoped = true
+				break
+			}
+		}
+	}
+}
+
+// parseImportDuration parses a lease time in seconds, or with a
+// trailing s, m, h, d, or w unit.
+func parseImportDuration(s string) (int32, error) {
+	mult := int64(1)
+	if l := len(s); l > 0 {
+		switch s[l-1] {
+		case 's':
+			s = s[:l-1]
+		case 'm':
+			mult, s = 60, s[:l-1]
+		case 'h':
+			mult, s = 3600, s[:l-1]
+		case 'd':
+			mult, s = 86400, s[:l-1]
+		case 'w':
+			mult, s = 604800, s[:l-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || v < 0 || v*mult > 1<<31-1 {
+		return 0, fmt.Errorf("Invalid lease time %s", s)
+	}
+	return int32(v * mult), nil
+}
+
+// ParseDhcpImport parses the files in imp and fills in its Subnets,
+// Reservations, Leases, and Warnings.  Nothing is checked against or
+// saved to the DataTracker.
+func ParseDhcpImport(imp *models.DhcpImport) error {
+	di := &dhcpImporter{
+		DhcpImport: imp,
+		subnets:    map[string]*models.Subnet{},
+		ranges:     map[string][]models.SubnetRange{},
+	}
+	imp.Subnets = []*models.Subnet{}
+	imp.Reservations = []*models.Reservation{}
+	imp.Leases = []*models.Lease{}
+	imp.Conflicts = []models.DhcpImportConflict{}
+	imp.Warnings = []string{}
+	var err error
+	switch imp.Format {
+	case "isc":
+		err = di.isc()
+	case "kea":
+		err = di.kea()
+	case "dnsmasq":
+		err = di.dnsmasq()
+	default:
+		return fmt.Errorf("Unknown import format %q: must be isc, kea, or dnsmasq", imp.Format)
+	}
+	if err != nil {
+		return err
+	}
+	di.finish()
+	return nil
+}
+
+// ImportDhcp parses the files in imp, checks the resulting objects
+// against the existing Subnets, Reservations, and Leases, and creates
+// the ones that do not conflict.  Objects that conflict, or that fail
+// validation, are listed in imp.Conflicts.  If imp.DryRun is set, the
+// objects are created in a Sandbox instead, so that the results are
+// the same as a real import would have without anything changing.
+func ImportDhcp(rt *RequestTracker, imp *models.DhcpImport) error {
+	if err := ParseDhcpImport(imp); err != nil {
+		return err
+	}
+	if imp.DryRun {
+		rt = rt.dt.Sandbox().Request(rt.Logger, rt.locks...)
+	}
+	conflict := func(prefix, key, f string, args ...interface{}) {
+		imp.Conflicts = append(imp.Conflicts, models.DhcpImportConflict{
+			Prefix: prefix,
+			Key:    key,
+			Reason: fmt.Sprintf(f, args...),
+		})
+	}
+	create := func(obj models.Model) bool {
+		if _, err := rt.Create(models.Clone(obj)); err != nil {
+			conflict(obj.Prefix(), obj.Key(), "%v", err)
+			return false
+		}
+		return true
+	}
+	rt.Do(func(d Stores) {
+		nets, names := []*net.IPNet{}, []string{}
+		for _, i := range d("subnets").Items() {
+			s := AsSubnet(i)
+			nets, names = append(nets, s.subnet()), append(names, s.Name)
+		}
+		for _, s := range imp.Subnets {
+			_, cidr, _ := net.ParseCIDR(s.Subnet)
+			if found := d("subnets").Find(s.Key()); found != nil {
+				conflict("subnets", s.Key(), "already exists as %s", AsSubnet(found).Subnet.Subnet)
+				continue
+			}
+			overlaps := false
+			for i, other := range nets {
+				if other.Contains(cidr.IP) || cidr.Contains(other.IP) {
+					conflict("subnets", s.Key(), "overlaps subnet %s (%s)", names[i], other)
+					overlaps = true
+					break
+				}
+			}
+			if !overlaps && create(s) {
+				nets, names = append(nets, cidr), append(names, s.Name)
+			}
+		}
+		reserved := map[string]*models.Reservation{}
+		for _, r := range imp.Reservations {
+			key := r.Key()
+			if found := d("reservations").Find(key); found != nil {
+				other := AsReservation(found)
+				if other.Strategy == r.Strategy && other.Token == r.Token {
+					conflict("reservations", key, "already exists")
+				} else {
+					conflict("reservations", key, "address is reserved for %s:%s", other.Strategy, other.Token)
+				}
+				continue
+			}
+			dup := false
+			for _, i := range d("reservations").Items() {
+				other := AsReservation(i)
+				if other.Strategy == r.Strategy && other.Token == r.Token {
+					conflict("reservations", key, "%s:%s already has a reservation for %s", r.Strategy, r.Token, other.Addr)
+					dup = true
+					break
+				}
+			}
+			if !dup && create(r) {
+				reserved[key] = r
+			}
+		}
+		for _, l := range imp.Leases {
+			key := l.Key()
+			if found := d("leases").Find(key); found != nil {
+				other := AsLease(found)
+				if other.Strategy == l.Strategy && other.Token == l.Token {
+					conflict("leases", key, "already exists")
+				} else {
+					conflict("leases", key, "address is leased to %s:%s", other.Strategy, other.Token)
+				}
+				continue
+			}
+			res, ok := reserved[key]
+			if !ok {
+				if found := d("reservations").Find(key); found != nil {
+					res, ok = AsReservation(found).Reservation, true
+				}
+			}
+			if ok && (res.Strategy != l.Strategy || res.Token != l.Token) {
+				conflict("leases", key, "address is reserved for %s:%s", res.Strategy, res.Token)
+				continue
+			}
+			if !ok {
+				covered := false
+				for _, cidr := range nets {
+					covered = covered || cidr.Contains(l.Addr)
+				}
+				if !covered {
+					conflict("leases", key, "address is not in a subnet or reservation")
+					continue
+				}
+			}
+			dup := false
+			for _, i := range d("leases").Items() {
+				other := AsLease(i)
+				if other.Strategy == l.Strategy && other.Token == l.Token && sameFamily(other.Addr, l.Addr) {
+					conflict("leases", key, "%s:%s already has a lease for %s", l.Strategy, l.Token, other.Addr)
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				create(l)
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,276 @@
+package backend
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// dnsmasqOptionCodes maps the option:name form of dnsmasq option names
+// to option codes.
+var dnsmasqOptionCodes = map[string]byte{
+	"netmask":       1,
+	"time-offset":   2,
+	"router":        3,
+	"time-server":   4,
+	"dns-server":    6,
+	"log-server":    7,
+	"hostname":      12,
+	"domain-name":   15,
+	"root-path":     17,
+	"mtu":           26,
+	"broadcast":     28,
+	"nis-domain":    40,
+	"nis-server":    41,
+	"ntp-server":    42,
+	"netbios-ns":    44,
+	"tftp-server":   66,
+	"bootfile-name": 67,
+}
+
+// dnsmasqTagged returns true if parts start with a tag, which limits a
+// setting to some clients.
+func dnsmasqTagged(parts []string) bool {
+	return len(parts) > 0 && (strings.HasPrefix(parts[0], "tag:") || strings.HasPrefix(parts[0], "net:"))
+}
+
+func (di *dhcpImporter) dnsmasqRange(val string) {
+	parts := strings.Split(val, ",")
+	i := 0
+	for i < len(parts) && net.ParseIP(parts[i]) == nil {
+		i++
+	}
+	if i == len(parts) {
+		di.warnf("dhcp-range=%s has no start address, skipping it", val)
+		return
+	}
+	start := net.ParseIP(parts[i]).To4()
+	if start == nil {
+		di.warnf("dhcp-range=%s is not an IPv4 range, skipping it", val)
+		return
+	}
+	end, mask := start, net.IP(nil)
+	ips := []net.IP{}
+	static, leaseTime := false, int32(0)
+	for _, p := range parts[i+1:] {
+		if ip := net.ParseIP(p); ip != nil {
+			ips = append(ips, ip.To4())
+			continue
+		}
+		switch p {
+		case "static":
+			static = true
+		case "proxy":
+			di.warnf("dhcp-range=%s is a proxy range, skipping it", val)
+			return
+		case "infinite":
+			di.warnf("dhcp-range=%s has an infinite lease time, using the default", val)
+		default:
+			d, err := parseImportDuration(p)
+			if err != nil {
+				di.warnf("dhcp-range=%s: %v", val, err)
+			}
+			leaseTime = d
+		}
+	}
+	if !static && len(ips) > 0 {
+		end, ips = ips[0], ips[1:]
+	}
+	if len(ips) > 0 {
+		mask = ips[0]
+	}
+	if mask == nil {
+		di.warnf("dhcp-range=%s has no netmask, assuming 255.255.255.0", val)
+		mask = net.IPv4(255, 255, 255, 0).To4()
+	}
+	if end == nil || mask.To4() == nil {
+		di.warnf("dhcp-range=%s is malformed, skipping it", val)
+		return
+	}
+	cidr := &net.IPNet{IP: start.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+	s := di.subnet(cidr)
+	if leaseTime > 0 {
+		s.ActiveLeaseTime = leaseTime
+	}
+	if !static {
+		di.addRange(cidr, start, end)
+	}
+}
+
+func (di *dhcpImporter) dnsmasqHost(val string) {
+	r := &models.Reservation{}
+	var mac, id string
+	for _, p := range strings.Split(val, ",") {
+		switch {
+		case p == "ignore":
+			return
+		case p == "id:*" || strings.HasPrefix(p, "set:") || strings.HasPrefix(p, "tag:"):
+		case strings.HasPrefix(p, "id:"):
+			var err error
+			if id, err = iscClientID(p[3:]); err != nil {
+				id, _ = iscClientID(`"` + p[3:])
+			}
+		case strings.HasPrefix(p, "["):
+			// An IPv6 address.
+		case strings.Contains(p, "*"):
+			di.warnf("dhcp-host=%s uses a wildcard MAC address, skipping it", val)
+			return
+		default:
+			if m, err := importMac(p); err == nil {
+				if mac != "" {
+					di.warnf("dhcp-host=%s has more than one MAC address, only using %s", val, mac)
+				} else {
+					mac = m
+				}
+			} else if ip := net.ParseIP(p); ip != nil {
+				r.Addr = ip.To4()
+			} else if d, err := parseImportDuration(p); err == nil {
+				r.Duration = d
+			} else if p != "infinite" {
+				r.Description = p
+				r.Options = setOption(r.Options, 12, p)
+			}
+		}
+	}
+	switch {
+	case mac != "":
+		r.Strategy, r.Token = "MAC", mac
+	case id != "":
+		r.Strategy, r.Token = "ClientID", id
+	default:
+		di.warnf("dhcp-host=%s has no MAC address or client id, skipping it", val)
+		return
+	}
+	if r.Addr == nil {
+		di.warnf("dhcp-host=%s has no IPv4 address, skipping it", val)
+		return
+	}
+	di.reserve(r)
+}
+
+// dnsmasqOption parses a dhcp-option setting into opts.
+func (di *dhcpImporter) dnsmasqOption(val string, opts []models.DhcpOption) []models.DhcpOption {
+	parts := strings.Split(val, ",")
+	if dnsmasqTagged(parts) {
+		di.warnf("dhcp-option=%s only applies to tagged clients, skipping it", val)
+		return opts
+	}
+	if len(parts) > 0 && strings.Contains(parts[0], ":") && !strings.HasPrefix(parts[0], "option:") {
+		di.warnf("dhcp-option=%s is not a plain DHCPv4 option, skipping it", val)
+		return opts
+	}
+	if len(parts) == 0 {
+		return opts
+	}
+	var code byte
+	ok := false
+	if strings.HasPrefix(parts[0], "option:") {
+		code, ok = dnsmasqOptionCodes[strings.TrimPrefix(parts[0], "option:")]
+	} else if v, err := strconv.Atoi(parts[0]); err == nil {
+		for _, known := range importOptionCodes {
+			ok = ok || int(known) == v
+		}
+		code = byte(v)
+	}
+	if !ok {
+		di.warnf("dhcp-option=%s is not supported, skipping it", val)
+		return opts
+	}
+	values := parts[1:]
+	for _, v := range values {
+		if v == "0.0.0.0" {
+			di.warnf("dhcp-option=%s refers to the dnsmasq server address, replace it on the imported subnets", val)
+			break
+		}
+	}
+	return setOption(opts, code, strings.Join(values, ","))
+}
+
+// dnsmasqLeases imports the leases in dnsmasq.leases.
+func (di *dhcpImporter) dnsmasqLeases(src string, now time.Time) error {
+	for _, line := range strings.Split(src, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] == "duid" {
+			continue
+		}
+		addr := net.ParseIP(fields[2]).To4()
+		if addr == nil {
+			continue
+		}
+		expire, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			di.warnf("Lease %s has a malformed expiry time, skipping it", addr)
+			continue
+		}
+		if expire == 0 {
+			di.warnf("Lease %s never expires, add a reservation for it instead", addr)
+			continue
+		}
+		mac, err := importMac(fields[1])
+		if err != nil {
+			di.warnf("Lease %s has no hardware address, skipping it", addr)
+			continue
+		}
+		di.lease(&models.Lease{
+			Addr:       addr,
+			Token:      mac,
+			Strategy:   "MAC",
+			State:      "ACK",
+			ExpireTime: time.Unix(expire, 0),
+		}, now)
+	}
+	return nil
+}
+
+// dnsmasq imports the dhcp-range, dhcp-host, dhcp-option, dhcp-boot,
+// and domain settings from a dnsmasq config, and dnsmasq.leases.
+func (di *dhcpImporter) dnsmasq() error {
+	opts := []models.DhcpOption{}
+	var nextServer net.IP
+	for _, line := range strings.Split(di.Config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, "--"), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "dhcp-range":
+			di.dnsmasqRange(val)
+		case "dhcp-host":
+			di.dnsmasqHost(val)
+		case "dhcp-option", "dhcp-option-force":
+			opts = di.dnsmasqOption(val, opts)
+		case "dhcp-boot":
+			parts := strings.Split(val, ",")
+			if dnsmasqTagged(parts) {
+				di.warnf("dhcp-boot=%s only applies to tagged clients, skipping it", val)
+				continue
+			}
+			opts = setOption(opts, 67, parts[0])
+			if len(parts) > 2 {
+				nextServer = net.ParseIP(parts[2])
+			}
+		case "domain":
+			if parts := strings.Split(val, ","); len(parts) == 1 {
+				opts = setOption(opts, 15, val)
+			} else {
+				di.warnf("domain=%s only applies to some addresses, skipping it", val)
+			}
+		}
+	}
+	for _, s := range di.Subnets {
+		s.Options = mergeImportOptions(s.Options, opts)
+		s.NextServer = nextServer
+	}
+	if di.LeaseData != "" {
+		return di.dnsmasqLeases(di.LeaseData, time.Now())
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package backend
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// iscStmt is a statement from dhcpd.conf or dhcpd.leases.  Quoted
+// strings in args keep their leading quote so that they can be told
+// apart from bare words.
+type iscStmt struct {
+	args  []string
+	block []*iscStmt
+}
+
+// iscTokens splits an ISC config file into words, quoted strings, and
+// the punctuation characters {, }, ;, and ,.
+func iscTokens(src string) ([]string, error) {
+	res := []string{}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '{' || c == '}' || c == ';' || c == ',':
+			res = append(res, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			buf := []byte{'"'}
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				buf = append(buf, src[j])
+			}
+			if j == len(src) {
+				return nil, fmt.Errorf("Unterminated string starting at offset %d", i)
+			}
+			res = append(res, string(buf))
+			i = j + 1
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\r\n{};,#\"", rune(src[j])) {
+				j++
+			}
+			res = append(res, src[i:j])
+			i = j
+		}
+	}
+	return res, nil
+}
+
+// iscParse parses statements from toks starting at *pos until the
+// end of the enclosing block.
+func iscParse(toks []string, pos *int, nested bool) ([]*iscStmt, error) {
+	res := []*iscStmt{}
+	curr := &iscStmt{}
+	for *pos < len(toks) {
+		tok := toks[*pos]
+		*pos++
+		switch tok {
+		case ";":
+			if len(curr.args) > 0 {
+				res = append(res, curr)
+			}
+			curr = &iscStmt{}
+		case "{":
+			block, err := iscParse(toks, pos, true)
+			if err != nil {
+				return nil, err
+			}
+			curr.block = block
+			res = append(res, curr)
+			curr = &iscStmt{}
+		case "}":
+			if !nested {
+				return nil, fmt.Errorf("Unexpected }")
+			}
+			if len(curr.args) > 0 {
+				return nil, fmt.Errorf("Missing ; after %s", strings.Join(curr.args, " "))
+			}
+			return res, nil
+		default:
+			curr.args = append(curr.args, tok)
+		}
+	}
+	if nested {
+		return nil, fmt.Errorf("Missing }")
+	}
+	if len(curr.args) > 0 {
+		return nil, fmt.Errorf("Missing ; after %s", strings.Join(curr.args, " "))
+	}
+	return res, nil
+}
+
+func iscParseFile(src string) ([]*iscStmt, error) {
+	toks, err := iscTokens(src)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	return iscParse(toks, &pos, false)
+}
+
+// iscVal strips the quote marker from a token.
+func iscVal(tok string) string {
+	return strings.TrimPrefix(tok, `"`)
+}
+
+// iscValues joins the comma separated values in args.
+func iscValues(args []string) string {
+	vals := []string{}
+	for _, a := range args {
+		if a != "," {
+			vals = append(vals, iscVal(a))
+		}
+	}
+	return strings.Join(vals, ",")
+}
+
+// iscClientID turns a dhcp-client-identifier value into a ClientID
+// strategy token.
+func iscClientID(tok string) (string, error) {
+	var buf []byte
+	if strings.HasPrefix(tok, `"`) {
+		buf = []byte(iscVal(tok))
+	} else {
+		for _, b := range strings.Split(tok, ":") {
+			v, err := strconv.ParseUint(b, 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("Invalid client identifier %s", tok)
+			}
+			buf = append(buf, byte(v))
+		}
+	}
+	parts := make([]string, len(buf))
+	for i := range buf {
+		parts[i] = hex.EncodeToString(buf[i : i+1])
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// iscScope holds the parameters that apply to a block and the blocks
+// it contains.  opts are all of the options in effect, and local are
+// the ones set since the enclosing subnet, which are the ones a host
+// needs to carry itself.
+type iscScope struct {
+	opts, local []models.DhcpOption
+	nextServer  net.IP
+	leaseTime   int32
+}
+
+// iscScope returns the scope for stmts, which are inside parent.  A
+// subnet starts a new set of local options.
+func (di *dhcpImporter) iscScope(stmts []*iscStmt, parent *iscScope, inSubnet bool) *iscScope {
+	res := &iscScope{
+		opts:       append([]models.DhcpOption{}, parent.opts...),
+		nextServer: parent.nextServer,
+		leaseTime:  parent.leaseTime,
+	}
+	if !inSubnet {
+		res.local = append(res.local, parent.local...)
+	}
+	set := func(code byte, val string) {
+		res.opts = setOption(res.opts, code, val)
+		res.local = setOption(res.local, code, val)
+	}
+	for _, st := range stmts {
+		if st.block != nil || len(st.args) < 2 {
+			continue
+		}
+		switch st.args[0] {
+		case "option":
+			if code, ok := importOptionCodes[st.args[1]]; ok {
+				set(code, iscValues(st.args[2:]))
+			} else if st.args[1] != "dhcp-client-identifier" && !strings.Contains(st.args[1], ".") {
+				di.warnf("Option %s is not supported, skipping it", st.args[1])
+			}
+		case "filename":
+			set(67, iscVal(st.args[1]))
+		case "server-name":
+			set(66, iscVal(st.args[1]))
+		case "next-server":
+			if ip := net.ParseIP(st.args[1]); ip != nil {
+				res.nextServer = ip
+			} else {
+				di.warnf("next-server %s is not an IP address, skipping it", st.args[1])
+			}
+		case "default-lease-time":
+			if v, err := strconv.ParseInt(st.args[1], 10, 32); err == nil {
+				res.leaseTime = int32(v)
+			}
+		}
+	}
+	if inSubnet {
+		res.local = nil
+	}
+	return res
+}
+
+// iscWalk processes the blocks, ranges, and hosts in stmts.  cidr is
+// the enclosing subnet, if any.
+func (di *dhcpImporter) iscWalk(stmts []*iscStmt, scope *iscScope, cidr *net.IPNet) {
+	for _, st := range stmts {
+		if len(st.args) == 0 {
+			continue
+		}
+		switch st.args[0] {
+		case "subnet":
+			if len(st.args) != 4 || st.args[2] != "netmask" || st.block == nil {
+				di.warnf("Malformed subnet declaration: %s", strings.Join(st.args, " "))
+				continue
+			}
+			ip, mask := net.ParseIP(st.args[1]).To4(), net.ParseIP(st.args[3]).To4()
+			if ip == nil || mask == nil {
+				di.warnf("Malformed subnet declaration: %s", strings.Join(st.args, " "))
+				continue
+			}
+			sn := &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+			child := di.iscScope(st.block, scope, true)
+			s := di.subnet(sn)
+			s.Options = mergeImportOptions(s.Options, child.opts)
+			s.NextServer = child.nextServer
+			s.ActiveLeaseTime = child.leaseTime
+			di.iscWalk(st.block, child, sn)
+		case "subnet6":
+			di.warnf("IPv6 subnet %s is not supported, skipping it", st.args[1])
+		case "shared-network", "group", "pool":
+			if st.block != nil {
+				di.iscWalk(st.block, di.iscScope(st.block, scope, false), cidr)
+			}
+		case "range":
+			args := st.args[1:]
+			if len(args) > 0 && args[0] == "dynamic-bootp" {
+				args = args[1:]
+			}
+			if cidr == nil || len(args) == 0 || len(args) > 2 {
+				di.warnf("Malformed range declaration: %s", strings.Join(st.args, " "))
+				continue
+			}
+			start := net.ParseIP(args[0]).To4()
+			end := start
+			if len(args) == 2 {
+				end = net.ParseIP(args[1]).To4()
+			}
+			if start == nil || end == nil {
+				di.warnf("Malformed range declaration: %s", strings.Join(st.args, " "))
+				continue
+			}
+			di.addRange(cidr, start, end)
+		case "host":
+			if st.block != nil && len(st.args) > 1 {
+				di.iscHost(iscVal(st.args[1]), st.block, scope)
+			}
+		case "if", "elsif", "else", "class", "subclass":
+			if st.block != nil {
+				di.warnf("Skipping %s block: conditionals and classes are not supported", st.args[0])
+			}
+		}
+	}
+}
+
+// iscHost turns a host declaration into a Reservation.
+func (di *dhcpImporter) iscHost(name string, stmts []*iscStmt, parent *iscScope) {
+	scope := di.iscScope(stmts, parent, false)
+	r := &models.Reservation{
+		Description: name,
+		NextServer:  scope.nextServer,
+		Options:     scope.local,
+	}
+	for _, st := range stmts {
+		if st.block != nil || len(st.args) < 2 {
+			continue
+		}
+		switch {
+		case st.args[0] == "hardware" && len(st.args) == 3 && st.args[1] == "ethernet":
+			mac, err := importMac(st.args[2])
+			if err != nil {
+				di.warnf("Host %s: %v", name, err)
+				return
+			}
+			r.Strategy, r.Token = "MAC", mac
+		case st.args[0] == "option" && st.args[1] == "dhcp-client-identifier" && len(st.args) == 3:
+			if r.Strategy != "" {
+				continue
+			}
+			id, err := iscClientID(st.args[2])
+			if err != nil {
+				di.warnf("Host %s: %v", name, err)
+				return
+			}
+			r.Strategy, r.Token = "ClientID", id
+		case st.args[0] == "fixed-address":
+			if r.Addr = net.ParseIP(st.args[1]).To4(); r.Addr == nil {
+				di.warnf("Host %s: fixed-address %s is not an IP address, skipping it", name, st.args[1])
+				return
+			}
+			if len(st.args) > 2 {
+				di.warnf("Host %s has more than one fixed-address, only using %s", name, r.Addr)
+			}
+		}
+	}
+	if r.Strategy == "" {
+		di.warnf("Host %s has no hardware ethernet or dhcp-client-identifier, skipping it", name)
+		return
+	}
+	if r.Addr == nil {
+		di.warnf("Host %s has no fixed-address, skipping it", name)
+		return
+	}
+	di.reserve(r)
+}
+
+// iscTime parses the time of a starts or ends statement in dhcpd.leases.
+func iscTime(args []string) (time.Time, error) {
+	switch {
+	case len(args) == 1 && args[0] == "never":
+		return time.Time{}, nil
+	case len(args) == 2 && args[0] == "epoch":
+		secs, err := strconv.ParseInt(args[1], 10, 64)
+		return time.Unix(secs, 0), err
+	case len(args) == 3:
+		return time.Parse("2006/01/02 15:04:05", args[1]+" "+args[2])
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %s", strings.Join(args, " "))
+}
+
+// iscLeases imports the active leases in dhcpd.leases.
+func (di *dhcpImporter) iscLeases(src string, now time.Time) error {
+	stmts, err := iscParseFile(src)
+	if err != nil {
+		return fmt.Errorf("Error parsing leases: %v", err)
+	}
+	for _, st := range stmts {
+		if len(st.args) != 2 || st.args[0] != "lease" || st.block == nil {
+			continue
+		}
+		addr := net.ParseIP(st.args[1]).To4()
+		if addr == nil {
+			di.warnf("Lease for %s is not for an IPv4 address, skipping it", st.args[1])
+			continue
+		}
+		l := &models.Lease{Addr: addr, Strategy: "MAC", State: "ACK"}
+		var starts time.Time
+		active, never := false, false
+		for _, ls := range st.block {
+			if len(ls.args) < 2 {
+				continue
+			}
+			switch ls.args[0] {
+			case "starts":
+				starts, _ = iscTime(ls.args[1:])
+			case "ends":
+				if l.ExpireTime, err = iscTime(ls.args[1:]); err != nil {
+					di.warnf("Lease %s: %v", addr, err)
+				}
+				never = ls.args[1] == "never"
+			case "binding":
+				active = len(ls.args) == 3 && ls.args[1] == "state" && ls.args[2] == "active"
+			case "hardware":
+				if len(ls.args) == 3 && ls.args[1] == "ethernet" {
+					if l.Token, err = importMac(ls.args[2]); err != nil {
+						di.warnf("Lease %s: %v", addr, err)
+					}
+				}
+			}
+		}
+		if !active {
+			// Later entries replace earlier ones, so a free or
+			// expired entry cancels any earlier active one.
+			di.lease(&models.Lease{Addr: addr}, now)
+			continue
+		}
+		if never {
+			di.warnf("Lease %s never expires, add a reservation for it instead", addr)
+			continue
+		}
+		if l.Token == "" {
+			di.warnf("Lease %s has no hardware address, skipping it", addr)
+			continue
+		}
+		if !starts.IsZero() && l.ExpireTime.After(starts) {
+			l.Duration = int32(l.ExpireTime.Sub(starts) / time.Second)
+		}
+		di.lease(l, now)
+	}
+	return nil
+}
+
+// isc imports dhcpd.conf and dhcpd.leases.
+func (di *dhcpImporter) isc() error {
+	if di.Config != "" {
+		stmts, err := iscParseFile(di.Config)
+		if err != nil {
+			return fmt.Errorf("Error parsing config: %v", err)
+		}
+		di.iscWalk(stmts, di.iscScope(stmts, &iscScope{}, false), nil)
+	}
+	if di.LeaseData != "" {
+		return di.iscLeases(di.LeaseData, time.Now())
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package backend
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+type keaOption struct {
+	Name  string `json:"name,omitempty"`
+	Code  int    `json:"code,omitempty"`
+	Space string `json:"space,omitempty"`
+	Data  string `json:"data"`
+}
+
+// keaParams are the parameters that Kea lets every scope set.
+type keaParams struct {
+	OptionData       []keaOption `json:"option-data,omitempty"`
+	ValidLifetime    int32       `json:"valid-lifetime,omitempty"`
+	MaxValidLifetime int32       `json:"max-valid-lifetime,omitempty"`
+	NextServer       string      `json:"next-server,omitempty"`
+	BootFileName     string      `json:"boot-file-name,omitempty"`
+}
+
+type keaReservation struct {
+	HwAddress    string      `json:"hw-address,omitempty"`
+	ClientID     string      `json:"client-id,omitempty"`
+	IPAddress    string      `json:"ip-address"`
+	Hostname     string      `json:"hostname,omitempty"`
+	NextServer   string      `json:"next-server,omitempty"`
+	BootFileName string      `json:"boot-file-name,omitempty"`
+	OptionData   []keaOption `json:"option-data,omitempty"`
+}
+
+type keaPool struct {
+	Pool string `json:"pool"`
+}
+
+type keaSubnet struct {
+	keaParams
+	ID                   int              `json:"id,omitempty"`
+	Subnet               string           `json:"subnet"`
+	Pools                []keaPool        `json:"pools,omitempty"`
+	Reservations         []keaReservation `json:"reservations,omitempty"`
+	RequireClientClasses []string         `json:"require-client-classes,omitempty"`
+}
+
+type keaClass struct {
+	Name           string      `json:"name"`
+	Test           string      `json:"test"`
+	OnlyIfRequired bool        `json:"only-if-required"`
+	BootFileName   string      `json:"boot-file-name"`
+	OptionData     []keaOption `json:"option-data,omitempty"`
+}
+
+type keaDhcp4 struct {
+	keaParams
+	Subnet4        []keaSubnet `json:"subnet4"`
+	SharedNetworks []struct {
+		keaParams
+		Name    string      `json:"name"`
+		Subnet4 []keaSubnet `json:"subnet4"`
+	} `json:"shared-networks,omitempty"`
+	Reservations  []keaReservation `json:"reservations,omitempty"`
+	ClientClasses []keaClass       `json:"client-classes,omitempty"`
+}
+
+type keaConfig struct {
+	Dhcp4 *keaDhcp4 `json:"Dhcp4"`
+}
+
+// keaStripComments removes the #, //, and /* */ comments Kea allows
+// in its JSON config.
+func keaStripComments(src string) string {
+	res := make([]byte, 0, len(src))
+	for i := 0; i < len(src); i++ {
+		switch {
+		case src[i] == '"':
+			j := i + 1
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				j = len(src) - 1
+			}
+			res = append(res, src[i:j+1]...)
+			i = j
+		case src[i] == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			if i < len(src) {
+				res = append(res, '\n')
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				return string(res)
+			}
+			i += end + 3
+		default:
+			res = append(res, src[i])
+		}
+	}
+	return string(res)
+}
+
+// keaOptions converts Kea option-data into DhcpOptions.
+func (di *dhcpImporter) keaOptions(base []models.DhcpOption, p *keaParams) []models.DhcpOption {
+	res := append([]models.DhcpOption{}, base...)
+	for _, o := range p.OptionData {
+		if o.Space != "" && o.Space != "dhcp4" {
+			continue
+		}
+		code, ok := importOptionCodes[o.Name]
+		if !ok && o.Code > 0 && o.Code < 255 {
+			for _, known := range importOptionCodes {
+				if known == byte(o.Code) {
+					code, ok = known, true
+				}
+			}
+		}
+		if !ok {
+			label := o.Name
+			if label == "" {
+				label = strconv.Itoa(o.Code)
+			}
+			di.warnf("Option %s is not supported, skipping it", label)
+			continue
+		}
+		vals := strings.Split(o.Data, ",")
+		for i := range vals {
+			vals[i] = strings.TrimSpace(vals[i])
+		}
+		res = setOption(res, code, strings.Join(vals, ","))
+	}
+	if p.BootFileName != "" {
+		res = setOption(res, 67, p.BootFileName)
+	}
+	return res
+}
+
+// keaInherit returns the parameters of p with those unset in p taken
+// from parent.
+func keaInherit(p, parent keaParams) keaParams {
+	if p.ValidLifetime == 0 {
+		p.ValidLifetime = parent.ValidLifetime
+	}
+	if p.NextServer == "" {
+		p.NextServer = parent.NextServer
+	}
+	return p
+}
+
+func (di *dhcpImporter) keaReservation(kr *keaReservation) {
+	r := &models.Reservation{
+		Addr:    net.ParseIP(kr.IPAddress).To4(),
+		Options: di.keaOptions(nil, &keaParams{OptionData: kr.OptionData, BootFileName: kr.BootFileName}),
+	}
+	switch {
+	case kr.HwAddress != "":
+		mac, err := importMac(kr.HwAddress)
+		if err != nil {
+			di.warnf("Reservation %s: %v", kr.IPAddress, err)
+			return
+		}
+		r.Strategy, r.Token = "MAC", mac
+	case kr.ClientID != "":
+		r.Strategy, r.Token = "ClientID", strings.ToLower(kr.ClientID)
+	default:
+		di.warnf("Reservation %s is not by hw-address or client-id, skipping it", kr.IPAddress)
+		return
+	}
+	if kr.Hostname != "" {
+		r.Description = kr.Hostname
+		r.Options = setOption(r.Options, 12, kr.Hostname)
+	}
+	if kr.NextServer != "" {
+		r.NextServer = net.ParseIP(kr.NextServer)
+	}
+	di.reserve(r)
+}
+
+func (di *dhcpImporter) keaSubnet(ks *keaSubnet, parent keaParams, opts []models.DhcpOption) {
+	_, cidr, err := net.ParseCIDR(ks.Subnet)
+	if err != nil || cidr.IP.To4() == nil {
+		di.warnf("Subnet %q is not an IPv4 subnet, skipping it", ks.Subnet)
+		return
+	}
+	p := keaInherit(ks.keaParams, parent)
+	s := di.subnet(cidr)
+	s.Options = di.keaOptions(mergeImportOptions(s.Options, opts), &ks.keaParams)
+	s.ActiveLeaseTime = p.ValidLifetime
+	if p.NextServer != "" {
+		s.NextServer = net.ParseIP(p.NextServer)
+	}
+	for _, pool := range ks.Pools {
+		var start, end net.IP
+		if parts := strings.SplitN(pool.Pool, "-", 2); len(parts) == 2 {
+			start = net.ParseIP(strings.TrimSpace(parts[0])).To4()
+			end = net.ParseIP(strings.TrimSpace(parts[1])).To4()
+		} else if _, pn, err := net.ParseCIDR(strings.TrimSpace(pool.Pool)); err == nil {
+			start = pn.IP.To4()
+			end = make(net.IP, len(start))
+			for i := range start {
+				end[i] = start[i] | ^pn.Mask[i]
+			}
+		}
+		if start == nil || end == nil {
+			di.warnf("Pool %q in subnet %s is malformed, skipping it", pool.Pool, ks.Subnet)
+			continue
+		}
+		di.addRange(cidr, start, end)
+	}
+	for i := range ks.Reservations {
+		di.keaReservation(&ks.Reservations[i])
+	}
+}
+
+// keaLeases imports the active leases in a Kea memfile lease CSV.
+func (di *dhcpImporter) keaLeases(src string, now time.Time) error {
+	rdr := csv.NewReader(strings.NewReader(src))
+	rdr.FieldsPerRecord = -1
+	recs, err := rdr.ReadAll()
+	if err != nil {
+		return fmt.Errorf("Error parsing leases: %v", err)
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	cols := map[string]int{}
+	for i, name := range recs[0] {
+		cols[name] = i
+	}
+	for _, want := range []string{"address", "hwaddr", "valid_lifetime", "expire", "state"} {
+		if _, ok := cols[want]; !ok {
+			return fmt.Errorf("Lease file is missing the %s column", want)
+		}
+	}
+	for _, rec := range recs[1:] {
+		if len(rec) < len(recs[0]) {
+			continue
+		}
+		addr := net.ParseIP(rec[cols["address"]]).To4()
+		if addr == nil {
+			continue
+		}
+		valid, _ := strconv.ParseInt(rec[cols["valid_lifetime"]], 10, 32)
+		expire, _ := strconv.ParseInt(rec[cols["expire"]], 10, 64)
+		l := &models.Lease{
+			Addr:       addr,
+			Strategy:   "MAC",
+			State:      "ACK",
+			Duration:   int32(valid),
+			ExpireTime: time.Unix(expire, 0),
+		}
+		// A zero lifetime marks a deleted lease, and any state other
+		// than 0 is declined or expired.
+		if valid == 0 || rec[cols["state"]] != "0" {
+			l.ExpireTime = time.Time{}
+		} else if l.Token, err = importMac(rec[cols["hwaddr"]]); err != nil {
+			di.warnf("Lease %s has no hardware address, skipping it", addr)
+			l.ExpireTime = time.Time{}
+		}
+		di.lease(l, now)
+	}
+	return nil
+}
+
+// kea imports kea-dhcp4.conf and the memfile lease CSV.
+func (di *dhcpImporter) kea() error {
+	if di.Config != "" {
+		cfg := &keaConfig{}
+		if err := json.Unmarshal([]byte(keaStripComments(di.Config)), cfg); err != nil {
+			return fmt.Errorf("Error parsing config: %v", err)
+		}
+		if cfg.Dhcp4 == nil {
+			return fmt.Errorf("Config has no Dhcp4 section")
+		}
+		global := cfg.Dhcp4.keaParams
+		opts := di.keaOptions(nil, &global)
+		for i := range cfg.Dhcp4.Subnet4 {
+			di.keaSubnet(&cfg.Dhcp4.Subnet4[i], global, opts)
+		}
+		for _, sn := range cfg.Dhcp4.SharedNetworks {
+			p := keaInherit(sn.keaParams, global)
+			snOpts := di.keaOptions(opts, &sn.keaParams)
+			for i := range sn.Subnet4 {
+				di.keaSubnet(&sn.Subnet4[i], p, snOpts)
+			}
+		}
+		for i := range cfg.Dhcp4.Reservations {
+			di.keaReservation(&cfg.Dhcp4.Reservations[i])
+		}
+	}
+	if di.LeaseData != "" {
+		return di.keaLeases(di.LeaseData, time.Now())
+	}
+	return nil
+}
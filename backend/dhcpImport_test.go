@@ -0,0 +1,322 @@
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+const iscTestConf = `
+# Global settings
+default-lease-time 600;
+option domain-name "example.com";
+option domain-search "example.com";
+
+subnet 10.0.0.0 netmask 255.255.255.0 {
+  range 10.0.0.10 10.0.0.50;
+  range 10.0.0.100 10.0.0.120;
+  option routers 10.0.0.1;
+  option domain-name-servers 10.0.0.2, 10.0.0.3;
+  next-server 10.0.0.5;
+  filename "pxelinux.0";
+  host web1 {
+    hardware ethernet 52:54:00:AA:BB:01;
+    fixed-address 10.0.0.200;
+    option host-name "web1";
+  }
+}
+
+group {
+  filename "ipxe.efi";
+  host web2 {
+    option dhcp-client-identifier "web2";
+    fixed-address 10.0.0.201;
+  }
+  host nomac {
+    fixed-address 10.0.0.202;
+  }
+}
+`
+
+const iscTestLeases = `
+lease 10.0.0.11 {
+  starts 4 2019/01/01 00:00:00;
+  ends 4 2099/01/01 00:00:00;
+  binding state active;
+  hardware ethernet 52:54:00:aa:bb:02;
+}
+lease 10.0.0.12 {
+  starts 4 2019/01/01 00:00:00;
+  ends 4 2099/01/01 00:00:00;
+  binding state active;
+  hardware ethernet 52:54:00:aa:bb:03;
+}
+lease 10.0.0.12 {
+  starts 4 2019/01/01 00:00:00;
+  ends 4 2019/01/01 00:00:00;
+  binding state free;
+  hardware ethernet 52:54:00:aa:bb:03;
+}
+lease 10.0.0.13 {
+  starts 4 2019/01/01 00:00:00;
+  ends 4 2019/01/02 00:00:00;
+  binding state active;
+  hardware ethernet 52:54:00:aa:bb:04;
+}
+`
+
+const keaTestConf = `{
+  // Kea allows comments
+  "Dhcp4": {
+    "valid-lifetime": 4000,
+    "option-data": [{"name": "domain-name-servers", "data": "10.1.0.2, 10.1.0.3"}],
+    "shared-networks": [{
+      "name": "lab",
+      "option-data": [{"code": 3, "data": "10.1.0.1"}],
+      "subnet4": [{
+        "id": 1,
+        "subnet": "10.1.0.0/24",
+        "pools": [{"pool": "10.1.0.10 - 10.1.0.50"}, {"pool": "10.1.0.64/28"}],
+        "reservations": [
+          {"hw-address": "52:54:00:aa:bb:10", "ip-address": "10.1.0.200", "hostname": "db1"},
+          {"client-id": "01:52:54:00:aa:bb:11", "ip-address": "10.1.0.201"},
+          {"duid": "00:01:02", "ip-address": "10.1.0.202"}
+        ]
+      }]
+    }],
+    "subnet4": [{"id": 2, "subnet": "10.2.0.0/24", "boot-file-name": "http://boot/ipxe.efi", "valid-lifetime": 100}]
+  }
+}`
+
+const keaTestLeases = `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context
+10.1.0.10,52:54:00:aa:bb:12,,4000,4102444800,1,0,0,,0,
+10.1.0.11,52:54:00:aa:bb:13,,4000,4102444800,1,0,0,,1,
+10.1.0.12,52:54:00:aa:bb:14,,0,4102444800,1,0,0,,0,
+`
+
+const dnsmasqTestConf = `
+interface=eth0
+dhcp-range=eth0,192.168.5.50,192.168.5.150,255.255.255.0,12h
+dhcp-range=192.168.6.0,static
+dhcp-option=option:router,192.168.5.1
+dhcp-option=6,192.168.5.2,192.168.5.3
+dhcp-option=tag:green,option:ntp-server,192.168.5.4
+dhcp-boot=pxelinux.0,boothost,192.168.5.5
+dhcp-host=52:54:00:aa:bb:20,192.168.5.200,printer,infinite
+dhcp-host=id:01:52:54:00:aa:bb:21,192.168.6.10,2h
+dhcp-host=52:54:00:*:*:*,192.168.5.201
+dhcp-host=52:54:00:aa:bb:22,ignore
+`
+
+const dnsmasqTestLeases = `4102444800 52:54:00:aa:bb:30 192.168.5.60 host1 *
+0 52:54:00:aa:bb:31 192.168.5.61 host2 *
+`
+
+func optVal(opts []models.DhcpOption, code byte) string {
+	for _, o := range opts {
+		if o.Code == code {
+			return o.Value
+		}
+	}
+	return ""
+}
+
+func TestDhcpImportParse(t *testing.T) {
+	isc := &models.DhcpImport{Format: "isc", Config: iscTestConf, LeaseData: iscTestLeases}
+	if err := ParseDhcpImport(isc); err != nil {
+		t.Fatalf("ISC: unexpected error: %v", err)
+	}
+	if len(isc.Subnets) != 1 {
+		t.Fatalf("ISC: expected 1 subnet, got %d", len(isc.Subnets))
+	}
+	s := isc.Subnets[0]
+	if s.Subnet != "10.0.0.0/24" || !s.ActiveStart.Equal(net.ParseIP("10.0.0.10")) ||
+		len(s.Pools) != 1 || !s.Pools[0].End.Equal(net.ParseIP("10.0.0.120")) {
+		t.Errorf("ISC: wrong subnet ranges: %v %v-%v %v", s.Subnet, s.ActiveStart, s.ActiveEnd, s.Pools)
+	}
+	if optVal(s.Options, 3) != "10.0.0.1" || optVal(s.Options, 6) != "10.0.0.2,10.0.0.3" ||
+		optVal(s.Options, 15) != "example.com" || optVal(s.Options, 67) != "pxelinux.0" ||
+		optVal(s.Options, 1) != "255.255.255.0" {
+		t.Errorf("ISC: wrong subnet options: %v", s.Options)
+	}
+	if s.ActiveLeaseTime != 600 || !s.NextServer.Equal(net.ParseIP("10.0.0.5")) || s.Enabled {
+		t.Errorf("ISC: wrong subnet settings: %d %v %v", s.ActiveLeaseTime, s.NextServer, s.Enabled)
+	}
+	if len(isc.Reservations) != 2 {
+		t.Fatalf("ISC: expected 2 reservations, got %d", len(isc.Reservations))
+	}
+	if r := isc.Reservations[0]; r.Token != "52:54:00:aa:bb:01" || r.Strategy != "MAC" ||
+		optVal(r.Options, 12) != "web1" || !r.Scoped {
+		t.Errorf("ISC: wrong reservation: %#v", r)
+	}
+	if r := isc.Reservations[1]; r.Token != "77:65:62:32" || r.Strategy != "ClientID" ||
+		optVal(r.Options, 67) != "ipxe.efi" {
+		t.Errorf("ISC: wrong reservation: %#v", r)
+	}
+	if len(isc.Leases) != 1 || !isc.Leases[0].Addr.Equal(net.ParseIP("10.0.0.11")) {
+		t.Errorf("ISC: expected only the lease for 10.0.0.11, got %v", isc.Leases)
+	}
+	if len(isc.Warnings) != 2 {
+		t.Errorf("ISC: expected 2 warnings, got %v", isc.Warnings)
+	}
+
+	kea := &models.DhcpImport{Format: "kea", Config: keaTestConf, LeaseData: keaTestLeases}
+	if err := ParseDhcpImport(kea); err != nil {
+		t.Fatalf("Kea: unexpected error: %v", err)
+	}
+	if len(kea.Subnets) != 2 {
+		t.Fatalf("Kea: expected 2 subnets, got %d", len(kea.Subnets))
+	}
+	s = kea.Subnets[1]
+	if len(s.Pools) != 1 || !s.Pools[0].Start.Equal(net.ParseIP("10.1.0.64")) ||
+		!s.Pools[0].End.Equal(net.ParseIP("10.1.0.79")) || s.ActiveLeaseTime != 4000 ||
+		optVal(s.Options, 3) != "10.1.0.1" || optVal(s.Options, 6) != "10.1.0.2,10.1.0.3" {
+		t.Errorf("Kea: wrong subnet: %#v", s)
+	}
+	if s = kea.Subnets[0]; s.ActiveLeaseTime != 100 || !s.OnlyReservations ||
+		optVal(s.Options, 67) != "http://boot/ipxe.efi" {
+		t.Errorf("Kea: wrong subnet: %#v", s)
+	}
+	if len(kea.Reservations) != 2 || kea.Reservations[1].Token != "01:52:54:00:aa:bb:11" {
+		t.Errorf("Kea: wrong reservations: %v", kea.Reservations)
+	}
+	if len(kea.Leases) != 1 || kea.Leases[0].Token != "52:54:00:aa:bb:12" {
+		t.Errorf("Kea: expected only the lease for 10.1.0.10, got %v", kea.Leases)
+	}
+
+	dm := &models.DhcpImport{Format: "dnsmasq", Config: dnsmasqTestConf, LeaseData: dnsmasqTestLeases, Enabled: true}
+	if err := ParseDhcpImport(dm); err != nil {
+		t.Fatalf("dnsmasq: unexpected error: %v", err)
+	}
+	if len(dm.Subnets) != 2 {
+		t.Fatalf("dnsmasq: expected 2 subnets, got %d", len(dm.Subnets))
+	}
+	s = dm.Subnets[0]
+	if !s.ActiveEnd.Equal(net.ParseIP("192.168.5.150")) || s.ActiveLeaseTime != 43200 || !s.Enabled ||
+		optVal(s.Options, 3) != "192.168.5.1" || optVal(s.Options, 6) != "192.168.5.2,192.168.5.3" ||
+		optVal(s.Options, 42) != "" || optVal(s.Options, 67) != "pxelinux.0" ||
+		!s.NextServer.Equal(net.ParseIP("192.168.5.5")) {
+		t.Errorf("dnsmasq: wrong subnet: %#v", s)
+	}
+	if !dm.Subnets[1].OnlyReservations {
+		t.Errorf("dnsmasq: static range should only allow reservations")
+	}
+	if len(dm.Reservations) != 2 || optVal(dm.Reservations[0].Options, 12) != "printer" ||
+		dm.Reservations[1].Strategy != "ClientID" || dm.Reservations[1].Duration != 7200 {
+		t.Errorf("dnsmasq: wrong reservations: %v", dm.Reservations)
+	}
+	if len(dm.Leases) != 1 {
+		t.Errorf("dnsmasq: expected 1 lease, got %v", dm.Leases)
+	}
+
+	if err := ParseDhcpImport(&models.DhcpImport{Format: "bogus"}); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+	if err := ParseDhcpImport(&models.DhcpImport{Format: "isc", Config: "subnet 10.0.0.0 netmask 255.0.0.0 {"}); err == nil {
+		t.Errorf("Expected an error for an unterminated block")
+	}
+}
+
+func TestDhcpImport(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "reservations", "leases")
+	for _, obj := range []crudTest{
+		{
+			"Existing Subnet",
+			rt.Create,
+			&models.Subnet{
+				Name:        "existing",
+				Subnet:      "10.0.0.0/16",
+				ActiveStart: net.ParseIP("10.0.1.10"),
+				ActiveEnd:   net.ParseIP("10.0.1.20"),
+				Strategy:    "MAC",
+			},
+			true,
+		},
+		{
+			"Existing Reservation",
+			rt.Create,
+			&models.Reservation{Addr: net.ParseIP("10.0.0.200"), Token: "52:54:00:aa:bb:ff", Strategy: "MAC"},
+			true,
+		},
+	} {
+		obj.Test(t, rt)
+	}
+	imp := &models.DhcpImport{Format: "isc", Config: iscTestConf, LeaseData: iscTestLeases, DryRun: true}
+	if err := ImportDhcp(rt, imp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(imp.Conflicts) != 2 {
+		t.Errorf("Expected 2 conflicts, got %v", imp.Conflicts)
+	}
+	for _, c := range imp.Conflicts {
+		t.Logf("%s %s: %s", c.Prefix, c.Key, c.Reason)
+	}
+	rt.Do(func(d Stores) {
+		if len(d("reservations").Items()) != 1 || len(d("leases").Items()) != 0 {
+			t.Errorf("A dry run should not create anything")
+		}
+	})
+	imp = &models.DhcpImport{
+		Format: "dnsmasq",
+		Config: "dhcp-range=172.16.0.10,172.16.0.20,255.255.255.0\n" +
+			"dhcp-host=52:54:00:aa:bb:40,172.16.0.100\n" +
+			"dhcp-host=52:54:00:aa:bb:41,10.9.9.9\n",
+		LeaseData: "4102444800 52:54:00:aa:bb:42 172.16.0.10 * *\n" +
+			"4102444800 52:54:00:aa:bb:43 172.16.0.100 * *\n" +
+			"4102444800 52:54:00:aa:bb:44 192.168.99.1 * *\n",
+	}
+	if err := ImportDhcp(rt, imp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(imp.Conflicts) != 2 {
+		t.Errorf("Expected 2 conflicts, got %v", imp.Conflicts)
+	}
+	rt.Do(func(d Stores) {
+		if d("subnets").Find("subnet-172.16.0.0-24") == nil {
+			t.Errorf("Expected the subnet to be created")
+		}
+		if len(d("reservations").Items()) != 3 {
+			t.Errorf("Expected 3 reservations, got %d", len(d("reservations").Items()))
+		}
+		if len(d("leases").Items()) != 1 {
+			t.Errorf("Expected 1 lease, got %d", len(d("leases").Items()))
+		}
+	})
+}
+
+func TestDhcpImportDryRunValidates(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "reservations", "leases")
+	crudTest{
+		"Subnet with the name the import wants",
+		rt.Create,
+		&models.Subnet{
+			Name:        "subnet-172.31.0.0-24",
+			Subnet:      "10.31.0.0/24",
+			ActiveStart: net.ParseIP("10.31.0.10"),
+			ActiveEnd:   net.ParseIP("10.31.0.20"),
+			Strategy:    "MAC",
+		},
+		true,
+	}.Test(t, rt)
+	// The Subnet conflicts by name, which leaves the Scoped
+	// Reservation in it without a Subnet, so creating it fails.
+	conf := "dhcp-range=172.31.0.10,172.31.0.20,255.255.255.0\n" +
+		"dhcp-host=52:54:00:aa:bb:50,172.31.0.100\n"
+	for _, dryRun := range []bool{true, false} {
+		imp := &models.DhcpImport{Format: "dnsmasq", Config: conf, DryRun: dryRun}
+		if err := ImportDhcp(rt, imp); err != nil {
+			t.Fatalf("DryRun %v: unexpected error: %v", dryRun, err)
+		}
+		if len(imp.Conflicts) != 2 {
+			t.Errorf("DryRun %v: expected 2 conflicts, got %v", dryRun, imp.Conflicts)
+		}
+	}
+	rt.Do(func(d Stores) {
+		if len(d("reservations").Items()) != 0 {
+			t.Errorf("Expected the invalid reservation to not be created")
+		}
+	})
+}
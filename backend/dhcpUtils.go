@@ -58,7 +58,7 @@ func mergeOptions(rt *RequestTracker, l *Lease, r *Reservation, s *Subnet) {
 				l.Duration = s.ActiveLeaseTime
 			}
 		}
-		if s.Pickers[0] == "point2point" {
+		if s.Pickers[0] == "point2point" && l.Via.To4() != nil {
 			mergedOpts[dhcp.OptionRouter] = models.DhcpOption{
 				Code:  byte(dhcp.OptionRouter),
 				Value: l.Via.String(),
@@ -71,7 +71,7 @@ func mergeOptions(rt *RequestTracker, l *Lease, r *Reservation, s *Subnet) {
 	}
 	l.ExpireTime = time.Now().Add(time.Duration(int64(l.Duration)) * time.Second)
 	if r != nil && r.NextServer.IsGlobalUnicast() {
-		l.NextServer = s.NextServer
+		l.NextServer = r.NextServer
 	}
 	l.Options = make([]models.DhcpOption, 0, len(mergedOpts))
 	for _, v := range mergedOpts {
@@ -82,6 +82,12 @@ func mergeOptions(rt *RequestTracker, l *Lease, r *Reservation, s *Subnet) {
 	})
 }
 
+// sameFamily returns true if both addresses are IPv4 addresses or
+// both are IPv6 addresses.
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
 func fillViaFromLease(lease *Lease, vias []net.IP) net.IP {
 	for _, via := range vias {
 		if via.Equal(lease.Via) {
@@ -112,16 +118,25 @@ func findReservation(rt *RequestTracker,
 	req net.IP) *Reservation {
 	reservations := rt.d("reservations")
 	if req.IsGlobalUnicast() {
-		if res := rt.find("reservations", models.Hexaddr(req.To4())); res != nil {
+		if res := rt.find("reservations", models.Hexaddr(req)); res != nil {
 			reservation := AsReservation(res)
 			if reservation.Strategy == strategy && reservation.Token == token {
 				return reservation
 			}
 		}
 	}
+	var family net.IP
+	if subnet != nil {
+		family = subnet.subnet().IP
+	} else if len(req) > 0 {
+		family = req
+	}
 	scopedCandidates, globalCandidates := []*Reservation{}, []*Reservation{}
 	for _, i := range reservations.Items() {
 		res := AsReservation(i)
+		if family != nil && !sameFamily(family, res.Addr) {
+			continue
+		}
 		if res.Token == token && res.Strategy == strategy {
 			if !res.Scoped {
 				globalCandidates = append(globalCandidates, res)
@@ -204,7 +219,7 @@ func findLease(rt *RequestTracker,
 	subnet *Subnet,
 	strategy, token string, req, via net.IP) (lease *Lease, err error) {
 	reservations, leases := rt.d("reservations"), rt.d("leases")
-	hexreq := models.Hexaddr(req.To4())
+	hexreq := models.Hexaddr(req)
 	found := leases.Find(hexreq)
 	if found == nil {
 		return
@@ -267,6 +282,10 @@ func FindLease(rt *RequestTracker,
 	strategy, token string,
 	req net.IP,
 	vias []net.IP) (lease *Lease, subnet *Subnet, reservation *Reservation, err error) {
+	if fo := rt.dt.failover; fo != nil && !fo.Serving() {
+		rt.Switch("dhcp").Debugf("Failover peer is serving DHCP, ignoring request for %s", req)
+		return
+	}
 	rt.Do(func(d Stores) {
 		subnet, via := findSubnetForVias(rt, vias)
 		lease, err = findLease(rt, subnet, strategy, token, req, via)
@@ -280,6 +299,13 @@ func FindLease(rt *RequestTracker,
 				err = LeaseNAK(fmt.Errorf("No lease for %s, convered by reservation %s", req, reservation.Addr))
 			}
 			if subnet != nil {
+				if fo := rt.dt.failover; fo != nil &&
+					subnet.InActiveRange(req) &&
+					!fo.scope(subnet).InActiveRange(req) {
+					// Our failover peer may have handed this out and not
+					// told us about it yet.  Let the peer deal with it.
+					return
+				}
 				err = LeaseNAK(fmt.Errorf("No lease for %s, covered by subnet %s", req, subnet.subnet().IP))
 			}
 			return
@@ -300,6 +326,9 @@ func FindLease(rt *RequestTracker,
 		lease.State = "ACK"
 		lease.Via = via
 		mergeOptions(rt, lease, reservation, subnet)
+		if fo := rt.dt.failover; fo != nil {
+			fo.clamp(lease)
+		}
 		rt.Save(lease)
 	})
 	return
@@ -315,6 +344,10 @@ func findViaSubnet(rt *RequestTracker,
 		// Subnet not found or isn't enabled, don't give out leases.
 		return
 	}
+	if subnet.Strategy != strategy {
+		// Subnet hands out leases using a different strategy.
+		return
+	}
 	// Return a fake lease
 	if subnet.Proxy || fake {
 		lease = &Lease{}
@@ -330,6 +363,10 @@ func findViaSubnet(rt *RequestTracker,
 	usedAddrs := map[string]models.Model{}
 	for _, i := range currLeases.Items() {
 		currLease := AsLease(i)
+		// IPv4 and IPv6 lease keys can interleave in the index.
+		if !subnet.InSubnetRange(currLease.Addr) {
+			continue
+		}
 		// While we are iterating over leases, see if we run across a candidate.
 		if currLease.Strategy == strategy &&
 			currLease.Token == token {
@@ -343,6 +380,9 @@ func findViaSubnet(rt *RequestTracker,
 	for _, i := range currReservations.Items() {
 		// While we are iterating over reservations, see if any candidate we found is still kosher.
 		currRes := AsReservation(i)
+		if !subnet.InSubnetRange(currRes.Addr) {
+			continue
+		}
 		if currRes.Strategy == strategy &&
 			currRes.Token == token {
 			if lease != nil {
@@ -361,8 +401,25 @@ func findViaSubnet(rt *RequestTracker,
 		return
 	}
 	rt.Switch("dhcp").Infof("Subnet %s: %s:%s is in my range, attempting lease creation.", subnet.Name, strategy, token)
-	lease, _ = subnet.next(usedAddrs, token, req, via)
+	if fo := rt.dt.failover; fo != nil {
+		// Only allocate from the part of the subnet our failover peer
+		// will not allocate from.
+		scope := fo.scope(subnet)
+		lease, _ = scope.next(usedAddrs, token, req, via)
+		if scope != subnet && scope.nextLeasableIP != nil {
+			subnet.nextLeasableIP = scope.nextLeasableIP
+		}
+	} else {
+		lease, _ = subnet.next(usedAddrs, token, req, via)
+	}
 	if lease != nil {
+		if lease.expired != nil {
+			// Record the expiry if no sweep has seen it yet.
+			if h := rt.dt.LeaseHistory; h != nil && rt.sandbox == nil && h.lapsed(lease.expired) {
+				h.recordExpire(lease.expired, via)
+			}
+			lease.expired = nil
+		}
 		lease.State = "PROBE"
 		if leases.Find(lease.Key()) == nil {
 			leases.Add(lease)
@@ -385,7 +442,9 @@ func FakeLeaseFor(rt *RequestTracker,
 		subnet, via := findSubnetForVias(rt, vias)
 		_, reservation, _ = findViaReservation(rt, subnet, strategy, token, nil, true)
 		lease, _ = findViaSubnet(rt, subnet, strategy, token, nil, via, true)
-		mergeOptions(rt, lease, reservation, subnet)
+		if lease != nil {
+			mergeOptions(rt, lease, reservation, subnet)
+		}
 	})
 	return
 }
@@ -399,6 +458,10 @@ func FindOrCreateLease(rt *RequestTracker,
 	strategy, token string,
 	req net.IP,
 	vias []net.IP) (lease *Lease, fresh bool) {
+	if fo := rt.dt.failover; fo != nil && !fo.Serving() {
+		rt.Switch("dhcp").Debugf("Failover peer is serving DHCP, not offering a lease to %s:%s", strategy, token)
+		return
+	}
 	rt.Do(func(d Stores) {
 		subnet, via := findSubnetForVias(rt, vias)
 		leases := d("leases")
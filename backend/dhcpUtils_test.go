@@ -351,3 +351,40 @@ func TestDHCPP2P(t *testing.T) {
 		obj.test(t, rt)
 	}
 }
+
+func TestDHCPCreateSubnetIPv6(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "leases", "reservations")
+	// A v4 and a v6 subnet, with a dual-stack client reserved in both.
+	startObjs := []crudTest{
+		{"Create v4 Subnet", rt.Create, &models.Subnet{Enabled: true, Name: "test4", Subnet: "192.168.124.0/24", ActiveStart: net.ParseIP("192.168.124.80"), ActiveEnd: net.ParseIP("192.168.124.83"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}, true},
+		{"Create v6 Subnet", rt.Create, &models.Subnet{Enabled: true, Name: "test6", Subnet: "fd00:124::/64", ActiveStart: net.ParseIP("fd00:124::80"), ActiveEnd: net.ParseIP("fd00:124::82"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "MAC"}, true},
+		{"Create invalid v6 Subnet(Proxy)", rt.Create, &models.Subnet{Enabled: true, Name: "test6p", Proxy: true, Subnet: "fd00:125::/64", ActiveLeaseTime: 60, ReservedLeaseTime: 7200}, false},
+		{"Create v4 Reservation", rt.Create, &models.Reservation{Addr: net.ParseIP("192.168.124.10"), Token: "res1", Strategy: "MAC"}, true},
+		{"Create v6 Reservation for the same token", rt.Create, &models.Reservation{Addr: net.ParseIP("fd00:124::10"), Token: "res1", Strategy: "MAC"}, true},
+	}
+	for _, obj := range startObjs {
+		obj.Test(t, rt)
+	}
+	createTests := []ltc{
+		{"Create v4 lease from reservation", "MAC", "res1", nil, net.ParseIP("192.168.124.1"), true, net.ParseIP("192.168.124.10")},
+		{"Create v6 lease from reservation", "MAC", "res1", nil, net.ParseIP("fd00:124::1"), true, net.ParseIP("fd00:124::10")},
+		{"Create v6 lease using pickNextFree", "MAC", "sub1", nil, net.ParseIP("fd00:124::1"), true, net.ParseIP("fd00:124::80")},
+		{"Create v6 lease using pickHint", "MAC", "sub2", net.ParseIP("fd00:124::82"), net.ParseIP("fd00:124::1"), true, net.ParseIP("fd00:124::82")},
+		{"Create v6 lease using pickNextFree", "MAC", "sub3", nil, net.ParseIP("fd00:124::1"), true, net.ParseIP("fd00:124::81")},
+		{"Create v4 lease for v6 client", "MAC", "sub1", nil, net.ParseIP("192.168.124.1"), true, net.ParseIP("192.168.124.80")},
+		{"Fail to get v6 lease due to address range exhaustion", "MAC", "sub4", nil, net.ParseIP("fd00:124::1"), false, nil},
+	}
+	for _, obj := range createTests {
+		obj.test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		subnet := AsSubnet(rt.find("subnets", "test6"))
+		if !subnet.InActiveRange(net.ParseIP("fd00:124::81")) {
+			t.Errorf("fd00:124::81 should be in the active range of %s", subnet.Name)
+		}
+		if subnet.InSubnetRange(net.ParseIP("192.168.124.81")) {
+			t.Errorf("192.168.124.81 should not be in the range of %s", subnet.Name)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package backend
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// Failover tracks the state of DHCP lease synchronization with a
+// peer dr-provision endpoint, and enforces the rules that keep the
+// two peers from handing out the same address.
+//
+// In "split" mode both peers answer DHCP requests, but each peer
+// only allocates new addresses from its half of every subnet's
+// active range.  The primary owns the lower half, the secondary the
+// upper half.
+//
+// In "standby" mode only the primary answers DHCP requests.  The
+// secondary takes over once it has not heard from the primary for
+// longer than the MCLT.
+//
+// In both modes, a lease is never granted for longer than the MCLT
+// past the expiry time that the peer has acknowledged for it.
+type Failover struct {
+	// Peer is the API endpoint of the failover peer.
+	Peer string
+	// Mode is either "split" or "standby"
+	Mode string
+	// Primary is true on the primary peer, and false on the secondary.
+	Primary bool
+	// MCLT is the Maximum Client Lead Time.
+	MCLT        time.Duration
+	mux         *sync.Mutex
+	peerUp      bool
+	lastContact time.Time
+	acked       map[string]time.Time
+}
+
+// NewFailover returns a new Failover for the passed peer, mode, role,
+// and MCLT.  The peer is assumed to be down until Contact is called.
+func NewFailover(peer, mode string, primary bool, mclt time.Duration) (*Failover, error) {
+	switch mode {
+	case "split", "standby":
+	default:
+		return nil, fmt.Errorf("Invalid failover mode %s: must be split or standby", mode)
+	}
+	if mclt <= 0 {
+		return nil, fmt.Errorf("Failover MCLT must be greater than zero")
+	}
+	return &Failover{
+		Peer:        peer,
+		Mode:        mode,
+		Primary:     primary,
+		MCLT:        mclt,
+		mux:         &sync.Mutex{},
+		lastContact: time.Now(),
+		acked:       map[string]time.Time{},
+	}, nil
+}
+
+// Contact records the result of the latest attempt to talk to the
+// peer.  It returns true if the peer has just come back up, in which
+// case the caller should send the peer all of our leases.
+func (f *Failover) Contact(ok bool) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	wasUp := f.peerUp
+	f.peerUp = ok
+	if ok {
+		f.lastContact = time.Now()
+	}
+	return ok && !wasUp
+}
+
+// Ack records that the peer has stored the lease with the passed
+// expiry time.
+func (f *Failover) Ack(key string, expire time.Time) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if expire.Before(time.Now()) {
+		delete(f.acked, key)
+		return
+	}
+	f.acked[key] = expire
+}
+
+func (f *Failover) partnerDown() bool {
+	return !f.peerUp && time.Since(f.lastContact) > f.MCLT
+}
+
+// Serving returns true if this endpoint should answer DHCP requests.
+func (f *Failover) Serving() bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.Mode == "split" || f.Primary || f.partnerDown()
+}
+
+// Status returns the current failover state.
+func (f *Failover) Status() *models.FailoverStatus {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return &models.FailoverStatus{
+		Peer:        f.Peer,
+		Mode:        f.Mode,
+		Primary:     f.Primary,
+		MCLT:        int(f.MCLT / time.Second),
+		PeerUp:      f.peerUp,
+		PartnerDown: f.partnerDown(),
+		LastContact: f.lastContact,
+	}
+}
+
+// splitRange returns the lower half of the range from start to end
+// for the primary, and the upper half for the secondary.
+func splitRange(start, end net.IP, primary bool) (net.IP, net.IP) {
+	if start == nil || end == nil {
+		return start, end
+	}
+	size := len(ipBytes(start))
+	lo, hi, mid := &big.Int{}, &big.Int{}, &big.Int{}
+	lo.SetBytes(ipBytes(start))
+	hi.SetBytes(ipBytes(end))
+	mid.Sub(hi, lo)
+	mid.Rsh(mid, 1)
+	mid.Add(mid, lo)
+	if primary {
+		return start, bigToIP(mid, size)
+	}
+	mid.Add(mid, big.NewInt(1))
+	return bigToIP(mid, size), end
+}
+
+// scope returns the Subnet that new addresses should be allocated
+// from.  In split mode, this is a copy of the Subnet whose active
+// range and Pools only cover our half of each, unless the peer has been down for
+// longer than the MCLT.
+func (f *Failover) scope(s *Subnet) *Subnet {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.Mode != "split" || f.partnerDown() {
+		return s
+	}
+	res := &Subnet{Subnet: &models.Subnet{}, validate: s.validate, sn: s.sn}
+	*res.Subnet = *s.Subnet
+	res.ActiveStart, res.ActiveEnd = splitRange(s.ActiveStart, s.ActiveEnd, f.Primary)
+	res.Pools = make([]models.SubnetRange, len(s.Pools))
+	for i, p := range s.Pools {
+		res.Pools[i].Start, res.Pools[i].End = splitRange(p.Start, p.End, f.Primary)
+	}
+	if s.nextLeasableIP != nil && res.InActiveRange(s.nextLeasableIP) {
+		res.nextLeasableIP = s.nextLeasableIP
+	}
+	return res
+}
+
+// clamp limits the lease so that it does not expire more than the
+// MCLT past the expiry time the peer has acknowledged.
+func (f *Failover) clamp(l *Lease) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	now := time.Now()
+	limit := now
+	if acked, ok := f.acked[l.Key()]; ok && acked.After(now) {
+		limit = acked
+	}
+	limit = limit.Add(f.MCLT)
+	if l.ExpireTime.After(limit) {
+		l.ExpireTime = limit
+		l.Duration = int32(limit.Sub(now) / time.Second)
+	}
+}
+
+// SetFailover enables DHCP failover handling for this DataTracker.
+func (p *DataTracker) SetFailover(f *Failover) {
+	p.failover = f
+}
+
+// Failover returns the Failover in use, or nil if DHCP failover is
+// not enabled.
+func (p *DataTracker) Failover() *Failover {
+	return p.failover
+}
+
+// SyncLease stores a lease replicated from our failover peer.  The
+// lease is saved as-is, and any other lease for the same client in
+// the same address family is removed.  applied is false if the lease
+// matched what we already had, which keeps updates from bouncing
+// between the peers forever.
+func SyncLease(rt *RequestTracker, in *models.Lease) (applied bool, err error) {
+	if in.Addr == nil || in.Addr.IsUnspecified() {
+		return false, fmt.Errorf("Replicated lease is missing an address")
+	}
+	rt.Do(func(d Stores) {
+		leases := d("leases")
+		if found := leases.Find(in.Key()); found != nil {
+			curr := AsLease(found)
+			if curr.Token == in.Token &&
+				curr.Strategy == in.Strategy &&
+				curr.State == in.State &&
+				curr.ExpireTime.Equal(in.ExpireTime) {
+				return
+			}
+		}
+		stale := []*Lease{}
+		for _, i := range leases.Items() {
+			other := AsLease(i)
+			if other.Addr.Equal(in.Addr) ||
+				!sameFamily(other.Addr, in.Addr) ||
+				other.Token != in.Token ||
+				other.Strategy != in.Strategy {
+				continue
+			}
+			stale = append(stale, other)
+		}
+		for _, other := range stale {
+			if _, err = rt.Remove(other); err != nil {
+				return
+			}
+		}
+		lease := &Lease{Lease: in}
+		// Via is usually one of the peer's addresses, which would
+		// make us NAK renewals.  It will be filled back in when we
+		// ACK the lease ourselves.
+		lease.Via = net.IP{}
+		applied, err = rt.Save(lease)
+	})
+	return
+}
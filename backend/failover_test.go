@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+func failoverDT(t *testing.T) (*DataTracker, *RequestTracker) {
+	t.Helper()
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "reservations", "leases")
+	subnet := crudTest{
+		"Create Subnet",
+		rt.Create,
+		&models.Subnet{
+			Enabled:           true,
+			Name:              "test",
+			Subnet:            "192.168.124.0/24",
+			ActiveStart:       net.ParseIP("192.168.124.80"),
+			ActiveEnd:         net.ParseIP("192.168.124.83"),
+			ActiveLeaseTime:   60,
+			ReservedLeaseTime: 7200,
+			Strategy:          "mac",
+		},
+		true,
+	}
+	subnet.Test(t, rt)
+	return dt, rt
+}
+
+func TestFailoverSplit(t *testing.T) {
+	dt, rt := failoverDT(t)
+	fo, err := NewFailover("https://peer:8092", "split", true, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create failover: %v", err)
+	}
+	fo.Contact(true)
+	dt.SetFailover(fo)
+	via := net.ParseIP("192.168.124.1")
+	primaryTests := []ltc{
+		{"Primary allocates from the lower half", "mac", "a", nil, via, true, net.ParseIP("192.168.124.80")},
+		{"Primary allocates from the lower half", "mac", "b", nil, via, true, net.ParseIP("192.168.124.81")},
+		{"Primary refuses to allocate from the upper half", "mac", "c", nil, via, false, nil},
+		{"Primary refuses a hint in the upper half", "mac", "d", net.ParseIP("192.168.124.82"), via, false, nil},
+	}
+	for _, obj := range primaryTests {
+		obj.test(t, rt)
+	}
+	finds := []ltf{
+		{"Primary ignores requests for the secondary's addresses", "mac", "c", net.ParseIP("192.168.124.83"), via, false, false},
+		{"Primary NAKs requests for its own addresses", "mac", "c", net.ParseIP("192.168.124.80"), via, false, true},
+	}
+	for _, obj := range finds {
+		obj.find(t, rt)
+	}
+	fo.Primary = false
+	secondaryTests := []ltc{
+		{"Secondary allocates from the upper half", "mac", "c", nil, via, true, net.ParseIP("192.168.124.82")},
+		{"Secondary hands out existing leases", "mac", "a", nil, via, true, net.ParseIP("192.168.124.80")},
+	}
+	for _, obj := range secondaryTests {
+		obj.test(t, rt)
+	}
+	// Once the peer has been gone for longer than the MCLT, we own everything.
+	fo.Contact(false)
+	fo.lastContact = time.Now().Add(-2 * time.Hour)
+	fo.Primary = true
+	partnerDownTests := []ltc{
+		{"Partner down allocates from the whole range", "mac", "d", nil, via, true, net.ParseIP("192.168.124.83")},
+	}
+	for _, obj := range partnerDownTests {
+		obj.test(t, rt)
+	}
+}
+
+func TestFailoverStandby(t *testing.T) {
+	dt, rt := failoverDT(t)
+	fo, _ := NewFailover("https://peer:8092", "standby", false, time.Hour)
+	fo.Contact(true)
+	dt.SetFailover(fo)
+	via := net.ParseIP("192.168.124.1")
+	if fo.Serving() {
+		t.Errorf("Secondary in standby mode should not be serving")
+	}
+	standbyTests := []ltc{
+		{"Secondary does not allocate while the primary is up", "mac", "a", nil, via, false, nil},
+	}
+	for _, obj := range standbyTests {
+		obj.test(t, rt)
+	}
+	fo.Contact(false)
+	if fo.Serving() {
+		t.Errorf("Secondary should wait for the MCLT before serving")
+	}
+	fo.lastContact = time.Now().Add(-2 * time.Hour)
+	if !fo.Serving() {
+		t.Errorf("Secondary should serve once the primary is down")
+	}
+	takeoverTests := []ltc{
+		{"Secondary allocates from the whole range once the primary is down", "mac", "a", nil, via, true, net.ParseIP("192.168.124.80")},
+	}
+	for _, obj := range takeoverTests {
+		obj.test(t, rt)
+	}
+	if st := fo.Status(); !st.PartnerDown || st.PeerUp || st.MCLT != 3600 {
+		t.Errorf("Unexpected failover status %#v", st)
+	}
+}
+
+func TestFailoverClamp(t *testing.T) {
+	fo, _ := NewFailover("https://peer:8092", "split", true, 10*time.Minute)
+	lease := &Lease{Lease: &models.Lease{Addr: net.ParseIP("192.168.124.80")}}
+	lease.ExpireTime = time.Now().Add(2 * time.Hour)
+	fo.clamp(lease)
+	if lease.ExpireTime.After(time.Now().Add(10 * time.Minute)) {
+		t.Errorf("Unacknowledged lease should be clamped to the MCLT, expires at %s", lease.ExpireTime)
+	}
+	fo.Ack(lease.Key(), time.Now().Add(time.Hour))
+	lease.ExpireTime = time.Now().Add(2 * time.Hour)
+	fo.clamp(lease)
+	if lease.ExpireTime.After(time.Now().Add(70*time.Minute)) ||
+		lease.ExpireTime.Before(time.Now().Add(69*time.Minute)) {
+		t.Errorf("Acknowledged lease should be clamped to the MCLT past the ack, expires at %s", lease.ExpireTime)
+	}
+	if lease.Duration < 69*60 || lease.Duration > 70*60 {
+		t.Errorf("Clamped lease has wrong duration %d", lease.Duration)
+	}
+	if _, err := NewFailover("https://peer:8092", "fred", true, time.Hour); err == nil {
+		t.Errorf("Invalid failover mode should be rejected")
+	}
+}
+
+func TestSyncLease(t *testing.T) {
+	_, rt := failoverDT(t)
+	expire := time.Now().Add(time.Minute)
+	mk := func(addr string) *models.Lease {
+		return &models.Lease{
+			Addr:       net.ParseIP(addr),
+			Via:        net.ParseIP("192.168.124.2"),
+			Strategy:   "mac",
+			Token:      "a",
+			State:      "ACK",
+			Duration:   60,
+			ExpireTime: expire,
+		}
+	}
+	first := mk("192.168.124.80")
+	if applied, err := SyncLease(rt, first); !applied || err != nil {
+		t.Fatalf("Expected replicated lease to be saved: %v %v", applied, err)
+	}
+	if applied, err := SyncLease(rt, mk("192.168.124.80")); applied || err != nil {
+		t.Errorf("Expected identical lease to be ignored: %v %v", applied, err)
+	}
+	if applied, err := SyncLease(rt, mk("192.168.124.81")); !applied || err != nil {
+		t.Errorf("Expected moved lease to be saved: %v %v", applied, err)
+	}
+	rt.Do(func(d Stores) {
+		if rt.find("leases", models.Hexaddr(net.ParseIP("192.168.124.80"))) != nil {
+			t.Errorf("Old lease for the same client should have been removed")
+		}
+		l := rt.find("leases", models.Hexaddr(net.ParseIP("192.168.124.81")))
+		if l == nil {
+			t.Errorf("Replicated lease is missing")
+		} else if len(AsLease(l).Via) != 0 {
+			t.Errorf("Replicated lease should not keep the peer's Via")
+		}
+	})
+	if _, err := SyncLease(rt, &models.Lease{Token: "a", Strategy: "mac"}); err == nil {
+		t.Errorf("Lease without an address should be rejected")
+	}
+}
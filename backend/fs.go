@@ -1,7 +1,10 @@
 package backend
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -9,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/digitalrebar/logger"
 )
@@ -70,6 +74,140 @@ func (fs *FileSystem) Open(p string, remoteIP net.IP) (io.Reader, error) {
 	return nil, nil
 }
 
+// fileETag makes a strong ETag for a file on disk out of its
+// modification time and size, so that it stays the same across
+// restarts for as long as the file is not changed.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// singleRange parses a Range header that asks for one range of a
+// size byte long stream.  ok is false if the whole stream should be
+// sent instead, and unsatisfiable is true if none of the range is in
+// the stream.
+func singleRange(hdr string, size int64) (start, length int64, ok, unsatisfiable bool) {
+	if size < 0 || !strings.HasPrefix(hdr, "bytes=") {
+		return
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(hdr, "bytes="))
+	if spec == "" || strings.Contains(spec, ",") {
+		return
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+	end := size - 1
+	if first == "" {
+		// A suffix range: the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return
+		}
+		if n == 0 {
+			unsatisfiable = true
+			return
+		}
+		if n > size {
+			n = size
+		}
+		start = size - n
+	} else {
+		var err error
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+			return 0, 0, false, false
+		}
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return 0, 0, false, false
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+	if start >= size {
+		return 0, 0, false, true
+	}
+	return start, end - start + 1, true, false
+}
+
+// serveStatic serves a file from disk.  http.ServeFile handles HEAD,
+// Range, If-Range, and the conditional headers, using the ETag we
+// set for it.
+func (fs *FileSystem) serveStatic(w http.ResponseWriter, r *http.Request, p string) {
+	if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+		w.Header().Set("ETag", fileETag(fi))
+		// Caches may keep the file, but have to check that it has
+		// not changed before using it.
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	http.ServeFile(w, r, p)
+}
+
+// serveDynamic serves the output of a lookaside.  Rendered templates
+// can seek, so they go through http.ServeContent with an ETag made
+// from what was rendered.  They are rendered for the machine asking
+// for them, so shared caches must not keep them.  Other lookasides
+// (such as install sources we proxy) are streamed, and a single
+// range can be asked for if we know how big they are.
+func (fs *FileSystem) serveDynamic(w http.ResponseWriter, r *http.Request, p string, out io.Reader) {
+	if cl, ok := out.(io.ReadCloser); ok {
+		defer cl.Close()
+	}
+	if rs, ok := out.(io.ReadSeeker); ok {
+		sum := sha256.New()
+		if _, err := io.Copy(sum, rs); err == nil {
+			if _, err = rs.Seek(0, io.SeekStart); err == nil {
+				w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum.Sum(nil)[:16]))
+				w.Header().Set("Cache-Control", "private, no-cache")
+				http.ServeContent(w, r, path.Base(p), time.Time{}, rs)
+				return
+			}
+		}
+		fs.logger.Errorf("Static FS: Failed to read rendered file %s", p)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	size := int64(-1)
+	if sz, ok := out.(Sizer); ok {
+		size = sz.Size()
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	// We have no validator for If-Range to match, so a conditional
+	// range request gets the whole thing.
+	start, length, ok, unsatisfiable := int64(0), size, false, false
+	if r.Header.Get("If-Range") == "" {
+		start, length, ok, unsatisfiable = singleRange(r.Header.Get("Range"), size)
+	}
+	switch {
+	case unsatisfiable:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	case ok:
+		if _, err := io.CopyN(ioutil.Discard, out, start); err != nil {
+			fs.logger.Errorf("Static FS: Failed to skip to offset %d of %s: %v", start, p, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method != "HEAD" {
+			io.CopyN(w, out, length)
+		}
+	default:
+		if size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		if r.Method != "HEAD" {
+			io.Copy(w, out)
+		}
+	}
+}
+
 // ServeHTTP implements http.Handler for the FileSystem.
 func (fs *FileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p := r.URL.Path
@@ -90,15 +228,9 @@ func (fs *FileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fs.logger.Errorf("Static FS: Dynamic file error for %s: %v", p, err)
 		w.WriteHeader(http.StatusInternalServerError)
 	} else if out != nil {
-		if sz, ok := out.(Sizer); ok {
-			w.Header().Set("Content-Length", strconv.FormatInt(sz.Size(), 10))
-		}
-		io.Copy(w, out)
-		if cl, ok := out.(io.ReadCloser); ok {
-			cl.Close()
-		}
+		fs.serveDynamic(w, r, p, out)
 	} else {
-		http.ServeFile(w, r, path.Join(fs.lower, p))
+		fs.serveStatic(w, r, path.Join(fs.lower, p))
 	}
 }
 
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/digitalrebar/logger"
+)
+
+type fsReq struct {
+	name    string
+	method  string
+	path    string
+	headers map[string]string
+	code    int
+	body    string
+}
+
+func (f fsReq) run(t *testing.T, fs *FileSystem) *httptest.ResponseRecorder {
+	t.Helper()
+	method := f.method
+	if method == "" {
+		method = "GET"
+	}
+	req := httptest.NewRequest(method, f.path, nil)
+	for k, v := range f.headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, req)
+	if w.Code != f.code {
+		t.Errorf("%s: expected status %d, got %d", f.name, f.code, w.Code)
+	}
+	if f.body != "" && w.Body.String() != f.body {
+		t.Errorf("%s: expected body %q, got %q", f.name, f.body, w.Body.String())
+	}
+	return w
+}
+
+type streamReader struct {
+	io.Reader
+	size int64
+}
+
+func (s *streamReader) Size() int64 {
+	return s.size
+}
+
+func TestFileSystemServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs-")
+	if err != nil {
+		t.Fatalf("Cannot make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "file.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatalf("Cannot write test file: %v", err)
+	}
+	fs := NewFS(dir, logger.New(nil).Log(""))
+	fs.AddDynamicFile("/rendered.txt", func(net.IP) (io.Reader, error) {
+		return bytes.NewReader([]byte("rendered content")), nil
+	})
+	fs.AddDynamicTree("/stream", func(string) (io.Reader, error) {
+		return &streamReader{bytes.NewBufferString("abcdefghij"), 10}, nil
+	})
+
+	w := fsReq{name: "Static file", path: "/file.txt", code: 200, body: "0123456789"}.run(t, fs)
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Errorf("Static file: missing ETag or Last-Modified")
+	}
+	if w.Header().Get("Cache-Control") != "public, no-cache" {
+		t.Errorf("Static file: unexpected Cache-Control %q", w.Header().Get("Cache-Control"))
+	}
+	if w2 := (fsReq{name: "Static file again", path: "/file.txt", code: 200}).run(t, fs); w2.Header().Get("ETag") != etag {
+		t.Errorf("Static file: ETag changed from %s to %s", etag, w2.Header().Get("ETag"))
+	}
+	for _, req := range []fsReq{
+		{name: "Static range", path: "/file.txt", headers: map[string]string{"Range": "bytes=2-4"}, code: 206, body: "234"},
+		{name: "Static suffix range", path: "/file.txt", headers: map[string]string{"Range": "bytes=-3"}, code: 206, body: "789"},
+		{name: "Static If-Range match", path: "/file.txt", headers: map[string]string{"Range": "bytes=5-", "If-Range": etag}, code: 206, body: "56789"},
+		{name: "Static If-Range mismatch", path: "/file.txt", headers: map[string]string{"Range": "bytes=5-", "If-Range": `"stale"`}, code: 200, body: "0123456789"},
+		{name: "Static If-None-Match", path: "/file.txt", headers: map[string]string{"If-None-Match": etag}, code: 304},
+		{name: "Static HEAD", method: "HEAD", path: "/file.txt", code: 200},
+		{name: "Static missing", path: "/missing.txt", code: 404},
+		{name: "Stream range", path: "/stream/iso", headers: map[string]string{"Range": "bytes=3-5"}, code: 206, body: "def"},
+		{name: "Stream open range", path: "/stream/iso", headers: map[string]string{"Range": "bytes=7-"}, code: 206, body: "hij"},
+		{name: "Stream bad range", path: "/stream/iso", headers: map[string]string{"Range": "bytes=20-"}, code: 416},
+		{name: "Stream If-Range", path: "/stream/iso", headers: map[string]string{"Range": "bytes=3-5", "If-Range": `"x"`}, code: 200, body: "abcdefghij"},
+	} {
+		req.run(t, fs)
+	}
+
+	w = fsReq{name: "Rendered file", path: "/rendered.txt", code: 200, body: "rendered content"}.run(t, fs)
+	etag = w.Header().Get("ETag")
+	if etag == "" {
+		t.Errorf("Rendered file: missing ETag")
+	}
+	if w.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("Rendered file: unexpected Cache-Control %q", w.Header().Get("Cache-Control"))
+	}
+	for _, req := range []fsReq{
+		{name: "Rendered range", path: "/rendered.txt", headers: map[string]string{"Range": "bytes=0-7"}, code: 206, body: "rendered"},
+		{name: "Rendered If-None-Match", path: "/rendered.txt", headers: map[string]string{"If-None-Match": etag}, code: 304},
+	} {
+		req.run(t, fs)
+	}
+}
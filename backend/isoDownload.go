@@ -0,0 +1,374 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+const (
+	// isoDownloadSlots is how many ISOs can be downloaded at once.
+	isoDownloadSlots = 2
+	// isoProgressInterval is how often progress events are published
+	// while an ISO is downloading.
+	isoProgressInterval = 5 * time.Second
+	// isoMaxBackoff is the longest we wait before trying a failed
+	// download again.
+	isoMaxBackoff = 5 * time.Minute
+)
+
+// isoDownloadFatal wraps download errors that will not go away by
+// trying again, such as a missing file or a bad checksum.
+type isoDownloadFatal struct {
+	error
+}
+
+// isoDownloads tracks the ISOs that BootEnvs need and that are being
+// downloaded from their IsoUrl.  Nothing is downloaded until
+// StartIsoDownloads is called, so that BootEnvs loaded at startup and
+// in tests do not reach out to the network on their own.  Cancelling
+// ctx stops every download, including ones waiting to try again.
+type isoDownloads struct {
+	mux     *sync.Mutex
+	client  *http.Client
+	started bool
+	retries int
+	backoff time.Duration
+	slots   chan struct{}
+	active  map[string]*models.IsoDownload
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running *sync.WaitGroup
+}
+
+func newIsoDownloads() *isoDownloads {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &isoDownloads{
+		mux: &sync.Mutex{},
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: time.Minute,
+			},
+		},
+		backoff: 10 * time.Second,
+		slots:   make(chan struct{}, isoDownloadSlots),
+		active:  map[string]*models.IsoDownload{},
+		ctx:     ctx,
+		cancel:  cancel,
+		running: &sync.WaitGroup{},
+	}
+}
+
+// IsoDownloader stops the ISO downloads started by StartIsoDownloads
+// when it is shut down.
+type IsoDownloader struct {
+	d *isoDownloads
+}
+
+// Shutdown stops downloading ISOs.  Partial downloads are kept, and
+// are picked up where they left off the next time.
+func (w *IsoDownloader) Shutdown(ctx context.Context) error {
+	d := w.d
+	if d == nil {
+		return nil
+	}
+	d.mux.Lock()
+	d.started = false
+	d.mux.Unlock()
+	d.cancel()
+	finished := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// StartIsoDownloads starts downloading the ISOs BootEnvs need and do
+// not have, both the ones that have been asked for already and any
+// that are asked for later.  Failed downloads are tried again up to
+// retries times, waiting longer each time.
+func (p *DataTracker) StartIsoDownloads(retries int) *IsoDownloader {
+	d := p.isoDownloads
+	if d == nil {
+		return &IsoDownloader{}
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.started = true
+	d.retries = retries
+	for _, dl := range d.active {
+		if dl.State == "queued" {
+			p.goDownloadIso(dl)
+		}
+	}
+	return &IsoDownloader{d: d}
+}
+
+// goDownloadIso downloads dl in the background.  It must be called
+// with the lock held.
+func (p *DataTracker) goDownloadIso(dl *models.IsoDownload) {
+	d := p.isoDownloads
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		p.downloadIso(dl)
+	}()
+}
+
+// queueIsoDownload arranges for file to be downloaded from url into
+// the isos directory, unless it is already being downloaded.
+func (p *DataTracker) queueIsoDownload(file, url, sum string) {
+	d := p.isoDownloads
+	if d == nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if dl, ok := d.active[file]; ok && dl.State != "complete" && dl.State != "failed" {
+		return
+	}
+	dl := &models.IsoDownload{File: file, Url: url, Sha256: sum, State: "queued"}
+	d.active[file] = dl
+	if d.started {
+		p.goDownloadIso(dl)
+	}
+}
+
+// updateIsoDownload changes dl with fn while holding the lock, and
+// publishes a copy of the result with action if it is not empty.
+func (p *DataTracker) updateIsoDownload(dl *models.IsoDownload, action string, fn func(*models.IsoDownload)) {
+	p.isoDownloads.mux.Lock()
+	if fn != nil {
+		fn(dl)
+	}
+	ev := *dl
+	p.isoDownloads.mux.Unlock()
+	if action != "" && p.publishers != nil {
+		p.publishers.Publish("isos", action, ev.File, "isos", &ev)
+	}
+}
+
+func (p *DataTracker) setIsoState(dl *models.IsoDownload, state string, err error) {
+	p.updateIsoDownload(dl, state, func(dl *models.IsoDownload) {
+		dl.State = state
+		dl.Error = ""
+		if err != nil {
+			dl.Error = err.Error()
+		}
+	})
+}
+
+// isoProgress counts the bytes written to an ISO as it downloads and
+// periodically publishes how far along it is.
+type isoProgress struct {
+	p    *DataTracker
+	dl   *models.IsoDownload
+	last time.Time
+}
+
+func (w *isoProgress) Write(buf []byte) (int, error) {
+	action := ""
+	if now := time.Now(); now.Sub(w.last) >= isoProgressInterval {
+		w.last = now
+		action = "progress"
+	}
+	w.p.updateIsoDownload(w.dl, action, func(dl *models.IsoDownload) {
+		dl.Downloaded += int64(len(buf))
+	})
+	return len(buf), nil
+}
+
+// fetchIso makes one attempt at downloading dl into tmp, picking up
+// where the last attempt left off if the server supports ranges.
+func (p *DataTracker) fetchIso(dl *models.IsoDownload, tmp string) error {
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return &isoDownloadFatal{err}
+	}
+	defer out.Close()
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", dl.Url, nil)
+	if err != nil {
+		return &isoDownloadFatal{err}
+	}
+	req = req.WithContext(p.isoDownloads.ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := p.isoDownloads.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The server sent the whole thing, so start over.
+		if offset, err = 0, out.Truncate(0); err != nil {
+			return err
+		}
+		if _, err = out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			out.Truncate(0)
+			return fmt.Errorf("%s sent range %q when asked to resume at byte %d", dl.Url, resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		var size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err == nil && size == offset {
+			// We already have all of it.
+			p.updateIsoDownload(dl, "", func(dl *models.IsoDownload) {
+				dl.Size, dl.Downloaded = size, size
+			})
+			return nil
+		}
+		out.Truncate(0)
+		return fmt.Errorf("%s cannot resume at byte %d", dl.Url, offset)
+	default:
+		err := fmt.Errorf("%s returned %s", dl.Url, resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return &isoDownloadFatal{err}
+		}
+		return err
+	}
+	p.updateIsoDownload(dl, "", func(dl *models.IsoDownload) {
+		dl.Downloaded = offset
+		if resp.ContentLength >= 0 {
+			dl.Size = offset + resp.ContentLength
+		}
+	})
+	copied, err := io.Copy(io.MultiWriter(out, &isoProgress{p: p, dl: dl, last: time.Now()}), resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength >= 0 && copied != resp.ContentLength {
+		return fmt.Errorf("%s sent %d bytes, expected %d", dl.Url, copied, resp.ContentLength)
+	}
+	return nil
+}
+
+func checkIsoSha256(name, sum string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != sum {
+		return &isoDownloadFatal{fmt.Errorf("SHA256 bad. actual: %s expected: %s", actual, sum)}
+	}
+	return nil
+}
+
+// downloadIso downloads dl into the isos directory, checks its
+// checksum, and then explodes it for the BootEnvs that use it.
+func (p *DataTracker) downloadIso(dl *models.IsoDownload) {
+	d := p.isoDownloads
+	select {
+	case d.slots <- struct{}{}:
+	case <-d.ctx.Done():
+		return
+	}
+	defer func() { <-d.slots }()
+	l := p.LogFor("bootenv")
+	isoName := filepath.Join(p.FileRoot, "isos", dl.File)
+	isoTmpName := filepath.Join(filepath.Dir(isoName), fmt.Sprintf(".%s.download", filepath.Base(isoName)))
+	if _, err := os.Stat(isoName); err == nil {
+		// Someone uploaded it while we were waiting.
+		p.setIsoState(dl, "complete", nil)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(isoName), 0755); err != nil {
+		l.Errorf("ISO download: cannot create %s: %v", p.reportPath(filepath.Dir(isoName)), err)
+		p.setIsoState(dl, "failed", err)
+		return
+	}
+	p.updateIsoDownload(dl, "downloading", func(dl *models.IsoDownload) {
+		dl.State = "downloading"
+		dl.Started = time.Now()
+	})
+	l.Infof("ISO download: downloading %s from %s", dl.File, dl.Url)
+	var err error
+	for {
+		attempts, retries := 0, 0
+		p.updateIsoDownload(dl, "", func(dl *models.IsoDownload) {
+			dl.Attempts++
+			attempts, retries = dl.Attempts, d.retries
+		})
+		if err = p.fetchIso(dl, isoTmpName); err == nil || d.ctx.Err() != nil {
+			break
+		}
+		if _, fatal := err.(*isoDownloadFatal); fatal || attempts > retries {
+			break
+		}
+		wait := d.backoff << uint(attempts-1)
+		if wait > isoMaxBackoff {
+			wait = isoMaxBackoff
+		}
+		l.Warnf("ISO download: attempt %d at %s failed: %v.  Trying again in %s", attempts, dl.File, err, wait)
+		p.setIsoState(dl, "downloading", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			continue
+		case <-d.ctx.Done():
+			timer.Stop()
+		}
+		break
+	}
+	if err != nil && d.ctx.Err() != nil {
+		l.Infof("ISO download: stopped downloading %s", dl.File)
+		p.updateIsoDownload(dl, "", func(dl *models.IsoDownload) {
+			dl.State = "queued"
+		})
+		return
+	}
+	if err == nil && dl.Sha256 != "" {
+		p.setIsoState(dl, "verifying", nil)
+		if err = checkIsoSha256(isoTmpName, dl.Sha256); err != nil {
+			os.Remove(isoTmpName)
+		}
+	}
+	if err == nil {
+		err = os.Rename(isoTmpName, isoName)
+	}
+	if err != nil {
+		l.Errorf("ISO download: failed to download %s from %s: %v", dl.File, dl.Url, err)
+		p.setIsoState(dl, "failed", err)
+		return
+	}
+	l.Infof("ISO download: downloaded %s", dl.File)
+	p.setIsoState(dl, "complete", nil)
+	rt := p.Request(l, "bootenvs")
+	rt.Do(func(d Stores) {
+		for _, obj := range d("bootenvs").Items() {
+			if env := AsBootEnv(obj); env.IsoFor(dl.File) {
+				env.ExplodeIsos(rt)
+			}
+		}
+	})
+}
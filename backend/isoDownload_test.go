@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+func TestIsoDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	sum := sha256.Sum256(content)
+	goodSum := hex.EncodeToString(sum[:])
+	mux := &sync.Mutex{}
+	ranges := map[string]string{}
+	flaked := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		ranges[r.URL.Path] = r.Header.Get("Range")
+		if r.URL.Path == "/flaky.iso" && !flaked {
+			flaked = true
+			mux.Unlock()
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		mux.Unlock()
+		if r.URL.Path == "/missing.iso" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dt := mkDT()
+	dt.isoDownloads.backoff = time.Millisecond
+	dt.isoDownloads.retries = 2
+	isoDir := filepath.Join(dt.FileRoot, "isos")
+	if err := os.MkdirAll(isoDir, 0755); err != nil {
+		t.Fatalf("Cannot make iso dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(isoDir, ".resume.iso.download"), content[:10000], 0644); err != nil {
+		t.Fatalf("Cannot write partial download: %v", err)
+	}
+
+	for _, test := range []struct {
+		file, sum, state, rng string
+		attempts              int
+	}{
+		{"fresh.iso", goodSum, "complete", "", 1},
+		{"resume.iso", goodSum, "complete", "bytes=10000-", 1},
+		{"flaky.iso", "", "complete", "", 2},
+		{"badsum.iso", "00", "failed", "", 1},
+		{"missing.iso", "", "failed", "", 1},
+	} {
+		dl := &models.IsoDownload{File: test.file, Url: srv.URL + "/" + test.file, Sha256: test.sum, State: "queued"}
+		dt.downloadIso(dl)
+		if dl.State != test.state || dl.Attempts != test.attempts {
+			t.Errorf("%s: expected %s after %d attempts, got %s after %d: %s", test.file, test.state, test.attempts, dl.State, dl.Attempts, dl.Error)
+		}
+		mux.Lock()
+		rng := ranges["/"+test.file]
+		mux.Unlock()
+		if rng != test.rng {
+			t.Errorf("%s: expected Range %q, got %q", test.file, test.rng, rng)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(isoDir, test.file))
+		if test.state == "complete" {
+			if err != nil || !bytes.Equal(buf, content) || dl.Downloaded != int64(len(content)) {
+				t.Errorf("%s: downloaded ISO does not match", test.file)
+			}
+		} else if err == nil {
+			t.Errorf("%s: failed download left an ISO behind", test.file)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(isoDir, ".badsum.iso.download")); err == nil {
+		t.Errorf("Download with a bad checksum was not removed")
+	}
+}
+
+func TestIsoDownloadShutdown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	dt := mkDT()
+	dt.isoDownloads.backoff = time.Hour
+	svc := dt.StartIsoDownloads(5)
+	dt.queueIsoDownload("stuck.iso", srv.URL+"/stuck.iso", "")
+	d := dt.isoDownloads
+	for i := 0; ; i++ {
+		d.mux.Lock()
+		failed := d.active["stuck.iso"].Error != ""
+		d.mux.Unlock()
+		if failed {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Download was never attempted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown did not interrupt the wait before retrying: %v", err)
+	}
+	d.mux.Lock()
+	dl := *d.active["stuck.iso"]
+	d.mux.Unlock()
+	if dl.State != "queued" || dl.Attempts != 1 {
+		t.Errorf("Expected a stopped download to be queued after 1 attempt, got %s after %d", dl.State, dl.Attempts)
+	}
+	dt.queueIsoDownload("late.iso", srv.URL+"/late.iso", "")
+	time.Sleep(100 * time.Millisecond)
+	d.mux.Lock()
+	late := *d.active["late.iso"]
+	d.mux.Unlock()
+	if late.State != "queued" || late.Attempts != 0 {
+		t.Errorf("Downloads should not start after Shutdown")
+	}
+}
@@ -0,0 +1,322 @@
+package backend
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalrebar/provision/backend/isofs"
+	"github.com/digitalrebar/provision/models"
+)
+
+var rhelishRE = regexp.MustCompile(`^(redhat|centos|fedora)`)
+
+// canaryText is what is written to the canary file of an exploded ISO.
+// Partial extractions are marked so that a full one will happen if
+// the BootEnv stops installing from a package repository.
+func canaryText(shaSum string, partial bool) string {
+	if partial {
+		return strings.TrimSpace(shaSum + " partial")
+	}
+	return shaSum
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// lowercaseTree renames everything under dir to lower case, deepest
+// first so that the paths of things not renamed yet stay valid.
+func lowercaseTree(dir string) error {
+	paths := []string{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && p != dir {
+			paths = append(paths, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], string(filepath.Separator)) > strings.Count(paths[j], string(filepath.Separator))
+	})
+	for _, p := range paths {
+		base := filepath.Base(p)
+		if lower := strings.ToLower(base); lower != base {
+			if err := os.Rename(p, filepath.Join(filepath.Dir(p), lower)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSha1sums checks the files listed in the sha1sums file that
+// Sledgehammer images carry.  Files that were not extracted are skipped
+// if the extraction was partial.
+func checkSha1sums(dir string, partial bool) error {
+	f, err := os.Open(filepath.Join(dir, "sha1sums"))
+	if err != nil {
+		if partial && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		name := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(fields[1], "*")))
+		in, err := os.Open(name)
+		if err != nil {
+			if partial && os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		hasher := sha1.New()
+		_, err = io.Copy(hasher, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		if actual := hex.EncodeToString(hasher.Sum(nil)); actual != fields[0] {
+			return fmt.Errorf("SHA1 of %s bad. actual: %s expected: %s", fields[1], actual, fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+// fixupExploded does the OS specific work needed to make an exploded
+// ISO usable.
+func fixupExploded(rt *RequestTracker, osName, fileRoot, dir string, partial bool) error {
+	switch {
+	case strings.HasPrefix(osName, "esxi"):
+		// ESXi expects everything in lower case, and needs an exact
+		// version of pxelinux.
+		if err := lowercaseTree(dir); err != nil {
+			return err
+		}
+		if err := copyFile(filepath.Join(fileRoot, "esxi.0"), filepath.Join(dir, "pxelinux.0")); err != nil {
+			rt.Warnf("Explode ISO: cannot add esxi.0 as pxelinux.0: %v", err)
+		}
+	case strings.HasPrefix(osName, "windows"):
+		if err := copyFile(filepath.Join(fileRoot, "wimboot"), filepath.Join(dir, "wimboot")); err != nil {
+			rt.Warnf("Explode ISO: cannot add wimboot: %v", err)
+		}
+		// Windows media is read-only.
+		return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+				return err
+			}
+			return os.Chmod(p, 0555)
+		})
+	case strings.HasPrefix(osName, "sledgehammer/"):
+		if err := checkSha1sums(dir, partial); err != nil {
+			return err
+		}
+	}
+	if rhelishRE.MatchString(osName) {
+		// Rewrite local package metadata.  This allows for properly
+		// handling the case where we only use disc 1 of a multi-disc
+		// set for initial install purposes.
+		groups, _ := filepath.Glob(filepath.Join(dir, "repodata", "*comps*.xml"))
+		if createrepo, err := exec.LookPath("createrepo"); err == nil && len(groups) > 0 {
+			cmd := exec.Command(createrepo, "-g", filepath.Join("repodata", filepath.Base(groups[len(groups)-1])), ".")
+			cmd.Dir = dir
+			if out, err := cmd.CombinedOutput(); err != nil {
+				rt.Warnf("Explode ISO: createrepo failed: %v\n%s", err, string(out))
+			}
+		}
+	}
+	return nil
+}
+
+// explodeISO extracts isoFile into dest.  If want is not empty, only
+// the files in it are extracted.  The ISO is extracted next to dest
+// and only merged into it once everything has worked, so a failure
+// leaves whatever was there before alone.  Merging only replaces the
+// paths the image provides, so anything else in dest is kept.  Images that are not ISO9660
+// or UDF (such as tarballs) are handed to explode_iso.sh.
+func explodeISO(rt *RequestTracker, envName, osName, fileRoot, isoFile, dest, shaSum string, want []string) {
+	p := rt.dt
+	explodeMux.Lock()
+	defer explodeMux.Unlock()
+	f, err := os.Open(isoFile)
+	if err != nil {
+		rt.Errorf("Explode ISO: failed to open iso file %s: %v", p.reportPath(isoFile), err)
+		return
+	}
+	defer f.Close()
+	// Only check the hash if we have one.
+	if shaSum != "" {
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, f); err != nil {
+			rt.Errorf("Explode ISO: failed to read iso file %s: %v", p.reportPath(isoFile), err)
+			return
+		}
+		hash := hex.EncodeToString(hasher.Sum(nil))
+		if hash != shaSum {
+			rt.Errorf("Explode ISO: SHA256 bad. actual: %v expected: %v", hash, shaSum)
+			return
+		}
+	}
+	img, err := isofs.Open(f)
+	if err == isofs.ErrNotImage {
+		explodeWithScript(rt, envName, osName, fileRoot, isoFile, dest, shaSum)
+		return
+	}
+	ex := &models.IsoExtract{
+		File:    filepath.Base(isoFile),
+		BootEnv: envName,
+		Dest:    p.reportPath(dest),
+		Partial: len(want) > 0,
+	}
+	publish := func(action string) {
+		if p.publishers != nil && rt.sandbox == nil {
+			ev := *ex
+			p.publishers.Publish("isos", action, ex.File, "isos", &ev)
+		}
+	}
+	if err == nil {
+		ex.Format = img.Format
+		err = extractImage(rt, img, ex, osName, fileRoot, dest, shaSum, want, publish)
+	}
+	if err != nil {
+		ex.Error = err.Error()
+		rt.Errorf("Explode ISO: failed to extract %s for %s: %v", ex.File, envName, err)
+		publish("extractfailed")
+		return
+	}
+	rt.Infof("Explode ISO: extracted %s for %s into %s", ex.File, envName, ex.Dest)
+	publish("extracted")
+}
+
+func extractImage(rt *RequestTracker,
+	img *isofs.Image,
+	ex *models.IsoExtract,
+	osName, fileRoot, dest, shaSum string,
+	want []string,
+	publish func(string)) error {
+	tmp := dest + ".extracting"
+	os.RemoveAll(tmp)
+	var filter func(string) bool
+	if len(want) > 0 {
+		wanted := map[string]bool{}
+		for _, w := range want {
+			wanted[strings.ToLower(strings.TrimPrefix(path.Clean("/"+w), "/"))] = true
+		}
+		filter = func(p string) bool {
+			return wanted[strings.ToLower(p)]
+		}
+	}
+	last := time.Now()
+	publish("extracting")
+	err := img.Extract(tmp, filter, func(done, total int64) {
+		ex.Extracted, ex.Size = done, total
+		if now := time.Now(); now.Sub(last) >= isoProgressInterval {
+			last = now
+			publish("extracting")
+		}
+	})
+	if err == nil {
+		err = fixupExploded(rt, osName, fileRoot, tmp, ex.Partial)
+	}
+	if err == nil {
+		canary := filepath.Join(tmp, "."+strings.Replace(osName, "/", "_", -1)+".rebar_canary")
+		err = ioutil.WriteFile(canary, []byte(canaryText(shaSum, ex.Partial)), 0644)
+	}
+	if err == nil {
+		err = mergeExtracted(tmp, dest)
+	}
+	os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+	if selinux, err := exec.LookPath("selinuxenabled"); err == nil && exec.Command(selinux).Run() == nil {
+		if out, err := exec.Command("restorecon", "-R", "-F", dest).CombinedOutput(); err != nil {
+			rt.Warnf("Explode ISO: restorecon failed: %v\n%s", err, string(out))
+		}
+	}
+	return nil
+}
+
+// mergeExtracted moves everything in src into dest, replacing
+// whatever is at the same paths in dest and leaving everything else
+// in dest alone.  Directories that exist in both are merged.
+func mergeExtracted(src, dest string) error {
+	fi, err := os.Lstat(dest)
+	if err != nil || !fi.IsDir() {
+		if err == nil {
+			if err := os.Remove(dest); err != nil {
+				return err
+			}
+		}
+		return os.Rename(src, dest)
+	}
+	ents, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		from, to := filepath.Join(src, ent.Name()), filepath.Join(dest, ent.Name())
+		if ent.IsDir() {
+			if err := mergeExtracted(from, to); err != nil {
+				return err
+			}
+			continue
+		}
+		if tfi, err := os.Lstat(to); err == nil && tfi.IsDir() {
+			if err := os.RemoveAll(to); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// explodeWithScript hands images we cannot read ourselves to
+// explode_iso.sh.
+func explodeWithScript(rt *RequestTracker, envName, osName, fileRoot, isoFile, dest, shaSum string) {
+	// Call extract script
+	// /explode_iso.sh b.OS.Name fileRoot isoPath path.Dir(canaryPath)
+	cmdName := path.Join(fileRoot, "explode_iso.sh")
+	cmdArgs := []string{osName, fileRoot, isoFile, dest, shaSum}
+	out, err := exec.Command(cmdName, cmdArgs...).CombinedOutput()
+	if err != nil {
+		rt.Errorf("Explode ISO: explode_iso.sh failed for %s: %s", envName, err)
+		rt.Errorf("Command output:\n%s", string(out))
+	}
+}
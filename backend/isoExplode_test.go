@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExplodeISO(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger)
+	isoDir := filepath.Join(dt.FileRoot, "isos")
+	if err := os.MkdirAll(isoDir, 0755); err != nil {
+		t.Fatalf("Cannot make iso dir: %v", err)
+	}
+	in, err := os.Open(filepath.Join("isofs", "test-data", "rr.iso.gz"))
+	if err != nil {
+		t.Fatalf("Cannot open test image: %v", err)
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		t.Fatalf("Cannot decompress test image: %v", err)
+	}
+	isoFile := filepath.Join(isoDir, "explode.iso")
+	out, err := os.Create(isoFile)
+	if err != nil {
+		t.Fatalf("Cannot create test image: %v", err)
+	}
+	if _, err := io.Copy(out, gz); err != nil {
+		t.Fatalf("Cannot write test image: %v", err)
+	}
+	out.Close()
+	dest := filepath.Join(dt.FileRoot, "explode-test", "install")
+	canary := filepath.Join(dest, ".explode-test.rebar_canary")
+
+	explodeISO(rt, "explode-test", "explode-test", dt.FileRoot, isoFile, dest, "", []string{"/images/pxeboot/vmlinuz", "images/pxeboot/initrd.img"})
+	for _, name := range []string{"images/pxeboot/vmlinuz", "images/pxeboot/initrd.img"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("Partial extraction did not extract %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "repodata", "repomd.xml")); err == nil {
+		t.Errorf("Partial extraction extracted repodata/repomd.xml")
+	}
+	if buf, err := ioutil.ReadFile(canary); err != nil || string(buf) != canaryText("", true) {
+		t.Errorf("Partial extraction wrote canary %q: %v", string(buf), err)
+	}
+
+	extra := filepath.Join(dest, "images", "pxeboot", "extra.cfg")
+	if err := ioutil.WriteFile(extra, []byte("extra"), 0644); err != nil {
+		t.Fatalf("Cannot write extra file: %v", err)
+	}
+	explodeISO(rt, "explode-test", "explode-test", dt.FileRoot, isoFile, dest, "", nil)
+	if buf, err := ioutil.ReadFile(extra); err != nil || string(buf) != "extra" {
+		t.Errorf("Full extraction did not keep %s: %v", extra, err)
+	}
+	for _, name := range []string{"images/pxeboot/vmlinuz", "repodata/repomd.xml", "a/b/c/d/e/f/g/h/i/deep.txt"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("Full extraction did not extract %s: %v", name, err)
+		}
+	}
+	if buf, err := ioutil.ReadFile(canary); err != nil || string(buf) != "" {
+		t.Errorf("Full extraction wrote canary %q: %v", string(buf), err)
+	}
+	if _, err := os.Stat(dest + ".extracting"); err == nil {
+		t.Errorf("Extraction left %s.extracting behind", dest)
+	}
+
+	explodeISO(rt, "explode-test", "explode-test", dt.FileRoot, isoFile, dest, "00", nil)
+	if buf, err := ioutil.ReadFile(canary); err != nil || string(buf) != "" {
+		t.Errorf("Extraction with a bad SHA256 replaced the exploded ISO")
+	}
+}
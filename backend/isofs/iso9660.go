@@ -0,0 +1,318 @@
+package isofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// isoVolume is an ISO9660 directory hierarchy, either the primary one
+// (possibly with Rock Ridge extensions) or a Joliet one.
+type isoVolume struct {
+	root      isoRecord
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+}
+
+// isoRecord is a parsed ISO9660 directory record.
+type isoRecord struct {
+	lba   uint32
+	size  uint32
+	flags byte
+	name  []byte
+	date  []byte
+	su    []byte
+}
+
+func (r *isoRecord) isDir() bool {
+	return r.flags&0x02 != 0
+}
+
+func parseIsoRecord(buf []byte) (isoRecord, error) {
+	res := isoRecord{}
+	if len(buf) < 34 || int(buf[0]) > len(buf) || buf[0] < 34 {
+		return res, fmt.Errorf("isofs: short directory record")
+	}
+	buf = buf[:buf[0]]
+	nameLen := int(buf[32])
+	if 33+nameLen > len(buf) {
+		return res, fmt.Errorf("isofs: directory record name overflows record")
+	}
+	res.lba = binary.LittleEndian.Uint32(buf[2:])
+	res.size = binary.LittleEndian.Uint32(buf[10:])
+	res.date = buf[18:25]
+	res.flags = buf[25]
+	res.name = buf[33 : 33+nameLen]
+	suStart := 33 + nameLen
+	if nameLen%2 == 0 {
+		suStart++
+	}
+	if suStart < len(buf) {
+		res.su = buf[suStart:]
+	}
+	return res, nil
+}
+
+func isoTime(b []byte) time.Time {
+	if len(b) < 7 || b[1] == 0 {
+		return time.Time{}
+	}
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0,
+		time.FixedZone("", int(int8(b[6]))*15*60))
+}
+
+func (img *Image) openIso(vd []byte, joliet bool) (*isoVolume, error) {
+	root, err := parseIsoRecord(vd[156:190])
+	if err != nil {
+		return nil, err
+	}
+	vol := &isoVolume{root: root, joliet: joliet}
+	if joliet {
+		return vol, nil
+	}
+	// Rock Ridge is signalled by a SUSP "SP" entry in the system use
+	// area of the "." record of the root directory.
+	recs, err := img.readIsoDir(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) > 0 {
+		su := recs[0].su
+		if len(su) >= 7 && string(su[0:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+			vol.rockRidge = true
+			vol.suspSkip = int(su[6])
+		}
+	}
+	return vol, nil
+}
+
+// readIsoDir returns all the records in a directory, including the
+// "." and ".." ones.
+func (img *Image) readIsoDir(dir isoRecord) ([]isoRecord, error) {
+	buf := make([]byte, dir.size)
+	if err := img.readAt(buf, int64(dir.lba)*sectorSize); err != nil {
+		return nil, err
+	}
+	res := []isoRecord{}
+	for off := 0; off < len(buf); {
+		if buf[off] == 0 {
+			// Records do not cross sector boundaries, so the rest of
+			// this sector is padding.
+			off = (off/sectorSize + 1) * sectorSize
+			continue
+		}
+		rec, err := parseIsoRecord(buf[off:])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+		off += int(buf[off])
+	}
+	return res, nil
+}
+
+// rrInfo is what we care about from the Rock Ridge entries of a
+// record.
+type rrInfo struct {
+	name      string
+	hasName   bool
+	mode      uint32
+	hasMode   bool
+	target    []string
+	childLink uint32
+	hasChild  bool
+	relocated bool
+}
+
+// susp walks the System Use Sharing Protocol entries in su, following
+// continuation areas.
+func (img *Image) susp(su []byte, info *rrInfo) error {
+	linkPart := ""
+	for depth := 0; len(su) > 0 && depth < 32; depth++ {
+		var next []byte
+		for off := 0; off+4 <= len(su); {
+			sig, l := string(su[off:off+2]), int(su[off+2])
+			if l < 4 || off+l > len(su) {
+				break
+			}
+			data := su[off+4 : off+l]
+			off += l
+			switch sig {
+			case "ST":
+				off = len(su)
+			case "CE":
+				if len(data) < 24 {
+					continue
+				}
+				lba := binary.LittleEndian.Uint32(data[0:])
+				start := binary.LittleEndian.Uint32(data[8:])
+				length := binary.LittleEndian.Uint32(data[16:])
+				next = make([]byte, length)
+				if err := img.readAt(next, int64(lba)*sectorSize+int64(start)); err != nil {
+					return err
+				}
+			case "NM":
+				if len(data) < 1 || data[0]&0x06 != 0 {
+					continue
+				}
+				info.name += string(data[1:])
+				info.hasName = true
+			case "PX":
+				if len(data) >= 4 {
+					info.mode = binary.LittleEndian.Uint32(data[0:])
+					info.hasMode = true
+				}
+			case "SL":
+				if len(data) < 1 {
+					continue
+				}
+				for c := data[1:]; len(c) >= 2 && 2+int(c[1]) <= len(c); c = c[2+int(c[1]):] {
+					flags := c[0]
+					switch {
+					case flags&0x02 != 0:
+						info.target = append(info.target, ".")
+					case flags&0x04 != 0:
+						info.target = append(info.target, "..")
+					case flags&0x08 != 0:
+						info.target = append(info.target[:0], "")
+					default:
+						linkPart += string(c[2 : 2+int(c[1])])
+						if flags&0x01 == 0 {
+							info.target = append(info.target, linkPart)
+							linkPart = ""
+						}
+					}
+				}
+			case "CL":
+				if len(data) >= 4 {
+					info.childLink = binary.LittleEndian.Uint32(data[0:])
+					info.hasChild = true
+				}
+			case "RE":
+				info.relocated = true
+			}
+		}
+		su = next
+	}
+	return nil
+}
+
+func (vol *isoVolume) plainName(rec isoRecord) string {
+	var name string
+	if vol.joliet {
+		u := make([]uint16, len(rec.name)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(rec.name[i*2:])
+		}
+		name = string(utf16.Decode(u))
+	} else {
+		name = string(rec.name)
+	}
+	if i := strings.LastIndex(name, ";"); i > 0 {
+		name = name[:i]
+	}
+	if !rec.isDir() {
+		name = strings.TrimSuffix(name, ".")
+	}
+	return name
+}
+
+func (img *Image) walkIso(fn func(*Entry) error) error {
+	return img.walkIsoDir(img.iso.root, "", fn, 0)
+}
+
+func (img *Image) walkIsoDir(dir isoRecord, dirPath string, fn func(*Entry) error, depth int) error {
+	if depth > 64 {
+		return fmt.Errorf("isofs: %s: directories nested too deeply", dirPath)
+	}
+	vol := img.iso
+	recs, err := img.readIsoDir(dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(recs); i++ {
+		rec := recs[i]
+		if len(rec.name) == 1 && (rec.name[0] == 0 || rec.name[0] == 1) {
+			continue
+		}
+		e := &Entry{ModTime: isoTime(rec.date), Mode: 0444}
+		if rec.isDir() {
+			e.Mode = os.ModeDir | 0555
+		}
+		name := vol.plainName(rec)
+		if vol.rockRidge {
+			info := &rrInfo{}
+			if len(rec.su) > vol.suspSkip {
+				if err := img.susp(rec.su[vol.suspSkip:], info); err != nil {
+					return err
+				}
+			}
+			if info.relocated {
+				continue
+			}
+			if info.hasName {
+				name = info.name
+			}
+			if info.hasMode {
+				e.Mode = os.FileMode(info.mode & 0777)
+				switch info.mode & 0170000 {
+				case 0040000:
+					e.Mode |= os.ModeDir
+				case 0120000:
+					e.Mode |= os.ModeSymlink
+					e.Target = strings.Join(info.target, "/")
+					if e.Target == "" && len(info.target) > 0 {
+						e.Target = "/"
+					}
+				}
+			}
+			if info.hasChild {
+				// The real directory was moved elsewhere to get around
+				// the depth limit of plain ISO9660.
+				moved, err := img.sector(int64(info.childLink))
+				if err != nil {
+					return err
+				}
+				if rec, err = parseIsoRecord(moved); err != nil {
+					return err
+				}
+				e.Mode |= os.ModeDir
+			}
+		}
+		if !validName(name) {
+			continue
+		}
+		if vol.rockRidge && dirPath == "" && e.IsDir() && (name == "rr_moved" || name == ".rr_moved") {
+			// This is where deep directories were relocated to, and
+			// they have already been seen in their real place.
+			continue
+		}
+		e.Path = joinPath(dirPath, name)
+		if !e.IsDir() && e.Mode&os.ModeSymlink == 0 {
+			// Files bigger than 4GB are split into several records
+			// with the same name, all but the last flagged as having
+			// more extents to come.
+			e.extents = append(e.extents, extent{int64(rec.lba) * sectorSize, int64(rec.size)})
+			e.Size = int64(rec.size)
+			for rec.flags&0x80 != 0 && i+1 < len(recs) {
+				i++
+				rec = recs[i]
+				e.extents = append(e.extents, extent{int64(rec.lba) * sectorSize, int64(rec.size)})
+				e.Size += int64(rec.size)
+			}
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		if e.IsDir() {
+			if err := img.walkIsoDir(rec, e.Path, fn, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
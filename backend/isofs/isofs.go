@@ -0,0 +1,348 @@
+// Package isofs reads the files out of ISO9660 and UDF images without
+// needing any external tools.
+//
+// ISO9660 images are read with their Rock Ridge or Joliet extensions
+// when they have them, so that long, mixed case file names, modes,
+// and symlinks come out the way the image author intended.  Images
+// that have a UDF file system and no Rock Ridge extensions (such as
+// Windows install media) are read through UDF instead.
+package isofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const sectorSize = 2048
+
+// ErrNotImage is returned by Open when the passed image is not an
+// ISO9660 or UDF image.
+var ErrNotImage = errors.New("isofs: not an ISO9660 or UDF image")
+
+// Entry is a file, directory, or symlink in an image.
+type Entry struct {
+	// Path is the slash separated path of the Entry relative to the
+	// root of the image.
+	Path string
+	// Mode holds the type and permissions of the Entry.
+	Mode os.FileMode
+	// Size is the size of a file in bytes.
+	Size int64
+	// ModTime is when the Entry was last modified.
+	ModTime time.Time
+	// Target is where a symlink points.
+	Target string
+
+	extents []extent
+	inline  []byte
+}
+
+// IsDir returns whether the Entry is a directory.
+func (e *Entry) IsDir() bool {
+	return e.Mode.IsDir()
+}
+
+// extent is a run of bytes in the image that holds part of a file.
+// Extents with a negative start are holes that read as zeros.
+type extent struct {
+	start, length int64
+}
+
+type zeros struct{}
+
+func (zeros) Read(buf []byte) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	return len(buf), nil
+}
+
+// Image is an opened ISO9660 or UDF image.
+type Image struct {
+	r io.ReaderAt
+	// Format is the file system the Image is read through, one of
+	// "rockridge", "joliet", "iso9660", or "udf".
+	Format string
+	iso    *isoVolume
+	udf    *udfVolume
+}
+
+func (img *Image) readAt(buf []byte, off int64) error {
+	n, err := img.r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (img *Image) sector(n int64) ([]byte, error) {
+	buf := make([]byte, sectorSize)
+	return buf, img.readAt(buf, n*sectorSize)
+}
+
+// Open reads the volume descriptors of the image in r and picks the
+// file system to read it through.
+func Open(r io.ReaderAt) (*Image, error) {
+	img := &Image{r: r}
+	var pvd, svd []byte
+	nsr := false
+scan:
+	for n := int64(16); n < 16+256; n++ {
+		buf, err := img.sector(n)
+		if err != nil {
+			break
+		}
+		switch string(buf[1:6]) {
+		case "CD001":
+			switch buf[0] {
+			case 1:
+				if pvd == nil {
+					pvd = buf
+				}
+			case 2:
+				esc := string(buf[88:120])
+				if svd == nil && (strings.Contains(esc, "%/@") || strings.Contains(esc, "%/C") || strings.Contains(esc, "%/E")) {
+					svd = buf
+				}
+			}
+		case "NSR02", "NSR03":
+			nsr = true
+		case "BEA01", "TEA01", "BOOT2", "CDW02":
+		default:
+			break scan
+		}
+	}
+	var primary *isoVolume
+	if pvd != nil {
+		vol, err := img.openIso(pvd, false)
+		if err != nil {
+			return nil, err
+		}
+		if vol.rockRidge {
+			img.Format, img.iso = "rockridge", vol
+			return img, nil
+		}
+		primary = vol
+	}
+	if nsr {
+		vol, err := img.openUdf()
+		if err == nil {
+			img.Format, img.udf = "udf", vol
+			return img, nil
+		}
+		if primary == nil && svd == nil {
+			return nil, err
+		}
+	}
+	if svd != nil {
+		vol, err := img.openIso(svd, true)
+		if err != nil {
+			return nil, err
+		}
+		img.Format, img.iso = "joliet", vol
+		return img, nil
+	}
+	if primary != nil {
+		img.Format, img.iso = "iso9660", primary
+		return img, nil
+	}
+	return nil, ErrNotImage
+}
+
+// validName rejects names that would escape the directory they are
+// extracted into.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// Walk calls fn for every Entry in the image, directories before the
+// things in them.  If fn returns an error, the walk stops and Walk
+// returns it.
+func (img *Image) Walk(fn func(*Entry) error) error {
+	if img.udf != nil {
+		return img.walkUdf(fn)
+	}
+	return img.walkIso(fn)
+}
+
+// Reader returns a Reader for the contents of a file in the image.
+func (img *Image) Reader(e *Entry) io.Reader {
+	if e.inline != nil {
+		return strings.NewReader(string(e.inline))
+	}
+	readers := []io.Reader{}
+	left := e.Size
+	for _, x := range e.extents {
+		if left <= 0 {
+			break
+		}
+		l := x.length
+		if l > left {
+			l = left
+		}
+		left -= l
+		if x.start < 0 {
+			readers = append(readers, io.LimitReader(zeros{}, l))
+		} else {
+			readers = append(readers, io.NewSectionReader(img.r, x.start, l))
+		}
+	}
+	return io.MultiReader(readers...)
+}
+
+type progressWriter struct {
+	w        io.Writer
+	done     *int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (p *progressWriter) Write(buf []byte) (int, error) {
+	n, err := p.w.Write(buf)
+	*p.done += int64(n)
+	if p.progress != nil {
+		p.progress(*p.done, p.total)
+	}
+	return n, err
+}
+
+// Extract copies the image into dest.  If want is not nil, only the
+// files and symlinks it returns true for are extracted, along with the
+// directories they are in.  If progress is not nil, it is called with
+// the number of bytes extracted so far and the number that will be
+// extracted in total as the files are copied.
+//
+// Extract refuses symlinks that point outside of dest, and never
+// writes through a symlink that is already there, so a hostile image
+// cannot use one to write anywhere else.
+func (img *Image) Extract(dest string, want func(string) bool, progress func(done, total int64)) error {
+	entries := []*Entry{}
+	var total, done int64
+	err := img.Walk(func(e *Entry) error {
+		if want == nil || (!e.IsDir() && want(e.Path)) {
+			entries = append(entries, e)
+			total += e.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		link := e.Mode&os.ModeSymlink != 0
+		target, err := safePath(dest, e.Path, link)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+		}
+		if err == nil {
+			switch {
+			case e.IsDir():
+				err = os.MkdirAll(target, 0755)
+			case link:
+				if linkEscapes(e.Path, e.Target) {
+					err = fmt.Errorf("symlink target %s is outside of the image", e.Target)
+					break
+				}
+				os.Remove(target)
+				err = os.Symlink(e.Target, target)
+			default:
+				err = img.extractFile(e, target, &progressWriter{done: &done, total: total, progress: progress})
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("isofs: extracting %s: %v", e.Path, err)
+		}
+	}
+	return nil
+}
+
+// safePath returns where the Entry at the slash separated path p is
+// extracted to in dest.  It fails if any of the directories leading
+// to it is a symlink, or if p itself is a symlink and link (which says
+// the Entry is going to replace it with another one) is false.
+func safePath(dest, p string, link bool) (string, error) {
+	target := dest
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if !validName(part) {
+			return "", fmt.Errorf("invalid path")
+		}
+		target = filepath.Join(target, part)
+		fi, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			// Nothing below here exists yet either.
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 && !(link && i == len(parts)-1) {
+			return "", fmt.Errorf("%s is already a symlink", target)
+		}
+	}
+	return filepath.Join(dest, filepath.FromSlash(p)), nil
+}
+
+// linkEscapes returns whether a symlink at the slash separated path p
+// pointing to target leads outside of the image.  Only leading ".."
+// components are allowed, since the directories they climb out of are
+// known not to be symlinks, while a ".." after some other symlink
+// could go anywhere.
+func linkEscapes(p, target string) bool {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) {
+		return true
+	}
+	parts := strings.Split(target, "/")
+	up := 0
+	for up < len(parts) && parts[up] == ".." {
+		up++
+	}
+	for _, part := range parts[up:] {
+		if part == ".." {
+			return true
+		}
+	}
+	depth := 0
+	if dir := path.Dir(p); dir != "." {
+		depth = strings.Count(dir, "/") + 1
+	}
+	return up > depth
+}
+
+func (img *Image) extractFile(e *Entry, target string, pw *progressWriter) error {
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, e.Mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	pw.w = out
+	if _, err := io.Copy(pw, img.Reader(e)); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if !e.ModTime.IsZero() {
+		os.Chtimes(target, e.ModTime, e.ModTime)
+	}
+	return nil
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return path.Join(dir, name)
+}
@@ -0,0 +1,428 @@
+package isofs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The images in test-data were made from the same tree with:
+//
+//	bsdtar -cf rr.iso --format iso9660 -C src .
+//	bsdtar -cf joliet.iso --format iso9660 --options '!rockridge' -C src .
+//	bsdtar -cf plain.iso --format iso9660 --options '!rockridge,!joliet' -C src .
+//
+// Joliet and plain ISO9660 cannot hold the symlink or the directories
+// nested more than 8 deep, so bsdtar left them out of those images.
+func loadImage(t *testing.T, name string) *Image {
+	t.Helper()
+	f, err := os.Open(filepath.Join("test-data", name+".iso.gz"))
+	if err != nil {
+		t.Fatalf("Cannot open %s: %v", name, err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Cannot decompress %s: %v", name, err)
+	}
+	buf, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Cannot decompress %s: %v", name, err)
+	}
+	img, err := Open(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("Cannot open %s as an image: %v", name, err)
+	}
+	return img
+}
+
+func listing(t *testing.T, img *Image) []string {
+	t.Helper()
+	res := []string{}
+	err := img.Walk(func(e *Entry) error {
+		line := e.Mode.String() + " " + e.Path
+		switch {
+		case e.Mode&os.ModeSymlink != 0:
+			line += " -> " + e.Target
+		case !e.IsDir():
+			buf, err := ioutil.ReadAll(img.Reader(e))
+			if err != nil {
+				return err
+			}
+			line += " " + string(buf)
+		}
+		res = append(res, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func checkListing(t *testing.T, name string, got, want []string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("%s: expected\n%s\ngot\n%s", name, strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestIso9660(t *testing.T) {
+	deep := []string{
+		"dr-xr-xr-x a",
+		"dr-xr-xr-x a/b",
+		"dr-xr-xr-x a/b/c",
+		"dr-xr-xr-x a/b/c/d",
+		"dr-xr-xr-x a/b/c/d/e",
+		"dr-xr-xr-x a/b/c/d/e/f",
+		"dr-xr-xr-x a/b/c/d/e/f/g",
+		"dr-xr-xr-x a/b/c/d/e/f/g/h",
+		"dr-xr-xr-x a/b/c/d/e/f/g/h/i",
+		"-r--r--r-- a/b/c/d/e/f/g/h/i/deep.txt deep",
+	}
+	rest := []string{
+		"-r--r--r-- MixedCase-Long_File.Name.txt mixed",
+		"dr-xr-xr-x images",
+		"dr-xr-xr-x images/pxeboot",
+		"-r--r--r-- images/pxeboot/initrd.img initrd",
+		"-r--r--r-- images/pxeboot/vmlinuz kernel",
+		"dr-xr-xr-x repodata",
+		"-r--r--r-- repodata/repomd.xml <repomd/>",
+	}
+	for _, test := range []struct {
+		name, format string
+		want         []string
+	}{
+		{"rr", "rockridge", append(append([]string{
+			"-r-xr-xr-x exec.sh #!/bin/sh\n",
+			"Lr-xr-xr-x link -> images/pxeboot/vmlinuz",
+		}, deep...), rest...)},
+		{"joliet", "joliet", append(append([]string{
+			"-r--r--r-- exec.sh #!/bin/sh\n",
+		}, deep...), rest...)},
+		{"plain", "iso9660", []string{
+			"-r--r--r-- EXEC.SH #!/bin/sh\n",
+			"-r--r--r-- IMAGES/PXEBOOT/INITRD.IMG initrd",
+			"-r--r--r-- IMAGES/PXEBOOT/VMLINUZ kernel",
+			"-r--r--r-- MIXEDCAS.TXT mixed",
+			"-r--r--r-- REPODATA/REPOMD.XML <repomd/>",
+			"dr-xr-xr-x A",
+			"dr-xr-xr-x A/B",
+			"dr-xr-xr-x A/B/C",
+			"dr-xr-xr-x A/B/C/D",
+			"dr-xr-xr-x A/B/C/D/E",
+			"dr-xr-xr-x A/B/C/D/E/F",
+			"dr-xr-xr-x A/B/C/D/E/F/G",
+			"dr-xr-xr-x IMAGES",
+			"dr-xr-xr-x IMAGES/PXEBOOT",
+			"dr-xr-xr-x REPODATA",
+		}},
+	} {
+		img := loadImage(t, test.name)
+		if img.Format != test.format {
+			t.Errorf("%s: expected format %s, got %s", test.name, test.format, img.Format)
+		}
+		sort.Strings(test.want)
+		checkListing(t, test.name, listing(t, img), test.want)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	img := loadImage(t, "rr")
+	dir, err := ioutil.TempDir("", "isofs-")
+	if err != nil {
+		t.Fatalf("Cannot make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var done, total int64
+	full := filepath.Join(dir, "full")
+	if err := img.Extract(full, nil, func(d, t int64) { done, total = d, t }); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if done != total || total != 40 {
+		t.Errorf("Expected progress to reach 40 bytes, got %d of %d", done, total)
+	}
+	for p, want := range map[string]string{
+		"images/pxeboot/vmlinuz":     "kernel",
+		"a/b/c/d/e/f/g/h/i/deep.txt": "deep",
+		"link":                       "kernel",
+	} {
+		buf, err := ioutil.ReadFile(filepath.Join(full, p))
+		if err != nil || string(buf) != want {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", p, want, string(buf), err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(full, "exec.sh")); err != nil || fi.Mode().Perm()&0111 == 0 {
+		t.Errorf("Expected exec.sh to be executable")
+	}
+
+	partial := filepath.Join(dir, "partial")
+	want := func(p string) bool { return strings.HasPrefix(p, "images/") }
+	if err := img.Extract(partial, want, nil); err != nil {
+		t.Fatalf("Partial extract failed: %v", err)
+	}
+	got := []string{}
+	filepath.Walk(partial, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rel, _ := filepath.Rel(partial, p)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(got)
+	checkListing(t, "partial", got, []string{"images/pxeboot/initrd.img", "images/pxeboot/vmlinuz"})
+}
+
+const (
+	udfPartStart = 300
+	udfRX        = 0x14a5
+	udfRWX       = 0x1ce7
+)
+
+// udfBuilder lays out small UDF images by hand, since there is nothing
+// around to make them with.  Block 0 of the partition holds the File
+// Set Descriptor, and block 1 the File Entry of the root directory.
+type udfBuilder struct {
+	img []byte
+}
+
+func newUdfBuilder() *udfBuilder {
+	u := &udfBuilder{img: make([]byte, (udfPartStart+16)*sectorSize)}
+	for i, id := range []string{"BEA01", "NSR02", "TEA01"} {
+		copy(u.sector(16 + i)[1:], id)
+		u.sector(16 + i)[6] = 1
+	}
+	avdp := u.sector(256)
+	binary.LittleEndian.PutUint32(avdp[16:], 3*sectorSize)
+	binary.LittleEndian.PutUint32(avdp[20:], 32)
+	udfTestTag(avdp, udfTagAnchor, 256)
+	pd := u.sector(32)
+	binary.LittleEndian.PutUint32(pd[188:], udfPartStart)
+	udfTestTag(pd, udfTagPartition, 32)
+	lvd := u.sector(33)
+	binary.LittleEndian.PutUint32(lvd[212:], sectorSize)
+	binary.LittleEndian.PutUint32(lvd[248:], sectorSize)
+	binary.LittleEndian.PutUint32(lvd[264:], 6)
+	binary.LittleEndian.PutUint32(lvd[268:], 1)
+	copy(lvd[440:], []byte{1, 6, 1, 0, 0, 0})
+	udfTestTag(lvd, udfTagLogicalVolume, 33)
+	udfTestTag(u.sector(34), udfTagTerminator, 34)
+	fsd := u.block(0)
+	binary.LittleEndian.PutUint32(fsd[400:], sectorSize)
+	binary.LittleEndian.PutUint32(fsd[404:], 1)
+	udfTestTag(fsd, udfTagFileSet, 0)
+	return u
+}
+
+func udfTestTag(buf []byte, id uint16, loc uint32) {
+	binary.LittleEndian.PutUint16(buf[0:], id)
+	binary.LittleEndian.PutUint16(buf[2:], 2)
+	binary.LittleEndian.PutUint32(buf[12:], loc)
+	buf[4] = 0
+	var sum byte
+	for i := 0; i < 16; i++ {
+		sum += buf[i]
+	}
+	buf[4] = sum
+}
+
+func (u *udfBuilder) sector(n int) []byte {
+	return u.img[n*sectorSize : (n+1)*sectorSize]
+}
+
+func (u *udfBuilder) block(n int) []byte {
+	return u.sector(udfPartStart + n)
+}
+
+func (u *udfBuilder) fileEntry(n int, ext bool, fileType byte, perm uint32, size uint64, allocType uint16, ads []byte) {
+	fe := u.block(n)
+	fe[27] = fileType
+	binary.LittleEndian.PutUint16(fe[34:], allocType)
+	binary.LittleEndian.PutUint32(fe[44:], perm)
+	binary.LittleEndian.PutUint64(fe[56:], size)
+	ts, lens, start, id := 84, 168, 176, uint16(udfTagFileEntry)
+	if ext {
+		ts, lens, start, id = 92, 208, 216, udfTagExtFileEntry
+	}
+	binary.LittleEndian.PutUint16(fe[ts:], 1<<12)
+	binary.LittleEndian.PutUint16(fe[ts+2:], 2018)
+	copy(fe[ts+4:], []byte{6, 15, 12, 30, 0})
+	binary.LittleEndian.PutUint32(fe[lens+4:], uint32(len(ads)))
+	copy(fe[start:], ads)
+	udfTestTag(fe, id, uint32(n))
+}
+
+func udfFid(chars byte, name string, icb uint32) []byte {
+	nameLen := 0
+	if name != "" {
+		nameLen = 1 + len(name)
+	}
+	buf := make([]byte, (38+nameLen+3)&^3)
+	buf[18] = chars
+	buf[19] = byte(nameLen)
+	binary.LittleEndian.PutUint32(buf[20:], sectorSize)
+	binary.LittleEndian.PutUint32(buf[24:], icb)
+	if name != "" {
+		buf[38] = 8
+		copy(buf[39:], name)
+	}
+	udfTestTag(buf, udfTagFileIdentifier, 0)
+	return buf
+}
+
+func udfShortAD(length, pos uint32) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[0:], length)
+	binary.LittleEndian.PutUint32(buf[4:], pos)
+	return buf
+}
+
+// udfImage has a regular file in an Extended File Entry, a directory
+// with its contents in a separate block, a sparse file, a symlink, and
+// a deleted file.
+func udfImage() []byte {
+	u := newUdfBuilder()
+	root := bytes.Join([][]byte{
+		udfFid(0x08, "", 1),
+		udfFid(0x02, "EFI", 2),
+		udfFid(0, "Setup.exe", 3),
+		udfFid(0, "link", 4),
+		udfFid(0x04, "gone", 3),
+	}, nil)
+	u.fileEntry(1, false, 4, udfRX, uint64(len(root)), 3, root)
+	efi := bytes.Join([][]byte{
+		udfFid(0x08, "", 1),
+		udfFid(0, "boot.efi", 6),
+	}, nil)
+	copy(u.block(5), efi)
+	u.fileEntry(2, false, 4, udfRX, uint64(len(efi)), 0, udfShortAD(uint32(len(efi)), 5))
+	copy(u.block(10), "MZ setup")
+	u.fileEntry(3, true, 5, udfRWX, 8, 0, udfShortAD(8, 10))
+	u.fileEntry(4, false, 12, udfRWX, 14, 3, append([]byte{5, 10, 0, 0, 8}, "Setup.exe"...))
+	copy(u.block(11), "abc")
+	u.fileEntry(6, false, 5, udfRX, 5, 0, append(udfShortAD(3, 11), udfShortAD(1<<30|2, 0)...))
+	return u.img
+}
+
+// hostileUdfImage has a symlink named evil that points out of the
+// image, followed by a directory also named evil with a file in it,
+// so that extracting the file would follow the symlink.
+func hostileUdfImage() []byte {
+	u := newUdfBuilder()
+	root := bytes.Join([][]byte{
+		udfFid(0x08, "", 1),
+		udfFid(0, "evil", 2),
+		udfFid(0x02, "evil", 3),
+	}, nil)
+	u.fileEntry(1, false, 4, udfRX, uint64(len(root)), 3, root)
+	target := append([]byte{3, 0, 0, 0, 5, 8, 0, 0, 8}, "outside"...)
+	u.fileEntry(2, false, 12, udfRWX, uint64(len(target)), 3, target)
+	dir := bytes.Join([][]byte{
+		udfFid(0x08, "", 1),
+		udfFid(0, "payload", 4),
+	}, nil)
+	u.fileEntry(3, false, 4, udfRX, uint64(len(dir)), 3, dir)
+	copy(u.block(10), "pwned")
+	u.fileEntry(4, false, 5, udfRWX, 5, 0, udfShortAD(5, 10))
+	return u.img
+}
+
+func TestUdf(t *testing.T) {
+	img, err := Open(bytes.NewReader(udfImage()))
+	if err != nil {
+		t.Fatalf("Cannot open UDF image: %v", err)
+	}
+	if img.Format != "udf" {
+		t.Errorf("Expected format udf, got %s", img.Format)
+	}
+	checkListing(t, "udf", listing(t, img), []string{
+		"-r-xr-xr-x EFI/boot.efi abc\x00\x00",
+		"-rwxrwxrwx Setup.exe MZ setup",
+		"Lrwxrwxrwx link -> Setup.exe",
+		"dr-xr-xr-x EFI",
+	})
+}
+
+func TestNotImage(t *testing.T) {
+	if _, err := Open(bytes.NewReader(make([]byte, 64*sectorSize))); err != ErrNotImage {
+		t.Errorf("Expected ErrNotImage, got %v", err)
+	}
+	if _, err := Open(strings.NewReader("short")); err != ErrNotImage {
+		t.Errorf("Expected ErrNotImage for a short file, got %v", err)
+	}
+}
+
+func TestExtractHostile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isofs-")
+	if err != nil {
+		t.Fatalf("Cannot make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatalf("Cannot make %s: %v", outside, err)
+	}
+
+	img, err := Open(bytes.NewReader(hostileUdfImage()))
+	if err != nil {
+		t.Fatalf("Cannot open hostile image: %v", err)
+	}
+	checkListing(t, "hostile", listing(t, img), []string{
+		"-rwxrwxrwx evil/payload pwned",
+		"Lrwxrwxrwx evil -> ../outside",
+		"dr-xr-xr-x evil",
+	})
+	if err := img.Extract(filepath.Join(dir, "dest"), nil, nil); err == nil {
+		t.Errorf("Expected extracting a symlink out of the image to fail")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "dest", "evil")); err == nil {
+		t.Errorf("Expected the escaping symlink to not be made")
+	}
+
+	// A symlink left in the destination must not be followed either.
+	dest := filepath.Join(dir, "existing")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatalf("Cannot make %s: %v", dest, err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "EFI")); err != nil {
+		t.Fatalf("Cannot make symlink: %v", err)
+	}
+	img, err = Open(bytes.NewReader(udfImage()))
+	if err != nil {
+		t.Fatalf("Cannot open UDF image: %v", err)
+	}
+	if err := img.Extract(dest, nil, nil); err == nil {
+		t.Errorf("Expected extracting through an existing symlink to fail")
+	}
+	if got, _ := ioutil.ReadDir(outside); len(got) != 0 {
+		t.Errorf("Expected nothing to be written outside of the destination, got %d files", len(got))
+	}
+}
+
+func TestLinkEscapes(t *testing.T) {
+	for _, test := range []struct {
+		path, target string
+		escapes      bool
+	}{
+		{"link", "images/pxeboot/vmlinuz", false},
+		{"debian", ".", false},
+		{"a/b/link", "../../c", false},
+		{"a/b/link", "../../../c", true},
+		{"link", "../outside", true},
+		{"link", "/etc/passwd", true},
+		{"link", "self/../../outside", true},
+		{"link", "", true},
+	} {
+		if got := linkEscapes(test.path, test.target); got != test.escapes {
+			t.Errorf("linkEscapes(%q, %q): expected %v, got %v", test.path, test.target, test.escapes, got)
+		}
+	}
+}
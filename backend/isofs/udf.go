@@ -0,0 +1,416 @@
+package isofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+	"unicode/utf16"
+)
+
+// UDF descriptor tag identifiers.
+const (
+	udfTagAnchor         = 2
+	udfTagPartition      = 5
+	udfTagLogicalVolume  = 6
+	udfTagTerminator     = 8
+	udfTagFileSet        = 256
+	udfTagFileIdentifier = 257
+	udfTagAllocExtent    = 258
+	udfTagFileEntry      = 261
+	udfTagExtFileEntry   = 266
+)
+
+// udfVolume is the part of a UDF logical volume we need to find files.
+// Only Type 1 partition maps are handled, which is what is used on
+// install media.
+type udfVolume struct {
+	partitions []uint32
+	root       udfLongAD
+}
+
+// udfLongAD is an extent in a particular partition.
+type udfLongAD struct {
+	length    uint32
+	block     uint32
+	partition uint16
+}
+
+func parseLongAD(buf []byte) udfLongAD {
+	return udfLongAD{
+		length:    binary.LittleEndian.Uint32(buf[0:]),
+		block:     binary.LittleEndian.Uint32(buf[4:]),
+		partition: binary.LittleEndian.Uint16(buf[8:]),
+	}
+}
+
+// udfTag checks the descriptor tag at the start of buf and returns its
+// identifier.
+func udfTag(buf []byte) (uint16, error) {
+	if len(buf) < 16 {
+		return 0, fmt.Errorf("isofs: short UDF descriptor")
+	}
+	var sum byte
+	for i := 0; i < 16; i++ {
+		if i != 4 {
+			sum += buf[i]
+		}
+	}
+	if sum != buf[4] {
+		return 0, fmt.Errorf("isofs: bad UDF descriptor tag checksum")
+	}
+	return binary.LittleEndian.Uint16(buf[0:]), nil
+}
+
+func (img *Image) udfBlock(vol *udfVolume, ad udfLongAD) (int64, error) {
+	if int(ad.partition) >= len(vol.partitions) {
+		return 0, fmt.Errorf("isofs: UDF partition %d does not exist", ad.partition)
+	}
+	return (int64(vol.partitions[ad.partition]) + int64(ad.block)) * sectorSize, nil
+}
+
+func (img *Image) openUdf() (*udfVolume, error) {
+	anchor, err := img.sector(256)
+	if err != nil {
+		return nil, err
+	}
+	if tag, err := udfTag(anchor); err != nil || tag != udfTagAnchor {
+		return nil, fmt.Errorf("isofs: missing UDF anchor volume descriptor")
+	}
+	vdsLen := binary.LittleEndian.Uint32(anchor[16:])
+	vdsLoc := binary.LittleEndian.Uint32(anchor[20:])
+	partStarts := map[uint16]uint32{}
+	var lvd []byte
+	for i := uint32(0); i < vdsLen/sectorSize; i++ {
+		buf, err := img.sector(int64(vdsLoc + i))
+		if err != nil {
+			return nil, err
+		}
+		tag, err := udfTag(buf)
+		if err != nil {
+			return nil, err
+		}
+		if tag == udfTagTerminator {
+			break
+		}
+		switch tag {
+		case udfTagPartition:
+			partStarts[binary.LittleEndian.Uint16(buf[22:])] = binary.LittleEndian.Uint32(buf[188:])
+		case udfTagLogicalVolume:
+			lvd = buf
+		}
+	}
+	if lvd == nil {
+		return nil, fmt.Errorf("isofs: missing UDF logical volume descriptor")
+	}
+	if bs := binary.LittleEndian.Uint32(lvd[212:]); bs != sectorSize {
+		return nil, fmt.Errorf("isofs: unsupported UDF block size %d", bs)
+	}
+	vol := &udfVolume{}
+	maps := lvd[440:]
+	for i := uint32(0); i < binary.LittleEndian.Uint32(lvd[268:]); i++ {
+		if len(maps) < 2 || int(maps[1]) > len(maps) || maps[1] < 2 {
+			return nil, fmt.Errorf("isofs: bad UDF partition map")
+		}
+		if maps[0] != 1 {
+			return nil, fmt.Errorf("isofs: unsupported UDF partition map type %d", maps[0])
+		}
+		start, ok := partStarts[binary.LittleEndian.Uint16(maps[4:])]
+		if !ok {
+			return nil, fmt.Errorf("isofs: UDF partition %d is not described", binary.LittleEndian.Uint16(maps[4:]))
+		}
+		vol.partitions = append(vol.partitions, start)
+		maps = maps[maps[1]:]
+	}
+	off, err := img.udfBlock(vol, parseLongAD(lvd[248:]))
+	if err != nil {
+		return nil, err
+	}
+	fsd := make([]byte, sectorSize)
+	if err := img.readAt(fsd, off); err != nil {
+		return nil, err
+	}
+	if tag, err := udfTag(fsd); err != nil || tag != udfTagFileSet {
+		return nil, fmt.Errorf("isofs: missing UDF file set descriptor")
+	}
+	vol.root = parseLongAD(fsd[400:])
+	return vol, nil
+}
+
+// udfTime converts a UDF timestamp.
+func udfTime(b []byte) time.Time {
+	typeTz := binary.LittleEndian.Uint16(b[0:])
+	loc := time.UTC
+	if typeTz>>12 == 1 {
+		if tz := int16(typeTz<<4) >> 4; tz != -2047 {
+			loc = time.FixedZone("", int(tz)*60)
+		}
+	}
+	return time.Date(int(int16(binary.LittleEndian.Uint16(b[2:]))), time.Month(b[4]), int(b[5]),
+		int(b[6]), int(b[7]), int(b[8]), int(b[9])*10000000, loc)
+}
+
+// udfDString decodes an OSTA compressed unicode string.
+func udfDString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	switch b[0] {
+	case 8:
+		r := make([]rune, len(b)-1)
+		for i, c := range b[1:] {
+			r[i] = rune(c)
+		}
+		return string(r)
+	case 16:
+		u := make([]uint16, (len(b)-1)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[1+i*2:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return ""
+}
+
+// udfFile is a parsed (Extended) File Entry.
+type udfFile struct {
+	fileType byte
+	mode     os.FileMode
+	size     int64
+	modTime  time.Time
+	extents  []extent
+	inline   []byte
+}
+
+func (img *Image) readUdfFile(vol *udfVolume, icb udfLongAD) (*udfFile, error) {
+	off, err := img.udfBlock(vol, icb)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, sectorSize)
+	if err := img.readAt(buf, off); err != nil {
+		return nil, err
+	}
+	tag, err := udfTag(buf)
+	if err != nil {
+		return nil, err
+	}
+	var eaLen, adLen uint32
+	var start int
+	res := &udfFile{fileType: buf[27], size: int64(binary.LittleEndian.Uint64(buf[56:]))}
+	switch tag {
+	case udfTagFileEntry:
+		res.modTime = udfTime(buf[84:])
+		eaLen, adLen, start = binary.LittleEndian.Uint32(buf[168:]), binary.LittleEndian.Uint32(buf[172:]), 176
+	case udfTagExtFileEntry:
+		res.modTime = udfTime(buf[92:])
+		eaLen, adLen, start = binary.LittleEndian.Uint32(buf[208:]), binary.LittleEndian.Uint32(buf[212:]), 216
+	default:
+		return nil, fmt.Errorf("isofs: expected a UDF file entry, got tag %d", tag)
+	}
+	if int(uint32(start)+eaLen+adLen) > len(buf) {
+		return nil, fmt.Errorf("isofs: UDF file entry overflows its block")
+	}
+	perm := binary.LittleEndian.Uint32(buf[44:])
+	// UDF keeps five bits each for other, group, and owner, the
+	// lowest three of which are execute, write, and read like POSIX.
+	res.mode = os.FileMode((perm>>4)&0700 | (perm>>2)&0070 | perm&0007)
+	ads := buf[int(uint32(start)+eaLen):int(uint32(start)+eaLen+adLen)]
+	flags := binary.LittleEndian.Uint16(buf[34:])
+	switch flags & 7 {
+	case 3:
+		res.inline = ads
+		if int64(len(res.inline)) > res.size {
+			res.inline = res.inline[:res.size]
+		}
+		return res, nil
+	case 0, 1:
+		res.extents, err = img.udfExtents(vol, ads, flags&7 == 1, icb.partition, 0)
+		return res, err
+	}
+	return nil, fmt.Errorf("isofs: unsupported UDF allocation descriptor type %d", flags&7)
+}
+
+// udfExtents turns short or long allocation descriptors into extents,
+// following allocation extent descriptors when there are too many to
+// fit in the file entry.
+func (img *Image) udfExtents(vol *udfVolume, ads []byte, long bool, partition uint16, depth int) ([]extent, error) {
+	if depth > 32 {
+		return nil, fmt.Errorf("isofs: too many UDF allocation extents")
+	}
+	adSize := 8
+	if long {
+		adSize = 16
+	}
+	res := []extent{}
+	for ; len(ads) >= adSize; ads = ads[adSize:] {
+		ad := udfLongAD{
+			length:    binary.LittleEndian.Uint32(ads[0:]),
+			block:     binary.LittleEndian.Uint32(ads[4:]),
+			partition: partition,
+		}
+		if long {
+			ad.partition = binary.LittleEndian.Uint16(ads[8:])
+		}
+		length := int64(ad.length & 0x3fffffff)
+		if length == 0 {
+			break
+		}
+		switch ad.length >> 30 {
+		case 0:
+			off, err := img.udfBlock(vol, ad)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, extent{off, length})
+		case 1, 2:
+			res = append(res, extent{-1, length})
+		case 3:
+			off, err := img.udfBlock(vol, ad)
+			if err != nil {
+				return nil, err
+			}
+			buf := make([]byte, sectorSize)
+			if err := img.readAt(buf, off); err != nil {
+				return nil, err
+			}
+			if tag, err := udfTag(buf); err != nil || tag != udfTagAllocExtent {
+				return nil, fmt.Errorf("isofs: missing UDF allocation extent descriptor")
+			}
+			l := binary.LittleEndian.Uint32(buf[20:])
+			if 24+int(l) > len(buf) {
+				return nil, fmt.Errorf("isofs: UDF allocation extent overflows its block")
+			}
+			more, err := img.udfExtents(vol, buf[24:24+l], long, ad.partition, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			return append(res, more...), nil
+		}
+	}
+	return res, nil
+}
+
+func (img *Image) readUdfContents(f *udfFile) ([]byte, error) {
+	if f.inline != nil {
+		return f.inline, nil
+	}
+	if f.size > 64<<20 {
+		return nil, fmt.Errorf("isofs: UDF directory or link too large")
+	}
+	buf := make([]byte, 0, f.size)
+	for _, x := range f.extents {
+		l := x.length
+		if left := f.size - int64(len(buf)); l > left {
+			l = left
+		}
+		part := make([]byte, l)
+		if x.start >= 0 {
+			if err := img.readAt(part, x.start); err != nil {
+				return nil, err
+			}
+		}
+		buf = append(buf, part...)
+	}
+	return buf, nil
+}
+
+// udfLinkTarget decodes the path components of a UDF symlink.
+func udfLinkTarget(buf []byte) string {
+	res := ""
+	for len(buf) >= 4 {
+		l := int(buf[1])
+		if 4+l > len(buf) {
+			break
+		}
+		part := ""
+		switch buf[0] {
+		case 1, 2:
+			res = "/"
+		case 3:
+			part = ".."
+		case 4:
+			part = "."
+		case 5:
+			part = udfDString(buf[4 : 4+l])
+		}
+		if part != "" {
+			if res != "" && res[len(res)-1] != '/' {
+				res += "/"
+			}
+			res += part
+		}
+		buf = buf[4+l:]
+	}
+	return res
+}
+
+func (img *Image) walkUdf(fn func(*Entry) error) error {
+	root, err := img.readUdfFile(img.udf, img.udf.root)
+	if err != nil {
+		return err
+	}
+	return img.walkUdfDir(root, "", fn, 0)
+}
+
+func (img *Image) walkUdfDir(dir *udfFile, dirPath string, fn func(*Entry) error, depth int) error {
+	if depth > 64 {
+		return fmt.Errorf("isofs: %s: directories nested too deeply", dirPath)
+	}
+	buf, err := img.readUdfContents(dir)
+	if err != nil {
+		return err
+	}
+	for off := 0; off+38 <= len(buf); {
+		fid := buf[off:]
+		if tag, err := udfTag(fid); err != nil || tag != udfTagFileIdentifier {
+			return fmt.Errorf("isofs: %s: bad UDF file identifier", dirPath)
+		}
+		chars, nameLen := fid[18], int(fid[19])
+		iuLen := int(binary.LittleEndian.Uint16(fid[36:]))
+		size := (38 + iuLen + nameLen + 3) &^ 3
+		if 38+iuLen+nameLen > len(fid) {
+			return fmt.Errorf("isofs: %s: UDF file identifier overflows directory", dirPath)
+		}
+		icb := parseLongAD(fid[20:])
+		name := udfDString(fid[38+iuLen : 38+iuLen+nameLen])
+		off += size
+		// Skip deleted entries and the parent directory.
+		if chars&0x0c != 0 || !validName(name) {
+			continue
+		}
+		f, err := img.readUdfFile(img.udf, icb)
+		if err != nil {
+			return err
+		}
+		e := &Entry{
+			Path:    joinPath(dirPath, name),
+			Mode:    f.mode,
+			ModTime: f.modTime,
+		}
+		switch f.fileType {
+		case 4:
+			e.Mode |= os.ModeDir
+		case 12:
+			e.Mode |= os.ModeSymlink
+			target, err := img.readUdfContents(f)
+			if err != nil {
+				return err
+			}
+			e.Target = udfLinkTarget(target)
+		case 5:
+			e.Size, e.extents, e.inline = f.size, f.extents, f.inline
+		default:
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		if e.IsDir() {
+			if err := img.walkUdfDir(f, e.Path, fn, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
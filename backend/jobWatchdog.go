@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+)
+
+const (
+	// jobWatchdogInterval is how often running Jobs are checked for
+	// ones that have timed out.
+	jobWatchdogInterval = 15 * time.Second
+	// defaultJobHeartbeatTimeout is how long the agent running a Job
+	// can go without a heartbeat when the jobHeartbeatTimeout
+	// preference is not set.
+	defaultJobHeartbeatTimeout = 5 * time.Minute
+)
+
+// jobHeartbeats tracks when the agents running Jobs last let us know
+// they are still alive.  Heartbeats are only kept in memory, and
+// Jobs run by agents that do not send them are only checked against
+// their timeout.
+type jobHeartbeats struct {
+	mux  *sync.Mutex
+	last map[string]time.Time
+}
+
+func newJobHeartbeats() *jobHeartbeats {
+	return &jobHeartbeats{mux: &sync.Mutex{}, last: map[string]time.Time{}}
+}
+
+// JobHeartbeat records that the agent running the Job with the
+// passed UUID is still alive at the passed time.
+func (p *DataTracker) JobHeartbeat(job string, at time.Time) {
+	p.jobHeartbeats.mux.Lock()
+	defer p.jobHeartbeats.mux.Unlock()
+	p.jobHeartbeats.last[job] = at
+}
+
+// prefSeconds returns the preference name as a number of seconds, or
+// def if it is not set.
+func (p *DataTracker) prefSeconds(name string, def time.Duration) time.Duration {
+	if val := p.pref(name); val != "" {
+		if secs, err := strconv.Atoi(val); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return def
+}
+
+// JobWatchdog periodically checks the running Jobs in a DataTracker
+// for ones that have timed out.
+type JobWatchdog struct {
+	dt       *DataTracker
+	done     chan struct{}
+	finished chan struct{}
+}
+
+func (w *JobWatchdog) run() {
+	defer close(w.finished)
+	ticker := time.NewTicker(jobWatchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-ticker.C:
+			w.dt.checkJobs(now)
+		}
+	}
+}
+
+// Shutdown stops checking for timed out Jobs.
+func (w *JobWatchdog) Shutdown(ctx context.Context) error {
+	close(w.done)
+	select {
+	case <-w.finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// StartJobWatchdog starts periodically checking for running Jobs that
+// have run for longer than they are allowed to, or whose agent has
+// stopped sending heartbeats.
+func (p *DataTracker) StartJobWatchdog() *JobWatchdog {
+	w := &JobWatchdog{
+		dt:       p,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// checkJobs looks for running Jobs that have timed out as of now.  A
+// Job that has run for longer than the Timeout of its Task (or the
+// jobTimeout preference) is marked as failed.  A Job whose agent has
+// not sent a heartbeat within the jobHeartbeatTimeout preference is
+// assumed to have lost its machine, and is marked as incomplete so
+// that it is run again once the machine comes back.  Either way, the
+// Machine is marked as not runnable.
+func (p *DataTracker) checkJobs(now time.Time) {
+	j := &Job{}
+	rt := p.Request(p.Logger, j.Locks("update")...)
+	jobTimeout := p.prefSeconds("jobTimeout", 0)
+	heartbeatTimeout := p.prefSeconds("jobHeartbeatTimeout", defaultJobHeartbeatTimeout)
+	hb := p.jobHeartbeats
+	rt.Do(func(d Stores) {
+		items, err := index.All(
+			index.Sort(j.Indexes()["State"]),
+			index.Eq("running"))(rt.Index("jobs"))
+		if err != nil {
+			rt.Errorf("Job watchdog: cannot find running jobs: %v", err)
+			return
+		}
+		running := map[string]struct{}{}
+		for _, item := range items.Items() {
+			job := AsJob(item)
+			running[job.Key()] = struct{}{}
+			if strings.HasPrefix(job.Task, "group:") {
+				// The Jobs for the Tasks in the group are checked instead.
+				continue
+			}
+			timeout := jobTimeout
+			if to := rt.find("tasks", job.Task); to != nil && AsTask(to).Timeout > 0 {
+				timeout = time.Duration(AsTask(to).Timeout) * time.Second
+			}
+			hb.mux.Lock()
+			last, beating := hb.last[job.Key()]
+			hb.mux.Unlock()
+			switch {
+			case beating && heartbeatTimeout > 0 && now.Sub(last) > heartbeatTimeout:
+				job.timeout(rt, "incomplete", "lost",
+					fmt.Sprintf("No heartbeat from the machine agent since %s", last.Format(time.RFC3339)))
+			case timeout > 0 && now.Sub(job.StartTime) > timeout:
+				job.timeout(rt, "failed", "timeout",
+					fmt.Sprintf("Task %s ran for longer than its timeout of %s", job.Task, timeout))
+			}
+		}
+		hb.mux.Lock()
+		for key := range hb.last {
+			if _, ok := running[key]; !ok {
+				delete(hb.last, key)
+			}
+		}
+		hb.mux.Unlock()
+	})
+}
+
+// timeout marks j as being in state because of reason, makes its
+// Machine not runnable, and publishes an event with action.
+func (j *Job) timeout(rt *RequestTracker, state, action, reason string) {
+	rt.Warnf("Job %s: %s, marking it %s", j.UUID(), reason, state)
+	j.stopMachine(rt)
+	nj := ModelToBackend(models.Clone(j)).(*Job)
+	nj.State = state
+	if state == "failed" {
+		nj.ExitState = "failed"
+	}
+	nj.Log(rt, strings.NewReader(reason+"\n"))
+	if _, err := rt.Update(nj); err != nil {
+		rt.Errorf("Job %s: failed to mark it %s: %v", j.UUID(), state, err)
+		return
+	}
+	rt.Publish("jobs", action, nj.Key(), nj)
+}
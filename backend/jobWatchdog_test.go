@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestJobWatchdog(t *testing.T) {
+	dt := mkDT()
+	j := &Job{}
+	rt := dt.Request(dt.Logger, j.Locks("update")...)
+	tests := []crudTest{
+		{"Create Task slow", rt.Create, &models.Task{Name: "slow", Timeout: 60}, true},
+		{"Create Task quiet", rt.Create, &models.Task{Name: "quiet"}, true},
+		{"Create Stage watched", rt.Create, &models.Stage{Name: "watched", BootEnv: "local", Tasks: []string{"slow", "quiet"}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	start := time.Now()
+	jobs := map[string]uuid.UUID{}
+	machines := map[string]uuid.UUID{}
+	// slow runs past its Timeout, lost stops sending heartbeats, and
+	// old comes from an agent that never sent any.
+	for name, task := range map[string]string{"slow": "slow", "lost": "quiet", "old": "quiet"} {
+		machines[name], jobs[name] = uuid.NewRandom(), uuid.NewRandom()
+		rt.Do(func(d Stores) {
+			m := &models.Machine{Uuid: machines[name], Name: name, Stage: "watched", Runnable: true}
+			if _, err := rt.Create(m); err != nil {
+				t.Errorf("Failed to create machine %s: %v", name, err)
+			}
+			job := &models.Job{
+				Uuid:     jobs[name],
+				Previous: uuid.Parse("00000000-0000-0000-0000-000000000000"),
+				Machine:  machines[name],
+				Task:     task,
+				Stage:    "watched",
+				State:    "running",
+			}
+			if _, err := rt.Create(job); err != nil {
+				t.Errorf("Failed to create job for %s: %v", name, err)
+			}
+			nm := AsMachine(rt.Find("machines", machines[name].String()))
+			nm.CurrentJob = jobs[name]
+			if _, err := rt.Update(nm); err != nil {
+				t.Errorf("Failed to update machine %s: %v", name, err)
+			}
+		})
+	}
+	dt.JobHeartbeat(jobs["slow"].String(), start.Add(9*time.Minute))
+	dt.JobHeartbeat(jobs["lost"].String(), start)
+	dt.checkJobs(start.Add(10 * time.Minute))
+	rt.Do(func(d Stores) {
+		for name, state := range map[string]string{"slow": "failed", "lost": "incomplete", "old": "running"} {
+			job := AsJob(rt.find("jobs", jobs[name].String()))
+			if job.State != state {
+				t.Errorf("Job for %s: expected state %s, got %s", name, state, job.State)
+			}
+			m := AsMachine(rt.find("machines", machines[name].String()))
+			if m.Runnable != (state == "running") {
+				t.Errorf("Machine %s: expected Runnable to be %v, got %v", name, state == "running", m.Runnable)
+			}
+		}
+	})
+}
+
+func TestJobWatchdogShutdown(t *testing.T) {
+	w := mkDT().StartJobWatchdog()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != nil {
+		t.Errorf("Failed to shut down the job watchdog: %v", err)
+	}
+}
@@ -52,10 +52,37 @@ import (
 //
 // * On provisioner startup, all machine CurrentJobs are set to "failed" if they are not "finished"
 //
+// * If a job fails and its Task has a Retry policy that allows it, the
+//   machine is made runnable again once the backoff is over, so that the
+//   client creates a new job for the Task.  Each attempt is its own job,
+//   linked to the one before it via Previous.
+//
+// * If CurrentTask indexes a task group, a Job for the group as a whole
+//   is created in the "running" state and becomes the machine's
+//   CurrentJob.  Each POST then hands out a Job for the next Task in the
+//   group that does not have one yet, with Group set to the group Job,
+//   so that the client can run them all at once.  The group Job fails
+//   as soon as one of them fails, after cancelling the rest of them,
+//   and finishes once they all have.
+//
+// * While a Job is running, the client sends heartbeats to
+//   jobs/:id/heartbeat.  A watchdog marks running Jobs that take longer
+//   than their Task's Timeout (or the jobTimeout preference) as
+//   "failed", and ones whose client stops sending heartbeats as
+//   "incomplete".  Either way, the machine is made not runnable.
+//
+// * POST to jobs/:id/cancel marks a Job that has not finished yet as
+//   "failed" with an ExitState of "cancelled", makes the machine not
+//   runnable, and publishes a cancel event that tells the client to
+//   kill the Task.  Cancelled Jobs are not retried.
+//
 type Job struct {
 	*models.Job
 	validate
 	oldState string
+	// failing is set on a task group Job while the rest of its group
+	// is being cancelled because one of them failed.
+	failing bool
 }
 
 func (j *Job) SetReadOnly(b bool) {
@@ -147,6 +174,28 @@ func (j *Job) Indexes() map[string]index.Maker {
 			job.Previous = id
 			return job, nil
 		})
+	res["Group"] = index.Make(
+		false,
+		"UUID string",
+		func(i, j models.Model) bool { return fix(i).Group.String() < fix(j).Group.String() },
+		func(ref models.Model) (gte, gt index.Test) {
+			refUuid := fix(ref).Group.String()
+			return func(s models.Model) bool {
+					return fix(s).Group.String() >= refUuid
+				},
+				func(s models.Model) bool {
+					return fix(s).Group.String() > refUuid
+				}
+		},
+		func(s string) (models.Model, error) {
+			id := uuid.Parse(s)
+			if id == nil {
+				return nil, fmt.Errorf("Invalid UUID: %s", s)
+			}
+			job := fix(j.New())
+			job.Group = id
+			return job, nil
+		})
 	res["Stage"] = index.Make(
 		false,
 		"string",
@@ -461,10 +510,300 @@ func (j *Job) BeforeSave() error {
 	return nil
 }
 
+// attempts returns how many Jobs in a row, ending with j, have failed
+// running the same Task at the same place in the Machine's task list.
+// It stops counting at max.
+func (j *Job) attempts(rt *RequestTracker, max int) int {
+	res := 1
+	for prev := j.Previous; res < max; {
+		po := rt.find("jobs", prev.String())
+		if po == nil {
+			break
+		}
+		pj := AsJob(po)
+		if pj.State != "failed" ||
+			pj.Task != j.Task ||
+			pj.CurrentIndex != j.CurrentIndex ||
+			!uuid.Equal(pj.Machine, j.Machine) {
+			break
+		}
+		res++
+		prev = pj.Previous
+	}
+	return res
+}
+
+// retryPolicy returns the Retry policy of the Task that j failed in,
+// along with how many times in a row it has failed, as long as the
+// policy applies to how j failed and j is still the CurrentJob of its
+// Machine.  Otherwise it returns nil.
+func (j *Job) retryPolicy(rt *RequestTracker) (*models.TaskRetry, int) {
+	to := rt.find("tasks", j.Task)
+	if to == nil {
+		return nil, 0
+	}
+	policy := AsTask(to).Retry
+	if policy == nil || !policy.Retryable(j.ExitCode) {
+		return nil, 0
+	}
+	mo := rt.find("machines", j.Machine.String())
+	if mo == nil {
+		return nil, 0
+	}
+	m := AsMachine(mo)
+	if !uuid.Equal(m.CurrentJob, j.Uuid) || m.CurrentTask != j.CurrentIndex {
+		return nil, 0
+	}
+	return policy, j.attempts(rt, policy.MaxAttempts)
+}
+
+// scheduleRetry makes the Machine that j is for runnable after delay,
+// unless something else happened to it in the meantime.
+func (j *Job) scheduleRetry(rt *RequestTracker, delay time.Duration) {
+	dt, l, machine, job := rt.dt, rt.Logger, j.Machine.String(), j.Uuid
+	time.AfterFunc(delay, func() {
+		rt := dt.Request(l, machineLockMap["update"]...)
+		rt.Do(func(_ Stores) {
+			mo := rt.find("machines", machine)
+			if mo == nil {
+				return
+			}
+			m := AsMachine(mo)
+			// Leave the Machine alone if anything else happened
+			// to it in the meantime.
+			if m.Runnable || !uuid.Equal(m.CurrentJob, job) {
+				return
+			}
+			nm := ModelToBackend(models.Clone(m)).(*Machine)
+			nm.Runnable = true
+			if _, err := rt.Update(nm); err != nil {
+				rt.Errorf("Machine %s: failed to make it runnable to retry Job %s: %v", machine, job.String(), err)
+			}
+		})
+	})
+}
+
+// retry applies the Retry policy of the Task that j failed in, if
+// it has one.  If the Task can be tried again, the Machine is made
+// runnable once the backoff is over, and the machine agent creates a
+// new Job for it that follows this one.  retry returns whether the
+// Task will be tried again.
+func (j *Job) retry() bool {
+	if j.rt.sandbox != nil {
+		return false
+	}
+	policy, attempts := j.retryPolicy(j.rt)
+	if policy == nil {
+		return false
+	}
+	if attempts >= policy.MaxAttempts {
+		j.rt.Infof("Job %s: Task %s failed %d times, not retrying it", j.UUID(), j.Task, attempts)
+		return false
+	}
+	delay := policy.Delay(attempts)
+	j.rt.Infof("Job %s: Task %s failed on attempt %d of %d, retrying in %s",
+		j.UUID(), j.Task, attempts, policy.MaxAttempts, delay)
+	j.scheduleRetry(j.rt, delay)
+	return true
+}
+
+// rearmRetries schedules the retries that were still waiting for
+// their backoff to end when dr-provision last stopped, counting the
+// backoff from when the failed Job ended.  It must be called with the
+// jobs, tasks, and machines locks held.
+func rearmRetries(rt *RequestTracker) {
+	for _, obj := range rt.d("machines").Items() {
+		m := AsMachine(obj)
+		if m.Runnable || m.CurrentJob == nil {
+			continue
+		}
+		jo := rt.find("jobs", m.CurrentJob.String())
+		if jo == nil {
+			continue
+		}
+		j := AsJob(jo)
+		if j.State != "failed" || j.ExitState == "cancelled" || len(j.Group) > 0 {
+			continue
+		}
+		policy, attempts := j.retryPolicy(rt)
+		if policy == nil || attempts >= policy.MaxAttempts {
+			continue
+		}
+		delay := j.EndTime.Add(policy.Delay(attempts)).Sub(time.Now())
+		if delay < 0 {
+			delay = 0
+		}
+		rt.Infof("Job %s: retrying Task %s in %s", j.UUID(), j.Task, delay)
+		j.scheduleRetry(rt, delay)
+	}
+}
+
+// followWorkflow lets the Machine's Workflow pick where it goes when
+// the Job fails.  If a transition matches, the Machine is made
+// runnable again to carry on from the Stage it picked.
+func (j *Job) followWorkflow() {
+	mo := j.rt.find("machines", j.Machine.String())
+	if mo == nil {
+		return
+	}
+	m := AsMachine(mo)
+	if m.Workflow == "" || m.Workflow != j.Workflow || m.CurrentTask != j.CurrentIndex {
+		return
+	}
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	if !nm.FollowWorkflow(j.rt, j.CurrentIndex+1, "failed") {
+		return
+	}
+	nm.InRunner()
+	nm.CurrentTask = j.CurrentIndex + 1
+	nm.Runnable = true
+	if _, err := j.rt.Update(nm); err != nil {
+		j.rt.Errorf("Machine %s: failed to follow Workflow %s after Job %s failed: %v", m.UUID(), m.Workflow, j.UUID(), err)
+	}
+}
+
+// GroupJobs returns the Jobs that have been handed out for the Tasks
+// in the task group that j runs, by Task name.
+func (j *Job) GroupJobs(rt *RequestTracker) map[string]*Job {
+	res := map[string]*Job{}
+	items, err := index.All(
+		index.Sort(j.Indexes()["Group"]),
+		index.Eq(j.Uuid.String()))(rt.Index("jobs"))
+	if err != nil {
+		return res
+	}
+	for _, item := range items.Items() {
+		mj := AsJob(item)
+		res[mj.Task] = mj
+	}
+	return res
+}
+
+// finishGroup marks the Job for the task group that j is in as failed
+// as soon as one of the Tasks in the group fails, and as finished once
+// all of them have finished.  When one fails, the rest of the group is
+// cancelled first, so that they are not left running when following
+// the Workflow hands out new Jobs.
+func (j *Job) finishGroup() {
+	gobj := j.rt.find("jobs", j.Group.String())
+	if gobj == nil {
+		return
+	}
+	g := AsJob(gobj)
+	if g.State != "running" || g.failing {
+		return
+	}
+	tasks, _ := models.TaskGroup(g.Task)
+	members := g.GroupJobs(j.rt)
+	state := "finished"
+	for _, name := range tasks {
+		mj, ok := members[name]
+		if ok && mj.State == "failed" {
+			state = "failed"
+			break
+		}
+		if !ok || mj.State != "finished" {
+			state = ""
+		}
+	}
+	if state == "" {
+		return
+	}
+	if state == "failed" {
+		g.failing = true
+		for _, name := range tasks {
+			mj, ok := members[name]
+			if !ok || mj.State == "finished" || mj.State == "failed" {
+				continue
+			}
+			if err := mj.Cancel(j.rt); err != nil {
+				j.rt.Errorf("Job %s: failed to cancel %s in task group %s: %v", j.UUID(), mj.UUID(), g.UUID(), err)
+			}
+		}
+		g.failing = false
+	}
+	ng := ModelToBackend(models.Clone(g)).(*Job)
+	ng.State = state
+	ng.ExitState = "complete"
+	if state == "failed" {
+		ng.ExitState = "failed"
+		if j.ExitState == "cancelled" {
+			ng.ExitState = "cancelled"
+		}
+	}
+	if _, err := j.rt.Update(ng); err != nil {
+		j.rt.Errorf("Job %s: failed to mark task group %s as %s: %v", j.UUID(), g.UUID(), state, err)
+	}
+}
+
+// stopMachine makes the Machine that j is for not runnable, as long
+// as j (or the task group it is in) is still its CurrentJob.
+func (j *Job) stopMachine(rt *RequestTracker) {
+	mo := rt.find("machines", j.Machine.String())
+	if mo == nil {
+		return
+	}
+	m := AsMachine(mo)
+	if !m.Runnable || !(uuid.Equal(m.CurrentJob, j.Uuid) || (len(j.Group) > 0 && uuid.Equal(m.CurrentJob, j.Group))) {
+		return
+	}
+	nm := ModelToBackend(models.Clone(m)).(*Machine)
+	nm.Runnable = false
+	if _, err := rt.Update(nm); err != nil {
+		rt.Errorf("Machine %s: failed to mark it not runnable: %v", m.Key(), err)
+	}
+}
+
+// Cancel stops j if it has not finished yet.  j is marked as failed
+// with an ExitState of "cancelled", along with the Jobs for the rest
+// of its task group if it is a group Job, and its Machine is made not
+// runnable so that the Task does not just start again.  A cancel
+// event is published for each Job, which tells the agent running it
+// to kill the Task.
+func (j *Job) Cancel(rt *RequestTracker) error {
+	if j.State == "finished" || j.State == "failed" {
+		return &models.Error{
+			Model:    j.Prefix(),
+			Key:      j.Key(),
+			Type:     "Conflict",
+			Code:     http.StatusConflict,
+			Messages: []string{fmt.Sprintf("Job %s is already %s", j.Key(), j.State)},
+		}
+	}
+	j.stopMachine(rt)
+	nj := ModelToBackend(models.Clone(j)).(*Job)
+	nj.State = "failed"
+	nj.ExitState = "cancelled"
+	nj.Log(rt, strings.NewReader("Job cancelled\n"))
+	if _, err := rt.Update(nj); err != nil {
+		return err
+	}
+	rt.Publish("jobs", "cancel", nj.Key(), nj)
+	if _, ok := models.TaskGroup(j.Task); ok {
+		for _, mj := range j.GroupJobs(rt) {
+			if mj.State != "finished" && mj.State != "failed" {
+				if err := mj.Cancel(rt); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func (j *Job) AfterSave() {
 	if !j.Current {
 		return
 	}
+	if len(j.Group) > 0 {
+		if j.State != j.oldState && (j.State == "finished" || j.State == "failed") {
+			j.finishGroup()
+		}
+		return
+	}
+	if j.State == "failed" && j.oldState != "failed" && j.ExitState != "cancelled" && !j.retry() {
+		j.followWorkflow()
+	}
 	oldJ := j.rt.d("jobs").Find(j.Previous.String())
 	if oldJ == nil {
 		return
@@ -472,6 +811,12 @@ func (j *Job) AfterSave() {
 	oj := oldJ.(*Job)
 	oj.Current = false
 	j.rt.Save(oj)
+	for _, mj := range oj.GroupJobs(j.rt) {
+		if mj.Current {
+			mj.Current = false
+			j.rt.Save(mj)
+		}
+	}
 }
 
 func (j *Job) BeforeDelete() error {
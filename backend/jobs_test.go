@@ -0,0 +1,177 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestJobGroupFailure(t *testing.T) {
+	dt := mkDT()
+	j := &Job{}
+	rt := dt.Request(dt.Logger, j.Locks("update")...)
+	tests := []crudTest{
+		{"Create Task fast", rt.Create, &models.Task{Name: "fast"}, true},
+		{"Create Task slow", rt.Create, &models.Task{Name: "slow"}, true},
+		{"Create Stage grouped", rt.Create, &models.Stage{Name: "grouped", BootEnv: "local", Tasks: []string{"group:fast,slow"}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	machine, group := uuid.NewRandom(), uuid.NewRandom()
+	members := map[string]uuid.UUID{"fast": uuid.NewRandom(), "slow": uuid.NewRandom()}
+	rt.Do(func(d Stores) {
+		m := &models.Machine{Uuid: machine, Name: "grouped", Stage: "grouped", Runnable: true}
+		if _, err := rt.Create(m); err != nil {
+			t.Fatalf("Failed to create machine: %v", err)
+		}
+		g := &models.Job{
+			Uuid:     group,
+			Previous: uuid.Parse("00000000-0000-0000-0000-000000000000"),
+			Machine:  machine,
+			Task:     "group:fast,slow",
+			Stage:    "grouped",
+			State:    "running",
+		}
+		if _, err := rt.Create(g); err != nil {
+			t.Fatalf("Failed to create group job: %v", err)
+		}
+		for task, id := range members {
+			job := &models.Job{
+				Uuid:     id,
+				Previous: group,
+				Group:    group,
+				Machine:  machine,
+				Task:     task,
+				Stage:    "grouped",
+				State:    "running",
+			}
+			if _, err := rt.Create(job); err != nil {
+				t.Fatalf("Failed to create job for %s: %v", task, err)
+			}
+		}
+		nm := AsMachine(rt.Find("machines", machine.String()))
+		nm.CurrentJob = group
+		if _, err := rt.Update(nm); err != nil {
+			t.Fatalf("Failed to update machine: %v", err)
+		}
+		failed := ModelToBackend(models.Clone(rt.Find("jobs", members["fast"].String()))).(*Job)
+		failed.State = "failed"
+		failed.ExitState = "failed"
+		failed.ExitCode = 1
+		if _, err := rt.Update(failed); err != nil {
+			t.Fatalf("Failed to fail job for fast: %v", err)
+		}
+	})
+	rt.Do(func(d Stores) {
+		for id, exitState := range map[string]string{
+			group.String():           "failed",
+			members["fast"].String(): "failed",
+			members["slow"].String(): "cancelled",
+		} {
+			job := AsJob(rt.find("jobs", id))
+			if job.State != "failed" || job.ExitState != exitState {
+				t.Errorf("Job %s for %s: expected failed/%s, got %s/%s", id, job.Task, exitState, job.State, job.ExitState)
+			}
+		}
+		if m := AsMachine(rt.find("machines", machine.String())); m.Runnable {
+			t.Errorf("Expected machine to not be runnable after its task group failed")
+		}
+	})
+}
+
+func TestJobRetry(t *testing.T) {
+	dt := mkDT()
+	j := &Job{}
+	rt := dt.Request(dt.Logger, j.Locks("update")...)
+	tests := []crudTest{
+		{"Create Task flaky", rt.Create, &models.Task{Name: "flaky", Retry: &models.TaskRetry{MaxAttempts: 3, Backoff: 1, MaxBackoff: 1}}, true},
+		{"Create Stage flaky", rt.Create, &models.Stage{Name: "flaky", BootEnv: "local", Tasks: []string{"flaky"}}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	machine := uuid.NewRandom()
+	rt.Do(func(d Stores) {
+		if _, err := rt.Create(&models.Machine{Uuid: machine, Name: "flaky", Stage: "flaky"}); err != nil {
+			t.Fatalf("Failed to create machine: %v", err)
+		}
+	})
+	// fail runs the Task again as a Job following prev, and fails it
+	// as the agent would.
+	fail := func(prev uuid.UUID, endTime time.Time) uuid.UUID {
+		id := uuid.NewRandom()
+		rt.Do(func(d Stores) {
+			job := &models.Job{
+				Uuid:     id,
+				Previous: prev,
+				Machine:  machine,
+				Task:     "flaky",
+				Stage:    "flaky",
+				State:    "running",
+			}
+			if _, err := rt.Create(job); err != nil {
+				t.Fatalf("Failed to create job: %v", err)
+			}
+			nm := ModelToBackend(models.Clone(rt.Find("machines", machine.String()))).(*Machine)
+			nm.CurrentJob = id
+			nm.CurrentTask = 0
+			nm.Runnable = false
+			if _, err := rt.Update(nm); err != nil {
+				t.Fatalf("Failed to update machine: %v", err)
+			}
+			failed := ModelToBackend(models.Clone(rt.Find("jobs", id.String()))).(*Job)
+			failed.State = "failed"
+			failed.ExitState = "failed"
+			failed.ExitCode = 1
+			failed.EndTime = endTime
+			if _, err := rt.Update(failed); err != nil {
+				t.Fatalf("Failed to fail job: %v", err)
+			}
+		})
+		return id
+	}
+	runnable := func(wait time.Duration) bool {
+		res := false
+		for deadline := time.Now().Add(wait); ; time.Sleep(50 * time.Millisecond) {
+			rt.Do(func(d Stores) {
+				res = AsMachine(rt.find("machines", machine.String())).Runnable
+			})
+			if res || time.Now().After(deadline) {
+				return res
+			}
+		}
+	}
+	rearm := func() {
+		rrt := dt.Request(dt.Logger, "jobs", "tasks", "machines")
+		rrt.Do(func(d Stores) { rearmRetries(rrt) })
+	}
+
+	first := fail(uuid.Parse("00000000-0000-0000-0000-000000000000"), time.Time{})
+	if runnable(0) {
+		t.Errorf("Machine should not be runnable before the backoff is over")
+	}
+	if !runnable(3 * time.Second) {
+		t.Fatalf("Machine should be runnable once the backoff is over")
+	}
+	// A retry that was pending when we stopped is started again,
+	// counting the backoff from when the Job ended.
+	second := fail(first, time.Now().Add(-time.Minute))
+	rearm()
+	if !runnable(500 * time.Millisecond) {
+		t.Fatalf("Machine should be runnable right away once a rearmed retry is overdue")
+	}
+	rt.Do(func(d Stores) {
+		if n := AsJob(rt.find("jobs", second.String())).attempts(rt, 10); n != 2 {
+			t.Errorf("Expected 2 attempts, got %d", n)
+		}
+	})
+	// The third failure uses up MaxAttempts.
+	fail(second, time.Time{})
+	rearm()
+	if runnable(1500 * time.Millisecond) {
+		t.Errorf("Machine should not be runnable once MaxAttempts is reached")
+	}
+}
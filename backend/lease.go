@@ -16,6 +16,19 @@ import (
 type Lease struct {
 	*models.Lease
 	validate
+	expired *models.Lease
+}
+
+// takeOver hands an expired lease to a new token.  The previous owner
+// is remembered so that the expiry can be recorded in the lease
+// history.
+func (l *Lease) takeOver(token, strategy string) {
+	if l.Token != token || l.Strategy != strategy {
+		prev := *l.Lease
+		l.expired = &prev
+	}
+	l.Token = token
+	l.Strategy = strategy
 }
 
 func (l *Lease) SetReadOnly(b bool) {
@@ -224,6 +237,10 @@ func (l *Lease) Validate() {
 		if leases[i].Addr.Equal(l.Addr) {
 			continue
 		}
+		// A dual-stack client can hold one lease per address family.
+		if !sameFamily(leases[i].Addr, l.Addr) {
+			continue
+		}
 		if leases[i].Token == l.Token &&
 			leases[i].Strategy == l.Strategy {
 			l.Errorf("Lease %s alreay has Strategy %s: Token %s", leases[i].Key(), l.Strategy, l.Token)
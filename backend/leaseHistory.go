@@ -0,0 +1,279 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// LeaseHistory is a persistent record of the DHCP transactions for
+// each address, kept as one JSON lines file per address.  Entries are
+// dropped once there are more than MaxEntries of them for an address,
+// or once they are older than MaxAge.  Setting MaxEntries to 0 turns
+// off recording.
+//
+// Entries are written by a background goroutine so that recording
+// never waits on the disk, and are only ever appended to a file.  A
+// file is trimmed after every MaxEntries appends, so it can briefly
+// hold more entries than are kept; History trims what it returns.
+//
+// EXPIRE entries are recorded by sweepExpired for Leases whose
+// ExpireTime has passed since the last sweep, or when an expired
+// Lease is handed to a new Token before a sweep has seen it.  Leases
+// that expired while dr-provision was not running are not recorded.
+type LeaseHistory struct {
+	MaxEntries int
+	MaxAge     time.Duration
+	root       string
+	mux        *sync.Mutex
+	appended   map[string]int
+	err        error
+	queue      chan *historyRecord
+	start      *sync.Once
+	swept      time.Time
+}
+
+// historyRecord is a queued write to the history of one address.  If
+// flushed is set, the record is a marker that is closed once every
+// record queued before it has been written.
+type historyRecord struct {
+	fileName   string
+	buf        []byte
+	maxEntries int
+	maxAge     time.Duration
+	flushed    chan struct{}
+}
+
+// NewLeaseHistory returns a LeaseHistory that keeps its files in root.
+func NewLeaseHistory(root string, maxEntries int, maxAge time.Duration) *LeaseHistory {
+	return &LeaseHistory{
+		MaxEntries: maxEntries,
+		MaxAge:     maxAge,
+		root:       root,
+		mux:        &sync.Mutex{},
+		appended:   map[string]int{},
+		queue:      make(chan *historyRecord, 1000),
+		start:      &sync.Once{},
+		swept:      time.Now(),
+	}
+}
+
+func (h *LeaseHistory) path(key string) (string, error) {
+	if key == "" || strings.Trim(key, "0123456789abcdefABCDEF") != "" {
+		return "", fmt.Errorf("Invalid lease key %s", key)
+	}
+	return filepath.Join(h.root, strings.ToLower(key)+".json"), nil
+}
+
+func (h *LeaseHistory) load(fileName string) ([]*models.LeaseHistoryEntry, error) {
+	res := []*models.LeaseHistoryEntry{}
+	fi, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		ent := &models.LeaseHistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), ent); err != nil {
+			// Skip a torn write rather than losing the whole history.
+			continue
+		}
+		res = append(res, ent)
+	}
+	return res, scanner.Err()
+}
+
+func trimHistory(ents []*models.LeaseHistoryEntry, maxEntries int, maxAge time.Duration) []*models.LeaseHistoryEntry {
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		kept := make([]*models.LeaseHistoryEntry, 0, len(ents))
+		for _, ent := range ents {
+			if !ent.Time.Before(cutoff) {
+				kept = append(kept, ent)
+			}
+		}
+		ents = kept
+	}
+	if maxEntries > 0 && len(ents) > maxEntries {
+		ents = ents[len(ents)-maxEntries:]
+	}
+	return ents
+}
+
+// rewrite replaces the file with only the entries that should be kept.
+func (h *LeaseHistory) rewrite(fileName string, maxEntries int, maxAge time.Duration) error {
+	ents, err := h.load(fileName)
+	if err != nil {
+		return err
+	}
+	kept := trimHistory(ents, maxEntries, maxAge)
+	if len(kept) == len(ents) {
+		return nil
+	}
+	out := []byte{}
+	for _, k := range kept {
+		b, _ := json.Marshal(k)
+		out = append(append(out, b...), '\n')
+	}
+	tmpName := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpName, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+func (h *LeaseHistory) write(rec *historyRecord) error {
+	if err := os.MkdirAll(h.root, 0755); err != nil {
+		return err
+	}
+	fi, err := os.OpenFile(rec.fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fi.Write(rec.buf)
+	fi.Close()
+	if err != nil {
+		return err
+	}
+	h.appended[rec.fileName]++
+	if h.appended[rec.fileName] < rec.maxEntries {
+		return nil
+	}
+	delete(h.appended, rec.fileName)
+	return h.rewrite(rec.fileName, rec.maxEntries, rec.maxAge)
+}
+
+func (h *LeaseHistory) run() {
+	for rec := range h.queue {
+		if rec.flushed != nil {
+			close(rec.flushed)
+			continue
+		}
+		h.mux.Lock()
+		if err := h.write(rec); err != nil {
+			h.err = err
+		}
+		h.mux.Unlock()
+	}
+}
+
+func (h *LeaseHistory) enqueue(rec *historyRecord, wait bool) bool {
+	h.start.Do(func() { go h.run() })
+	if wait {
+		h.queue <- rec
+		return true
+	}
+	select {
+	case h.queue <- rec:
+		return true
+	default:
+		return false
+	}
+}
+
+// Record queues an entry to be added to the history of its address.
+// It does not wait for the entry to be written, so it is safe to call
+// with backend locks held.  Errors from writing earlier entries are
+// returned by the next call.
+func (h *LeaseHistory) Record(ent *models.LeaseHistoryEntry) error {
+	if h == nil || h.MaxEntries == 0 {
+		return nil
+	}
+	if ent.Time.IsZero() {
+		ent.Time = time.Now()
+	}
+	fileName, err := h.path(models.Hexaddr(ent.Addr))
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	rec := &historyRecord{
+		fileName:   fileName,
+		buf:        append(buf, '\n'),
+		maxEntries: h.MaxEntries,
+		maxAge:     h.MaxAge,
+	}
+	if !h.enqueue(rec, false) {
+		return fmt.Errorf("Lease history queue is full, dropping %s entry for %s", ent.State, ent.Addr)
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	err, h.err = h.err, nil
+	return err
+}
+
+// History returns the recorded transactions for the lease with the
+// passed key, oldest first.
+func (h *LeaseHistory) History(key string) ([]*models.LeaseHistoryEntry, error) {
+	fileName, err := h.path(key)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure everything recorded so far is on disk.
+	flushed := make(chan struct{})
+	h.enqueue(&historyRecord{flushed: flushed}, true)
+	<-flushed
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	ents, err := h.load(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return trimHistory(ents, h.MaxEntries, h.MaxAge), nil
+}
+
+// lapsed returns whether l expired without being released, declined,
+// or invalidated, after the last sweep.
+func (h *LeaseHistory) lapsed(l *models.Lease) bool {
+	switch l.State {
+	case "EXPIRED", "FAKE", "INVALID":
+		return false
+	}
+	return l.Token != "" && l.ExpireTime.After(h.swept)
+}
+
+// sweepExpired records an EXPIRE entry for every Lease that lapsed
+// since the last sweep.  It is called periodically with the leases
+// lock held, which also guards swept.
+func (h *LeaseHistory) sweepExpired(leases []models.Model, now time.Time) {
+	if h == nil {
+		return
+	}
+	for _, i := range leases {
+		l := AsLease(i)
+		if h.lapsed(l.Lease) && !l.ExpireTime.After(now) {
+			h.recordExpire(l.Lease, nil)
+		}
+	}
+	h.swept = now
+}
+
+// recordExpire notes that a lease expired.  It is called with the
+// leases lock held, which is fine as Record does not wait on the disk.
+func (h *LeaseHistory) recordExpire(l *models.Lease, via net.IP) {
+	h.Record(&models.LeaseHistoryEntry{
+		Time:       l.ExpireTime,
+		Addr:       l.Addr,
+		State:      "EXPIRE",
+		Strategy:   l.Strategy,
+		Token:      l.Token,
+		Via:        via,
+		ExpireTime: l.ExpireTime,
+	})
+}
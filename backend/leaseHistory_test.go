@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+func TestLeaseHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease-history-")
+	if err != nil {
+		t.Fatalf("Failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	h := NewLeaseHistory(dir, 3, time.Hour)
+	addr := net.ParseIP("192.168.124.10")
+	key := models.Hexaddr(addr)
+	states := []string{"OFFER", "ACK", "RELEASE", "OFFER", "ACK"}
+	for _, state := range states {
+		if err := h.Record(&models.LeaseHistoryEntry{Addr: addr, State: state, Token: "a"}); err != nil {
+			t.Fatalf("Failed to record %s: %v", state, err)
+		}
+	}
+	ents, err := h.History(key)
+	if err != nil {
+		t.Fatalf("Failed to load history: %v", err)
+	}
+	if len(ents) != 3 || ents[0].State != "RELEASE" || ents[2].State != "ACK" {
+		t.Errorf("Expected the last 3 entries, got %d", len(ents))
+	}
+	h.Record(&models.LeaseHistoryEntry{Addr: addr, State: "NAK", Time: time.Now().Add(-2 * time.Hour)})
+	h.MaxEntries = 10
+	if ents, _ = h.History(key); len(ents) != 3 {
+		t.Errorf("Entries older than MaxAge should not be returned, got %d", len(ents))
+	}
+	if ents, err = h.History(models.Hexaddr(net.ParseIP("192.168.124.11"))); err != nil || len(ents) != 0 {
+		t.Errorf("Expected an empty history for an unused address: %v", err)
+	}
+	if _, err = h.History("../../etc/passwd"); err == nil {
+		t.Errorf("Expected an invalid key to be rejected")
+	}
+	// Files are trimmed on disk after every MaxEntries appends.
+	h.MaxEntries = 2
+	for i := 0; i < 4; i++ {
+		h.Record(&models.LeaseHistoryEntry{Addr: addr, State: "ACK", Token: "b"})
+	}
+	h.History(key)
+	fileName, _ := h.path(key)
+	if onDisk, _ := h.load(fileName); len(onDisk) != 2 {
+		t.Errorf("Expected the history file to be trimmed to 2 entries, got %d", len(onDisk))
+	}
+	h.MaxEntries = 0
+	h.Record(&models.LeaseHistoryEntry{Addr: addr, State: "ACK"})
+	h.MaxEntries = 10
+	if ents, _ = h.History(key); len(ents) != 2 {
+		t.Errorf("Nothing should be recorded when MaxEntries is 0")
+	}
+}
+
+func TestLeaseHistoryExpire(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "reservations", "leases")
+	dt.LeaseHistory.swept = time.Now().Add(-time.Minute)
+	lease := func(addr, state string, expire time.Duration) *models.Lease {
+		return &models.Lease{
+			Addr:       net.ParseIP(addr),
+			Token:      "52:54:00:aa:bb:" + addr[len(addr)-2:],
+			Strategy:   "MAC",
+			State:      state,
+			ExpireTime: time.Now().Add(expire),
+		}
+	}
+	for _, obj := range []crudTest{
+		{
+			"Expire Subnet",
+			rt.Create,
+			&models.Subnet{
+				Name:        "expire",
+				Subnet:      "10.4.0.0/24",
+				ActiveStart: net.ParseIP("10.4.0.10"),
+				ActiveEnd:   net.ParseIP("10.4.0.19"),
+				Strategy:    "MAC",
+			},
+			true,
+		},
+		{"Lapsed Lease", rt.Create, lease("10.4.0.12", "ACK", -30*time.Second), true},
+		{"Released Lease", rt.Create, lease("10.4.0.13", "EXPIRED", -30*time.Second), true},
+		{"Already Swept Lease", rt.Create, lease("10.4.0.14", "ACK", -2*time.Minute), true},
+		{"Active Lease", rt.Create, lease("10.4.0.15", "ACK", time.Hour), true},
+	} {
+		obj.Test(t, rt)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := RecordSubnetStats(rt); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	ents, err := dt.LeaseHistory.History(models.Hexaddr(net.ParseIP("10.4.0.12")))
+	if err != nil || len(ents) != 1 || ents[0].State != "EXPIRE" || ents[0].Token != "52:54:00:aa:bb:12" {
+		t.Errorf("Expected one EXPIRE entry for a lease that lapsed, got %v: %v", ents, err)
+	}
+	for _, addr := range []string{"10.4.0.13", "10.4.0.14", "10.4.0.15"} {
+		if ents, _ := dt.LeaseHistory.History(models.Hexaddr(net.ParseIP(addr))); len(ents) != 0 {
+			t.Errorf("Expected no history for %s, got %v", addr, ents)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package backend
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
@@ -25,6 +27,8 @@ type Machine struct {
 	oldBootEnv, oldStage, oldWorkflow      string
 	oldMachine                             *Machine
 	changeStageAllowed, inCreate, inRunner bool
+	// transitioned is set when FollowWorkflow rewrote the task list.
+	transitioned bool
 
 	toDeRegister, toRegister renderers
 }
@@ -48,12 +52,7 @@ func (n *Machine) SaveClean() store.KeySaver {
 }
 
 func (n *Machine) HasTask(s string) bool {
-	for _, p := range n.Tasks {
-		if p == s {
-			return true
-		}
-	}
-	return false
+	return taskListHas(n.Tasks, s)
 }
 
 func (n *Machine) Indexes() map[string]index.Maker {
@@ -499,6 +498,13 @@ func (n *Machine) Validate() {
 			case "action":
 				continue
 			case "chroot":
+			case "group":
+				group, _ := models.TaskGroup(ent)
+				for _, name := range group {
+					if tasks.Find(name) == nil {
+						n.Errorf("Task %s (in group at %d) does not exist", name, i)
+					}
+				}
 			default:
 				n.Errorf("%s (at %d) is malformed", ent, i)
 			}
@@ -563,7 +569,11 @@ func (n *Machine) BeforeSave() error {
 	return nil
 }
 func (n *Machine) AfterSave() {
-	if n.Available {
+	// Machines saved in a Sandbox must not change what the
+	// DataTracker serves or which Machine it thinks owns a MAC
+	// address.
+	sandboxed := n.rt.sandbox != nil
+	if n.Available && !sandboxed {
 		if n.toDeRegister != nil {
 			n.toDeRegister.deregister(n.rt.dt.FS)
 		}
@@ -580,6 +590,10 @@ func (n *Machine) AfterSave() {
 	n.changeStageAllowed = false
 	n.inCreate = false
 	n.inRunner = false
+	n.transitioned = false
+	if sandboxed {
+		return
+	}
 	n.rt.dt.macAddrMux.Lock()
 	for _, mac := range n.HardwareAddrs {
 		n.rt.dt.macAddrMap[mac] = n.UUID()
@@ -648,28 +662,102 @@ func (n *Machine) validateChangeWorkflow(oldm *Machine, e *models.Error) (newSta
 		return
 	}
 	n.CurrentTask = -1
-	taskList := []string{}
-	lastEnv := ""
-	firstStage := true
-	for _, stageName := range workflow.Stages {
-		stage := n.rt.find("stages", stageName).(*Stage)
-		taskList = append(taskList, "stage:"+stageName)
-		if firstStage {
-			newStage = stage.Name
+	if len(workflow.Stages) > 0 {
+		stage := n.rt.find("stages", workflow.Stages[0]).(*Stage)
+		newStage = stage.Name
+		if stage.BootEnv != "" {
+			newEnv = stage.BootEnv
+			n.BootEnv = stage.BootEnv
+		}
+	}
+	n.Tasks = workflow.tasksFrom(n.rt, 0)
+	return
+}
+
+// workflowTransition returns the first transition in the Workflow out
+// of the Stage from that matches exitState and the Machine's params.
+func (n *Machine) workflowTransition(rt *RequestTracker, w *Workflow, from, exitState string) *models.WorkflowTransition {
+	for i := range w.Transitions {
+		t := &w.Transitions[i]
+		if t.From != from {
+			continue
 		}
-		if stage.BootEnv != "" && stage.BootEnv != lastEnv {
-			if firstStage {
-				newEnv = stage.BootEnv
-				n.BootEnv = stage.BootEnv
+		if want := t.ExitState; want != exitState && !(want == "" && exitState == "complete") {
+			continue
+		}
+		matched := true
+		for k, v := range t.Params {
+			have, ok := rt.GetParam(n, k, true, false)
+			if !ok {
+				matched = false
+				break
+			}
+			// Compare the JSON forms, so that numbers match no
+			// matter how they were decoded.
+			hb, herr := json.Marshal(have)
+			vb, verr := json.Marshal(v)
+			if herr != nil || verr != nil || !bytes.Equal(hb, vb) {
+				matched = false
+				break
 			}
-			taskList = append(taskList, "bootenv:"+stage.BootEnv)
-			lastEnv = stage.BootEnv
 		}
-		taskList = append(taskList, stage.Tasks...)
-		firstStage = false
+		if matched {
+			return t
+		}
+	}
+	return nil
+}
+
+// StageBefore returns the Stage that the entries in the task list
+// just before index at belong to, or "" if there is none.
+func (n *Machine) StageBefore(at int) string {
+	if at > len(n.Tasks) {
+		at = len(n.Tasks)
+	}
+	for i := at - 1; i >= 0; i-- {
+		if strings.HasPrefix(n.Tasks[i], "stage:") {
+			return strings.TrimPrefix(n.Tasks[i], "stage:")
+		}
+	}
+	return ""
+}
+
+// FollowWorkflow is called when a Machine running a Workflow is about
+// to move past the entry at index at in its task list, which is either
+// the start of the next Stage or the end of the list.  exitState is
+// "complete" if the Stage the Machine is leaving finished, or "failed"
+// if a Task in it failed.  If a transition in the Workflow out of that
+// Stage matches, everything in the task list from at on is replaced
+// with the Tasks for the Stage the transition goes to, and
+// FollowWorkflow returns true.  Saving the Machine afterwards is up to
+// the caller.
+func (n *Machine) FollowWorkflow(rt *RequestTracker, at int, exitState string) bool {
+	if n.Workflow == "" || at > len(n.Tasks) {
+		return false
+	}
+	from := n.StageBefore(at)
+	if from == "" {
+		return false
+	}
+	obj := rt.find("workflows", n.Workflow)
+	if obj == nil {
+		return false
+	}
+	w := AsWorkflow(obj)
+	t := n.workflowTransition(rt, w, from, exitState)
+	if t == nil || (t.To != "" && w.stageIndex(t.To) == -1) {
+		return false
+	}
+	taskList := append([]string{}, n.Tasks[:at]...)
+	if t.To == "" {
+		rt.Infof("Machine %s: Workflow %s ends after %s Stage %s", n.UUID(), w.Name, exitState, from)
+	} else {
+		rt.Infof("Machine %s: Workflow %s going from %s Stage %s to %s", n.UUID(), w.Name, exitState, from, t.To)
+		taskList = append(taskList, w.tasksFrom(rt, w.stageIndex(t.To))...)
 	}
 	n.Tasks = taskList
-	return
+	n.transitioned = true
+	return true
 }
 
 func (n *Machine) validateChangeStage(oldm *Machine, e *models.Error) {
@@ -835,6 +923,11 @@ func (n *Machine) OnChange(oldThing store.KeySaver) error {
 	if e.ContainsError() {
 		return e
 	}
+	if n.transitioned {
+		// The Workflow rewrote the task list, and the runner
+		// moves along it.
+		return e.HasError()
+	}
 	if (n.Workflow != "" && n.Workflow == oldm.Workflow) ||
 		(n.Workflow == "" && n.Stage == oldm.Stage) {
 		if oldm.CurrentTask == n.CurrentTask {
@@ -862,10 +955,14 @@ func (n *Machine) OnChange(oldThing store.KeySaver) error {
 
 func (n *Machine) AfterDelete() {
 	e := &models.Error{}
-	if b := n.rt.stores("bootenvs").Find(n.BootEnv); b != nil {
+	sandboxed := n.rt.sandbox != nil
+	if n.rt.dt.bootFetches != nil && !sandboxed {
+		n.rt.dt.bootFetches.forget(n.UUID())
+	}
+	if b := n.rt.stores("bootenvs").Find(n.BootEnv); b != nil && !sandboxed {
 		AsBootEnv(b).render(n.rt, n, e).deregister(n.rt.dt.FS)
 	}
-	if s := n.rt.stores("stages").Find(n.Stage); s != nil {
+	if s := n.rt.stores("stages").Find(n.Stage); s != nil && !sandboxed {
 		AsStage(s).render(n.rt, n, e).deregister(n.rt.dt.FS)
 	}
 	if j := n.rt.stores("jobs").Find(n.CurrentJob.String()); j != nil {
@@ -873,6 +970,9 @@ func (n *Machine) AfterDelete() {
 		job.Current = false
 		n.rt.Save(job)
 	}
+	if sandboxed {
+		return
+	}
 	n.rt.dt.macAddrMux.Lock()
 	for _, mac := range n.HardwareAddrs {
 		if v, ok := n.rt.dt.macAddrMap[mac]; ok && v == n.UUID() {
@@ -0,0 +1,44 @@
+package backend
+
+// PxeLoader is the boot file dr-provision hands out by default to
+// net booting clients of some architectures, as identified by DHCP
+// option 93 (RFC 4578).
+type PxeLoader struct {
+	// Name is a short name for the loader.
+	Name string
+	// File is the path of the loader on the TFTP and static file
+	// servers.
+	File string
+	// Arch is the BootEnv architecture whose Loader or HttpLoader is
+	// used instead of File, if the BootEnv sets one.
+	Arch string
+	// Http is true if the clients are UEFI firmware that HTTP Boots
+	// directly, and should be given a URL for the loader.
+	Http bool
+	// Arches are the option 93 values of the clients.
+	Arches []uint16
+}
+
+// PxeLoaders lists every client architecture dr-provision can net
+// boot, along with the loader it hands out to each one.  Clients that
+// do not send option 93 are treated as legacy BIOS clients.
+var PxeLoaders = []*PxeLoader{
+	{Name: "bios", File: "lpxelinux.0", Arches: []uint16{0}},
+	{Name: "efi64", File: "ipxe.efi", Arch: "amd64", Arches: []uint16{7, 9}},
+	{Name: "efi64-http", File: "ipxe.efi", Arch: "amd64", Http: true, Arches: []uint16{16}},
+	{Name: "arm64", File: "ipxe-arm64.efi", Arch: "arm64", Arches: []uint16{11}},
+	{Name: "arm64-http", File: "ipxe-arm64.efi", Arch: "arm64", Http: true, Arches: []uint16{19}},
+}
+
+// PxeLoaderFor returns the PxeLoader for clients of the passed
+// architecture, or nil if dr-provision cannot net boot them.
+func PxeLoaderFor(arch uint16) *PxeLoader {
+	for _, l := range PxeLoaders {
+		for _, a := range l.Arches {
+			if a == arch {
+				return l
+			}
+		}
+	}
+	return nil
+}
@@ -97,6 +97,7 @@ func newRenderedTemplate(r *RenderData,
 	}
 	targetPrefix := r.target.Prefix()
 	dt := r.rt.dt
+	overrides := r.overrides
 	return renderer{
 		path: path,
 		name: tmplKey,
@@ -111,7 +112,7 @@ func newRenderedTemplate(r *RenderData,
 				"profiles",
 				"params",
 				"preferences")
-			rd := &RenderData{rt: rt}
+			rd := &RenderData{rt: rt, overrides: overrides}
 			rd.rt.Do(func(d Stores) {
 				for i, prefix := range prefixes {
 					item := rd.rt.find(prefix, keys[i])
@@ -468,6 +469,9 @@ type RenderData struct {
 	target            renderable
 	tmplKey, tmplPath string
 	remoteIP          net.IP
+	// overrides are param values that take precedence over the
+	// Machine's when previewing templates.
+	overrides map[string]interface{}
 }
 
 func (r *RenderData) fetchRepos(test func(*Repo) bool) (res []*Repo) {
@@ -691,6 +695,7 @@ func (r *RenderData) GenerateToken() string {
 			AddRawClaim("jobs", "update", r.Machine.Key()).
 			AddRawClaim("jobs", "actions", r.Machine.Key()).
 			AddRawClaim("jobs", "log", r.Machine.Key()).
+			AddRawClaim("jobs", "cancel", r.Machine.Key()).
 			AddRawClaim("tasks", "get", "*").
 			AddRawClaim("info", "get", "*").
 			AddRawClaim("events", "post", "*").
@@ -815,6 +820,9 @@ func (r *RenderData) ParseUrl(segment, rawUrl string) (string, error) {
 
 // Param is a helper function for extracting a parameter from Machine.Params
 func (r *RenderData) Param(key string) (interface{}, error) {
+	if v, ok := r.overrides[key]; ok {
+		return v, nil
+	}
 	if r.Machine != nil {
 		v, ok := r.rt.GetParam(r.Machine, key, true, r.Task != nil)
 		if ok {
@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// RenderPreview renders the templates of the BootEnv, Stage, or Task
+// named in p for the Machine with the passed UUID, the same way they
+// would be rendered if the Machine were moved into it, and fills in
+// p.Templates and p.Errors.  The Machine is not changed and nothing is
+// registered with the file server.  The returned error is only for
+// problems with the request itself, such as a missing Machine.
+func RenderPreview(rt *RequestTracker, uuid string, p *models.RenderPreview) error {
+	res := &models.Error{
+		Type:  "POST",
+		Code:  http.StatusBadRequest,
+		Model: "machines",
+		Key:   uuid,
+	}
+	prefix, name := "", ""
+	for _, t := range []struct{ prefix, name string }{
+		{"bootenvs", p.BootEnv},
+		{"stages", p.Stage},
+		{"tasks", p.Task},
+	} {
+		if t.name == "" {
+			continue
+		}
+		if prefix != "" {
+			res.Errorf("Only one of BootEnv, Stage, or Task may be rendered at a time")
+			return res
+		}
+		prefix, name = t.prefix, t.name
+	}
+	if prefix == "" {
+		res.Errorf("One of BootEnv, Stage, or Task must be set")
+		return res
+	}
+	p.Templates = []*models.RenderedTemplate{}
+	p.Errors = []string{}
+	var rts renderers
+	var addr net.IP
+	rt.Do(func(d Stores) {
+		mo := d("machines").Find(uuid)
+		if mo == nil {
+			res.Code = http.StatusNotFound
+			res.Errorf("Not Found")
+			return
+		}
+		m := AsMachine(mo)
+		to := d(prefix).Find(name)
+		if to == nil {
+			res.Code = http.StatusNotFound
+			res.Errorf("%s %s does not exist", prefix, name)
+			return
+		}
+		target := to.(renderable)
+		if v, ok := to.(models.Validator); ok && !v.IsAvailable() {
+			res.Code = http.StatusUnprocessableEntity
+			res.Errorf("%s %s is not available", prefix, name)
+			if err := v.HasError(); err != nil {
+				res.AddError(err)
+			}
+			return
+		}
+		e := &models.Error{}
+		r := newRenderData(rt, m, target)
+		r.overrides = p.Params
+		if env, ok := target.(*BootEnv); ok {
+			rts = env.renderWith(r, e)
+		} else {
+			rts = r.makeRenderers(e)
+		}
+		p.Errors = append(p.Errors, e.Messages...)
+		addr = m.Address
+	})
+	if res.ContainsError() {
+		return res
+	}
+	for _, r := range rts {
+		tmpl := &models.RenderedTemplate{Name: r.name, Path: r.path, Meta: r.meta}
+		rr, err := writePanicSafe(r.name, r.write, addr)
+		if err == nil {
+			var buf []byte
+			if buf, err = ioutil.ReadAll(rr); err == nil {
+				tmpl.Content = string(buf)
+			}
+		}
+		if err != nil {
+			tmpl.Error = err.Error()
+			p.Errors = append(p.Errors, fmt.Sprintf("Error rendering template %s: %v", r.name, err))
+		}
+		p.Templates = append(p.Templates, tmpl)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestRenderPreview(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger,
+		"stages",
+		"bootenvs",
+		"templates",
+		"machines",
+		"profiles",
+		"params",
+		"tasks",
+		"preferences",
+		"workflows")
+	id := uuid.NewRandom()
+	for _, obj := range []crudTest{
+		{"Create preview template", rt.Create, &models.Template{ID: "preview", Contents: `Name = {{.Machine.Name}} Foo = {{.Param "foo"}}`}, true},
+		{"Create preview bootenv", rt.Create, &models.BootEnv{
+			Name:           "preview",
+			RequiredParams: []string{"needed"},
+			Templates: []models.TemplateInfo{
+				{Name: "kickstart", Path: "machines/{{.Machine.UUID}}/ks", ID: "preview"},
+			},
+		}, true},
+		{"Create machine", rt.Create, &models.Machine{Uuid: id, Name: "preview.fqdn", Params: map[string]interface{}{"foo": "bar"}}, true},
+	} {
+		obj.Test(t, rt)
+	}
+
+	p := &models.RenderPreview{BootEnv: "preview"}
+	if err := RenderPreview(rt, id.String(), p); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(p.Errors) != 1 || !strings.Contains(p.Errors[0], "needed") {
+		t.Errorf("Expected a missing param error for needed, got %v", p.Errors)
+	}
+	if len(p.Templates) != 1 {
+		t.Fatalf("Expected 1 rendered template, got %d", len(p.Templates))
+	}
+	if tmpl := p.Templates[0]; tmpl.Path != "/machines/"+id.String()+"/ks" || tmpl.Content != "Name = preview.fqdn Foo = bar" {
+		t.Errorf("Unexpected rendered template %s: %q", tmpl.Path, tmpl.Content)
+	}
+
+	p = &models.RenderPreview{BootEnv: "preview", Params: map[string]interface{}{"foo": "baz", "needed": true}}
+	if err := RenderPreview(rt, id.String(), p); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(p.Errors) != 0 {
+		t.Errorf("Expected no errors with overrides, got %v", p.Errors)
+	}
+	if len(p.Templates) != 1 || p.Templates[0].Content != "Name = preview.fqdn Foo = baz" {
+		t.Errorf("Overridden param was not used: %v", p.Templates)
+	}
+
+	var m *Machine
+	rt.Do(func(d Stores) {
+		m = AsMachine(d("machines").Find(id.String()))
+	})
+	if m.BootEnv == "preview" || m.Params["foo"] != "bar" {
+		t.Errorf("Rendering a preview changed the machine")
+	}
+	dt.FS.Lock()
+	_, registered := dt.FS.dynamicFiles["/machines/"+id.String()+"/ks"]
+	dt.FS.Unlock()
+	if registered {
+		t.Errorf("Rendering a preview registered a dynamic file")
+	}
+
+	for _, test := range []struct {
+		name string
+		uuid string
+		p    *models.RenderPreview
+		code int
+	}{
+		{"nothing to render", id.String(), &models.RenderPreview{}, 400},
+		{"two things to render", id.String(), &models.RenderPreview{BootEnv: "preview", Stage: "none"}, 400},
+		{"missing bootenv", id.String(), &models.RenderPreview{BootEnv: "missing"}, 404},
+		{"missing machine", uuid.NewRandom().String(), &models.RenderPreview{BootEnv: "preview"}, 404},
+	} {
+		err := RenderPreview(rt, test.uuid, test.p)
+		if err == nil || err.(*models.Error).Code != test.code {
+			t.Errorf("%s: expected a %d error, got %v", test.name, test.code, err)
+		}
+	}
+}
@@ -37,6 +37,9 @@ type RequestTracker struct {
 	// This is used by the publish system to prevent dead locks.
 	// The d Stores are assumed to be NOT locked and not Present.
 	toPublishAfter []func()
+	// sandbox is set for RequestTrackers that must not change
+	// the real data.
+	sandbox *Sandbox
 }
 
 func (rt *RequestTracker) unlocker(u func()) {
@@ -96,7 +99,7 @@ func (p *DataTracker) Request(l logger.Logger, locks ...string) *RequestTracker
 func (rt *RequestTracker) PublishEvent(e *models.Event) error {
 	rt.Lock()
 	defer rt.Unlock()
-	if rt.dt.publishers == nil {
+	if rt.dt.publishers == nil || rt.sandbox != nil {
 		return nil
 	}
 	e.Principal = rt.Principal()
@@ -122,7 +125,7 @@ func (rt *RequestTracker) Publish(prefix, action, key string, ref interface{}) e
 func (rt *RequestTracker) PublishExt(prefix, action, key string, ref, target interface{}) error {
 	rt.Lock()
 	defer rt.Unlock()
-	if rt.dt.publishers == nil {
+	if rt.dt.publishers == nil || rt.sandbox != nil {
 		return nil
 	}
 	if rt.d == nil {
@@ -219,7 +222,13 @@ func (rt *RequestTracker) Do(thunk func(Stores)) {
 		rt.Unlock()
 		rt.Panicf("Recursive lock of request tracker!")
 	}
-	d, unlocker := rt.dt.lockEnts(rt.locks...)
+	var d Stores
+	var unlocker func()
+	if rt.sandbox != nil {
+		d, unlocker = rt.sandbox.lockEnts(rt.locks...)
+	} else {
+		d, unlocker = rt.dt.lockEnts(rt.locks...)
+	}
 	rt.d = d
 	rt.Unlock()
 	defer rt.unlocker(unlocker)
@@ -232,6 +241,10 @@ func (rt *RequestTracker) Do(thunk func(Stores)) {
 // It is assumed that is as lamdba function.
 func (rt *RequestTracker) AllLocked(thunk func(Stores)) {
 	rt.Lock()
+	if rt.sandbox != nil {
+		rt.Unlock()
+		rt.Panicf("AllLocked is not supported in a Sandbox")
+	}
 	d, unlocker := rt.dt.lockAll()
 	rt.d = d
 	rt.Unlock()
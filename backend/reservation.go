@@ -213,6 +213,10 @@ func (r *Reservation) OnCreate() error {
 			reservations[i].Strategy == r.Strategy) {
 			continue
 		}
+		// A dual-stack client can hold one reservation per address family.
+		if !sameFamily(reservations[i].Addr, r.Addr) {
+			continue
+		}
 		if !r.Scoped {
 			r.Errorf("Reservation %s already has Strategy %s: Token %s", reservations[i].Key(), r.Strategy, r.Token)
 			continue
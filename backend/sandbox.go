@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"log"
+	"sync"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	"github.com/digitalrebar/store"
+)
+
+// Sandbox is a scratch copy of the objects in a DataTracker.  A
+// RequestTracker made from a Sandbox starts out seeing the same
+// objects as the DataTracker, but anything it creates, saves, or
+// removes only changes the copy in the Sandbox.  Nothing is written
+// to the backing stores, and no events are published.  Sandboxes are
+// used to see what would happen without making it happen, such as
+// when simulating a DHCP request.
+type Sandbox struct {
+	dt   *DataTracker
+	mux  *sync.Mutex
+	objs map[string]*Store
+}
+
+// Sandbox returns a new, empty Sandbox for the DataTracker.  Objects
+// are copied in from the DataTracker the first time they are locked.
+func (p *DataTracker) Sandbox() *Sandbox {
+	return &Sandbox{dt: p, mux: &sync.Mutex{}, objs: map[string]*Store{}}
+}
+
+// Request initializes a RequestTracker that works against the Sandbox.
+func (s *Sandbox) Request(l logger.Logger, locks ...string) *RequestTracker {
+	rt := s.dt.Request(l, locks...)
+	rt.sandbox = s
+	return rt
+}
+
+// lockEnts copies any of ents that are not already in the Sandbox
+// from the DataTracker, and returns the Sandbox copies.  The whole
+// Sandbox stays locked until the returned unlocker is called.
+func (s *Sandbox) lockEnts(ents ...string) (Stores, func()) {
+	s.mux.Lock()
+	missing := []string{}
+	for _, ent := range ents {
+		if _, ok := s.objs[ent]; !ok {
+			missing = append(missing, ent)
+		}
+	}
+	if len(missing) > 0 {
+		mem, _ := store.Open("memory:///")
+		d, unlocker := s.dt.lockEnts(missing...)
+		for _, ent := range missing {
+			items := d(ent).Items()
+			copies := make([]models.Model, len(items))
+			for i := range items {
+				obj := ModelToBackend(models.Clone(items[i]))
+				if sub, ok := obj.(*Subnet); ok {
+					sub.nextLeasableIP = AsSubnet(items[i]).nextLeasableIP
+				}
+				copies[i] = obj
+			}
+			bk, _ := mem.MakeSub(ent)
+			s.objs[ent] = &Store{Index: *index.Create(copies), backingStore: bk}
+		}
+		unlocker()
+	}
+	return func(ref string) *Store {
+		res, ok := s.objs[ref]
+		if !ok {
+			log.Panicf("Tried to access unlocked resource %s", ref)
+		}
+		return res
+	}, s.mux.Unlock
+}
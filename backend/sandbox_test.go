@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/pborman/uuid"
+)
+
+func TestSandbox(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "leases", "reservations")
+	subnet := crudTest{
+		"Create Subnet",
+		rt.Create,
+		&models.Subnet{
+			Enabled:           true,
+			Name:              "test",
+			Subnet:            "192.168.124.0/24",
+			ActiveStart:       net.ParseIP("192.168.124.80"),
+			ActiveEnd:         net.ParseIP("192.168.124.81"),
+			ActiveLeaseTime:   60,
+			ReservedLeaseTime: 7200,
+			Strategy:          "mac",
+		},
+		true,
+	}
+	subnet.Test(t, rt)
+	via := net.ParseIP("192.168.124.1")
+	live := ltc{"Create a live lease", "mac", "a", nil, via, true, net.ParseIP("192.168.124.80")}
+	live.test(t, rt)
+
+	sb := dt.Sandbox()
+	srt := sb.Request(dt.Logger, "subnets", "leases", "reservations")
+	for _, obj := range []ltc{
+		{"Sandbox sees the live lease", "mac", "a", nil, via, true, net.ParseIP("192.168.124.80")},
+		{"Create a sandbox lease", "mac", "b", nil, via, true, net.ParseIP("192.168.124.81")},
+		{"Sandbox remembers its own leases", "mac", "c", nil, via, false, nil},
+	} {
+		obj.test(t, srt)
+	}
+	rt.Do(func(d Stores) {
+		if l := rt.find("leases", models.Hexaddr(net.ParseIP("192.168.124.81"))); l != nil {
+			t.Errorf("Lease created in the Sandbox leaked into the DataTracker")
+		}
+		if len(d("leases").Items()) != 1 {
+			t.Errorf("Expected 1 live lease, got %d", len(d("leases").Items()))
+		}
+	})
+	next := ltc{"Live allocation ignores the Sandbox", "mac", "b", nil, via, true, net.ParseIP("192.168.124.81")}
+	next.test(t, rt)
+}
+
+// TestSandboxMachine checks that saving a Machine in a Sandbox, as
+// checkMachine does when a DHCP request is simulated, does not
+// register files or MAC addresses with the DataTracker.
+func TestSandboxMachine(t *testing.T) {
+	dt := mkDT()
+	locks := []string{"stages", "bootenvs", "templates", "machines", "profiles", "params", "tasks", "preferences", "workflows"}
+	rt := dt.Request(dt.Logger, locks...)
+	id := uuid.NewRandom()
+	for _, obj := range []crudTest{
+		{"Create sandbox template", rt.Create, &models.Template{ID: "sandboxed", Contents: "{{.Machine.Address}}"}, true},
+		{"Create sandbox bootenv", rt.Create, &models.BootEnv{
+			Name: "sandboxed",
+			Templates: []models.TemplateInfo{
+				{Name: "ipxe", Path: "machines/{{.Machine.Address}}/ipxe", ID: "sandboxed"},
+			},
+		}, true},
+		{"Create machine", rt.Create, &models.Machine{
+			Uuid:          id,
+			Name:          "sandboxed.fqdn",
+			BootEnv:       "sandboxed",
+			Address:       net.ParseIP("192.168.124.10"),
+			HardwareAddrs: []string{"52:54:00:00:00:01"},
+		}, true},
+	} {
+		obj.Test(t, rt)
+	}
+
+	srt := dt.Sandbox().Request(dt.Logger, locks...)
+	srt.Do(func(d Stores) {
+		m := AsMachine(ModelToBackend(models.Clone(srt.Find("machines", id.String()))))
+		m.Address = net.ParseIP("192.168.124.11")
+		m.HardwareAddrs = append(m.HardwareAddrs, "52:54:00:00:00:02")
+		if _, err := srt.Save(m); err != nil {
+			t.Errorf("Failed to save machine in the Sandbox: %v", err)
+		}
+	})
+
+	dt.FS.Lock()
+	_, live := dt.FS.dynamicFiles["/machines/192.168.124.10/ipxe"]
+	_, sandboxed := dt.FS.dynamicFiles["/machines/192.168.124.11/ipxe"]
+	dt.FS.Unlock()
+	if !live {
+		t.Errorf("Expected the live machine to still have its file registered")
+	}
+	if sandboxed {
+		t.Errorf("Saving a machine in the Sandbox registered a dynamic file")
+	}
+	if got := dt.MacToMachineUUID("52:54:00:00:00:01"); got != id.String() {
+		t.Errorf("Expected the live MAC address to map to %s, got %q", id, got)
+	}
+	if got := dt.MacToMachineUUID("52:54:00:00:00:02"); got != "" {
+		t.Errorf("Saving a machine in the Sandbox mapped its MAC address to %q", got)
+	}
+}
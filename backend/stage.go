@@ -34,12 +34,7 @@ func (s *Stage) SaveClean() store.KeySaver {
 
 // HasTask returns true if the task name is in the Tasks list.
 func (s *Stage) HasTask(ts string) bool {
-	for _, p := range s.Tasks {
-		if p == ts {
-			return true
-		}
-	}
-	return false
+	return taskListHas(s.Tasks, ts)
 }
 
 // HasProfile returns true if the profile name is in the Profiles list.
@@ -161,8 +156,14 @@ func (s *Stage) Validate() {
 	s.renderers = renderers{}
 	// First, the stuff that must be correct in order for
 	for _, taskName := range s.Tasks {
-		if s.rt.find("tasks", taskName) == nil {
-			s.Errorf("Task %s does not exist", taskName)
+		names := []string{taskName}
+		if group, ok := models.TaskGroup(taskName); ok {
+			names = group
+		}
+		for _, name := range names {
+			if s.rt.find("tasks", name) == nil {
+				s.Errorf("Task %s does not exist", name)
+			}
 		}
 	}
 	for _, profileName := range s.Profiles {
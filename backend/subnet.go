@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -26,7 +27,7 @@ func pickMostExpired(s *Subnet, usedAddrs map[string]models.Model, token string,
 	currLeases := []*Lease{}
 	for _, obj := range usedAddrs {
 		lease, ok := obj.(*Lease)
-		if ok {
+		if ok && s.InActiveRange(lease.Addr) {
 			currLeases = append(currLeases, lease)
 		}
 	}
@@ -41,8 +42,7 @@ func pickMostExpired(s *Subnet, usedAddrs map[string]models.Model, token string,
 		}
 		// Because if how usedAddrs is built, we are guaranteed that an expired
 		// lease here is not associated with a reservation.
-		lease.Token = token
-		lease.Strategy = s.Strategy
+		lease.takeOver(token, s.Strategy)
 		return lease, false
 	}
 	return nil, true
@@ -68,8 +68,7 @@ func pickHint(s *Subnet, usedAddrs map[string]models.Model, token string, hint,
 		if lease.Expired() {
 			// We don't own this lease, but it is
 			// expired, so we can steal it.
-			lease.Token = token
-			lease.Strategy = s.Strategy
+			lease.takeOver(token, s.Strategy)
 			return lease, false
 		}
 	}
@@ -77,41 +76,52 @@ func pickHint(s *Subnet, usedAddrs map[string]models.Model, token string, hint,
 }
 
 func pickNextFree(s *Subnet, usedAddrs map[string]models.Model, token string, hint, via net.IP) (*Lease, bool) {
-	if s.nextLeasableIP == nil {
-		s.nextLeasableIP = net.IP(make([]byte, 4))
-		copy(s.nextLeasableIP, s.ActiveStart.To4())
+	ranges := s.activeRanges()
+	if len(ranges) == 0 {
+		return nil, true
+	}
+	size := len(ipBytes(ranges[0].Start))
+	first := -1
+	for i := range ranges {
+		if s.nextLeasableIP != nil && ranges[i].Contains(s.nextLeasableIP) {
+			first = i
+			break
+		}
+	}
+	if first == -1 {
+		first = 0
+		s.nextLeasableIP = net.IP(make([]byte, size))
+		copy(s.nextLeasableIP, ipBytes(ranges[0].Start))
 	}
 	one := big.NewInt(1)
 	end := &big.Int{}
 	curr := &big.Int{}
-	end.SetBytes(s.ActiveEnd.To4())
-	curr.SetBytes(s.nextLeasableIP.To4())
-	// First, check from nextLeasableIp to ActiveEnd
-	for curr.Cmp(end) < 1 {
-		addr := net.IP(curr.Bytes()).To4()
-		hex := models.Hexaddr(addr)
-		curr.Add(curr, one)
-		if _, ok := usedAddrs[hex]; !ok {
-			s.nextLeasableIP = addr
-			lease := &Lease{}
-			Fill(lease)
-			lease.Addr, lease.Token, lease.Strategy = addr, token, s.Strategy
-			return lease, false
+	// Walk each range in address order, starting at nextLeasableIP and
+	// wrapping around back to it.
+	for n := 0; n <= len(ranges); n++ {
+		r := ranges[(first+n)%len(ranges)]
+		curr.SetBytes(ipBytes(r.Start))
+		end.SetBytes(ipBytes(r.End))
+		if n == 0 {
+			curr.SetBytes(ipBytes(s.nextLeasableIP))
 		}
-	}
-	// Next, check from ActiveStart to nextLeasableIP
-	end.SetBytes(s.nextLeasableIP.To4())
-	curr.SetBytes(s.ActiveStart.To4())
-	for curr.Cmp(end) < 1 {
-		addr := net.IP(curr.Bytes()).To4()
-		hex := models.Hexaddr(addr)
-		curr.Add(curr, one)
-		if _, ok := usedAddrs[hex]; !ok {
-			s.nextLeasableIP = addr
-			lease := &Lease{}
-			Fill(lease)
-			lease.Addr, lease.Token, lease.Strategy = addr, token, s.Strategy
-			return lease, false
+		if n == len(ranges) {
+			end.SetBytes(ipBytes(s.nextLeasableIP))
+		}
+		for ; curr.Cmp(end) < 1; curr.Add(curr, one) {
+			addr := bigToIP(curr, size)
+			if x := s.exclusionFor(addr); x != nil {
+				// Skip straight to the end of the exclusion.
+				curr.SetBytes(ipBytes(x.End))
+				continue
+			}
+			if _, ok := usedAddrs[models.Hexaddr(addr)]; !ok {
+				s.nextLeasableIP = addr
+				lease := &Lease{}
+				Fill(lease)
+				lease.Addr, lease.Token, lease.Strategy = addr, token, s.Strategy
+				return lease, false
+			}
 		}
 	}
 	// No free address, but we can use the most expired one.
@@ -127,7 +137,7 @@ func pickPoint2Point(s *Subnet, usedAddrs map[string]models.Model, token string,
 		other.SetBytes(v2)
 	}
 	other = other.Xor(mask, other)
-	addr := net.IP(other.Bytes())
+	addr := bigToIP(other, len(ipBytes(via)))
 	if !s.InActiveRange(addr) {
 		return nil, true
 	}
@@ -139,6 +149,24 @@ func pickPoint2Point(s *Subnet, usedAddrs map[string]models.Model, token string,
 	return lease, false
 }
 
+// ipBytes returns the canonical byte form of an IP address: 4 bytes
+// for IPv4 addresses and 16 bytes for IPv6 addresses.
+func ipBytes(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// bigToIP converts a big.Int back into an IP address of the passed
+// length, padding it with leading zero bytes as needed.
+func bigToIP(i *big.Int, size int) net.IP {
+	b := i.Bytes()
+	res := make(net.IP, size)
+	copy(res[size-len(b):], b)
+	return res
+}
+
 var (
 	pickStrategies = map[string]picker{}
 )
@@ -460,14 +488,16 @@ func (s *Subnet) sbounds() (net.IP, net.IP) {
 	}
 	mask.SetBytes(notBits)
 	last.Or(first, mask)
-	return net.IP(first.Bytes()), net.IP(last.Bytes())
+	return bigToIP(first, len(sub.IP)), bigToIP(last, len(sub.IP))
 }
 
 func (s *Subnet) sBounds() (func(string) bool, func(string) bool) {
 	lb, ub := s.sbounds()
 	// first "address" in this range is the network address, which cannot be handed out.
+	// Keys for the other address family are never in range.
 	lower := func(key string) bool {
-		return key > models.Hexaddr(lb)
+		lk := models.Hexaddr(lb)
+		return len(key) == len(lk) && key > lk
 	}
 	// last "address" in this range is the broadcast address, which also cannot be handed out.
 	upper := func(key string) bool {
@@ -476,12 +506,82 @@ func (s *Subnet) sBounds() (func(string) bool, func(string) bool) {
 	return lower, upper
 }
 
+// activeRanges returns the active range and any Pools, sorted by
+// their first address.
+func (s *Subnet) activeRanges() []models.SubnetRange {
+	res := make([]models.SubnetRange, 0, len(s.Pools)+1)
+	if s.ActiveStart != nil && s.ActiveEnd != nil {
+		res = append(res, models.SubnetRange{Start: s.ActiveStart, End: s.ActiveEnd})
+	}
+	res = append(res, s.Pools...)
+	sort.Slice(res, func(i, j int) bool {
+		return models.Hexaddr(res[i].Start) < models.Hexaddr(res[j].Start)
+	})
+	return res
+}
+
+// ipOffset returns the IPv4 address n addresses away from ip.
+func ipOffset(ip net.IP, n int64) net.IP {
+	return ipBytes(bigToIP(new(big.Int).Add(a2i(ip), big.NewInt(n)), net.IPv6len))
+}
+
+// leasableRanges returns the active range and Pools of the Subnet
+// with its Exclusions cut out of them.
+func (s *Subnet) leasableRanges() []models.SubnetRange {
+	excl := append([]models.SubnetRange{}, s.Exclusions...)
+	sort.Slice(excl, func(i, j int) bool {
+		return bytes.Compare(excl[i].Start.To16(), excl[j].Start.To16()) < 0
+	})
+	res := []models.SubnetRange{}
+	for _, r := range s.activeRanges() {
+		cur := models.SubnetRange{Start: r.Start, End: r.End}
+		for _, ex := range excl {
+			if cur.Start == nil || !ex.Overlaps(cur) {
+				continue
+			}
+			if bytes.Compare(ex.Start.To16(), cur.Start.To16()) > 0 {
+				res = append(res, models.SubnetRange{Start: cur.Start, End: ipOffset(ex.Start, -1)})
+			}
+			if bytes.Compare(ex.End.To16(), cur.End.To16()) >= 0 {
+				cur.Start = nil
+			} else {
+				cur.Start = ipOffset(ex.End, 1)
+			}
+		}
+		if cur.Start != nil {
+			res = append(res, cur)
+		}
+	}
+	return res
+}
+
+// exclusionFor returns the Exclusion that ip falls in, if any.
+func (s *Subnet) exclusionFor(ip net.IP) *models.SubnetRange {
+	for i := range s.Exclusions {
+		if s.Exclusions[i].Contains(ip) {
+			return &s.Exclusions[i]
+		}
+	}
+	return nil
+}
+
+// aBounds returns tests for the lowest and highest address in any of
+// the Subnet's active ranges.
 func (s *Subnet) aBounds() (func(string) bool, func(string) bool) {
+	lk, uk := "", ""
+	for _, r := range s.activeRanges() {
+		if lk == "" || models.Hexaddr(r.Start) < lk {
+			lk = models.Hexaddr(r.Start)
+		}
+		if uk == "" || models.Hexaddr(r.End) > uk {
+			uk = models.Hexaddr(r.End)
+		}
+	}
 	return func(key string) bool {
-			return key >= models.Hexaddr(s.ActiveStart)
+			return lk != "" && len(key) == len(lk) && key >= lk
 		},
 		func(key string) bool {
-			return key > models.Hexaddr(s.ActiveEnd)
+			return key > uk
 		}
 }
 
@@ -503,11 +603,18 @@ func (s *Subnet) InSubnetRange(ip net.IP) bool {
 }
 
 // InActiveRange returns true if the IP is inside the
-// subnet's active range, inclusively.
+// subnet's active range or one of its Pools, inclusively, and
+// is not in one of its Exclusions.
 func (s *Subnet) InActiveRange(ip net.IP) bool {
-	lower, upper := s.aBounds()
-	hex := models.Hexaddr(ip)
-	return lower(hex) && !upper(hex)
+	if ip == nil || s.exclusionFor(ip) != nil {
+		return false
+	}
+	for _, r := range s.activeRanges() {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // LeaseTimeFor returns the lease time for the IP in question.
@@ -556,6 +663,30 @@ func (s *Subnet) Validate() {
 			s.Errorf("Picker %s is not a valid lease picking strategy", p)
 		}
 	}
+	if subnet.IP.To4() != nil {
+		s.fillV4Options(subnet)
+	}
+	s.AddError(index.CheckUnique(s, s.rt.stores("subnets").Items()))
+	s.SetValid()
+	if !s.Useable() {
+		return
+	}
+	subnets := AsSubnets(s.rt.stores("subnets").Items())
+	for i := range subnets {
+		if subnets[i].Name == s.Name {
+			continue
+		}
+		if subnets[i].subnet().Contains(s.subnet().IP) {
+			s.Errorf("Overlaps subnet %s", subnets[i].Name)
+		}
+	}
+	s.SetAvailable()
+}
+
+// fillV4Options makes sure that IPv4 subnets always hand out the
+// correct netmask and broadcast address options.  IPv6 subnets have
+// no equivalent options.
+func (s *Subnet) fillV4Options(subnet *net.IPNet) {
 	if s.Pickers[0] == "point2point" {
 		newOpts := []models.DhcpOption{}
 		for i := range s.Options {
@@ -597,21 +728,6 @@ func (s *Subnet) Validate() {
 	if needBCast {
 		s.Options = append(s.Options, models.DhcpOption{byte(dhcp.OptionBroadcastAddress), net.IP(buf).String()})
 	}
-	s.AddError(index.CheckUnique(s, s.rt.stores("subnets").Items()))
-	s.SetValid()
-	if !s.Useable() {
-		return
-	}
-	subnets := AsSubnets(s.rt.stores("subnets").Items())
-	for i := range subnets {
-		if subnets[i].Name == s.Name {
-			continue
-		}
-		if subnets[i].subnet().Contains(s.subnet().IP) {
-			s.Errorf("Overlaps subnet %s", subnets[i].Name)
-		}
-	}
-	s.SetAvailable()
 }
 
 func (s *Subnet) BeforeDelete() error {
@@ -0,0 +1,234 @@
+package backend
+
+import (
+	"math"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+)
+
+const (
+	// usageWindow is how far back SecondsToExhaustion looks.
+	usageWindow = time.Hour
+	// usageGap is the least time between two recorded samples.
+	usageGap = 30 * time.Second
+)
+
+type usageSample struct {
+	at   time.Time
+	used int64
+}
+
+// subnetUsage remembers how many addresses each Subnet had in use
+// over the last usageWindow, so that we can guess when it will run
+// out.
+type subnetUsage struct {
+	mux     *sync.Mutex
+	samples map[string][]usageSample
+}
+
+func newSubnetUsage() *subnetUsage {
+	return &subnetUsage{
+		mux:     &sync.Mutex{},
+		samples: map[string][]usageSample{},
+	}
+}
+
+// recent drops the samples that are older than usageWindow.
+func recent(samples []usageSample, now time.Time) []usageSample {
+	for len(samples) > 0 && now.Sub(samples[0].at) > usageWindow {
+		samples = samples[1:]
+	}
+	return samples
+}
+
+// exhaustion returns the number of seconds until free runs out at the
+// rate addresses have been used up since the first of samples.
+func exhaustion(samples []usageSample, now time.Time, used, free int64) int64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	first := samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 || used <= first.used {
+		return 0
+	}
+	rate := float64(used-first.used) / elapsed
+	return int64(math.Ceil(float64(free) / rate))
+}
+
+// record adds a sample for the named Subnet and returns the number
+// of seconds until it runs out of free addresses at the rate they
+// have been used up since the oldest sample we still have.
+func (u *subnetUsage) record(name string, now time.Time, used, free int64) int64 {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	samples := recent(u.samples[name], now)
+	if len(samples) == 0 || now.Sub(samples[len(samples)-1].at) >= usageGap {
+		samples = append(samples, usageSample{at: now, used: used})
+	}
+	u.samples[name] = samples
+	return exhaustion(samples, now, used, free)
+}
+
+// estimate is like record, but only looks at the samples recorded so
+// far without adding one.
+func (u *subnetUsage) estimate(name string, now time.Time, used, free int64) int64 {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return exhaustion(recent(u.samples[name], now), now, used, free)
+}
+
+// forget drops the samples of Subnets that are not in names.
+func (u *subnetUsage) forget(names map[string]bool) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	for name := range u.samples {
+		if !names[name] {
+			delete(u.samples, name)
+		}
+	}
+}
+
+// clampInt64 returns i, or the largest int64 if i is bigger than that.
+func clampInt64(i *big.Int) int64 {
+	if !i.IsInt64() {
+		return math.MaxInt64
+	}
+	return i.Int64()
+}
+
+// size returns the number of usable addresses in the Subnet.  The
+// network and broadcast addresses of IPv4 subnets are not counted.
+func (s *Subnet) size() int64 {
+	ones, bits := s.subnet().Mask.Size()
+	res := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	if bits == 32 && bits-ones > 1 {
+		res.Sub(res, big.NewInt(2))
+	}
+	return clampInt64(res)
+}
+
+// stats computes the SubnetStats of the Subnet from the leases and
+// reservations indexes.
+func (s *Subnet) stats(d Stores, now time.Time) *models.SubnetStats {
+	res := &models.SubnetStats{
+		Name:   s.Name,
+		Subnet: s.Subnet.Subnet,
+		Size:   s.size(),
+	}
+	active := !s.Proxy && !s.OnlyReservations
+	if active {
+		total := big.NewInt(0)
+		for _, r := range s.leasableRanges() {
+			total.Add(total, new(big.Int).Sub(a2i(r.End), a2i(r.Start)))
+			total.Add(total, big.NewInt(1))
+		}
+		res.ActiveSize = clampInt64(total)
+	}
+	used := map[string]bool{}
+	leases, _ := index.Subset(s.idxBounds(s.sbounds()))(&d("leases").Index)
+	for _, i := range leases.Items() {
+		l := AsLease(i)
+		// IPv4 and IPv6 lease keys can interleave in the index.
+		if l.Fake() || !s.InSubnetRange(l.Addr) {
+			continue
+		}
+		if l.ExpireTime.Before(now) {
+			res.Expired++
+			continue
+		}
+		res.Leased++
+		if active && s.InActiveRange(l.Addr) {
+			used[l.Key()] = true
+		}
+	}
+	reservations, _ := index.Subset(s.idxBounds(s.sbounds()))(&d("reservations").Index)
+	for _, i := range reservations.Items() {
+		r := AsReservation(i)
+		if !s.InSubnetRange(r.Addr) {
+			continue
+		}
+		res.Reserved++
+		if active && s.InActiveRange(r.Addr) {
+			used[r.Key()] = true
+		}
+	}
+	if res.ActiveSize > 0 {
+		inUse := int64(len(used))
+		res.Free = res.ActiveSize - inUse
+		if res.Free < 0 {
+			res.Free = 0
+		}
+		res.PercentUsed = float64(inUse) * 100 / float64(res.ActiveSize)
+	}
+	return res
+}
+
+// SubnetStats returns the SubnetStats of the named Subnets, or of all
+// of them if no names are passed.  SecondsToExhaustion is estimated
+// from the usage recorded by RecordSubnetStats.
+func SubnetStats(rt *RequestTracker, names ...string) ([]*models.SubnetStats, error) {
+	return subnetStats(rt, false, names...)
+}
+
+// RecordSubnetStats returns the SubnetStats of all the Subnets, and
+// records how many addresses each one has in use for estimating
+// SecondsToExhaustion.  It also records the Leases that have expired
+// since the last call in the lease history.  It should only be called
+// periodically.
+func RecordSubnetStats(rt *RequestTracker) ([]*models.SubnetStats, error) {
+	return subnetStats(rt, true)
+}
+
+func subnetStats(rt *RequestTracker, record bool, names ...string) ([]*models.SubnetStats, error) {
+	res := []*models.SubnetStats{}
+	var err error
+	now := time.Now()
+	rt.Do(func(d Stores) {
+		subnets := []*Subnet{}
+		if len(names) == 0 {
+			for _, i := range d("subnets").Items() {
+				subnets = append(subnets, AsSubnet(i))
+			}
+		}
+		for _, name := range names {
+			found := d("subnets").Find(name)
+			if found == nil {
+				err = &models.Error{
+					Type:     "GET",
+					Code:     404,
+					Model:    "subnets",
+					Key:      name,
+					Messages: []string{"Not Found"},
+				}
+				return
+			}
+			subnets = append(subnets, AsSubnet(found))
+		}
+		for _, s := range subnets {
+			res = append(res, s.stats(d, now))
+		}
+		if usage := rt.dt.subnetUsage; usage != nil && rt.sandbox == nil {
+			for _, st := range res {
+				if record {
+					st.SecondsToExhaustion = usage.record(st.Name, now, st.ActiveSize-st.Free, st.Free)
+				} else {
+					st.SecondsToExhaustion = usage.estimate(st.Name, now, st.ActiveSize-st.Free, st.Free)
+				}
+			}
+			if record && len(names) == 0 {
+				rt.dt.LeaseHistory.sweepExpired(d("leases").Items(), now)
+				known := map[string]bool{}
+				for _, st := range res {
+					known[st.Name] = true
+				}
+				usage.forget(known)
+			}
+		}
+	})
+	return res, err
+}
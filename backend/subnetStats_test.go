@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+func TestSubnetStats(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "reservations", "leases")
+	for _, obj := range []crudTest{
+		{
+			"Stats Subnet",
+			rt.Create,
+			&models.Subnet{
+				Name:        "stats",
+				Subnet:      "10.2.0.0/24",
+				ActiveStart: net.ParseIP("10.2.0.10"),
+				ActiveEnd:   net.ParseIP("10.2.0.19"),
+				Exclusions:  []models.SubnetRange{{Start: net.ParseIP("10.2.0.15"), End: net.ParseIP("10.2.0.15")}},
+				Strategy:    "MAC",
+			},
+			true,
+		},
+		{
+			"Active Reservation",
+			rt.Create,
+			&models.Reservation{Addr: net.ParseIP("10.2.0.11"), Token: "52:54:00:aa:bb:01", Strategy: "MAC"},
+			true,
+		},
+		{
+			"Static Reservation",
+			rt.Create,
+			&models.Reservation{Addr: net.ParseIP("10.2.0.200"), Token: "52:54:00:aa:bb:02", Strategy: "MAC"},
+			true,
+		},
+		{
+			"Active Lease",
+			rt.Create,
+			&models.Lease{Addr: net.ParseIP("10.2.0.12"), Token: "52:54:00:aa:bb:03", Strategy: "MAC", State: "ACK", ExpireTime: time.Now().Add(time.Hour)},
+			true,
+		},
+		{
+			"Expired Lease",
+			rt.Create,
+			&models.Lease{Addr: net.ParseIP("10.2.0.13"), Token: "52:54:00:aa:bb:04", Strategy: "MAC", State: "ACK", ExpireTime: time.Now().Add(-time.Hour)},
+			true,
+		},
+	} {
+		obj.Test(t, rt)
+	}
+	if _, err := SubnetStats(rt, "missing"); err == nil {
+		t.Errorf("Expected an error getting stats for a missing subnet")
+	}
+	res, err := SubnetStats(rt, "stats")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	st := res[0]
+	if st.Size != 254 || st.ActiveSize != 9 {
+		t.Errorf("Expected 254 addresses with 9 active, got %d with %d active", st.Size, st.ActiveSize)
+	}
+	if st.Leased != 1 || st.Reserved != 2 || st.Expired != 1 {
+		t.Errorf("Expected 1 leased, 2 reserved, and 1 expired, got %d, %d, and %d", st.Leased, st.Reserved, st.Expired)
+	}
+	if st.Free != 7 {
+		t.Errorf("Expected 7 free addresses, got %d", st.Free)
+	}
+	if st.PercentUsed < 22.2 || st.PercentUsed > 22.3 {
+		t.Errorf("Expected 22.2%% used, got %f", st.PercentUsed)
+	}
+	if len(rt.dt.subnetUsage.samples) != 0 {
+		t.Errorf("Getting subnet stats should not record usage samples")
+	}
+	if _, err := RecordSubnetStats(rt); err != nil || len(rt.dt.subnetUsage.samples["stats"]) != 1 {
+		t.Errorf("Expected recording subnet stats to take a usage sample: %v", err)
+	}
+}
+
+func TestSubnetUsage(t *testing.T) {
+	u := newSubnetUsage()
+	now := time.Now()
+	if left := u.record("test", now, 0, 10); left != 0 {
+		t.Errorf("Expected no estimate from one sample, got %d", left)
+	}
+	if left := u.estimate("test", now.Add(100*time.Second), 5, 5); left != 100 || len(u.samples["test"]) != 1 {
+		t.Errorf("Expected an estimate of 100 seconds left without a new sample, got %d", left)
+	}
+	if left := u.record("test", now.Add(100*time.Second), 5, 5); left != 100 {
+		t.Errorf("Expected 100 seconds left, got %d", left)
+	}
+	if left := u.record("test", now.Add(2*time.Hour), 5, 5); left != 0 {
+		t.Errorf("Expected no estimate once old samples age out, got %d", left)
+	}
+	u.forget(map[string]bool{})
+	if len(u.samples) != 0 {
+		t.Errorf("Expected forgotten subnets to be dropped")
+	}
+}
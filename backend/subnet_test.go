@@ -23,6 +23,10 @@ func TestSubnetCrud(t *testing.T) {
 		{"Create invalid Subnet(ActiveEnd out of range)", rt.Create, &models.Subnet{Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.126.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, false},
 		{"Create invalid Subnet(ActiveLeaseTime too short)", rt.Create, &models.Subnet{Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 59, ReservedLeaseTime: 7200, Strategy: "mac"}, false},
 		{"Create invalid Subnet(ReservedLeaseTime too short)", rt.Create, &models.Subnet{Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.254"), ActiveLeaseTime: 60, ReservedLeaseTime: 7199, Strategy: "mac"}, false},
+		{"Create invalid Subnet(Pool overlaps Active range)", rt.Create, &models.Subnet{Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.100"), Pools: []models.SubnetRange{{Start: net.ParseIP("192.168.125.100"), End: net.ParseIP("192.168.125.120")}}, ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, false},
+		{"Create invalid Subnet(overlapping Pools)", rt.Create, &models.Subnet{Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.100"), Pools: []models.SubnetRange{{Start: net.ParseIP("192.168.125.110"), End: net.ParseIP("192.168.125.120")}, {Start: net.ParseIP("192.168.125.115"), End: net.ParseIP("192.168.125.130")}}, ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, false},
+		{"Create invalid Subnet(Pool out of range)", rt.Create, &models.Subnet{Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.100"), Pools: []models.SubnetRange{{Start: net.ParseIP("192.168.126.10"), End: net.ParseIP("192.168.126.20")}}, ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, false},
+		{"Create invalid Subnet(swapped Exclusion endpoints)", rt.Create, &models.Subnet{Name: "test2", Subnet: "192.168.125.0/24", ActiveStart: net.ParseIP("192.168.125.80"), ActiveEnd: net.ParseIP("192.168.125.100"), Exclusions: []models.SubnetRange{{Start: net.ParseIP("192.168.125.90"), End: net.ParseIP("192.168.125.85")}}, ActiveLeaseTime: 60, ReservedLeaseTime: 7200, Strategy: "mac"}, false},
 	}
 	for _, test := range createTests {
 		test.Test(t, rt)
@@ -39,3 +43,50 @@ func TestSubnetCrud(t *testing.T) {
 		}
 	})
 }
+
+func TestSubnetPools(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "subnets", "leases", "reservations")
+	subnet := crudTest{
+		"Create Subnet with Pools and Exclusions",
+		rt.Create,
+		&models.Subnet{
+			Enabled:           true,
+			Name:              "test",
+			Subnet:            "192.168.124.0/24",
+			ActiveStart:       net.ParseIP("192.168.124.80"),
+			ActiveEnd:         net.ParseIP("192.168.124.82"),
+			Pools:             []models.SubnetRange{{Start: net.ParseIP("192.168.124.90"), End: net.ParseIP("192.168.124.90")}},
+			Exclusions:        []models.SubnetRange{{Start: net.ParseIP("192.168.124.81"), End: net.ParseIP("192.168.124.81")}},
+			ActiveLeaseTime:   60,
+			ReservedLeaseTime: 7200,
+			Strategy:          "mac",
+		},
+		true,
+	}
+	subnet.Test(t, rt)
+	via := net.ParseIP("192.168.124.1")
+	tests := []ltc{
+		{"Allocate from the Active range", "mac", "a", nil, via, true, net.ParseIP("192.168.124.80")},
+		{"Skip the Exclusion", "mac", "b", nil, via, true, net.ParseIP("192.168.124.82")},
+		{"Allocate from the Pool", "mac", "c", nil, via, true, net.ParseIP("192.168.124.90")},
+		{"Refuse when every range is full", "mac", "d", nil, via, false, nil},
+		{"Refuse a hint in the Exclusion", "mac", "e", net.ParseIP("192.168.124.81"), via, false, nil},
+	}
+	for _, obj := range tests {
+		obj.test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		s := AsSubnet(rt.find("subnets", "test"))
+		for addr, want := range map[string]bool{
+			"192.168.124.80": true,
+			"192.168.124.81": false,
+			"192.168.124.85": false,
+			"192.168.124.90": true,
+		} {
+			if s.InActiveRange(net.ParseIP(addr)) != want {
+				t.Errorf("InActiveRange(%s) should be %v", addr, want)
+			}
+		}
+	})
+}
@@ -152,6 +152,24 @@ type taskHaver interface {
 	HasTask(string) bool
 }
 
+// taskListHas returns true if the task name is in the task list,
+// either by itself or as one of the Tasks in a task group.
+func taskListHas(list []string, name string) bool {
+	for _, ent := range list {
+		if ent == name {
+			return true
+		}
+		if group, ok := models.TaskGroup(ent); ok {
+			for _, member := range group {
+				if member == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 // BeforeDelete makes sure that the task is not referenced before deleteing.
 func (t *Task) BeforeDelete() error {
 	e := &models.Error{Code: 409, Type: StillInUseError, Model: t.Prefix(), Key: t.Key()}
@@ -30,6 +30,10 @@ func TestTaskCrud(t *testing.T) {
 		{"Create Task with invalid models.TemplateInfo (invalid Path)", rt.Create, &models.Task{Name: "test 3", Templates: []models.TemplateInfo{{Name: "test 3", Path: "{{ .Env.Name }", ID: "ok"}}}, false},
 		{"Create Task with valid models.TemplateInfo (not available}", rt.Create, &models.Task{Name: "test 3", Templates: []models.TemplateInfo{{Name: "unavailable", Path: "{{ .Env.Name }}", ID: "ok"}}}, true},
 		{"Create Task with valid models.TemplateInfo (available)", rt.Create, &models.Task{Name: "available", Templates: []models.TemplateInfo{{Name: "ipxe", Path: "{{ .Env.Name }}", ID: "ok"}}}, true},
+		{"Create Task with Retry and no MaxAttempts", rt.Create, &models.Task{Name: "retry", Retry: &models.TaskRetry{}}, false},
+		{"Create Task with Retry and negative Backoff", rt.Create, &models.Task{Name: "retry", Retry: &models.TaskRetry{MaxAttempts: 3, Backoff: -1}}, false},
+		{"Create Task with Retry and invalid ExitCode", rt.Create, &models.Task{Name: "retry", Retry: &models.TaskRetry{MaxAttempts: 3, ExitCodes: []int{0}}}, false},
+		{"Create Task with negative Timeout", rt.Create, &models.Task{Name: "timeout", Timeout: -1}, false},
 	}
 
 	for _, test := range tests {
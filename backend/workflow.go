@@ -99,9 +99,94 @@ func (w *Workflow) Validate() {
 			w.Errorf("Stage %s is not available", stageName)
 		}
 	}
+	w.validateTransitions()
 	w.SetAvailable()
 }
 
+// stageIndex returns the index of the first occurrence of stage in
+// the Workflow's Stages, or -1 if it is not there.
+func (w *Workflow) stageIndex(stage string) int {
+	for i, name := range w.Stages {
+		if name == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// validateTransitions makes sure that the Transitions only refer to
+// Stages in the Workflow, and that every Stage in the Workflow can
+// be reached from the first one.
+func (w *Workflow) validateTransitions() {
+	if len(w.Transitions) == 0 {
+		return
+	}
+	for i, t := range w.Transitions {
+		if w.stageIndex(t.From) == -1 {
+			w.Errorf("Transition %d is from Stage %s, which is not in the Workflow", i, t.From)
+		}
+		if t.To != "" && w.stageIndex(t.To) == -1 {
+			w.Errorf("Transition %d is to Stage %s, which is not in the Workflow", i, t.To)
+		}
+	}
+	if len(w.Stages) == 0 {
+		return
+	}
+	reached := make([]bool, len(w.Stages))
+	todo := []int{0}
+	for len(todo) > 0 {
+		i := todo[0]
+		todo = todo[1:]
+		if reached[i] {
+			continue
+		}
+		reached[i] = true
+		// Once an unconditional transition is seen, no later
+		// transition for a finished Stage can be taken, and neither
+		// can the next Stage in the list.
+		shadowed := false
+		for _, t := range w.Transitions {
+			if t.From != w.Stages[i] {
+				continue
+			}
+			if t.ExitState != "failed" {
+				if shadowed {
+					continue
+				}
+				shadowed = t.Unconditional()
+			}
+			if to := w.stageIndex(t.To); to != -1 {
+				todo = append(todo, to)
+			}
+		}
+		if !shadowed && i+1 < len(w.Stages) {
+			todo = append(todo, i+1)
+		}
+	}
+	for i, ok := range reached {
+		if !ok {
+			w.Errorf("Stage %s at position %d can never be reached", w.Stages[i], i)
+		}
+	}
+}
+
+// tasksFrom returns the task list a Machine needs to run the Workflow
+// from the Stage at index start to the end.
+func (w *Workflow) tasksFrom(rt *RequestTracker, start int) []string {
+	taskList := []string{}
+	lastEnv := ""
+	for _, stageName := range w.Stages[start:] {
+		stage := rt.find("stages", stageName).(*Stage)
+		taskList = append(taskList, "stage:"+stageName)
+		if stage.BootEnv != "" && stage.BootEnv != lastEnv {
+			taskList = append(taskList, "bootenv:"+stage.BootEnv)
+			lastEnv = stage.BootEnv
+		}
+		taskList = append(taskList, stage.Tasks...)
+	}
+	return taskList
+}
+
 // BeforeSave validates the state of the Workflow.
 // This is used generally before saving but also
 // when an object needs to initialized and
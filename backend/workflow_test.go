@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/digitalrebar/provision/models"
@@ -22,3 +23,92 @@ func TestWorkflowCrud(t *testing.T) {
 		test.Test(t, rt)
 	}
 }
+
+func TestWorkflowTransitions(t *testing.T) {
+	dt := mkDT()
+	rt := dt.Request(dt.Logger, "stages", "bootenvs", "templates", "tasks", "machines", "profiles", "params", "workflows")
+	tests := []crudTest{
+		{"Create Stage a", rt.Create, &models.Stage{Name: "a"}, true},
+		{"Create Stage b", rt.Create, &models.Stage{Name: "b"}, true},
+		{"Create Stage c", rt.Create, &models.Stage{Name: "c"}, true},
+		{"Create Workflow with bad ExitState", rt.Create, &models.Workflow{
+			Name:        "badexit",
+			Stages:      []string{"a", "b"},
+			Transitions: []models.WorkflowTransition{{From: "a", To: "b", ExitState: "bogus"}},
+		}, false},
+		{"Create Workflow with bad transition Stage name", rt.Create, &models.Workflow{
+			Name:        "badname",
+			Stages:      []string{"a", "b"},
+			Transitions: []models.WorkflowTransition{{From: "a/b", To: "b"}},
+		}, false},
+		{"Create Workflow with transition to missing Stage", rt.Create, &models.Workflow{
+			Name:        "missingto",
+			Stages:      []string{"a", "b"},
+			Transitions: []models.WorkflowTransition{{From: "a", To: "c", ExitState: "failed"}},
+		}, true},
+		{"Create Workflow with unreachable Stage", rt.Create, &models.Workflow{
+			Name:        "unreachable",
+			Stages:      []string{"a", "b", "c"},
+			Transitions: []models.WorkflowTransition{{From: "a", To: "c"}},
+		}, true},
+		{"Create Workflow with branches", rt.Create, &models.Workflow{
+			Name:   "branches",
+			Stages: []string{"a", "b", "c"},
+			Transitions: []models.WorkflowTransition{
+				{From: "a", To: "c", Params: map[string]interface{}{"skip-b": true}},
+				{From: "a", ExitState: "failed"},
+				{From: "b", To: "a", ExitState: "failed"},
+			},
+		}, true},
+	}
+	for _, test := range tests {
+		test.Test(t, rt)
+	}
+	rt.Do(func(d Stores) {
+		for name, available := range map[string]bool{
+			"missingto":   false,
+			"unreachable": false,
+			"branches":    true,
+		} {
+			w := AsWorkflow(d("workflows").Find(name))
+			if w.Available != available {
+				t.Errorf("Workflow %s: expected Available to be %v, got %v (%v)", name, available, w.Available, w.Errors)
+			}
+		}
+		tasks := []string{"stage:a", "stage:b", "stage:c"}
+		for _, test := range []struct {
+			name      string
+			params    map[string]interface{}
+			at        int
+			exitState string
+			followed  bool
+			tasks     []string
+		}{
+			{"finished a", nil, 1, "complete", false, tasks},
+			{"finished a with skip-b", map[string]interface{}{"skip-b": true}, 1, "complete", true, []string{"stage:a", "stage:c"}},
+			{"finished a with skip-b false", map[string]interface{}{"skip-b": false}, 1, "complete", false, tasks},
+			{"failed in a", nil, 1, "failed", true, []string{"stage:a"}},
+			{"failed in b", nil, 2, "failed", true, []string{"stage:a", "stage:b", "stage:a", "stage:b", "stage:c"}},
+			{"finished c", nil, 3, "complete", false, tasks},
+		} {
+			m := &Machine{Machine: &models.Machine{
+				Workflow: "branches",
+				Params:   test.params,
+				Tasks:    append([]string{}, tasks...),
+			}}
+			followed := m.FollowWorkflow(rt, test.at, test.exitState)
+			if followed != test.followed {
+				t.Errorf("%s: expected FollowWorkflow to return %v, got %v", test.name, test.followed, followed)
+			}
+			if strings.Join(m.Tasks, ",") != strings.Join(test.tasks, ",") {
+				t.Errorf("%s: expected tasks %v, got %v", test.name, test.tasks, m.Tasks)
+			}
+		}
+		m := &Machine{Machine: &models.Machine{Tasks: []string{"stage:a", "bootenv:local", "task1", "stage:b"}}}
+		for at, stage := range map[int]string{0: "", 1: "a", 3: "a", 4: "b", 9: "b"} {
+			if got := m.StageBefore(at); got != stage {
+				t.Errorf("StageBefore(%d): expected %q, got %q", at, stage, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/digitalrebar/provision/models"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	addRegistrar(registerDhcp)
+}
+
+func registerDhcp(app *cobra.Command) {
+	tree := addDhcpCommands()
+	app.AddCommand(tree)
+}
+
+func addDhcpCommands() (res *cobra.Command) {
+	name := "dhcp"
+	res = &cobra.Command{
+		Use:   name,
+		Short: fmt.Sprintf("Access CLI commands relating to %v", name),
+	}
+	sim := &models.DhcpSimulation{}
+	var arch int
+	var relay, requested, packet string
+	simCmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Simulate a DHCP request without changing anything",
+		Long: `Runs a DHCP request through the DHCP server in dry-run mode.
+The request is either built from the flags, or is a packet captured
+from the DHCP server debug log passed with --packet.  No Leases are
+committed and nothing is sent over the network.  The reply packets
+are printed along with the Subnet, Reservation, BootEnv, and boot
+file the server picked.`,
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			if packet != "" {
+				var buf []byte
+				var err error
+				if packet == "-" {
+					buf, err = ioutil.ReadAll(os.Stdin)
+				} else {
+					buf, err = ioutil.ReadFile(packet)
+				}
+				if err != nil {
+					return fmt.Errorf("Error reading packet: %v", err)
+				}
+				sim.Packet = string(buf)
+			} else if sim.Mac == "" {
+				return fmt.Errorf("%v requires --mac or --packet", c.UseLine())
+			}
+			if arch >= 0 {
+				a := uint16(arch)
+				sim.Arch = &a
+			}
+			for _, addr := range []struct {
+				flag, val string
+				tgt       *net.IP
+			}{{"relay", relay, &sim.Relay}, {"requested", requested, &sim.RequestedAddr}} {
+				if addr.val == "" {
+					continue
+				}
+				if *addr.tgt = net.ParseIP(addr.val); *addr.tgt == nil {
+					return fmt.Errorf("Invalid IP address for --%s: %s", addr.flag, addr.val)
+				}
+			}
+			res := &models.DhcpSimulation{}
+			if err := session.Req().Post(sim).UrlFor("dhcp", "simulate").Do(res); err != nil {
+				return generateError(err, "Error simulating DHCP request")
+			}
+			return prettyPrint(res)
+		},
+	}
+	simCmd.Flags().StringVar(&sim.Mac, "mac", "", "Hardware address of the simulated client")
+	simCmd.Flags().StringVar(&sim.MessageType, "type", "discover", "DHCP message type (discover, request, decline, release, or inform)")
+	simCmd.Flags().IntVar(&arch, "arch", -1, "Client system architecture (option 93) to send")
+	simCmd.Flags().StringVar(&sim.VendorClass, "vendor-class", "", "Vendor class identifier (option 60) to send, such as PXEClient:Arch:00007")
+	simCmd.Flags().StringVar(&sim.UserClass, "user-class", "", "User class (option 77) to send.  iPXE sends iPXE")
+	simCmd.Flags().StringVar(&relay, "relay", "", "Address of the relay agent the request comes through")
+	simCmd.Flags().StringVar(&sim.CircuitID, "circuit-id", "", "Relay agent circuit-id to send")
+	simCmd.Flags().StringVar(&sim.RemoteID, "remote-id", "", "Relay agent remote-id to send")
+	simCmd.Flags().StringVar(&requested, "requested", "", "Address the client asks for (option 50)")
+	simCmd.Flags().StringVar(&sim.Interface, "interface", "", "Interface the request arrives on.  Defaults to the first one with an IPv4 address")
+	simCmd.Flags().BoolVar(&sim.Binl, "binl", false, "Send the request to the PXE/BINL server instead of the DHCP server")
+	simCmd.Flags().StringVar(&packet, "packet", "", "File holding a captured packet to send instead, or - for stdin")
+	res.AddCommand(simCmd)
+
+	imp := &models.DhcpImport{}
+	var confFile, leaseFile string
+	impCmd := &cobra.Command{
+		Use:   "import [isc|kea|dnsmasq]",
+		Short: "Import subnets, reservations, and leases from another DHCP server",
+		Long: `Converts the configuration and lease database of an ISC dhcpd, Kea,
+or dnsmasq server into Subnets, Reservations, and Leases.  Objects
+that conflict with existing ones are skipped and reported.  Use
+--dry-run to see what would be imported without creating anything.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			imp.Format = args[0]
+			if confFile == "" && leaseFile == "" {
+				return fmt.Errorf("%v requires --config or --leases", c.UseLine())
+			}
+			for _, f := range []struct {
+				name string
+				tgt  *string
+			}{{confFile, &imp.Config}, {leaseFile, &imp.LeaseData}} {
+				if f.name == "" {
+					continue
+				}
+				buf, err := ioutil.ReadFile(f.name)
+				if err != nil {
+					return fmt.Errorf("Error reading %s: %v", f.name, err)
+				}
+				*f.tgt = string(buf)
+			}
+			res := &models.DhcpImport{}
+			if err := session.Req().Post(imp).UrlFor("dhcp", "import").Do(res); err != nil {
+				return generateError(err, "Error importing %s config", imp.Format)
+			}
+			return prettyPrint(res)
+		},
+	}
+	impCmd.Flags().StringVar(&confFile, "config", "", "Server configuration file: dhcpd.conf, kea-dhcp4.conf, or dnsmasq.conf")
+	impCmd.Flags().StringVar(&leaseFile, "leases", "", "Lease database: dhcpd.leases, the Kea lease CSV, or dnsmasq.leases")
+	impCmd.Flags().BoolVar(&imp.DryRun, "dry-run", false, "Report what would be imported and any conflicts without creating anything")
+	impCmd.Flags().BoolVar(&imp.Enabled, "enabled", false, "Enable the imported subnets")
+	res.AddCommand(impCmd)
+	return res
+}
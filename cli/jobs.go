@@ -78,6 +78,23 @@ You may also pass in a machine UUID or Name to create a new job on that Name.
 	}
 	actionsCmd.Flags().StringVar(&actionsFor, "for-os", "", "OS to fetch actions for.  Defaults to fetching all actions")
 	op.addCommand(actionsCmd)
+	op.addCommand(&cobra.Command{
+		Use:   "cancel [id]",
+		Short: "Cancel a job that has not finished yet",
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			res := &models.Job{}
+			if err := session.Req().Post(nil).UrlFor("jobs", args[0], "cancel").Do(res); err != nil {
+				return generateError(err, "Error cancelling job")
+			}
+			return prettyPrint(res)
+		},
+	})
 	op.addCommand(&cobra.Command{
 		Use:   "log [id] [- or string]",
 		Short: "Gets the log or appends to the log if a second argument or stream is given",
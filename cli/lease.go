@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"fmt"
+
 	"github.com/digitalrebar/provision/models"
 	"github.com/spf13/cobra"
 )
@@ -17,5 +19,23 @@ func registerLease(app *cobra.Command) {
 		noCreate:   true,
 		noUpdate:   true,
 	}
+	op.addCommand(&cobra.Command{
+		Use:   "history [address]",
+		Short: "Show the DHCP transaction history of an address",
+		Long:  `Show the recorded DHCP transactions for an address, oldest first.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			res := []*models.LeaseHistoryEntry{}
+			if err := session.Req().UrlFor("leases", args[0], "history").Do(&res); err != nil {
+				return generateError(err, "Failed to fetch history for %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
 	op.command(app)
 }
@@ -16,4 +16,5 @@ func TestLeaseCli(t *testing.T) {
 	cliTest(false, false, "leases", "list", "State=sleep").run(t)
 	cliTest(false, true, "leases", "list", "ExpireTime=fred").run(t)
 	cliTest(false, false, "leases", "list", "ExpireTime=2006-01-02T15:04:05-07:00").run(t)
+	cliTest(false, false, "leases", "history", "1.1.1.1").run(t)
 }
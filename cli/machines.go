@@ -182,6 +182,78 @@ func registerMachine(app *cobra.Command) {
 			return session.Req().UrlFor("jobs", m.(*models.Machine).CurrentJob.String(), "log").Do(os.Stdout)
 		},
 	})
+	op.addCommand(&cobra.Command{
+		Use:   "fetches [id]",
+		Short: "Show the files the machine fetched recently while booting",
+		Long: `Shows the files the machine fetched most recently from the TFTP and
+static HTTP servers, oldest first, along with the part of the boot
+process each one belongs to.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			res := []*models.BootFetch{}
+			if err := session.Req().UrlFor("machines", m.Key(), "fetches").Do(&res); err != nil {
+				return generateError(err, "Failed to fetch boot progress for %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
+	preview := &models.RenderPreview{}
+	var previewParams string
+	renderCmd := &cobra.Command{
+		Use:   "render [id]",
+		Short: "Render the templates of a bootenv, stage, or task for the machine",
+		Long: `Renders the templates of the bootenv, stage, or task passed with
+--bootenv, --stage, or --task for the machine as if it had been moved
+into it, without changing the machine.  --params takes a JSON or YAML
+object (or a file holding one, or - for stdin) of param values that
+override the machine's.  Each rendered template is printed along with
+any missing params and render errors.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("%v requires 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			set := 0
+			for _, v := range []string{preview.BootEnv, preview.Stage, preview.Task} {
+				if v != "" {
+					set++
+				}
+			}
+			if set != 1 {
+				return fmt.Errorf("%v requires exactly one of --bootenv, --stage, or --task", c.UseLine())
+			}
+			if previewParams != "" {
+				if err := into(previewParams, &preview.Params); err != nil {
+					return fmt.Errorf("Invalid params: %v", err)
+				}
+			}
+			m, err := op.refOrFill(args[0])
+			if err != nil {
+				return generateError(err, "Failed to fetch %v: %v", op.singleName, args[0])
+			}
+			res := &models.RenderPreview{}
+			if err := session.Req().Post(preview).UrlFor("machines", m.Key(), "render").Do(res); err != nil {
+				return generateError(err, "Failed to render templates for %v: %v", op.singleName, args[0])
+			}
+			return prettyPrint(res)
+		},
+	}
+	renderCmd.Flags().StringVar(&preview.BootEnv, "bootenv", "", "BootEnv to render")
+	renderCmd.Flags().StringVar(&preview.Stage, "stage", "", "Stage to render")
+	renderCmd.Flags().StringVar(&preview.Task, "task", "", "Task to render")
+	renderCmd.Flags().StringVar(&previewParams, "params", "", "JSON or YAML object of param values to use instead of the machine's")
+	op.addCommand(renderCmd)
 	op.addCommand(&cobra.Command{
 		Use:   "deletejobs [id]",
 		Short: "Delete all jobs associated with machine",
@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 
@@ -245,5 +246,50 @@ func registerSubnet(app *cobra.Command) {
 			return fmt.Errorf("option %v does not exist", getVal)
 		},
 	})
+	exportFormat := "dhcpd"
+	exportCmd := &cobra.Command{
+		Use:   "export [subnetNames...]",
+		Short: "Export subnets as a dhcpd or kea configuration",
+		Long: `Renders the named subnets, or all of them if no names are passed,
+and the reservations in them as an ISC dhcpd or Kea DHCPv4
+configuration.  Boot files are picked by client architecture the same
+way dr-provision picks them.`,
+		RunE: func(c *cobra.Command, args []string) error {
+			params := []string{"format", exportFormat}
+			for _, name := range args {
+				params = append(params, "subnet", name)
+			}
+			return session.Req().UrlFor("dhcp", "export").Params(params...).Do(os.Stdout)
+		},
+	}
+	exportCmd.Flags().StringVar(&exportFormat, "format", "dhcpd", "Configuration format to export.  Can be \"dhcpd\" or \"kea\"")
+	op.addCommand(exportCmd)
+	op.addCommand(&cobra.Command{
+		Use:   "stats [subnetName]",
+		Short: "Show how full subnets are",
+		Long: `Shows how many addresses in the named subnet, or in all of them if no
+name is passed, are leased, reserved, and free, along with an
+estimate of when it will run out of free addresses.`,
+		Args: func(c *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("%v requires at most 1 argument", c.UseLine())
+			}
+			return nil
+		},
+		RunE: func(c *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				res := []*models.SubnetStats{}
+				if err := session.Req().UrlFor("dhcp", "stats").Do(&res); err != nil {
+					return generateError(err, "Failed to fetch subnet stats")
+				}
+				return prettyPrint(res)
+			}
+			res := &models.SubnetStats{}
+			if err := session.Req().UrlFor("subnets", args[0], "stats").Do(res); err != nil {
+				return generateError(err, "Failed to fetch stats for subnet %v", args[0])
+			}
+			return prettyPrint(res)
+		},
+	})
 	op.command(app)
 }
@@ -0,0 +1,205 @@
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/midlayer"
+	"github.com/digitalrebar/provision/models"
+	"github.com/gin-gonic/gin"
+)
+
+// DhcpSimulationResponse returned on a successful DHCP simulation
+// swagger:response
+type DhcpSimulationResponse struct {
+	// in: body
+	Body *models.DhcpSimulation
+}
+
+// DhcpSimulationBodyParameter used to describe the packet to simulate
+// swagger:parameters simulateDhcp
+type DhcpSimulationBodyParameter struct {
+	// in: body
+	// required: true
+	Body *models.DhcpSimulation
+}
+
+// DhcpImportResponse returned on a successful DHCP import
+// swagger:response
+type DhcpImportResponse struct {
+	// in: body
+	Body *models.DhcpImport
+}
+
+// DhcpImportBodyParameter used to pass the files to import
+// swagger:parameters importDhcp
+type DhcpImportBodyParameter struct {
+	// in: body
+	// required: true
+	Body *models.DhcpImport
+}
+
+// DhcpExportResponse returned on a successful DHCP export
+// swagger:response
+type DhcpExportResponse struct {
+	// in: body
+	Body string
+}
+
+// DhcpExportParameters pick the format and Subnets to export
+// swagger:parameters exportDhcp
+type DhcpExportParameters struct {
+	// in: query
+	Format string `json:"format"`
+	// in: query
+	Subnet []string `json:"subnet"`
+}
+
+func (f *Frontend) InitDhcpApi() {
+	// swagger:route POST /dhcp/simulate Dhcp simulateDhcp
+	//
+	// Simulate a DHCP request
+	//
+	// The passed packet is run through the DHCP server without
+	// committing any Leases, publishing any events, or sending
+	// anything over the network.  The simulation is returned with
+	// the replies the server would have sent and the Subnet,
+	// Reservation, BootEnv, and boot file that were picked.
+	//
+	//     Responses:
+	//       200: DhcpSimulationResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.POST("/dhcp/simulate",
+		func(c *gin.Context) {
+			if !f.assureSimpleAuth(c, "leases", "list", "") {
+				return
+			}
+			sim := &models.DhcpSimulation{}
+			if !assureDecode(c, sim) {
+				return
+			}
+			if err := midlayer.SimulateDhcp(f.dt, sim); err != nil {
+				res := &models.Error{
+					Type:  c.Request.Method,
+					Code:  http.StatusBadRequest,
+					Model: "dhcp",
+				}
+				res.AddError(err)
+				c.JSON(res.Code, res)
+				return
+			}
+			c.JSON(http.StatusOK, sim)
+		})
+	// swagger:route POST /dhcp/import Dhcp importDhcp
+	//
+	// Import Subnets, Reservations, and Leases from another DHCP server
+	//
+	// The passed ISC dhcpd, Kea, or dnsmasq configuration and lease
+	// database are converted into Subnets, Reservations, and Leases.
+	// The ones that do not conflict with existing objects are
+	// created, unless DryRun is set.  The import is returned with
+	// everything that was found, the conflicts, and anything that
+	// could not be converted.
+	//
+	//     Responses:
+	//       200: DhcpImportResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.POST("/dhcp/import",
+		func(c *gin.Context) {
+			imp := &models.DhcpImport{}
+			if !assureDecode(c, imp) {
+				return
+			}
+			action := "create"
+			if imp.DryRun {
+				action = "list"
+			}
+			for _, scope := range []string{"subnets", "reservations", "leases"} {
+				if !f.assureSimpleAuth(c, scope, action, "") {
+					return
+				}
+			}
+			rt := f.rt(c, "subnets", "reservations", "leases")
+			if err := backend.ImportDhcp(rt, imp); err != nil {
+				res := &models.Error{
+					Type:  c.Request.Method,
+					Code:  http.StatusBadRequest,
+					Model: "dhcp",
+				}
+				res.AddError(err)
+				c.JSON(res.Code, res)
+				return
+			}
+			c.JSON(http.StatusOK, imp)
+		})
+	// swagger:route GET /dhcp/export Dhcp exportDhcp
+	//
+	// Export Subnets and Reservations as another DHCP server's config
+	//
+	// The Subnets named by the subnet parameters, or all of them if
+	// there are none, and the Reservations in them are rendered as
+	// an ISC dhcpd (format=dhcpd, the default) or Kea (format=kea)
+	// DHCPv4 configuration.
+	//
+	//     Produces:
+	//       text/plain
+	//
+	//     Responses:
+	//       200: DhcpExportResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/dhcp/export",
+		func(c *gin.Context) {
+			for _, scope := range []string{"subnets", "reservations"} {
+				if !f.assureSimpleAuth(c, scope, "list", "") {
+					return
+				}
+			}
+			format := c.Query("format")
+			if format == "" {
+				format = "dhcpd"
+			}
+			names := c.Request.URL.Query()["subnet"]
+			out, err := backend.ExportDhcp(f.rt(c, "subnets", "reservations"), format, names...)
+			if err != nil {
+				res := &models.Error{
+					Type:  c.Request.Method,
+					Code:  http.StatusBadRequest,
+					Model: "dhcp",
+				}
+				if be, ok := err.(*models.Error); ok {
+					res.Code = be.Code
+				}
+				res.AddError(err)
+				c.JSON(res.Code, res)
+				return
+			}
+			c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(out))
+		})
+	// swagger:route GET /dhcp/stats Dhcp listSubnetStats
+	//
+	// Get the utilization of all Subnets
+	//
+	// Get how many addresses in each Subnet are leased, reserved,
+	// and free, along with an estimate of when each one will run out
+	// of free addresses.
+	//
+	//     Responses:
+	//       200: SubnetStatsListResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/dhcp/stats",
+		func(c *gin.Context) {
+			if !f.assureSimpleAuth(c, "subnets", "list", "") {
+				return
+			}
+			res, _ := backend.SubnetStats(f.rt(c, "subnets", "leases", "reservations"))
+			c.JSON(http.StatusOK, res)
+		})
+}
@@ -0,0 +1,103 @@
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	"github.com/gin-gonic/gin"
+)
+
+// FailoverResponse returned on a successful GET of the failover status
+// swagger:response
+type FailoverResponse struct {
+	// in: body
+	Body *models.FailoverStatus
+}
+
+// FailoverLeasesBodyParameter used to replicate Leases from a failover peer
+// swagger:parameters syncFailoverLeases
+type FailoverLeasesBodyParameter struct {
+	// in: body
+	// required: true
+	Body []*models.Lease
+}
+
+func (f *Frontend) failover(c *gin.Context) *backend.Failover {
+	fo := f.dt.Failover()
+	if fo == nil {
+		err := &models.Error{Type: c.Request.Method, Code: http.StatusNotFound, Model: "failover"}
+		err.Errorf("DHCP failover is not enabled")
+		c.JSON(err.Code, err)
+	}
+	return fo
+}
+
+func (f *Frontend) InitFailoverApi() {
+	// swagger:route GET /failover Failover getFailover
+	//
+	// Get the DHCP failover status
+	//
+	// Get the state of lease synchronization with the DHCP failover peer.
+	//
+	//     Responses:
+	//       200: FailoverResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/failover",
+		func(c *gin.Context) {
+			if !f.assureSimpleAuth(c, "leases", "list", "") {
+				return
+			}
+			fo := f.failover(c)
+			if fo == nil {
+				return
+			}
+			c.JSON(http.StatusOK, fo.Status())
+		})
+
+	// swagger:route POST /failover/leases Failover syncFailoverLeases
+	//
+	// Replicate Leases from the DHCP failover peer
+	//
+	// The passed Leases are saved as-is, replacing any Leases at the
+	// same addresses.  The Leases are returned once they are saved.
+	//
+	//     Responses:
+	//       200: LeasesResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/failover/leases",
+		func(c *gin.Context) {
+			if !f.assureSimpleAuth(c, "leases", "update", "") {
+				return
+			}
+			if f.failover(c) == nil {
+				return
+			}
+			leases := []*models.Lease{}
+			if !assureDecode(c, &leases) {
+				return
+			}
+			res := &models.Error{
+				Type:  c.Request.Method,
+				Code:  http.StatusUnprocessableEntity,
+				Model: "leases",
+			}
+			rt := f.rt(c, (&backend.Lease{}).Locks("update")...)
+			for _, lease := range leases {
+				if _, err := backend.SyncLease(rt, lease); err != nil {
+					res.AddError(err)
+				}
+			}
+			if res.ContainsError() {
+				c.JSON(res.Code, res)
+				return
+			}
+			c.JSON(http.StatusOK, leases)
+		})
+}
@@ -621,6 +621,8 @@ func NewFrontend(
 	me.InitMachineApi()
 	me.InitProfileApi()
 	me.InitLeaseApi()
+	me.InitFailoverApi()
+	me.InitDhcpApi()
 	me.InitReservationApi()
 	me.InitSubnetApi()
 	me.InitUserApi()
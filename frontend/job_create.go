@@ -168,6 +168,48 @@ func saveMachineAndCreateJob(rt *backend.RequestTracker, m *backend.Machine, b *
 	ret.Code = http.StatusCreated
 }
 
+// handOutGroupJob returns a Job for the next Task in the task group
+// that g runs.  That is either a new Job for a Task that does not have
+// one yet, or an incomplete one that needs to be rerun.  If every Task
+// in the group already has a Job, there is nothing to hand out.
+func handOutGroupJob(rt *backend.RequestTracker, g *backend.Job, b *backend.Job, err *models.Error) *backend.Job {
+	tasks, _ := models.TaskGroup(g.Task)
+	members := g.GroupJobs(rt)
+	for _, name := range tasks {
+		if mj, ok := members[name]; ok {
+			if mj.State == "incomplete" {
+				rt.Infof("Machine %s task %s in group at %d is incomplete, rerunning it",
+					g.Machine.String(), name, g.CurrentIndex)
+				*b = *(backend.ModelToBackend(models.Clone(mj)).(*backend.Job))
+				err.Code = http.StatusAccepted
+				return b
+			}
+			continue
+		}
+		b.StartTime = time.Now()
+		b.Previous = g.Uuid
+		b.Group = g.Uuid
+		b.Machine = g.Machine
+		b.Stage = g.Stage
+		b.BootEnv = g.BootEnv
+		b.Workflow = g.Workflow
+		b.CurrentIndex = g.CurrentIndex
+		b.NextIndex = g.NextIndex
+		b.Task = name
+		b.State = "created"
+		if _, cerr := rt.Create(b); cerr != nil {
+			err.Code = http.StatusInternalServerError
+			err.AddError(cerr)
+			return nil
+		}
+		rt.Infof("Created job %s for task %s in group at index %d", b.UUID(), b.Task, b.CurrentIndex)
+		err.Code = http.StatusCreated
+		return b
+	}
+	// Every Task in the group is already being run.
+	return nil
+}
+
 // This function is sort of hairy, and I do not apoligize for it.
 func realCreateJob(f *Frontend,
 	rt *backend.RequestTracker,
@@ -217,6 +259,11 @@ func realCreateJob(f *Frontend,
 		// Nothing to do here.
 		return nil, nil
 	}
+	if _, ok := models.TaskGroup(cj.Task); ok && cj.State == "running" && cj.CurrentIndex == m.CurrentTask {
+		// The Tasks in a group run at the same time, so hand out the
+		// next one instead of waiting for the group to finish.
+		return handOutGroupJob(rt, cj, b, err), nil
+	}
 	// Figure out what task to run next.  This is almost always the same as the current
 	// task
 	taskToRun := m.CurrentTask
@@ -261,6 +308,32 @@ func realCreateJob(f *Frontend,
 		// Someone reset the task list, and we are not in workflow mode.
 		taskToRun = 0
 	}
+	// Workflows can pick where to go next whenever the Machine
+	// finishes a Stage, including the Stages without Tasks that it
+	// passes straight through below.  stageDone is true once
+	// everything before taskToRun has finished, and visited keeps a
+	// loop through Stages without Tasks from spinning forever.
+	stageDone := m.Workflow != "" && cj.State == "finished"
+	visited := map[string]bool{}
+	followWorkflow := func() bool {
+		if !stageDone {
+			return false
+		}
+		from := m.StageBefore(taskToRun)
+		if visited[from] {
+			rt.Warnf("Machine %s: Workflow %s came back to Stage %s without running any Tasks, not following its transitions again",
+				b.Machine.String(), m.Workflow, from)
+			return false
+		}
+		if !m.FollowWorkflow(rt, taskToRun, "complete") {
+			return false
+		}
+		visited[from] = true
+		return true
+	}
+	if taskToRun >= len(m.Tasks) {
+		followWorkflow()
+	}
 	// Exit early if we finished all our tasks
 	if taskToRun >= len(m.Tasks) {
 		m.CurrentTask = len(m.Tasks)
@@ -270,11 +343,19 @@ func realCreateJob(f *Frontend,
 	// Check for stage and bootenv changes.
 	// These generate fake server side job logs as needed, and any stage or bootenv changes
 	// are gathered to be committed all at once.
-	for ; taskToRun < len(m.Tasks) && strings.Contains(m.Tasks[taskToRun], ":"); taskToRun++ {
+	for ; taskToRun < len(m.Tasks) &&
+		strings.Contains(m.Tasks[taskToRun], ":") &&
+		!strings.HasPrefix(m.Tasks[taskToRun], "group:"); taskToRun++ {
 		rt.Infof("Machine %s ([%d]%s)is checking to see if it needs to change stage",
 			b.Machine.String(),
 			taskToRun,
 			m.Tasks[taskToRun])
+		if strings.HasPrefix(m.Tasks[taskToRun], "stage:") &&
+			followWorkflow() &&
+			taskToRun >= len(m.Tasks) {
+			// The Workflow ended.
+			break
+		}
 		st := strings.SplitN(m.Tasks[taskToRun], ":", 2)
 		logMsg := ""
 		// Handle bootenv and stage changes if needed, If no changes are
@@ -288,12 +369,14 @@ func realCreateJob(f *Frontend,
 				b.Machine.String(), st[1])
 		case "stage":
 			if m.Stage == st[1] {
+				stageDone = m.Workflow != ""
 				continue
 			}
 			logMsg = fmt.Sprintf("Machine %s changing from stage %s to %s", b.Machine.String(), m.Stage, st[1])
 			m.Stage = st[1]
 		case "bootenv":
 			if m.BootEnv == st[1] {
+				stageDone = m.Workflow != ""
 				continue
 			}
 			logMsg = fmt.Sprintf("Machine %s changing from bootenv %s to %s", b.Machine.String(), m.BootEnv, st[1])
@@ -343,9 +426,32 @@ func realCreateJob(f *Frontend,
 		saveMachineAndNoJob(rt, m, err)
 		return cj, nil
 	}
+	if _, ok := models.TaskGroup(m.Tasks[m.CurrentTask]); ok {
+		// Track the group as a whole with a Job of its own, and hand
+		// out the first Task in it.
+		g := backend.ModelToBackend(&models.Job{}).(*backend.Job)
+		g.Fill()
+		g.Uuid = uuid.NewRandom()
+		g.StartTime = time.Now()
+		g.Previous = cj.Uuid
+		g.Machine = m.Uuid
+		g.Stage = m.Stage
+		g.BootEnv = m.BootEnv
+		g.Workflow = m.Workflow
+		g.CurrentIndex = m.CurrentTask
+		g.NextIndex = m.CurrentTask + 1
+		g.Task = m.Tasks[m.CurrentTask]
+		g.State = "running"
+		saveMachineAndCreateJob(rt, m, g, err)
+		if err.Code != http.StatusCreated {
+			return nil, nil
+		}
+		return handOutGroupJob(rt, g, b, err), nil
+	}
 	// Create our shiny new task.
 	b.StartTime = time.Now()
 	b.Previous = cj.Uuid
+	b.Group = nil
 	b.Machine = m.Uuid
 	b.Stage = m.Stage
 	b.BootEnv = m.BootEnv
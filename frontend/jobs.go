@@ -3,6 +3,7 @@ package frontend
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/VictorLowther/jsonpatch2"
 	"github.com/digitalrebar/provision/backend"
@@ -80,7 +81,7 @@ type JobLogPutBodyParameter struct {
 }
 
 // JobPathParameter used to find a Job in the path
-// swagger:parameters putJobs getJob putJob patchJob deleteJob getJobParams postJobParams getJobActions getJobLog putJobLog headJob
+// swagger:parameters putJobs getJob putJob patchJob deleteJob getJobParams postJobParams getJobActions getJobLog putJobLog headJob postJobHeartbeat cancelJob
 type JobPathParameter struct {
 	// in: path
 	// required: true
@@ -596,6 +597,126 @@ func (f *Frontend) InitJobApi() {
 			}
 		})
 
+	// swagger:route POST /jobs/{uuid}/heartbeat Jobs postJobHeartbeat
+	//
+	// Let the server know that the agent running the job is still alive.
+	//
+	// Jobs whose agent has sent a heartbeat are marked as incomplete
+	// if it stops sending them for longer than the jobHeartbeatTimeout
+	// preference.
+	//
+	//     Responses:
+	//       204: NoContentResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	f.ApiGroup.POST("/jobs/:uuid/heartbeat",
+		func(c *gin.Context) {
+			uuid := c.Param(`uuid`)
+			j := &backend.Job{}
+			var err *models.Error
+			rt := f.rt(c, j.Locks("get")...)
+			rt.Do(func(d backend.Stores) {
+				jo := d("jobs").Find(uuid)
+				if jo == nil {
+					err = &models.Error{Code: http.StatusNotFound, Type: backend.ValidationError,
+						Messages: []string{fmt.Sprintf("Job %s does not exist", uuid)}}
+					return
+				}
+				j = backend.AsJob(jo)
+			})
+			if err != nil {
+				c.JSON(err.Code, err)
+				return
+			}
+			if !f.assureSimpleAuth(c, "jobs", "update", j.AuthKey()) {
+				return
+			}
+			rt.Do(func(d backend.Stores) {
+				jo := d("jobs").Find(uuid)
+				if jo == nil {
+					err = &models.Error{Code: http.StatusNotFound, Type: backend.ValidationError,
+						Messages: []string{fmt.Sprintf("Job %s does not exist", uuid)}}
+					return
+				}
+				if j = backend.AsJob(jo); j.State != "running" {
+					err = &models.Error{Code: http.StatusConflict, Type: backend.ValidationError,
+						Messages: []string{fmt.Sprintf("Job %s is %s, not running", uuid, j.State)}}
+					return
+				}
+				f.dt.JobHeartbeat(j.Key(), time.Now())
+			})
+			if err != nil {
+				c.JSON(err.Code, err)
+				return
+			}
+			c.Data(http.StatusNoContent, gin.MIMEJSON, nil)
+		})
+
+	// swagger:route POST /jobs/{uuid}/cancel Jobs cancelJob
+	//
+	// Cancel a job that has not finished yet.
+	//
+	// The job is marked as failed with an ExitState of cancelled, its
+	// machine is made not runnable, and the agent running it is told
+	// to kill it.
+	//
+	//     Responses:
+	//       200: JobResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       409: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/jobs/:uuid/cancel",
+		func(c *gin.Context) {
+			uuid := c.Param(`uuid`)
+			j := &backend.Job{}
+			var err *models.Error
+			rt := f.rt(c, j.Locks("update")...)
+			rt.Do(func(d backend.Stores) {
+				jo := d("jobs").Find(uuid)
+				if jo == nil {
+					err = &models.Error{Code: http.StatusNotFound, Type: backend.ValidationError,
+						Messages: []string{fmt.Sprintf("Job %s does not exist", uuid)}}
+					return
+				}
+				j = backend.AsJob(jo)
+			})
+			if err != nil {
+				c.JSON(err.Code, err)
+				return
+			}
+			if !f.assureSimpleAuth(c, "jobs", "cancel", j.AuthKey()) {
+				return
+			}
+			var res models.Model
+			rt.Do(func(d backend.Stores) {
+				jo := d("jobs").Find(uuid)
+				if jo == nil {
+					err = &models.Error{Code: http.StatusNotFound, Type: backend.ValidationError,
+						Messages: []string{fmt.Sprintf("Job %s does not exist", uuid)}}
+					return
+				}
+				if cerr := backend.AsJob(jo).Cancel(rt); cerr != nil {
+					if me, ok := cerr.(*models.Error); ok {
+						err = me
+					} else {
+						err = &models.Error{Code: http.StatusUnprocessableEntity, Type: backend.ValidationError}
+						err.AddError(cerr)
+					}
+					return
+				}
+				res = rt.Find("jobs", uuid)
+			})
+			if err != nil {
+				c.JSON(err.Code, err)
+				return
+			}
+			c.JSON(http.StatusOK, res)
+		})
+
 	job := &backend.Job{}
 	pActions, pAction, pRun := f.makeActionEndpoints(job.Prefix(), job, "uuid")
 
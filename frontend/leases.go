@@ -1,6 +1,8 @@
 package frontend
 
 import (
+	"net/http"
+
 	"github.com/VictorLowther/jsonpatch2"
 	"github.com/digitalrebar/provision/backend"
 	"github.com/digitalrebar/provision/models"
@@ -46,6 +48,22 @@ type LeasePathParameter struct {
 	Address string `json:"address"`
 }
 
+// LeaseHistoryResponse returned on a successful GET of the history of a lease
+// swagger:response
+type LeaseHistoryResponse struct {
+	//in: body
+	Body []*models.LeaseHistoryEntry
+}
+
+// LeaseHistoryPathParameter used to address the history of a Lease in the path
+// swagger:parameters getLeaseHistory
+type LeaseHistoryPathParameter struct {
+	// in: path
+	// required: true
+	// swagger:strfmt ip
+	Address string `json:"address"`
+}
+
 // LeaseListPathParameter used to limit lists of Lease by path options
 // swagger:parameters listLeases listStatsLeases
 type LeaseListPathParameter struct {
@@ -247,6 +265,34 @@ func (f *Frontend) InitLeaseApi() {
 			f.Remove(c, &backend.Lease{}, ifIpConvertToHex(c.Param(`address`)))
 		})
 
+	// swagger:route GET /leases/{address}/history Leases getLeaseHistory
+	//
+	// Get the history of a Lease
+	//
+	// Get the recorded DHCP transactions for the address {address},
+	// oldest first.  The address does not need to have a Lease
+	// right now.
+	//
+	//     Responses:
+	//       200: LeaseHistoryResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	f.ApiGroup.GET("/leases/:address/history",
+		func(c *gin.Context) {
+			key := ifIpConvertToHex(c.Param(`address`))
+			if !f.assureSimpleAuth(c, "leases", "get", key) {
+				return
+			}
+			res, err := f.dt.LeaseHistory.History(key)
+			if err != nil {
+				c.JSON(http.StatusBadRequest,
+					models.NewError("API_ERROR", http.StatusBadRequest, err.Error()))
+				return
+			}
+			c.JSON(http.StatusOK, res)
+		})
+
 	lease := &backend.Lease{}
 	pActions, pAction, pRun := f.makeActionEndpoints(lease.Prefix(), lease, "address")
 
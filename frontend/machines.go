@@ -1,6 +1,8 @@
 package frontend
 
 import (
+	"net/http"
+
 	"github.com/VictorLowther/jsonpatch2"
 	"github.com/digitalrebar/provision/backend"
 	"github.com/digitalrebar/provision/models"
@@ -43,6 +45,28 @@ type MachineParamResponse struct {
 	Body interface{}
 }
 
+// MachineFetchesResponse return on a successful GET of the files a Machine fetched recently
+// swagger:response
+type MachineFetchesResponse struct {
+	// in: body
+	Body []*models.BootFetch
+}
+
+// MachineRenderResponse returned on a successful render preview
+// swagger:response
+type MachineRenderResponse struct {
+	// in: body
+	Body *models.RenderPreview
+}
+
+// MachineRenderBodyParameter used to pick what to render for a Machine
+// swagger:parameters renderMachine
+type MachineRenderBodyParameter struct {
+	// in: body
+	// required: true
+	Body *models.RenderPreview
+}
+
 // MachineBodyParameter used to inject a Machine
 // swagger:parameters createMachine putMachine
 type MachineBodyParameter struct {
@@ -88,7 +112,7 @@ type MachinePostParamsParameter struct {
 }
 
 // MachinePathParameter used to find a Machine in the path
-// swagger:parameters putMachines getMachine putMachine patchMachine deleteMachine headMachine patchMachineParams postMachineParams getMachinePubKey
+// swagger:parameters putMachines getMachine putMachine patchMachine deleteMachine headMachine patchMachineParams postMachineParams getMachinePubKey getMachineFetches renderMachine
 type MachinePathParameter struct {
 	// in: path
 	// required: true
@@ -439,6 +463,71 @@ func (f *Frontend) InitMachineApi() {
 	//       500: ErrorResponse
 	f.ApiGroup.GET("/machines/:uuid/pubkey", pGetPubKey)
 
+	// swagger:route GET /machines/{uuid}/fetches Machines getMachineFetches
+	//
+	// Get the files a Machine fetched recently
+	//
+	// Get the files the Machine specified by {uuid} fetched most
+	// recently from the TFTP and static HTTP servers, oldest first,
+	// along with the part of the boot process each one belongs to.
+	//
+	//     Responses:
+	//       200: MachineFetchesResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/machines/:uuid/fetches",
+		func(c *gin.Context) {
+			id := c.Param(`uuid`)
+			if !f.assureSimpleAuth(c, "machines", "get", id) {
+				return
+			}
+			res, err := backend.BootFetches(f.rt(c, "machines"), id)
+			if err != nil {
+				c.JSON(err.(*models.Error).Code, err)
+				return
+			}
+			c.JSON(http.StatusOK, res)
+		})
+
+	// swagger:route POST /machines/{uuid}/render Machines renderMachine
+	//
+	// Preview the templates of a BootEnv, Stage, or Task for a Machine
+	//
+	// Render the templates of the BootEnv, Stage, or Task named in
+	// the body for the Machine specified by {uuid}, as if it had
+	// been moved into it, with the passed Params overriding the
+	// Machine's.  The Machine is not changed.  The rendered templates
+	// are returned along with any missing parameters and render
+	// errors.
+	//
+	//     Responses:
+	//       200: MachineRenderResponse
+	//       400: ErrorResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	//       422: ErrorResponse
+	f.ApiGroup.POST("/machines/:uuid/render",
+		func(c *gin.Context) {
+			id := c.Param(`uuid`)
+			// Rendered templates can hold tokens that grant
+			// access to the Machine, so this needs update rights.
+			if !f.assureSimpleAuth(c, "machines", "update", id) {
+				return
+			}
+			preview := &models.RenderPreview{}
+			if !assureDecode(c, preview) {
+				return
+			}
+			rt := f.rt(c, "templates", "tasks", "stages", "bootenvs", "machines", "profiles", "params", "preferences")
+			if err := backend.RenderPreview(rt, id, preview); err != nil {
+				c.JSON(err.(*models.Error).Code, err)
+				return
+			}
+			c.JSON(http.StatusOK, preview)
+		})
+
 	// swagger:route GET /machines/{uuid}/params Machines getMachineParams
 	//
 	// List machine params Machine
@@ -84,7 +84,7 @@ func (f *Frontend) InitPrefApi() {
 					if !f.assureSimpleAuth(c, "prefs", "post", k) {
 						return
 					}
-				case "knownTokenTimeout", "unknownTokenTimeout":
+				case "knownTokenTimeout", "unknownTokenTimeout", "jobTimeout", "jobHeartbeatTimeout":
 					if !f.assureSimpleAuth(c, "prefs", "post", k) {
 						return
 					}
@@ -1,6 +1,8 @@
 package frontend
 
 import (
+	"net/http"
+
 	"github.com/VictorLowther/jsonpatch2"
 	"github.com/digitalrebar/provision/backend"
 	"github.com/digitalrebar/provision/models"
@@ -21,6 +23,20 @@ type SubnetsResponse struct {
 	Body []*models.Subnet
 }
 
+// SubnetStatsResponse returned on a successful GET of the utilization of a subnet
+// swagger:response
+type SubnetStatsResponse struct {
+	// in: body
+	Body *models.SubnetStats
+}
+
+// SubnetStatsListResponse returned on a successful GET of the utilization of all the subnets
+// swagger:response
+type SubnetStatsListResponse struct {
+	// in: body
+	Body []*models.SubnetStats
+}
+
 // SubnetBodyParameter used to inject a Subnet
 // swagger:parameters createSubnet putSubnet
 type SubnetBodyParameter struct {
@@ -38,7 +54,7 @@ type SubnetPatchBodyParameter struct {
 }
 
 // SubnetPathParameter used to name a Subnet in the path
-// swagger:parameters putSubnets getSubnet putSubnet patchSubnet deleteSubnet headSubnet
+// swagger:parameters putSubnets getSubnet putSubnet patchSubnet deleteSubnet headSubnet getSubnetStats
 type SubnetPathParameter struct {
 	// in: path
 	// required: true
@@ -309,6 +325,33 @@ func (f *Frontend) InitSubnetApi() {
 			f.Remove(c, &backend.Subnet{}, c.Param(`name`))
 		})
 
+	// swagger:route GET /subnets/{name}/stats Subnets getSubnetStats
+	//
+	// Get the utilization of a Subnet
+	//
+	// Get how many addresses in the Subnet specified by {name} are
+	// leased, reserved, and free, along with an estimate of when
+	// it will run out of free addresses.
+	//
+	//     Responses:
+	//       200: SubnetStatsResponse
+	//       401: NoContentResponse
+	//       403: NoContentResponse
+	//       404: ErrorResponse
+	f.ApiGroup.GET("/subnets/:name/stats",
+		func(c *gin.Context) {
+			name := c.Param(`name`)
+			if !f.assureSimpleAuth(c, "subnets", "get", name) {
+				return
+			}
+			res, err := backend.SubnetStats(f.rt(c, "subnets", "leases", "reservations"), name)
+			if err != nil {
+				c.JSON(err.(*models.Error).Code, err)
+				return
+			}
+			c.JSON(http.StatusOK, res[0])
+		})
+
 	subnet := &backend.Subnet{}
 	pActions, pAction, pRun := f.makeActionEndpoints(subnet.Prefix(), subnet, "name")
 
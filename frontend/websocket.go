@@ -55,9 +55,15 @@ func wsFilterFunction(emap []string,
 		break
 	}
 
-	// Make sure we are authorized to see this event.
+	// Make sure we are authorized to see this event.  Objects like
+	// Jobs are authorized against something other than their Key,
+	// so use the same key the API would.
 	if matched && auth != nil {
-		matched = auth.matchClaim(models.MakeRole("", e.Type, e.Action, e.Key).Compile())
+		key := e.Key
+		if ak, ok := e.Object.(interface{ AuthKey() string }); ok {
+			key = ak.AuthKey()
+		}
+		matched = auth.matchClaim(models.MakeRole("", e.Type, e.Action, key).Compile())
 	}
 	return matched
 }
@@ -0,0 +1,121 @@
+package midlayer
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+)
+
+// BootProgress watches the files that the TFTP and static HTTP
+// servers send, and records the ones fetched by Machines as
+// BootFetches.  Each one is published as a "machines" event with the
+// "bootprogress" action, so that it is possible to tell how far along
+// in booting a Machine is without looking at its console.
+type BootProgress struct {
+	logger.Logger
+	dt       *backend.DataTracker
+	pubs     *backend.Publishers
+	pending  chan *models.Event
+	dropped  int32
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// Publish queues file server events for processing.  It never blocks
+// and never logs.
+func (bp *BootProgress) Publish(e *models.Event) error {
+	if (e.Type != "tftp" && e.Type != "static") || e.Action != "serve" {
+		return nil
+	}
+	select {
+	case bp.pending <- e:
+	default:
+		atomic.AddInt32(&bp.dropped, 1)
+	}
+	return nil
+}
+
+func (bp *BootProgress) Reserve() error { return nil }
+func (bp *BootProgress) Release()       {}
+func (bp *BootProgress) Unload()        {}
+
+func (bp *BootProgress) handle(e *models.Event) {
+	fd, ok := e.Object.(*fileData)
+	if !ok {
+		return
+	}
+	addr := net.ParseIP(strings.Trim(fd.Requestor, "[]"))
+	if addr == nil {
+		return
+	}
+	f := &models.BootFetch{
+		Time:    fd.Start,
+		Source:  "tftp",
+		Address: addr,
+		Path:    fd.Url,
+		Status:  fd.Status,
+		Size:    fd.ResponseSize,
+		Seconds: fd.End.Sub(fd.Start).Seconds(),
+	}
+	if e.Type == "static" {
+		f.Source = "http"
+		if u, err := url.Parse(fd.Url); err == nil {
+			f.Path = u.Path
+		}
+	}
+	rt := bp.dt.Request(bp.Logger, "machines", "bootenvs", "leases")
+	if m := backend.RecordBootFetch(rt, addr, f); m == nil {
+		return
+	}
+	bp.Debugf("Machine %s fetched %s (%s) over %s", f.Machine, f.Path, f.Stage, f.Source)
+	bp.pubs.Publish("machines", "bootprogress", f.Machine, f.Source, f)
+}
+
+func (bp *BootProgress) run() {
+	defer close(bp.finished)
+	for {
+		select {
+		case <-bp.done:
+			return
+		case e := <-bp.pending:
+			bp.handle(e)
+		}
+		if n := atomic.SwapInt32(&bp.dropped, 0); n > 0 {
+			bp.Warnf("Boot progress: dropped %d file server events", n)
+		}
+	}
+}
+
+// Shutdown stops recording boot progress.
+func (bp *BootProgress) Shutdown(ctx context.Context) error {
+	bp.pubs.Remove(bp)
+	close(bp.done)
+	select {
+	case <-bp.finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// StartBootProgress starts recording the files Machines fetch from
+// the TFTP and static HTTP servers.
+func StartBootProgress(dt *backend.DataTracker, log logger.Logger, pubs *backend.Publishers) *BootProgress {
+	bp := &BootProgress{
+		Logger:   log,
+		dt:       dt,
+		pubs:     pubs,
+		pending:  make(chan *models.Event, 1000),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	pubs.Add(bp)
+	go bp.run()
+	return bp
+}
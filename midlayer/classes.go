@@ -0,0 +1,85 @@
+package midlayer
+
+import (
+	"bytes"
+
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// inClass returns true if the request matches every match field set
+// in c.
+func (dhr *DhcpRequest) inClass(c *models.ClientClass) bool {
+	if c.VendorClass != "" &&
+		!bytes.HasPrefix(dhr.pktOpts[dhcp.OptionVendorClassIdentifier], []byte(c.VendorClass)) {
+		return false
+	}
+	if c.UserClass != "" &&
+		!bytes.HasPrefix(dhr.pktOpts[dhcp.OptionUserClass], []byte(c.UserClass)) {
+		return false
+	}
+	if len(c.Arches) > 0 {
+		val := dhr.pktOpts[dhcp.OptionClientArchitecture]
+		if len(val) < 2 {
+			return false
+		}
+		arch := uint16(val[0])<<8 + uint16(val[1])
+		found := false
+		for _, a := range c.Arches {
+			found = found || a == arch
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.MacPrefix != "" && !c.MatchesMac(dhr.request.CHAddr().String()) {
+		return false
+	}
+	if c.CircuitID != "" && relayAgentToken(dhr.pktOpts, 1) != c.CircuitID {
+		return false
+	}
+	if c.RemoteID != "" && relayAgentToken(dhr.pktOpts, 2) != c.RemoteID {
+		return false
+	}
+	return true
+}
+
+// clientClass returns the first ClientClass of the Subnet l is in
+// that the request matches, if any.  It also returns the option codes
+// set by the Reservation for l, which classes cannot override.  A
+// Reservation with a NextServer counts as setting option 66, since
+// the next server is sent as that option as well.
+func (dhr *DhcpRequest) clientClass(l *backend.Lease) (*models.ClientClass, map[byte]bool) {
+	var res *models.ClientClass
+	reserved := map[byte]bool{}
+	if l.Addr == nil {
+		return nil, reserved
+	}
+	rt := dhr.Request("subnets", "reservations")
+	rt.Do(func(d backend.Stores) {
+		if r := rt.RawFind("reservations", models.Hexaddr(l.Addr)); r != nil {
+			res := backend.AsReservation(r)
+			for _, opt := range res.Options {
+				reserved[opt.Code] = true
+			}
+			if res.NextServer.IsGlobalUnicast() {
+				reserved[byte(dhcp.OptionTFTPServerName)] = true
+			}
+		}
+		for _, i := range d("subnets").Items() {
+			s := backend.AsSubnet(i)
+			if !s.InSubnetRange(l.Addr) {
+				continue
+			}
+			for j := range s.ClientClasses {
+				if dhr.inClass(&s.ClientClasses[j]) {
+					c := s.ClientClasses[j]
+					res = &c
+					return
+				}
+			}
+		}
+	})
+	return res, reserved
+}
@@ -32,6 +32,84 @@ func MacStrategy(p dhcp.Packet, options dhcp.Options) string {
 	return p.CHAddr().String()
 }
 
+// ClientIDStrategy keys leases off the client identifier (option 61),
+// rendered as colon-separated hex bytes.
+func ClientIDStrategy(p dhcp.Packet, options dhcp.Options) string {
+	return colonHex(options[dhcp.OptionClientIdentifier])
+}
+
+// CircuitIDStrategy keys leases off the circuit-id sub-option of the
+// relay agent information (option 82).  This is usually the switch
+// port the client is plugged in to.
+func CircuitIDStrategy(p dhcp.Packet, options dhcp.Options) string {
+	return relayAgentToken(options, 1)
+}
+
+// RemoteIDStrategy keys leases off the remote-id sub-option of the
+// relay agent information (option 82).  This is usually the switch
+// the client is plugged in to.
+func RemoteIDStrategy(p dhcp.Packet, options dhcp.Options) string {
+	return relayAgentToken(options, 2)
+}
+
+// RelayAgentStrategy keys leases off both the remote-id and the
+// circuit-id of the relay agent information (option 82), in the form
+// remote-id/circuit-id.  Both must be present.
+func RelayAgentStrategy(p dhcp.Packet, options dhcp.Options) string {
+	remote, circuit := relayAgentToken(options, 2), relayAgentToken(options, 1)
+	if remote == "" || circuit == "" {
+		return ""
+	}
+	return remote + "/" + circuit
+}
+
+// relayAgentToken returns the passed sub-option of the relay agent
+// information option.  Values made up entirely of printable ASCII are
+// returned as-is, everything else as colon-separated hex bytes.
+func relayAgentToken(options dhcp.Options, code byte) string {
+	buf := options[dhcp.OptionRelayAgentInformation]
+	for len(buf) >= 2 {
+		subCode, subLen := buf[0], int(buf[1])
+		if len(buf) < 2+subLen {
+			return ""
+		}
+		val := buf[2 : 2+subLen]
+		buf = buf[2+subLen:]
+		if subCode != code || len(val) == 0 {
+			continue
+		}
+		for _, b := range val {
+			if b < 0x20 || b > 0x7e {
+				return colonHex(val)
+			}
+		}
+		return string(val)
+	}
+	return ""
+}
+
+func colonHex(buf []byte) string {
+	parts := make([]string, len(buf))
+	for i, b := range buf {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// defaultStrategies are tried in order until one of them finds or
+// creates a lease.  The relay agent and client identifier strategies
+// come before MAC so that Reservations made with them take priority.
+// Strategies that produce an empty token for a packet are skipped.
+func defaultStrategies() []*Strategy {
+	return []*Strategy{
+		{Name: "RelayAgent", GenToken: RelayAgentStrategy},
+		{Name: "CircuitID", GenToken: CircuitIDStrategy},
+		{Name: "RemoteID", GenToken: RemoteIDStrategy},
+		{Name: "ClientID", GenToken: ClientIDStrategy},
+		{Name: "MAC", GenToken: MacStrategy},
+	}
+}
+
 // DhcpRequest records all the information needed to handle a single
 // in-flight DHCP request.  One of these is created for every incoming
 // DHCP packet.
@@ -54,6 +132,9 @@ type DhcpRequest struct {
 	start                         time.Time
 	machine                       *backend.Machine
 	bootEnv                       *backend.BootEnv
+	// sandbox is set when the request is being simulated, and keeps
+	// it from changing anything.
+	sandbox *backend.Sandbox
 }
 
 func (dhr *DhcpRequest) Reply(p dhcp.Packet) {
@@ -78,17 +159,29 @@ func (dhr *DhcpRequest) ifname() string {
 // basis to ensure that dr-provision operates correctly in the face of
 // a dynamic networking environment.
 func (dhr *DhcpRequest) fill() *DhcpRequest {
-	dhr.idxMap = map[int][]*net.IPNet{}
-	dhr.nameMap = map[int]string{}
-	ifs, err := net.Interfaces()
+	var err error
+	dhr.idxMap, dhr.nameMap, err = interfaceMaps(dhr.Logger)
 	if err != nil {
-		dhr.Errorf("Cannot fetch local interface map: %v", err)
 		return nil
 	}
+	return dhr
+}
+
+// interfaceMaps builds maps of interface index to addresses and
+// interface index to name for all of the network interfaces on the
+// system.
+func interfaceMaps(l logger.Logger) (map[int][]*net.IPNet, map[int]string, error) {
+	idxMap := map[int][]*net.IPNet{}
+	nameMap := map[int]string{}
+	ifs, err := net.Interfaces()
+	if err != nil {
+		l.Errorf("Cannot fetch local interface map: %v", err)
+		return idxMap, nameMap, err
+	}
 	for _, iface := range ifs {
 		addrs, err := iface.Addrs()
 		if err != nil {
-			dhr.Errorf("Failed to fetch addresses for %s: %v", iface.Name, err)
+			l.Errorf("Failed to fetch addresses for %s: %v", iface.Name, err)
 			continue
 		}
 		toAdd := []*net.IPNet{}
@@ -98,10 +191,10 @@ func (dhr *DhcpRequest) fill() *DhcpRequest {
 				toAdd = append(toAdd, addr)
 			}
 		}
-		dhr.idxMap[iface.Index] = toAdd
-		dhr.nameMap[iface.Index] = iface.Name
+		idxMap[iface.Index] = toAdd
+		nameMap[iface.Index] = iface.Name
 	}
-	return dhr
+	return idxMap, nameMap, nil
 }
 
 // proxyOnly returns whether the DhcpHandler that created this request
@@ -113,6 +206,9 @@ func (dhr *DhcpRequest) binlOnly() bool {
 // Request is a shorthand function for creating a RequestTracker to
 // interact with the backend.
 func (dhr *DhcpRequest) Request(locks ...string) *backend.RequestTracker {
+	if dhr.sandbox != nil {
+		return dhr.sandbox.Request(dhr.Logger, locks...)
+	}
 	res := dhr.handler.bk.Request(dhr.Logger, locks...)
 	return res
 }
@@ -302,17 +398,26 @@ func (dhr *DhcpRequest) coalesceOptions(l *backend.Lease) {
 		opt.FillFromPacketOpt(v)
 		srcOpts[int(c)] = opt.Value
 	}
-	for _, opt := range l.Options {
+	render := func(opt models.DhcpOption) {
 		c, v, err := opt.RenderToDHCP(srcOpts)
 		if err != nil {
 			dhr.Errorf("Failed to render option %v: %v, %v", opt.Code, opt.Value, err)
-			continue
+			return
 		}
 		dhr.outOpts[dhcp.OptionCode(c)] = v
 	}
+	for _, opt := range l.Options {
+		render(opt)
+	}
 	if l.NextServer.IsGlobalUnicast() {
 		dhr.nextServer = l.NextServer
 	}
+	// Then layer the client class on top, leaving anything the
+	// reservation set alone.
+	if class, reserved := dhr.clientClass(l); class != nil {
+		dhr.Debugf("Client is in class %s", class.Name)
+		dhr.applyClass(class, reserved, render)
+	}
 	if nextServer := dhr.nextServer.To4(); nextServer != nil && !nextServer.IsUnspecified() {
 		dhr.nextServer = nextServer
 		dhr.outOpts[dhcp.OptionTFTPServerName] = []byte(dhr.nextServer.String())
@@ -320,12 +425,29 @@ func (dhr *DhcpRequest) coalesceOptions(l *backend.Lease) {
 		dhr.nextServer = nil
 	}
 	dhr.checkMachine(l)
-	if dhr.offerNetBoot && dhr.offerPXE() {
+	if dhr.offerNetBoot && (dhr.offerPXE() || dhr.offerHttpBoot()) {
 		dhr.fillForPXE(l)
 		return
 	}
 }
 
+// applyClass layers the options, boot file name, and next server of
+// class on top of the ones from the subnet and reservation.  Nothing
+// whose option code is in reserved is changed.
+func (dhr *DhcpRequest) applyClass(class *models.ClientClass, reserved map[byte]bool, render func(models.DhcpOption)) {
+	for _, opt := range class.Options {
+		if !reserved[opt.Code] {
+			render(opt)
+		}
+	}
+	if class.BootFileName != "" && !reserved[byte(dhcp.OptionBootFileName)] {
+		dhr.outOpts[dhcp.OptionBootFileName] = []byte(class.BootFileName)
+	}
+	if class.NextServer.IsGlobalUnicast() && !reserved[byte(dhcp.OptionTFTPServerName)] {
+		dhr.nextServer = class.NextServer
+	}
+}
+
 // buildReply is the general purpose function for building the
 // appropriate response to the DHCP packet we are currently handling.
 func (dhr *DhcpRequest) buildReply(
@@ -335,6 +457,7 @@ func (dhr *DhcpRequest) buildReply(
 	order := dhr.pktOpts[dhcp.OptionParameterRequestList]
 	toAdd := []dhcp.Option{}
 	var fileName, sName []byte
+	httpBoot := dhr.offerNetBoot && dhr.offerHttpBoot()
 	if !dhr.offerNetBoot {
 		delete(dhr.outOpts, dhcp.OptionTFTPServerName)
 		delete(dhr.outOpts, dhcp.OptionBootFileName)
@@ -360,10 +483,19 @@ func (dhr *DhcpRequest) buildReply(
 			fileName = opt.Value
 		case dhcp.OptionTFTPServerName:
 			sName = opt.Value
+		case dhcp.OptionVendorClassIdentifier:
+			if !httpBoot {
+				toAdd = append(toAdd, opt)
+			}
 		default:
 			toAdd = append(toAdd, opt)
 		}
 	}
+	// UEFI HTTP Boot clients ignore offers that do not say they are
+	// for HTTPClient, whether or not they asked for option 60.
+	if httpBoot {
+		toAdd = append(toAdd, dhcp.Option{Code: dhcp.OptionVendorClassIdentifier, Value: []byte("HTTPClient")})
+	}
 	// Add renew and rebind times based on the expire time.
 	if dhr.duration > 0 {
 		toAdd = append(toAdd,
@@ -377,6 +509,10 @@ func (dhr *DhcpRequest) buildReply(
 			},
 		)
 	}
+	// Relay agents expect their information to be echoed back (RFC 3046)
+	if relay, ok := dhr.pktOpts[dhcp.OptionRelayAgentInformation]; ok {
+		toAdd = append(toAdd, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: relay})
+	}
 	res := dhcp.ReplyPacket(dhr.request, mt, serverID, yAddr, dhr.duration, toAdd)
 	if dhr.nextServer.IsGlobalUnicast() {
 		res.SetSIAddr(dhr.nextServer)
@@ -413,6 +549,63 @@ func (dhr *DhcpRequest) Strategy(name string) StrategyFunc {
 	return nil
 }
 
+// strategies returns the strategies that can generate a token for the
+// current packet.  If req is already leased via one of them, that one
+// is tried first so the lease is renewed instead of replaced.
+func (dhr *DhcpRequest) strategies(req net.IP) []*Strategy {
+	res := []*Strategy{}
+	for _, s := range dhr.handler.strats {
+		if s.GenToken(dhr.request, dhr.pktOpts) != "" {
+			res = append(res, s)
+		}
+	}
+	if len(res) < 2 || req == nil || !req.IsGlobalUnicast() {
+		return res
+	}
+	current := ""
+	rt := dhr.Request("leases")
+	rt.Do(func(d backend.Stores) {
+		if l := rt.RawFind("leases", models.Hexaddr(req)); l != nil {
+			current = backend.AsLease(l).Strategy
+		}
+	})
+	for i, s := range res {
+		if s.Name == current {
+			res = append([]*Strategy{s}, append(res[:i:i], res[i+1:]...)...)
+			break
+		}
+	}
+	return res
+}
+
+// history records a transaction for addr in the lease history.  If
+// lease is nil, the client is identified by its MAC address.
+func (dhr *DhcpRequest) history(state string, addr net.IP, lease *backend.Lease, msg string) {
+	if dhr.sandbox != nil {
+		return
+	}
+	ent := &models.LeaseHistoryEntry{
+		Addr:     addr,
+		State:    state,
+		Strategy: "MAC",
+		Token:    dhr.request.CHAddr().String(),
+		Xid:      fmt.Sprintf("0x%x", binary.BigEndian.Uint32(dhr.request.XId())),
+		Message:  msg,
+	}
+	if giaddr := dhr.request.GIAddr(); giaddr != nil && !giaddr.IsUnspecified() {
+		ent.Via = giaddr
+	}
+	if dhr.cm != nil {
+		ent.Interface = dhr.ifname()
+	}
+	if lease != nil {
+		ent.Strategy, ent.Token, ent.ExpireTime = lease.Strategy, lease.Token, lease.ExpireTime
+	}
+	if err := dhr.handler.bk.LeaseHistory.Record(ent); err != nil {
+		dhr.Errorf("%s: Failed to record lease history for %s: %v", dhr.xid(), addr, err)
+	}
+}
+
 // Helper for quickly generating a nak.
 func (dhr *DhcpRequest) nak(addr net.IP) {
 	dhr.Reply(dhcp.ReplyPacket(dhr.request, dhcp.NAK, addr, nil, 0, nil))
@@ -455,7 +648,7 @@ func (dhr *DhcpRequest) reqAddr(msgType dhcp.MessageType) (addr net.IP, state in
 // anything crazy like that.
 func (dhr *DhcpRequest) FakeLease(req net.IP) *backend.Lease {
 	rt := dhr.Request("leases", "reservations", "subnets")
-	for _, s := range dhr.handler.strats {
+	for _, s := range dhr.strategies(nil) {
 		strategy := s.Name
 		token := s.GenToken(dhr.request, dhr.pktOpts)
 		via := []net.IP{dhr.request.GIAddr()}
@@ -490,6 +683,7 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 			dhr.Warnf("WARNING: %s: Competing DHCP server on network: %s", dhr.xid(), dhr.cm.Src)
 		}
 	case dhcp.Decline:
+		var declined *backend.Lease
 		rt := dhr.Request("leases")
 		rt.Do(func(d backend.Stores) {
 			leaseThing := rt.Find("leases", models.Hexaddr(req))
@@ -501,13 +695,19 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 			stratfn := dhr.Strategy(lease.Strategy)
 			if stratfn != nil && stratfn(dhr.request, dhr.pktOpts) == lease.Token {
 				dhr.Infof("%s: Lease for %s declined, invalidating.", dhr.xid(), lease.Addr)
+				prev := *lease.Lease
+				declined = &backend.Lease{Lease: &prev}
 				lease.Invalidate()
 				rt.Save(lease)
 			} else {
 				dhr.Infof("%s: Received spoofed decline for %s, ignoring", dhr.xid(), lease.Addr)
 			}
 		})
+		if declined != nil {
+			dhr.history("DECLINE", declined.Addr, declined, "")
+		}
 	case dhcp.Release:
+		var released *backend.Lease
 		rt := dhr.Request("leases")
 		rt.Do(func(d backend.Stores) {
 			leaseThing := rt.Find("leases", models.Hexaddr(req))
@@ -521,10 +721,14 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 				rt.Infof("%s: Lease for %s released, expiring.", dhr.xid(), lease.Addr)
 				lease.Expire()
 				rt.Save(lease)
+				released = lease
 			} else {
 				rt.Infof("%s: Received spoofed release for %s, ignoring", dhr.xid(), lease.Addr)
 			}
 		})
+		if released != nil {
+			dhr.history("RELEASE", released.Addr, released, "")
+		}
 	case dhcp.Request:
 		serverBytes, ok := dhr.pktOpts[dhcp.OptionServerIdentifier]
 		server := net.IP(serverBytes)
@@ -535,6 +739,9 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 		if !req.IsGlobalUnicast() {
 			dhr.Infof("%s: NAK'ing invalid requested IP %s", dhr.xid(), req)
 			dhr.nak(dhr.respondFrom(req))
+			if req != nil && !req.IsUnspecified() {
+				dhr.history("NAK", req, nil, "Invalid requested IP")
+			}
 			return "NAK"
 		}
 		via := []net.IP{dhr.request.GIAddr()}
@@ -544,8 +751,10 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 		var lease *backend.Lease
 		var reservation *backend.Reservation
 		var subnet *backend.Subnet
+		var nakLease *backend.Lease
+		var nakErr error
 		rt := dhr.Request("leases", "reservations", "subnets")
-		for _, s := range dhr.handler.strats {
+		for _, s := range dhr.strategies(req) {
 			lease, subnet, reservation, err = backend.FindLease(rt, s.Name, s.GenToken(dhr.request, dhr.pktOpts), req, via)
 			if lease == nil &&
 				subnet == nil &&
@@ -554,27 +763,37 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 				continue
 			}
 			if err != nil {
-				if lease != nil {
-					dhr.Infof("%s: %s already leased to %s:%s: %s",
-						dhr.xid(),
-						req,
-						lease.Strategy,
-						lease.Token,
-						err)
-				} else {
-					dhr.Warnf("%s: Another DHCP server may be on the network: %s", dhr.xid(), net.IP(server))
-					dhr.Infof("%s: %s is no longer able to be leased: %s",
-						dhr.xid(),
-						req,
-						err)
+				// Another strategy may still own the address, so hold
+				// off on the NAK until they have all been tried.
+				if nakErr == nil {
+					nakLease, nakErr = lease, err
 				}
-				dhr.nak(dhr.respondFrom(req))
-				return "NAK"
+				lease = nil
+				continue
 			}
 			if lease != nil {
 				break
 			}
 		}
+		if lease == nil && nakErr != nil {
+			if nakLease != nil {
+				dhr.Infof("%s: %s already leased to %s:%s: %s",
+					dhr.xid(),
+					req,
+					nakLease.Strategy,
+					nakLease.Token,
+					nakErr)
+			} else {
+				dhr.Warnf("%s: Another DHCP server may be on the network: %s", dhr.xid(), net.IP(server))
+				dhr.Infof("%s: %s is no longer able to be leased: %s",
+					dhr.xid(),
+					req,
+					nakErr)
+			}
+			dhr.nak(dhr.respondFrom(req))
+			dhr.history("NAK", req, nakLease, nakErr.Error())
+			return "NAK"
+		}
 		if lease == nil {
 			if reqState == reqInitReboot {
 				dhr.Infof("%s: No lease for %s in database, client in INIT-REBOOT.  Ignoring request.", dhr.xid(), req)
@@ -583,6 +802,7 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 			if subnet != nil || reservation != nil {
 				dhr.Infof("%s: No lease for %s in database, NAK'ing", dhr.xid(), req)
 				dhr.nak(dhr.respondFrom(req))
+				dhr.history("NAK", req, nil, "No lease in database")
 				return "NAK"
 			}
 
@@ -602,9 +822,10 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 			reply.CHAddr(),
 			serverID)
 		dhr.Reply(reply)
+		dhr.history("ACK", lease.Addr, lease, "")
 		return "ACK"
 	case dhcp.Discover:
-		for _, s := range dhr.handler.strats {
+		for _, s := range dhr.strategies(nil) {
 			strategy := s.Name
 			token := s.GenToken(dhr.request, dhr.pktOpts)
 			via := []net.IP{dhr.request.GIAddr()}
@@ -658,7 +879,7 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 				break
 			}
 			if lease == nil {
-				return "NoLease"
+				continue
 			}
 			if lease.Fake() {
 				lease.Addr = net.IPv4(0, 0, 0, 0)
@@ -695,8 +916,10 @@ func (dhr *DhcpRequest) ServeDHCP() string {
 				dhr.buildAppleBsdpOptions(serverID)
 				dhr.Reply(dhr.buildReply(dhcp.Offer, serverID, net.IPv4zero))
 			}
+			dhr.history("OFFER", lease.Addr, lease, "")
 			return "Offer"
 		}
+		return "NoLease"
 	}
 	return "NotHandled"
 }
@@ -739,6 +962,9 @@ func (dhr *DhcpRequest) Process() (string, string) {
 			return dhr.reqType.String(), "Ignored"
 		}
 	}
+	if dhr.sandbox == nil && dhr.handler.throttled(dhr) {
+		return dhr.reqType.String(), "Throttled"
+	}
 	var resType string
 	if dhr.binlOnly() {
 		resType = dhr.ServeBinl()
@@ -802,6 +1028,7 @@ type DhcpHandler struct {
 	strats     []*Strategy
 	publishers *backend.Publishers
 	metrics    *DhcpMetrics
+	limiter    *rateLimiter
 }
 
 func (h *DhcpHandler) NewRequest(buf []byte, cm *ipv4.ControlMessage, srcAddr net.Addr, start time.Time) *DhcpRequest {
@@ -866,7 +1093,8 @@ func StartDhcpHandler(dhcpInfo *backend.DataTracker,
 	dhcpPort int,
 	pubs *backend.Publishers,
 	proxyOnly bool,
-	fakePinger bool) (Service, error) {
+	fakePinger bool,
+	limits DhcpRateLimit) (Service, error) {
 
 	ifs := []string{}
 	if dhcpIfs != "" {
@@ -878,10 +1106,11 @@ func StartDhcpHandler(dhcpInfo *backend.DataTracker,
 		ifs:        ifs,
 		bk:         dhcpInfo,
 		port:       dhcpPort,
-		strats:     []*Strategy{{Name: "MAC", GenToken: MacStrategy}},
+		strats:     defaultStrategies(),
 		publishers: pubs,
 		binlOnly:   proxyOnly,
 		metrics:    NewDhcpMetrics(log, proxyOnly),
+		limiter:    newRateLimiter(limits),
 	}
 
 	// If we aren't the PXE/BINL proxy, run a pinger
@@ -0,0 +1,945 @@
+package midlayer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv6"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/backend/index"
+	"github.com/digitalrebar/provision/models"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/pborman/uuid"
+)
+
+// Strategy6Func generates a lease token from an incoming DHCPv6 request.
+type Strategy6Func func(dhr *Dhcp6Request) string
+
+type Strategy6 struct {
+	Name     string
+	GenToken Strategy6Func
+}
+
+// DuidStrategy uses the client DUID as the lease token.
+func DuidStrategy(dhr *Dhcp6Request) string {
+	return duidToken(dhr.clientID)
+}
+
+// Mac6Strategy uses the client link-layer address as the lease token,
+// which lets IPv6 leases and reservations share tokens with their
+// IPv4 counterparts.  The address comes from the RFC 6939 relay
+// option if present, otherwise from a DUID-LLT or DUID-LL.
+func Mac6Strategy(dhr *Dhcp6Request) string {
+	if mac := dhr.clientMac(); mac != nil {
+		return mac.String()
+	}
+	return ""
+}
+
+// Dhcp6Request records all the information needed to handle a single
+// in-flight DHCPv6 request.
+type Dhcp6Request struct {
+	logger.Logger
+	idxMap       map[int][]*net.IPNet
+	nameMap      map[int]string
+	srcAddr      net.Addr
+	cm           *ipv6.ControlMessage
+	relays       []*dhcp6Packet
+	request      *dhcp6Packet
+	reply        *dhcp6Packet
+	clientID     []byte
+	handler      *Dhcp6Handler
+	start        time.Time
+	offerNetBoot bool
+	machine      *backend.Machine
+	bootEnv      *backend.BootEnv
+}
+
+func (dhr *Dhcp6Request) xid() string {
+	return dhr.request.xid()
+}
+
+func (dhr *Dhcp6Request) ifname() string {
+	if dhr.cm == nil {
+		return ""
+	}
+	return dhr.nameMap[dhr.cm.IfIndex]
+}
+
+func (dhr *Dhcp6Request) fill() *Dhcp6Request {
+	var err error
+	dhr.idxMap, dhr.nameMap, err = interfaceMaps(dhr.Logger)
+	if err != nil {
+		return nil
+	}
+	return dhr
+}
+
+// Request is a shorthand function for creating a RequestTracker to
+// interact with the backend.
+func (dhr *Dhcp6Request) Request(locks ...string) *backend.RequestTracker {
+	return dhr.handler.bk.Request(dhr.Logger, locks...)
+}
+
+// listenIPs returns the global IPv6 addresses on the interface the
+// request came in on.
+func (dhr *Dhcp6Request) listenIPs() []net.IP {
+	res := []net.IP{}
+	if dhr.cm == nil {
+		return res
+	}
+	for _, addr := range dhr.idxMap[dhr.cm.IfIndex] {
+		if addr.IP.To4() == nil && addr.IP.IsGlobalUnicast() {
+			res = append(res, addr.IP)
+		}
+	}
+	return res
+}
+
+// vias returns the addresses used to pick the Subnet for this request.
+// For relayed requests, this is the link address of the relay closest
+// to the client.
+func (dhr *Dhcp6Request) vias() []net.IP {
+	if len(dhr.relays) > 0 {
+		link := dhr.relays[len(dhr.relays)-1].LinkAddr
+		if link.IsGlobalUnicast() {
+			return []net.IP{link}
+		}
+	}
+	return dhr.listenIPs()
+}
+
+// respondFrom determines which of our IPv6 addresses the client
+// should use to reach us.
+func (dhr *Dhcp6Request) respondFrom(testAddr net.IP) net.IP {
+	if dhr.cm != nil {
+		addrs := dhr.idxMap[dhr.cm.IfIndex]
+		for _, addr := range addrs {
+			if addr.IP.To4() == nil && addr.IP.IsGlobalUnicast() && addr.Contains(testAddr) {
+				return addr.IP
+			}
+		}
+	}
+	if ips := dhr.listenIPs(); len(ips) > 0 {
+		return ips[0]
+	}
+	if ip := net.ParseIP(dhr.handler.bk.OurAddress); ip != nil && ip.To4() == nil {
+		return ip
+	}
+	return nil
+}
+
+// clientMac returns the link-layer address of the client, if we can
+// figure it out.
+func (dhr *Dhcp6Request) clientMac() net.HardwareAddr {
+	for i := len(dhr.relays) - 1; i >= 0; i-- {
+		if val, ok := dhr.relays[i].Options.Get(opt6ClientLinkLayerAddr); ok &&
+			len(val) == 8 && binary.BigEndian.Uint16(val) == 1 {
+			return net.HardwareAddr(val[2:])
+		}
+	}
+	return duidMac(dhr.clientID)
+}
+
+func (dhr *Dhcp6Request) strategy(name string) Strategy6Func {
+	for idx := range dhr.handler.strats {
+		if dhr.handler.strats[idx].Name == name {
+			return dhr.handler.strats[idx].GenToken
+		}
+	}
+	return nil
+}
+
+func (dhr *Dhcp6Request) ownsLease(l *backend.Lease) bool {
+	stratfn := dhr.strategy(l.Strategy)
+	return stratfn != nil && stratfn(dhr) == l.Token
+}
+
+// requested returns whether the client asked for the passed option in
+// its Option Request option.  Clients that send no ORO get everything.
+func (dhr *Dhcp6Request) requested(code uint16) bool {
+	oro, ok := dhr.request.Options.Get(opt6ORO)
+	if !ok {
+		return true
+	}
+	for i := 0; i+1 < len(oro); i += 2 {
+		if binary.BigEndian.Uint16(oro[i:]) == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (dhr *Dhcp6Request) ianas() []*dhcp6IANA {
+	res := []*dhcp6IANA{}
+	for _, buf := range dhr.request.Options.All(opt6IANA) {
+		ia, err := parseIANA(buf)
+		if err != nil {
+			dhr.Errorf("%s: Malformed IA_NA: %v", dhr.xid(), err)
+			continue
+		}
+		res = append(res, ia)
+	}
+	return res
+}
+
+func (dhr *Dhcp6Request) newReply(t dhcp6MsgType) *dhcp6Packet {
+	res := &dhcp6Packet{Type: t, TxID: dhr.request.TxID}
+	if len(dhr.clientID) > 0 {
+		res.Options.Add(opt6ClientID, dhr.clientID)
+	}
+	res.Options.Add(opt6ServerID, dhr.handler.serverID)
+	dhr.reply = res
+	return res
+}
+
+// leaseIA builds the IA_NA we send back to the client for a lease.
+// T1 and T2 follow the recommendations in RFC 8415 section 21.4.
+func leaseIA(iaid []byte, l *backend.Lease) *dhcp6IANA {
+	dur := uint32(l.Duration)
+	return &dhcp6IANA{
+		IAID:  iaid,
+		T1:    dur / 2,
+		T2:    dur * 4 / 5,
+		Addrs: []*dhcp6IAAddr{{Addr: l.Addr, Preferred: dur, Valid: dur}},
+	}
+}
+
+func statusIA(iaid []byte, code uint16, msg string) *dhcp6IANA {
+	return &dhcp6IANA{IAID: iaid, Options: dhcp6Options{status6Option(code, msg)}}
+}
+
+// wireReply wraps the reply in a Relay-reply message for every relay
+// the request passed through.
+func (dhr *Dhcp6Request) wireReply() []byte {
+	if dhr.reply == nil {
+		return nil
+	}
+	buf := dhr.reply.marshal()
+	for i := len(dhr.relays) - 1; i >= 0; i-- {
+		relay := dhr.relays[i]
+		repl := &dhcp6Packet{
+			Type:     dhcp6RelayRepl,
+			HopCount: relay.HopCount,
+			LinkAddr: relay.LinkAddr,
+			PeerAddr: relay.PeerAddr,
+		}
+		if id, ok := relay.Options.Get(opt6InterfaceID); ok {
+			repl.Options.Add(opt6InterfaceID, id)
+		}
+		repl.Options.Add(opt6RelayMsg, buf)
+		buf = repl.marshal()
+	}
+	return buf
+}
+
+func (dhr *Dhcp6Request) checkMachine(l *backend.Lease, opts map[uint16][]byte) {
+	if _, ok := dhr.request.Options.Get(opt6ORO); !ok || !dhr.requested(opt6BootFileURL) {
+		dhr.Tracef("Refusing netboot, no boot file url option requested")
+		dhr.offerNetBoot = false
+		return
+	}
+	// If we have a boot file URL set to "", a reservation told us
+	// to not net boot.
+	if val, ok := opts[opt6BootFileURL]; ok && len(val) == 0 {
+		dhr.Tracef("Refusing netboot, no boot file url option set")
+		dhr.offerNetBoot = false
+		return
+	}
+	if l.SkipBoot {
+		dhr.Tracef("Refusing netboot, subnet does not allow it")
+		dhr.offerNetBoot = false
+		return
+	}
+	rt := dhr.Request(dhr.machine.Locks("update")...)
+	rt.Do(func(d backend.Stores) {
+		if mac := dhr.clientMac(); mac != nil {
+			dhr.machine = rt.MachineForMac(mac.String())
+		}
+		if dhr.machine == nil && !l.Fake() {
+			m2 := rt.FindByIndex("machines", dhr.machine.Indexes()["Address"], l.Addr.String())
+			if m2 != nil {
+				dhr.machine = backend.AsMachine(m2)
+			}
+		}
+		if dhr.machine == nil {
+			if pref, found := rt.Prefs()["unknownBootEnv"]; found {
+				envIsh := rt.RawFind("bootenvs", pref)
+				if envIsh != nil {
+					dhr.bootEnv = backend.AsBootEnv(envIsh)
+				}
+			}
+			dhr.offerNetBoot = true
+			return
+		}
+		if bk := rt.RawFind("bootenvs", dhr.machine.BootEnv); bk != nil {
+			dhr.bootEnv = backend.AsBootEnv(bk)
+		} else {
+			rt.Errorf("%s: Machine %s refers to missing BootEnv %s",
+				dhr.xid(),
+				dhr.machine.UUID(),
+				dhr.machine.BootEnv)
+			dhr.offerNetBoot = true
+			return
+		}
+		if !dhr.bootEnv.NetBoot() {
+			dhr.Tracef("Refusing netboot, bootenv %s does not allow it", dhr.bootEnv.Name)
+			dhr.offerNetBoot = false
+			return
+		}
+		dhr.offerNetBoot = true
+		if l.Fake() {
+			return
+		}
+		// Only record the IPv6 address on machines that do not already
+		// have an IPv4 address, as templates and reservations expect
+		// the IPv4 address when there is one.
+		if dhr.machine.Address.To4() != nil && !dhr.machine.Address.IsUnspecified() {
+			return
+		}
+		if dhr.machine.Address.Equal(l.Addr) {
+			return
+		}
+		others, err := index.All(
+			index.Sort(dhr.machine.Indexes()["Address"]),
+			index.Eq(l.Addr.String()))(rt.Index("machines"))
+		if err == nil && others.Count() > 0 {
+			for _, other := range others.Items() {
+				if other.Key() == dhr.machine.UUID() {
+					continue
+				}
+				oMachine := backend.AsMachine(other)
+				rt.Warnf("Machine %s also has address %s, which we are handing out to %s", oMachine.UUID(), l.Addr, dhr.machine.UUID())
+				oMachine.Address = net.IPv6unspecified
+				rt.Save(oMachine)
+			}
+		}
+		rt.Warnf("%s: Updating machine %s address from %s to %s", dhr.xid(), dhr.machine.UUID(), dhr.machine.Address, l.Addr)
+		dhr.machine.Address = l.Addr
+		rt.Save(dhr.machine)
+	})
+}
+
+// bootFileURL figures out the RFC 5970 boot file URL for the client,
+// based on its architecture and the BootEnv it should be booting.
+func (dhr *Dhcp6Request) bootFileURL(l *backend.Lease) string {
+	host := l.NextServer
+	if host.To4() != nil || !host.IsGlobalUnicast() {
+		host = dhr.respondFrom(l.Addr)
+	}
+	if host == nil {
+		dhr.Errorf("%s: No IPv6 address to serve boot files from", dhr.xid())
+		return ""
+	}
+	var arch uint16
+	if val, ok := dhr.request.Options.Get(opt6ClientArchType); ok && len(val) >= 2 {
+		arch = binary.BigEndian.Uint16(val)
+	}
+	inIPxe := false
+	if val, ok := dhr.request.Options.Get(opt6UserClass); ok {
+		for len(val) >= 2 {
+			n := int(binary.BigEndian.Uint16(val))
+			if n > len(val[2:]) {
+				break
+			}
+			if string(val[2:2+n]) == "iPXE" {
+				inIPxe = true
+			}
+			val = val[2+n:]
+		}
+	}
+	loader := backend.PxeLoaderFor(arch)
+	switch {
+	case arch == 0:
+		dhr.Errorf("%s: Legacy BIOS clients cannot net boot over IPv6", dhr.xid())
+		return ""
+	case loader == nil:
+		dhr.Errorf("%s: Unknown client arch %d: cannot net boot it remotely", dhr.xid(), arch)
+		return ""
+	}
+	fname, useHttp := "", loader.Http
+	if inIPxe {
+		fname = "default.ipxe"
+	} else if dhr.bootEnv != nil {
+		archInfo := dhr.bootEnv.RealArch(loader.Arch)
+		if useHttp && archInfo.HttpLoader != "" {
+			fname = archInfo.HttpLoader
+		} else if archInfo.Loader != "" {
+			fname = archInfo.Loader
+		}
+	}
+	if fname == "" {
+		fname = loader.File
+	}
+	if strings.Contains(fname, "://") {
+		return fname
+	}
+	if useHttp {
+		return fmt.Sprintf("http://[%s]:%d/%s", host, dhr.handler.bk.StaticPort, fname)
+	}
+	return fmt.Sprintf("tftp://[%s]/%s", host, fname)
+}
+
+// addOptions renders the options from the lease and adds the ones the
+// client asked for to the reply, along with the boot file URL if the
+// client should net boot.
+func (dhr *Dhcp6Request) addOptions(reply *dhcp6Packet, l *backend.Lease) {
+	srcOpts := map[int]string{}
+	for _, opt := range dhr.request.Options {
+		_, fn := models.DHCP6OptionParser(opt.Code)
+		srcOpts[int(opt.Code)] = fn(opt.Value)
+	}
+	outOpts := map[uint16][]byte{}
+	for _, opt := range l.Options {
+		c, v, err := opt.RenderToDHCP6(srcOpts)
+		if err != nil {
+			dhr.Errorf("Failed to render option %v: %v, %v", opt.Code, opt.Value, err)
+			continue
+		}
+		outOpts[c] = v
+	}
+	dhr.checkMachine(l, outOpts)
+	if dhr.offerNetBoot {
+		if _, ok := outOpts[opt6BootFileURL]; !ok {
+			if url := dhr.bootFileURL(l); url != "" {
+				outOpts[opt6BootFileURL] = []byte(url)
+			}
+		}
+		if url, ok := outOpts[opt6BootFileURL]; ok && bytes.HasPrefix(url, []byte("http")) {
+			// UEFI HTTP boot clients ignore offers without the
+			// HTTPClient vendor class.
+			vc := []byte{0, 0, 1, 87, 0, 10}
+			outOpts[opt6VendorClass] = append(vc, []byte("HTTPClient")...)
+		}
+	} else {
+		delete(outOpts, opt6BootFileURL)
+		delete(outOpts, models.DHCP6OptionBootFileParam)
+	}
+	codes := []int{}
+	for c := range outOpts {
+		codes = append(codes, int(c))
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		code := uint16(c)
+		if code == opt6VendorClass || dhr.requested(code) {
+			reply.Options.Add(code, outOpts[code])
+		}
+	}
+}
+
+// history records a transaction for addr in the lease history.  If
+// lease is nil, the client is identified by its DUID.
+func (dhr *Dhcp6Request) history(state string, addr net.IP, lease *backend.Lease, msg string) {
+	ent := &models.LeaseHistoryEntry{
+		Addr:     addr,
+		State:    state,
+		Strategy: "DUID",
+		Token:    duidToken(dhr.clientID),
+		Xid:      fmt.Sprintf("0x%06x", dhr.request.TxID),
+		Message:  msg,
+	}
+	if len(dhr.relays) > 0 {
+		ent.Via = dhr.relays[len(dhr.relays)-1].LinkAddr
+	}
+	if dhr.cm != nil {
+		ent.Interface = dhr.ifname()
+	}
+	if lease != nil {
+		ent.Strategy, ent.Token, ent.ExpireTime = lease.Strategy, lease.Token, lease.ExpireTime
+	}
+	if err := dhr.handler.bk.LeaseHistory.Record(ent); err != nil {
+		dhr.Errorf("%s: Failed to record lease history for %s: %v", dhr.xid(), addr, err)
+	}
+}
+
+// findLease finds (and renews) the lease for the passed address,
+// trying each strategy in turn.  If req is nil, the client did not
+// tell us what address it wants, so we use whatever lease it has.
+func (dhr *Dhcp6Request) findLease(req net.IP, vias []net.IP) (lease *backend.Lease, known bool, err error) {
+	for _, s := range dhr.handler.strats {
+		token := s.GenToken(dhr)
+		if token == "" {
+			continue
+		}
+		rt := dhr.Request("leases", "reservations", "subnets")
+		addr := req
+		if addr == nil {
+			l, _ := backend.FindOrCreateLease(rt, s.Name, token, nil, vias)
+			if l == nil {
+				continue
+			}
+			addr = l.Addr
+		}
+		var subnet *backend.Subnet
+		var reservation *backend.Reservation
+		lease, subnet, reservation, err = backend.FindLease(rt, s.Name, token, addr, vias)
+		if lease == nil && subnet == nil && reservation == nil && err == nil {
+			continue
+		}
+		return lease, true, err
+	}
+	return nil, false, nil
+}
+
+func (dhr *Dhcp6Request) solicit() string {
+	ias := dhr.ianas()
+	if len(ias) == 0 {
+		dhr.Infof("%s: Solicit without IA_NA, we only hand out non-temporary addresses", dhr.xid())
+		return "NoIANA"
+	}
+	var hint net.IP
+	if len(ias[0].Addrs) > 0 {
+		hint = ias[0].Addrs[0].Addr
+	}
+	vias := dhr.vias()
+	for _, s := range dhr.handler.strats {
+		token := s.GenToken(dhr)
+		if token == "" {
+			continue
+		}
+		rt := dhr.Request("leases", "reservations", "subnets")
+		lease, fresh := backend.FindOrCreateLease(rt, s.Name, token, hint, vias)
+		if lease == nil {
+			continue
+		}
+		if lease.State == "PROBE" {
+			if !fresh {
+				rt.Debugf("%s: Ignoring Solicit from %s, its request is being processed by another goroutine", dhr.xid(), token)
+				return "InFlight"
+			}
+			// IPv6 clients perform duplicate address detection, so
+			// we do not probe the address first.
+			rt.Do(func(d backend.Stores) {
+				lease.State = "OFFER"
+				rt.Save(lease)
+			})
+		}
+		reply := dhr.newReply(dhcp6Advertise)
+		reply.Options.Add(opt6IANA, leaseIA(ias[0].IAID, lease).marshal())
+		for _, ia := range ias[1:] {
+			reply.Options.Add(opt6IANA, statusIA(ia.IAID, status6NoAddrsAvail, "One address per client").marshal())
+		}
+		dhr.addOptions(reply, lease)
+		dhr.history("OFFER", lease.Addr, lease, "")
+		dhr.Infof("%s: Solicit handing out: %s to %s:%s", dhr.xid(), lease.Addr, s.Name, token)
+		return "Advertise"
+	}
+	return "NoLease"
+}
+
+func (dhr *Dhcp6Request) renew() string {
+	reqType := dhr.request.Type
+	ias := dhr.ianas()
+	if len(ias) == 0 {
+		dhr.Infof("%s: %s without IA_NA, ignoring", dhr.xid(), reqType)
+		return "NoIANA"
+	}
+	var req net.IP
+	if len(ias[0].Addrs) > 0 {
+		req = ias[0].Addrs[0].Addr
+	}
+	lease, known, err := dhr.findLease(req, dhr.vias())
+	if !known && reqType == dhcp6Rebind {
+		// RFC 8415 section 18.3.5: stay quiet if we know nothing about
+		// the client or its link.
+		dhr.Infof("%s: Rebind for %s not covered by any subnet or reservation, ignoring", dhr.xid(), req)
+		return "NoLease"
+	}
+	reply := dhr.newReply(dhcp6Reply)
+	if lease == nil || err != nil {
+		if err != nil {
+			dhr.Infof("%s: %s for %s refused: %v", dhr.xid(), reqType, req, err)
+		}
+		if req != nil {
+			msg := "No lease in database"
+			if err != nil {
+				msg = err.Error()
+			}
+			dhr.history("NAK", req, lease, msg)
+		}
+		var ia *dhcp6IANA
+		switch reqType {
+		case dhcp6Request:
+			ia = statusIA(ias[0].IAID, status6NotOnLink, "Address not available")
+		case dhcp6Rebind:
+			ia = &dhcp6IANA{IAID: ias[0].IAID}
+			for _, addr := range ias[0].Addrs {
+				// Zero lifetimes tell the client to stop using the address.
+				ia.Addrs = append(ia.Addrs, &dhcp6IAAddr{Addr: addr.Addr})
+			}
+		default:
+			ia = statusIA(ias[0].IAID, status6NoBinding, "No binding")
+		}
+		reply.Options.Add(opt6IANA, ia.marshal())
+		return "NAK"
+	}
+	reply.Options.Add(opt6IANA, leaseIA(ias[0].IAID, lease).marshal())
+	for _, ia := range ias[1:] {
+		reply.Options.Add(opt6IANA, statusIA(ia.IAID, status6NoAddrsAvail, "One address per client").marshal())
+	}
+	dhr.addOptions(reply, lease)
+	dhr.history("ACK", lease.Addr, lease, "")
+	dhr.Infof("%s: %s handing out: %s to %s:%s", dhr.xid(), reqType, lease.Addr, lease.Strategy, lease.Token)
+	return "Reply"
+}
+
+func (dhr *Dhcp6Request) release(decline bool) string {
+	rt := dhr.Request("leases")
+	rt.Do(func(d backend.Stores) {
+		for _, ia := range dhr.ianas() {
+			for _, addr := range ia.Addrs {
+				leaseThing := rt.Find("leases", models.Hexaddr(addr.Addr))
+				if leaseThing == nil {
+					rt.Infof("%s: Asked to release or decline a lease we didn't issue by %s, ignoring", dhr.xid(), addr.Addr)
+					continue
+				}
+				lease := backend.AsLease(leaseThing)
+				if !dhr.ownsLease(lease) {
+					rt.Infof("%s: Received spoofed release or decline for %s, ignoring", dhr.xid(), lease.Addr)
+					continue
+				}
+				if decline {
+					rt.Infof("%s: Lease for %s declined, invalidating.", dhr.xid(), lease.Addr)
+					lease.Invalidate()
+					dhr.history("DECLINE", lease.Addr, lease, "")
+				} else {
+					rt.Infof("%s: Lease for %s released, expiring.", dhr.xid(), lease.Addr)
+					lease.Expire()
+					dhr.history("RELEASE", lease.Addr, lease, "")
+				}
+				rt.Save(lease)
+			}
+		}
+	})
+	reply := dhr.newReply(dhcp6Reply)
+	reply.Options = append(reply.Options, status6Option(status6Success, ""))
+	return "Reply"
+}
+
+func (dhr *Dhcp6Request) confirm() string {
+	var subnet *backend.Subnet
+	vias := dhr.vias()
+	rt := dhr.Request("subnets")
+	rt.Do(func(d backend.Stores) {
+		for _, s := range backend.AsSubnets(d("subnets").Items()) {
+			for _, via := range vias {
+				if s.InSubnetRange(via) {
+					subnet = s
+					return
+				}
+			}
+		}
+	})
+	if subnet == nil {
+		dhr.Infof("%s: Cannot determine link for Confirm, ignoring", dhr.xid())
+		return "NoSubnet"
+	}
+	status := status6Success
+	for _, ia := range dhr.ianas() {
+		for _, addr := range ia.Addrs {
+			if !subnet.InSubnetRange(addr.Addr) {
+				status = status6NotOnLink
+			}
+		}
+	}
+	reply := dhr.newReply(dhcp6Reply)
+	reply.Options = append(reply.Options, status6Option(status, ""))
+	return "Reply"
+}
+
+func (dhr *Dhcp6Request) inform() string {
+	vias := dhr.vias()
+	for _, s := range dhr.handler.strats {
+		rt := dhr.Request("leases", "reservations", "subnets")
+		lease := backend.FakeLeaseFor(rt, s.Name, s.GenToken(dhr), vias)
+		if lease == nil {
+			continue
+		}
+		reply := dhr.newReply(dhcp6Reply)
+		dhr.addOptions(reply, lease)
+		return "Reply"
+	}
+	return "NoSubnet"
+}
+
+// ServeDHCP6 is responsible for handling all DHCPv6 client messages.
+func (dhr *Dhcp6Request) ServeDHCP6() string {
+	req := dhr.request
+	switch req.Type {
+	case dhcp6Advertise, dhcp6Reply, dhcp6Reconfigure:
+		dhr.Warnf("WARNING: %s: Competing DHCPv6 server on network: %s", dhr.xid(), dhr.srcAddr)
+		return "Ignored"
+	case dhcp6RelayRepl:
+		return "Ignored"
+	}
+	clientID, haveClient := req.Options.Get(opt6ClientID)
+	serverID, haveServer := req.Options.Get(opt6ServerID)
+	dhr.clientID = clientID
+	switch req.Type {
+	case dhcp6Solicit, dhcp6Confirm, dhcp6Rebind:
+		if !haveClient || haveServer {
+			dhr.Infof("%s: Malformed %s", dhr.xid(), req.Type)
+			return "Malformed"
+		}
+	case dhcp6Request, dhcp6Renew, dhcp6Release, dhcp6Decline:
+		if !haveClient || !haveServer {
+			dhr.Infof("%s: Malformed %s", dhr.xid(), req.Type)
+			return "Malformed"
+		}
+		if !bytes.Equal(serverID, dhr.handler.serverID) {
+			dhr.Debugf("%s: Ignoring %s for DHCPv6 server %s", dhr.xid(), req.Type, duidToken(serverID))
+			return "OtherServer"
+		}
+	case dhcp6InformationRequest:
+		if haveServer && !bytes.Equal(serverID, dhr.handler.serverID) {
+			return "OtherServer"
+		}
+	}
+	switch req.Type {
+	case dhcp6Solicit:
+		return dhr.solicit()
+	case dhcp6Request, dhcp6Renew, dhcp6Rebind:
+		return dhr.renew()
+	case dhcp6Release:
+		return dhr.release(false)
+	case dhcp6Decline:
+		return dhr.release(true)
+	case dhcp6Confirm:
+		return dhr.confirm()
+	case dhcp6InformationRequest:
+		return dhr.inform()
+	}
+	return "NotHandled"
+}
+
+// Process unwraps any relay messages around the incoming packet,
+// checks basic sanity, and hands the client message to ServeDHCP6.
+func (dhr *Dhcp6Request) Process(buf []byte) (string, string) {
+	pkt, err := parseDhcp6(buf)
+	if err != nil {
+		dhr.Errorf("Malformed DHCPv6 packet: %v", err)
+		return "Malformed", "Error"
+	}
+	for pkt.Type == dhcp6RelayForw {
+		// RFC 8415 section 7.6 HOP_COUNT_LIMIT
+		if len(dhr.relays) > 8 {
+			dhr.Errorf("Too many DHCPv6 relay hops")
+			return "RelayForw", "TooManyHops"
+		}
+		dhr.relays = append(dhr.relays, pkt)
+		inner, ok := pkt.Options.Get(opt6RelayMsg)
+		if !ok {
+			dhr.Errorf("Relay message from %s missing relay message option", pkt.PeerAddr)
+			return "RelayForw", "Error"
+		}
+		if pkt, err = parseDhcp6(inner); err != nil {
+			dhr.Errorf("Malformed relayed DHCPv6 packet: %v", err)
+			return "RelayForw", "Error"
+		}
+	}
+	dhr.request = pkt
+	reqType := pkt.Type.String()
+	if dhr.IsDebug() {
+		dhr.Debugf("Handling packet:\n%s", dhr.marshalText(pkt))
+	}
+	tgtName := dhr.ifname()
+	if tgtName == "" {
+		dhr.Infof("Inferface vanished")
+		return reqType, "BadInterface"
+	}
+	if len(dhr.handler.ifs) > 0 {
+		canProcess := false
+		for _, ifName := range dhr.handler.ifs {
+			if strings.TrimSpace(ifName) == tgtName {
+				canProcess = true
+				break
+			}
+		}
+		if !canProcess {
+			dhr.Infof("%s Ignoring packet from interface %s", dhr.xid(), tgtName)
+			return reqType, "Ignored"
+		}
+	}
+	return reqType, dhr.ServeDHCP6()
+}
+
+// Run processes an incoming DHCPv6 packet and sends the resulting
+// reply (if any) back to the client or relay that sent it.
+func (dhr *Dhcp6Request) Run(buf []byte) {
+	rqt, rst := dhr.Process(buf)
+	elapsed := float64(time.Since(dhr.start)) / float64(time.Second)
+	out := dhr.wireReply()
+	if out == nil {
+		dhr.handler.metrics.CountPacket(float64(len(buf)), elapsed, nil, rqt, rst)
+		return
+	}
+	if dhr.IsDebug() {
+		dhr.Debugf("Sending packet:\n%s", dhr.marshalText(dhr.reply))
+	}
+	var cm *ipv6.ControlMessage
+	if len(dhr.relays) == 0 && dhr.cm != nil {
+		cm = &ipv6.ControlMessage{IfIndex: dhr.cm.IfIndex}
+	}
+	dhr.handler.conn.WriteTo(out, cm, dhr.srcAddr)
+	dhr.handler.metrics.CountPacket(float64(len(buf)), elapsed, dhcp.Packet(out), rqt, rst)
+}
+
+// Dhcp6Handler listens for incoming DHCPv6 packets and builds a
+// Dhcp6Request to handle each one.
+type Dhcp6Handler struct {
+	logger.Logger
+	waitGroup  *sync.WaitGroup
+	closing    bool
+	ifs        []string
+	port       int
+	conn       *ipv6.PacketConn
+	bk         *backend.DataTracker
+	strats     []*Strategy6
+	serverID   []byte
+	publishers *backend.Publishers
+	metrics    *DhcpMetrics
+}
+
+// serverDUID builds a DUID-UUID (RFC 6355) for this dr-provision
+// endpoint.  It is derived from the endpoint ID so that it stays the
+// same across restarts and hardware changes.
+func serverDUID(drpId string) []byte {
+	res := []byte{0, 4}
+	return append(res, uuid.NewSHA1(uuid.NameSpace_OID, []byte("dr-provision:"+drpId))...)
+}
+
+func (h *Dhcp6Handler) NewRequest(cm *ipv6.ControlMessage, srcAddr net.Addr, start time.Time) *Dhcp6Request {
+	res := &Dhcp6Request{}
+	res.Logger = h.Logger.Fork().SetPrincipal("dhcp6")
+	res.srcAddr = srcAddr
+	res.cm = cm
+	res.handler = h
+	res.start = start
+	res.fill()
+	return res
+}
+
+func (h *Dhcp6Handler) Serve() error {
+	defer h.waitGroup.Done()
+	defer h.conn.Close()
+	buf := make([]byte, 16384)
+	for {
+		h.conn.SetReadDeadline(time.Now().Add(time.Second))
+		cnt, cm, srcAddr, err := h.conn.ReadFrom(buf)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		if cnt < 4 {
+			h.metrics.CountPacket(float64(cnt), float64(0), nil, "TooSmall", "TooSmall")
+			continue
+		}
+		pktBytes := make([]byte, cnt)
+		copy(pktBytes, buf)
+		go h.NewRequest(cm, srcAddr, start).Run(pktBytes)
+	}
+}
+
+func (h *Dhcp6Handler) Shutdown(ctx context.Context) error {
+	h.Infof("Shutting down DHCPv6 handler")
+	h.closing = true
+	h.conn.Close()
+	h.waitGroup.Wait()
+	h.Infof("DHCPv6 handler shut down")
+	return nil
+}
+
+// StartDhcp6Handler starts a DHCPv6 server listening on the passed port
+// that joins the All_DHCP_Relay_Agents_and_Servers multicast group on
+// every usable interface.
+func StartDhcp6Handler(dhcpInfo *backend.DataTracker,
+	log logger.Logger,
+	dhcpIfs string,
+	dhcpPort int,
+	pubs *backend.Publishers) (Service, error) {
+
+	ifs := []string{}
+	if dhcpIfs != "" {
+		ifs = strings.Split(dhcpIfs, ",")
+	}
+	handler := &Dhcp6Handler{
+		Logger:    log,
+		waitGroup: &sync.WaitGroup{},
+		ifs:       ifs,
+		bk:        dhcpInfo,
+		port:      dhcpPort,
+		strats: []*Strategy6{
+			{Name: "DUID", GenToken: DuidStrategy},
+			{Name: "MAC", GenToken: Mac6Strategy},
+		},
+		serverID:   serverDUID(dhcpInfo.DrpId),
+		publishers: pubs,
+		metrics:    newDhcpMetrics(log, "drp_dhcp6"),
+	}
+
+	l, err := net.ListenPacket("udp6", fmt.Sprintf("[::]:%d", handler.port))
+	if err != nil {
+		return nil, err
+	}
+	handler.conn = ipv6.NewPacketConn(l)
+	if err := handler.conn.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		l.Close()
+		return nil, err
+	}
+	group := &net.UDPAddr{IP: net.ParseIP("ff02::1:2")}
+	netIfs, err := net.Interfaces()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	joined := 0
+	for i := range netIfs {
+		iface := netIfs[i]
+		if iface.Flags&net.FlagUp == 0 ||
+			iface.Flags&net.FlagMulticast == 0 ||
+			iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if len(ifs) > 0 {
+			wanted := false
+			for _, ifName := range ifs {
+				if strings.TrimSpace(ifName) == iface.Name {
+					wanted = true
+					break
+				}
+			}
+			if !wanted {
+				continue
+			}
+		}
+		if err := handler.conn.JoinGroup(&iface, group); err != nil {
+			log.Warnf("DHCPv6: cannot join %s on %s: %v", group.IP, iface.Name, err)
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		log.Warnf("DHCPv6: not listening for multicast on any interface, only relayed requests will be handled")
+	}
+	handler.waitGroup.Add(1)
+	go func() {
+		err := handler.Serve()
+		if !handler.closing {
+			handler.Fatalf("DHCPv6 handler died: %v", err)
+		}
+	}()
+	return handler, nil
+}
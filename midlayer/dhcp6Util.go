@@ -0,0 +1,329 @@
+package midlayer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// dhcp6MsgType is a DHCPv6 message type, as defined in RFC 8415 section 7.3
+type dhcp6MsgType byte
+
+const (
+	dhcp6Solicit            dhcp6MsgType = 1
+	dhcp6Advertise          dhcp6MsgType = 2
+	dhcp6Request            dhcp6MsgType = 3
+	dhcp6Confirm            dhcp6MsgType = 4
+	dhcp6Renew              dhcp6MsgType = 5
+	dhcp6Rebind             dhcp6MsgType = 6
+	dhcp6Reply              dhcp6MsgType = 7
+	dhcp6Release            dhcp6MsgType = 8
+	dhcp6Decline            dhcp6MsgType = 9
+	dhcp6Reconfigure        dhcp6MsgType = 10
+	dhcp6InformationRequest dhcp6MsgType = 11
+	dhcp6RelayForw          dhcp6MsgType = 12
+	dhcp6RelayRepl          dhcp6MsgType = 13
+)
+
+func (t dhcp6MsgType) String() string {
+	switch t {
+	case dhcp6Solicit:
+		return "Solicit"
+	case dhcp6Advertise:
+		return "Advertise"
+	case dhcp6Request:
+		return "Request"
+	case dhcp6Confirm:
+		return "Confirm"
+	case dhcp6Renew:
+		return "Renew"
+	case dhcp6Rebind:
+		return "Rebind"
+	case dhcp6Reply:
+		return "Reply"
+	case dhcp6Release:
+		return "Release"
+	case dhcp6Decline:
+		return "Decline"
+	case dhcp6Reconfigure:
+		return "Reconfigure"
+	case dhcp6InformationRequest:
+		return "InformationRequest"
+	case dhcp6RelayForw:
+		return "RelayForw"
+	case dhcp6RelayRepl:
+		return "RelayRepl"
+	default:
+		return fmt.Sprintf("Unknown(%d)", byte(t))
+	}
+}
+
+// DHCPv6 option codes that the server handles directly.  Options
+// that are only passed through to clients live in models.
+const (
+	opt6ClientID            uint16 = 1
+	opt6ServerID            uint16 = 2
+	opt6IANA                uint16 = 3
+	opt6IAAddr              uint16 = 5
+	opt6ORO                 uint16 = 6
+	opt6ElapsedTime         uint16 = 8
+	opt6RelayMsg            uint16 = 9
+	opt6StatusCode          uint16 = 13
+	opt6RapidCommit         uint16 = 14
+	opt6UserClass           uint16 = 15
+	opt6VendorClass         uint16 = 16
+	opt6InterfaceID         uint16 = 18
+	opt6BootFileURL         uint16 = 59
+	opt6ClientArchType      uint16 = 61
+	opt6ClientNII           uint16 = 62
+	opt6ClientLinkLayerAddr uint16 = 79
+)
+
+// DHCPv6 status codes, from RFC 8415 section 21.13
+const (
+	status6Success      uint16 = 0
+	status6UnspecFail   uint16 = 1
+	status6NoAddrsAvail uint16 = 2
+	status6NoBinding    uint16 = 3
+	status6NotOnLink    uint16 = 4
+	status6UseMulticast uint16 = 5
+)
+
+type dhcp6Option struct {
+	Code  uint16
+	Value []byte
+}
+
+// dhcp6Options is an ordered list of DHCPv6 options.  Unlike DHCPv4,
+// an option code may legitimately appear more than once.
+type dhcp6Options []dhcp6Option
+
+func (o dhcp6Options) Get(code uint16) ([]byte, bool) {
+	for i := range o {
+		if o[i].Code == code {
+			return o[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+func (o dhcp6Options) All(code uint16) [][]byte {
+	res := [][]byte{}
+	for i := range o {
+		if o[i].Code == code {
+			res = append(res, o[i].Value)
+		}
+	}
+	return res
+}
+
+func (o *dhcp6Options) Add(code uint16, val []byte) {
+	*o = append(*o, dhcp6Option{Code: code, Value: val})
+}
+
+func (o dhcp6Options) marshal() []byte {
+	buf := &bytes.Buffer{}
+	hdr := make([]byte, 4)
+	for _, opt := range o {
+		binary.BigEndian.PutUint16(hdr, opt.Code)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(opt.Value)))
+		buf.Write(hdr)
+		buf.Write(opt.Value)
+	}
+	return buf.Bytes()
+}
+
+func parseDhcp6Options(buf []byte) (dhcp6Options, error) {
+	res := dhcp6Options{}
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, fmt.Errorf("Truncated DHCPv6 option header")
+		}
+		code := binary.BigEndian.Uint16(buf)
+		l := int(binary.BigEndian.Uint16(buf[2:]))
+		buf = buf[4:]
+		if l > len(buf) {
+			return nil, fmt.Errorf("DHCPv6 option %d length %d overruns packet", code, l)
+		}
+		val := make([]byte, l)
+		copy(val, buf[:l])
+		res = append(res, dhcp6Option{Code: code, Value: val})
+		buf = buf[l:]
+	}
+	return res, nil
+}
+
+// dhcp6Packet is either a client/server message or a relay message.
+// For relay messages, HopCount, LinkAddr, and PeerAddr are filled,
+// and TxID is unused.
+type dhcp6Packet struct {
+	Type     dhcp6MsgType
+	TxID     uint32
+	HopCount byte
+	LinkAddr net.IP
+	PeerAddr net.IP
+	Options  dhcp6Options
+}
+
+func (p *dhcp6Packet) isRelay() bool {
+	return p.Type == dhcp6RelayForw || p.Type == dhcp6RelayRepl
+}
+
+func parseDhcp6(buf []byte) (*dhcp6Packet, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("DHCPv6 packet too short")
+	}
+	res := &dhcp6Packet{Type: dhcp6MsgType(buf[0])}
+	var err error
+	if res.isRelay() {
+		if len(buf) < 34 {
+			return nil, fmt.Errorf("DHCPv6 relay packet too short")
+		}
+		res.HopCount = buf[1]
+		res.LinkAddr = net.IP(append([]byte{}, buf[2:18]...))
+		res.PeerAddr = net.IP(append([]byte{}, buf[18:34]...))
+		res.Options, err = parseDhcp6Options(buf[34:])
+	} else {
+		res.TxID = uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
+		res.Options, err = parseDhcp6Options(buf[4:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (p *dhcp6Packet) marshal() []byte {
+	var hdr []byte
+	if p.isRelay() {
+		hdr = make([]byte, 34)
+		hdr[0] = byte(p.Type)
+		hdr[1] = p.HopCount
+		copy(hdr[2:18], p.LinkAddr.To16())
+		copy(hdr[18:34], p.PeerAddr.To16())
+	} else {
+		hdr = []byte{byte(p.Type), byte(p.TxID >> 16), byte(p.TxID >> 8), byte(p.TxID)}
+	}
+	return append(hdr, p.Options.marshal()...)
+}
+
+func (p *dhcp6Packet) xid() string {
+	return fmt.Sprintf("xid 0x%06x", p.TxID)
+}
+
+// dhcp6IAAddr is an IA Address option (RFC 8415 section 21.6)
+type dhcp6IAAddr struct {
+	Addr      net.IP
+	Preferred uint32
+	Valid     uint32
+	Options   dhcp6Options
+}
+
+func (a *dhcp6IAAddr) marshal() []byte {
+	buf := make([]byte, 24)
+	copy(buf, a.Addr.To16())
+	binary.BigEndian.PutUint32(buf[16:], a.Preferred)
+	binary.BigEndian.PutUint32(buf[20:], a.Valid)
+	return append(buf, a.Options.marshal()...)
+}
+
+// dhcp6IANA is an Identity Association for Non-temporary Addresses
+// (RFC 8415 section 21.4).
+type dhcp6IANA struct {
+	IAID    []byte
+	T1, T2  uint32
+	Addrs   []*dhcp6IAAddr
+	Options dhcp6Options
+}
+
+func parseIANA(buf []byte) (*dhcp6IANA, error) {
+	if len(buf) < 12 {
+		return nil, fmt.Errorf("IA_NA option too short")
+	}
+	res := &dhcp6IANA{
+		IAID:  append([]byte{}, buf[:4]...),
+		T1:    binary.BigEndian.Uint32(buf[4:]),
+		T2:    binary.BigEndian.Uint32(buf[8:]),
+		Addrs: []*dhcp6IAAddr{},
+	}
+	opts, err := parseDhcp6Options(buf[12:])
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if opt.Code != opt6IAAddr {
+			res.Options = append(res.Options, opt)
+			continue
+		}
+		if len(opt.Value) < 24 {
+			return nil, fmt.Errorf("IAADDR option too short")
+		}
+		addr := &dhcp6IAAddr{
+			Addr:      net.IP(append([]byte{}, opt.Value[:16]...)),
+			Preferred: binary.BigEndian.Uint32(opt.Value[16:]),
+			Valid:     binary.BigEndian.Uint32(opt.Value[20:]),
+		}
+		if addr.Options, err = parseDhcp6Options(opt.Value[24:]); err != nil {
+			return nil, err
+		}
+		res.Addrs = append(res.Addrs, addr)
+	}
+	return res, nil
+}
+
+func (ia *dhcp6IANA) marshal() []byte {
+	buf := make([]byte, 12)
+	copy(buf, ia.IAID)
+	binary.BigEndian.PutUint32(buf[4:], ia.T1)
+	binary.BigEndian.PutUint32(buf[8:], ia.T2)
+	opts := dhcp6Options{}
+	for _, addr := range ia.Addrs {
+		opts.Add(opt6IAAddr, addr.marshal())
+	}
+	opts = append(opts, ia.Options...)
+	return append(buf, opts.marshal()...)
+}
+
+func status6Option(code uint16, msg string) dhcp6Option {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, code)
+	return dhcp6Option{Code: opt6StatusCode, Value: append(buf, []byte(msg)...)}
+}
+
+// duidToken renders a DUID as colon-separated hex bytes.  This is the
+// token used by the DUID strategy.
+func duidToken(duid []byte) string {
+	return colonHex(duid)
+}
+
+// duidMac extracts the Ethernet address from a DUID-LLT or DUID-LL.
+// It returns nil for all other DUID types.
+func duidMac(duid []byte) net.HardwareAddr {
+	if len(duid) < 4 || binary.BigEndian.Uint16(duid[2:]) != 1 {
+		return nil
+	}
+	var mac []byte
+	switch binary.BigEndian.Uint16(duid) {
+	case 1:
+		if len(duid) >= 8 {
+			mac = duid[8:]
+		}
+	case 3:
+		mac = duid[4:]
+	}
+	if len(mac) != 6 {
+		return nil
+	}
+	return net.HardwareAddr(mac)
+}
+
+func (dhr *Dhcp6Request) marshalText(p *dhcp6Packet) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "proto:dhcp6 iface:%s ifaddr:%s\n", dhr.ifname(), dhr.srcAddr)
+	fmt.Fprintf(buf, "type:%s %s\n", p.Type, p.xid())
+	for _, opt := range p.Options {
+		fmt.Fprintf(buf, "option:code:%03d val:%x\n", opt.Code, opt.Value)
+	}
+	return buf.String()
+}
@@ -0,0 +1,217 @@
+package midlayer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/ipv6"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+)
+
+var (
+	testDuid  = []byte{0, 3, 0, 1, 0x52, 0x54, 0, 0x12, 0x34, 0x56}
+	otherDuid = []byte{0, 3, 0, 1, 0x52, 0x54, 0, 0x65, 0x43, 0x21}
+)
+
+func dhcp6Handler() *Dhcp6Handler {
+	return &Dhcp6Handler{
+		Logger: logger.New(nil).Log("dhcp6"),
+		ifs:    []string{},
+		bk:     dataTracker,
+		strats: []*Strategy6{
+			{Name: "DUID", GenToken: DuidStrategy},
+			{Name: "MAC", GenToken: Mac6Strategy},
+		},
+		serverID: serverDUID("fred"),
+	}
+}
+
+func rt6(t *testing.T, h *Dhcp6Handler) *Dhcp6Request {
+	return &Dhcp6Request{
+		Logger: logger.New(nil).Log("dhcp6").SetLevel(logger.Info),
+		idxMap: map[int][]*net.IPNet{
+			1: {{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)}},
+			2: {
+				{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+				{IP: net.ParseIP("fd00:124::1"), Mask: net.CIDRMask(64, 128)},
+			},
+			3: {{IP: net.ParseIP("fe80::2"), Mask: net.CIDRMask(64, 128)}},
+		},
+		nameMap: map[int]string{1: "lo", 2: "eno1", 3: "eno2"},
+		cm:      &ipv6.ControlMessage{IfIndex: 2},
+		srcAddr: &net.UDPAddr{IP: net.ParseIP("fe80::5054:ff:fe12:3456"), Port: 546},
+		handler: h,
+	}
+}
+
+func clientMsg(mt dhcp6MsgType, duid, serverID []byte, addr net.IP) []byte {
+	p := &dhcp6Packet{Type: mt, TxID: 0x123456}
+	p.Options.Add(opt6ClientID, duid)
+	if serverID != nil {
+		p.Options.Add(opt6ServerID, serverID)
+	}
+	ia := &dhcp6IANA{IAID: []byte{0, 0, 0, 1}}
+	if addr != nil {
+		ia.Addrs = append(ia.Addrs, &dhcp6IAAddr{Addr: addr})
+	}
+	p.Options.Add(opt6IANA, ia.marshal())
+	p.Options.Add(opt6ORO, []byte{0, 23, 0, 24, 0, 59})
+	p.Options.Add(opt6ClientArchType, []byte{0, 7})
+	return p.marshal()
+}
+
+func replyIA(t *testing.T, p *dhcp6Packet) *dhcp6IANA {
+	t.Helper()
+	buf, ok := p.Options.Get(opt6IANA)
+	if !ok {
+		t.Fatalf("Reply missing IA_NA")
+	}
+	ia, err := parseIANA(buf)
+	if err != nil {
+		t.Fatalf("Reply has bad IA_NA: %v", err)
+	}
+	return ia
+}
+
+func TestDHCP6Codec(t *testing.T) {
+	buf := clientMsg(dhcp6Request, testDuid, serverDUID("fred"), net.ParseIP("fd00:124::10"))
+	p, err := parseDhcp6(buf)
+	if err != nil {
+		t.Fatalf("Failed to parse packet: %v", err)
+	}
+	if p.Type != dhcp6Request || p.TxID != 0x123456 {
+		t.Errorf("Expected Request xid 0x123456, got %s %s", p.Type, p.xid())
+	}
+	if !bytes.Equal(p.marshal(), buf) {
+		t.Errorf("Packet did not survive a round trip")
+	}
+	ia := replyIA(t, p)
+	if len(ia.Addrs) != 1 || !ia.Addrs[0].Addr.Equal(net.ParseIP("fd00:124::10")) {
+		t.Errorf("IA_NA did not survive a round trip: %v", ia.Addrs)
+	}
+	if _, err := parseDhcp6(buf[:len(buf)-1]); err == nil {
+		t.Errorf("Truncated packet should not parse")
+	}
+	if mac := duidMac(testDuid); mac.String() != "52:54:00:12:34:56" {
+		t.Errorf("Expected MAC 52:54:00:12:34:56 from DUID-LL, got %s", mac)
+	}
+	if duidToken(testDuid) != "00:03:00:01:52:54:00:12:34:56" {
+		t.Errorf("Unexpected DUID token %s", duidToken(testDuid))
+	}
+}
+
+func TestDHCP6Exchange(t *testing.T) {
+	clearLeases()
+	h := dhcp6Handler()
+	// Solicit
+	dhr := rt6(t, h)
+	if _, res := dhr.Process(clientMsg(dhcp6Solicit, testDuid, nil, nil)); res != "Advertise" {
+		t.Fatalf("Expected Advertise, got %s", res)
+	}
+	ia := replyIA(t, dhr.reply)
+	if len(ia.Addrs) != 1 {
+		t.Fatalf("Expected 1 address in Advertise, got %d", len(ia.Addrs))
+	}
+	addr := ia.Addrs[0].Addr
+	if !addr.Equal(net.ParseIP("fd00:124::10")) {
+		t.Errorf("Expected to be offered fd00:124::10, got %s", addr)
+	}
+	if ia.T1 != 30 || ia.T2 != 48 || ia.Addrs[0].Valid != 60 {
+		t.Errorf("Unexpected lifetimes T1 %d T2 %d valid %d", ia.T1, ia.T2, ia.Addrs[0].Valid)
+	}
+	if sid, _ := dhr.reply.Options.Get(opt6ServerID); !bytes.Equal(sid, h.serverID) {
+		t.Errorf("Advertise has wrong server ID")
+	}
+	if dns, _ := dhr.reply.Options.Get(23); !net.IP(dns).Equal(net.ParseIP("fd00:124::1")) {
+		t.Errorf("Advertise has wrong DNS server option: %v", dns)
+	}
+	if url, _ := dhr.reply.Options.Get(opt6BootFileURL); !strings.HasPrefix(string(url), "tftp://[fd00:124::1]/") {
+		t.Errorf("Advertise has wrong boot file URL: %q", string(url))
+	}
+	// Request
+	dhr = rt6(t, h)
+	if _, res := dhr.Process(clientMsg(dhcp6Request, testDuid, h.serverID, addr)); res != "Reply" {
+		t.Fatalf("Expected Reply, got %s", res)
+	}
+	if got := replyIA(t, dhr.reply); len(got.Addrs) != 1 || !got.Addrs[0].Addr.Equal(addr) {
+		t.Errorf("Request did not get %s", addr)
+	}
+	rt := dataTracker.Request(dataTracker.Logger, "leases")
+	rt.Do(func(d backend.Stores) {
+		l := rt.Find("leases", models.Hexaddr(addr))
+		if l == nil {
+			t.Errorf("No lease saved for %s", addr)
+			return
+		}
+		lease := backend.AsLease(l)
+		if lease.State != "ACK" || lease.Token != duidToken(testDuid) || lease.Strategy != "DUID" {
+			t.Errorf("Unexpected lease %s: %s %s:%s", addr, lease.State, lease.Strategy, lease.Token)
+		}
+	})
+	// Requests for another server are ignored
+	dhr = rt6(t, h)
+	if _, res := dhr.Process(clientMsg(dhcp6Request, testDuid, serverDUID("barney"), addr)); res != "OtherServer" {
+		t.Errorf("Expected OtherServer, got %s", res)
+	}
+	// Renew from a different client
+	dhr = rt6(t, h)
+	if _, res := dhr.Process(clientMsg(dhcp6Renew, otherDuid, h.serverID, addr)); res != "NAK" {
+		t.Errorf("Expected NAK, got %s", res)
+	}
+	if st, _ := replyIA(t, dhr.reply).Options.Get(opt6StatusCode); len(st) < 2 || binary.BigEndian.Uint16(st) != status6NoBinding {
+		t.Errorf("Expected NoBinding status, got %v", st)
+	}
+	// Release
+	dhr = rt6(t, h)
+	if _, res := dhr.Process(clientMsg(dhcp6Release, testDuid, h.serverID, addr)); res != "Reply" {
+		t.Errorf("Expected Reply, got %s", res)
+	}
+	rt.Do(func(d backend.Stores) {
+		if l := rt.Find("leases", models.Hexaddr(addr)); l == nil || !backend.AsLease(l).Expired() {
+			t.Errorf("Lease for %s should have been expired", addr)
+		}
+	})
+}
+
+func TestDHCP6Relay(t *testing.T) {
+	clearLeases()
+	h := dhcp6Handler()
+	dhr := rt6(t, h)
+	// Relayed requests arrive on an interface with no global address.
+	dhr.cm.IfIndex = 3
+	dhr.srcAddr = &net.UDPAddr{IP: net.ParseIP("fd00:99::1"), Port: 547}
+	relay := &dhcp6Packet{
+		Type:     dhcp6RelayForw,
+		LinkAddr: net.ParseIP("fd00:124::2"),
+		PeerAddr: net.ParseIP("fe80::5054:ff:fe65:4321"),
+	}
+	relay.Options.Add(opt6InterfaceID, []byte("swp1"))
+	relay.Options.Add(opt6RelayMsg, clientMsg(dhcp6Solicit, otherDuid, nil, nil))
+	if rqt, res := dhr.Process(relay.marshal()); rqt != "Solicit" || res != "Advertise" {
+		t.Fatalf("Expected Solicit/Advertise, got %s/%s", rqt, res)
+	}
+	out, err := parseDhcp6(dhr.wireReply())
+	if err != nil {
+		t.Fatalf("Cannot parse relay reply: %v", err)
+	}
+	if out.Type != dhcp6RelayRepl || !out.PeerAddr.Equal(relay.PeerAddr) {
+		t.Errorf("Expected RelayRepl to %s, got %s to %s", relay.PeerAddr, out.Type, out.PeerAddr)
+	}
+	if id, _ := out.Options.Get(opt6InterfaceID); string(id) != "swp1" {
+		t.Errorf("Relay reply did not echo interface ID")
+	}
+	inner, _ := out.Options.Get(opt6RelayMsg)
+	adv, err := parseDhcp6(inner)
+	if err != nil || adv.Type != dhcp6Advertise {
+		t.Fatalf("Relay reply does not contain an Advertise: %v", err)
+	}
+	if ia := replyIA(t, adv); len(ia.Addrs) != 1 || !ia.Addrs[0].Addr.Equal(net.ParseIP("fd00:124::10")) {
+		t.Errorf("Relayed client did not get fd00:124::10")
+	}
+}
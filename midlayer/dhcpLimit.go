@@ -0,0 +1,129 @@
+package midlayer
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/provision/models"
+)
+
+// DhcpRateLimit configures DHCP storm protection.  A client MAC
+// address that sends more than MacBurst packets within Window, or a
+// relay that forwards more than RelayBurst packets within Window, is
+// ignored for IgnoreFor.  A zero burst turns off limiting for that
+// kind of sender.
+type DhcpRateLimit struct {
+	MacBurst   int
+	RelayBurst int
+	Window     time.Duration
+	IgnoreFor  time.Duration
+}
+
+type rateCount struct {
+	start, until time.Time
+	count        int
+}
+
+// rateLimiter counts packets per sender over fixed windows, and
+// tracks which senders are currently being ignored.
+type rateLimiter struct {
+	DhcpRateLimit
+	mux       *sync.Mutex
+	counts    map[string]*rateCount
+	lastPrune time.Time
+}
+
+func newRateLimiter(limits DhcpRateLimit) *rateLimiter {
+	if limits.MacBurst <= 0 && limits.RelayBurst <= 0 {
+		return nil
+	}
+	if limits.Window <= 0 {
+		limits.Window = 10 * time.Second
+	}
+	if limits.IgnoreFor <= 0 {
+		limits.IgnoreFor = time.Minute
+	}
+	return &rateLimiter{
+		DhcpRateLimit: limits,
+		mux:           &sync.Mutex{},
+		counts:        map[string]*rateCount{},
+	}
+}
+
+// prune drops senders whose window is over and who are not being
+// ignored.  It must be called with the lock held.
+func (r *rateLimiter) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < r.Window {
+		return
+	}
+	r.lastPrune = now
+	for k, c := range r.counts {
+		if now.Sub(c.start) >= r.Window && now.After(c.until) {
+			delete(r.counts, k)
+		}
+	}
+}
+
+// allow counts a packet from key.  It returns false if the packet
+// should be dropped, along with a DhcpThrottle if this packet is the
+// one that started the sender being ignored.
+func (r *rateLimiter) allow(kind, key string, burst int, now time.Time) (bool, *models.DhcpThrottle) {
+	if r == nil || burst <= 0 || key == "" {
+		return true, nil
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.prune(now)
+	c, ok := r.counts[kind+":"+key]
+	if !ok {
+		c = &rateCount{start: now}
+		r.counts[kind+":"+key] = c
+	}
+	if now.Before(c.until) {
+		return false, nil
+	}
+	if now.Sub(c.start) >= r.Window {
+		c.start, c.count = now, 0
+	}
+	c.count++
+	if c.count <= burst {
+		return true, nil
+	}
+	c.until = now.Add(r.IgnoreFor)
+	return false, &models.DhcpThrottle{Kind: kind, Key: key, Count: c.count, Until: c.until}
+}
+
+type rateCheck struct {
+	kind, key string
+	burst     int
+}
+
+// throttled returns true if the request should be ignored because its
+// client or relay has been sending packets too quickly.
+func (h *DhcpHandler) throttled(dhr *DhcpRequest) bool {
+	if h.limiter == nil {
+		return false
+	}
+	now := time.Now()
+	checks := []rateCheck{{"mac", dhr.request.CHAddr().String(), h.limiter.MacBurst}}
+	if relay := dhr.request.GIAddr(); !relay.Equal(net.IPv4zero) {
+		checks = append(checks, rateCheck{"relay", relay.String(), h.limiter.RelayBurst})
+	}
+	for _, c := range checks {
+		ok, ev := h.limiter.allow(c.kind, c.key, c.burst, now)
+		if ok {
+			continue
+		}
+		h.metrics.CountThrottled(c.kind)
+		if ev != nil {
+			dhr.Warnf("%s Ignoring %s %s until %s: %d packets in %s",
+				dhr.xid(), c.kind, c.key, ev.Until.Format(time.RFC3339), ev.Count, h.limiter.Window)
+			if h.publishers != nil {
+				h.publishers.Publish("dhcp", "throttle", c.key, "dhcp", ev)
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package midlayer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDhcpRateLimit(t *testing.T) {
+	if newRateLimiter(DhcpRateLimit{}) != nil {
+		t.Errorf("Expected no rate limiter when both bursts are 0")
+	}
+	r := newRateLimiter(DhcpRateLimit{MacBurst: 3, Window: 10 * time.Second, IgnoreFor: time.Minute})
+	now := time.Now()
+	mac := "52:54:00:12:34:56"
+	for i := 0; i < 3; i++ {
+		if ok, _ := r.allow("mac", mac, r.MacBurst, now); !ok {
+			t.Fatalf("Packet %d should be allowed", i)
+		}
+	}
+	ok, ev := r.allow("mac", mac, r.MacBurst, now)
+	if ok || ev == nil {
+		t.Fatalf("Fourth packet should start throttling")
+	}
+	if ev.Kind != "mac" || ev.Key != mac || ev.Count != 4 || !ev.Until.Equal(now.Add(time.Minute)) {
+		t.Errorf("Bad throttle event: %#v", ev)
+	}
+	if ok, ev := r.allow("mac", mac, r.MacBurst, now.Add(30*time.Second)); ok || ev != nil {
+		t.Errorf("Packets should be silently dropped while ignored")
+	}
+	if ok, _ := r.allow("mac", "52:54:00:12:34:57", r.MacBurst, now); !ok {
+		t.Errorf("Other clients should not be throttled")
+	}
+	if ok, _ := r.allow("relay", "192.168.124.1", r.RelayBurst, now); !ok {
+		t.Errorf("Relays should not be limited when RelayBurst is 0")
+	}
+	if ok, _ := r.allow("mac", mac, r.MacBurst, now.Add(61*time.Second)); !ok {
+		t.Errorf("Client should be allowed once the ignore time is over")
+	}
+}
@@ -0,0 +1,199 @@
+package midlayer
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/pinger"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+var simMessageTypes = map[string]dhcp.MessageType{
+	"discover": dhcp.Discover,
+	"request":  dhcp.Request,
+	"decline":  dhcp.Decline,
+	"release":  dhcp.Release,
+	"inform":   dhcp.Inform,
+}
+
+// simInterface sets the interface the simulated packet arrives on.
+func (dhr *DhcpRequest) simInterface(name string) error {
+	idxs := make([]int, 0, len(dhr.nameMap))
+	for idx := range dhr.nameMap {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	for _, idx := range idxs {
+		if name != "" {
+			if dhr.nameMap[idx] == name {
+				dhr.cm.IfIndex = idx
+				return nil
+			}
+			continue
+		}
+		for _, addr := range dhr.idxMap[idx] {
+			if addr.IP.To4() != nil && addr.IP.IsGlobalUnicast() {
+				dhr.cm.IfIndex = idx
+				return nil
+			}
+		}
+	}
+	if name != "" {
+		return fmt.Errorf("No interface named %s", name)
+	}
+	return fmt.Errorf("No interface with an IPv4 address")
+}
+
+// synthesize builds the request packet from the fields of sim.
+func (dhr *DhcpRequest) synthesize(sim *models.DhcpSimulation) error {
+	mac, err := net.ParseMAC(sim.Mac)
+	if err != nil {
+		return fmt.Errorf("Invalid MAC address %q: %v", sim.Mac, err)
+	}
+	mtName := strings.ToLower(sim.MessageType)
+	if mtName == "" {
+		mtName = "discover"
+	}
+	mt, ok := simMessageTypes[mtName]
+	if !ok {
+		return fmt.Errorf("Unknown DHCP message type %s", sim.MessageType)
+	}
+	opts := []dhcp.Option{
+		{Code: dhcp.OptionParameterRequestList, Value: []byte{1, 3, 6, 12, 15, 28, 43, 60, 66, 67}},
+	}
+	if sim.Arch != nil {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionClientArchitecture, Value: []byte{byte(*sim.Arch >> 8), byte(*sim.Arch)}})
+	}
+	if sim.VendorClass != "" {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionVendorClassIdentifier, Value: []byte(sim.VendorClass)})
+	}
+	if sim.UserClass != "" {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionUserClass, Value: []byte(sim.UserClass)})
+	}
+	if sim.RequestedAddr != nil {
+		req := sim.RequestedAddr.To4()
+		if req == nil {
+			return fmt.Errorf("RequestedAddr %s is not an IPv4 address", sim.RequestedAddr)
+		}
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: []byte(req)})
+	}
+	relayInfo := []byte{}
+	for _, sub := range []struct {
+		code byte
+		val  string
+	}{{1, sim.CircuitID}, {2, sim.RemoteID}} {
+		if sub.val != "" {
+			relayInfo = append(append(relayInfo, sub.code, byte(len(sub.val))), sub.val...)
+		}
+	}
+	if len(relayInfo) > 0 {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: relayInfo})
+	}
+	xid := make([]byte, 4)
+	rand.Read(xid)
+	dhr.request = dhcp.RequestPacket(mt, mac, nil, xid, false, opts)
+	src := &net.UDPAddr{IP: net.IPv4zero, Port: 68}
+	if sim.Relay != nil {
+		relay := sim.Relay.To4()
+		if relay == nil {
+			return fmt.Errorf("Relay %s is not an IPv4 address", sim.Relay)
+		}
+		dhr.request.SetGIAddr(relay)
+		dhr.request.SetHops(1)
+		src = &net.UDPAddr{IP: relay, Port: 67}
+	}
+	dhr.srcAddr = src
+	dhr.cm = &ipv4.ControlMessage{Src: src.IP}
+	return dhr.simInterface(sim.Interface)
+}
+
+// SimulateDhcp runs the packet described by sim through the DHCP
+// server, or the PXE/BINL server if sim.Binl is set, and fills in the
+// results in sim.  The packet is handled in a Sandbox, so no Leases
+// or Machines are changed, no events are published, and nothing is
+// sent over the network.
+func SimulateDhcp(dt *backend.DataTracker, sim *models.DhcpSimulation) error {
+	port := 67
+	if sim.Binl {
+		port = 4011
+	}
+	l := logger.New(nil).Log("dhcp").SetLevel(logger.Debug)
+	dhr := &DhcpRequest{
+		Logger:    l,
+		defaultIP: net.ParseIP(dt.OurAddress),
+		replies:   []dhcp.Packet{},
+		pinger:    pinger.Fake(false),
+		lPort:     port,
+		start:     time.Now(),
+		sandbox:   dt.Sandbox(),
+		handler: &DhcpHandler{
+			Logger:   l,
+			port:     port,
+			bk:       dt,
+			strats:   defaultStrategies(),
+			binlOnly: sim.Binl,
+		},
+	}
+	if dhr.fill() == nil {
+		return fmt.Errorf("Cannot read the network interfaces")
+	}
+	if sim.Packet != "" {
+		if err := dhr.UnmarshalText([]byte(sim.Packet)); err != nil {
+			return err
+		}
+	} else if err := dhr.synthesize(sim); err != nil {
+		return err
+	}
+	sim.Request = dhr.PrintIncoming()
+	_, sim.Result = dhr.Process()
+	sim.Replies = make([]string, len(dhr.replies))
+	for i := range dhr.replies {
+		sim.Replies[i] = dhr.PrintOutgoing(dhr.replies[i])
+	}
+	sim.Logs = []string{}
+	for _, line := range l.Buffer().Lines(-1) {
+		sim.Logs = append(sim.Logs, line.Message)
+	}
+	if len(dhr.replies) > 0 {
+		reply := dhr.replies[0]
+		if addr := reply.YIAddr(); !addr.IsUnspecified() {
+			sim.Address = addr
+		}
+		sim.FileName = strings.TrimRight(string(reply.File()), "\x00")
+	}
+	if sim.FileName == "" {
+		sim.FileName = string(dhr.outOpts[dhcp.OptionBootFileName])
+	}
+	if dhr.machine != nil {
+		sim.Machine = dhr.machine.UUID()
+		sim.BootEnv = dhr.machine.BootEnv
+	}
+	if dhr.bootEnv != nil {
+		sim.BootEnv = dhr.bootEnv.Name
+	}
+	if sim.Address == nil {
+		return nil
+	}
+	rt := dhr.Request("subnets", "reservations")
+	rt.Do(func(d backend.Stores) {
+		if r := rt.RawFind("reservations", models.Hexaddr(sim.Address)); r != nil {
+			sim.Reservation = backend.AsReservation(r).Addr
+		}
+		for _, i := range d("subnets").Items() {
+			if s := backend.AsSubnet(i); s.InSubnetRange(sim.Address) {
+				sim.Subnet = s.Name
+				break
+			}
+		}
+	})
+	return nil
+}
@@ -180,6 +180,10 @@ func NewDhcpMetrics(l logger.Logger, binlOnly bool) *DhcpMetrics {
 	if binlOnly {
 		ss = "drp_binl"
 	}
+	return newDhcpMetrics(l, ss)
+}
+
+func newDhcpMetrics(l logger.Logger, ss string) *DhcpMetrics {
 	mets := []*utils.Metric{
 		{
 			ID:          "reqCnt",
@@ -213,6 +217,13 @@ func NewDhcpMetrics(l logger.Logger, binlOnly bool) *DhcpMetrics {
 			Description: "The DHCP request sizes in bytes.",
 			Type:        "summary",
 		},
+		{
+			ID:          "thrCnt",
+			Name:        "throttled_total",
+			Description: "How many DHCP requests were dropped by rate limiting, partitioned by sender kind.",
+			Type:        "counter_vec",
+			Args:        []string{"kind"},
+		},
 	}
 	return &DhcpMetrics{p: utils.NewPrometheus(l, ss, mets)}
 }
@@ -228,3 +239,8 @@ func (dm *DhcpMetrics) CountPacket(count, elapsed float64, res dhcp.Packet, reqT
 	dm.p.Observe("resSz", resSz)
 	dm.p.CounterWithLabelValues("resCnt", resType).Inc()
 }
+
+// CountThrottled counts a request dropped by rate limiting.
+func (dm *DhcpMetrics) CountThrottled(kind string) {
+	dm.p.CounterWithLabelValues("thrCnt", kind).Inc()
+}
@@ -16,6 +16,8 @@ import (
 	"github.com/digitalrebar/logger"
 	"github.com/digitalrebar/pinger"
 	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	dhcp "github.com/krolaw/dhcp4"
 )
 
 /*
@@ -151,3 +153,120 @@ func TestDHCPCases(t *testing.T) {
 		}
 	}
 }
+
+func TestDhcpStrategies(t *testing.T) {
+	p := dhcp.NewPacket(dhcp.BootRequest)
+	p.SetCHAddr(net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56})
+	bare := dhcp.Options{}
+	relayed := dhcp.Options{
+		dhcp.OptionClientIdentifier: []byte{1, 0x52, 0x54, 0, 0x12, 0x34, 0x56},
+		dhcp.OptionRelayAgentInformation: []byte{
+			1, 7, 'e', 't', 'h', '1', '/', '1', '7',
+			2, 4, 0xde, 0xad, 0xbe, 0xef,
+		},
+	}
+	tests := []struct {
+		name  string
+		fn    StrategyFunc
+		opts  dhcp.Options
+		token string
+	}{
+		{"MAC", MacStrategy, bare, "52:54:00:12:34:56"},
+		{"ClientID", ClientIDStrategy, bare, ""},
+		{"ClientID", ClientIDStrategy, relayed, "01:52:54:00:12:34:56"},
+		{"CircuitID", CircuitIDStrategy, bare, ""},
+		{"CircuitID", CircuitIDStrategy, relayed, "eth1/17"},
+		{"RemoteID", RemoteIDStrategy, relayed, "de:ad:be:ef"},
+		{"RelayAgent", RelayAgentStrategy, relayed, "de:ad:be:ef/eth1/17"},
+		{"RelayAgent", RelayAgentStrategy, dhcp.Options{
+			dhcp.OptionRelayAgentInformation: []byte{1, 2, 'p', '1'},
+		}, ""},
+		{"CircuitID", CircuitIDStrategy, dhcp.Options{
+			dhcp.OptionRelayAgentInformation: []byte{1, 9, 'p', '1'},
+		}, ""},
+	}
+	for _, tt := range tests {
+		if res := tt.fn(p, tt.opts); res != tt.token {
+			t.Errorf("%s: expected token %q, got %q", tt.name, tt.token, res)
+		}
+	}
+	dhr := &DhcpRequest{
+		handler: &DhcpHandler{strats: defaultStrategies()},
+		request: p,
+		pktOpts: bare,
+	}
+	if strats := dhr.strategies(nil); len(strats) != 1 || strats[0].Name != "MAC" {
+		t.Errorf("Expected only the MAC strategy for a bare packet, got %d strategies", len(strats))
+	}
+	dhr.pktOpts = relayed
+	if strats := dhr.strategies(nil); len(strats) != 5 || strats[0].Name != "RelayAgent" {
+		t.Errorf("Expected all strategies for a relayed packet, got %d strategies", len(strats))
+	}
+}
+
+func TestClientClasses(t *testing.T) {
+	p := dhcp.NewPacket(dhcp.BootRequest)
+	p.SetCHAddr(net.HardwareAddr{0x00, 0x25, 0x90, 0x12, 0x34, 0x56})
+	dhr := &DhcpRequest{
+		request: p,
+		pktOpts: dhcp.Options{
+			dhcp.OptionVendorClassIdentifier: []byte("PXEClient:Arch:00007:UNDI:003016"),
+			dhcp.OptionClientArchitecture:    []byte{0, 7},
+			dhcp.OptionRelayAgentInformation: []byte{1, 7, 'e', 't', 'h', '1', '/', '1', '7'},
+		},
+	}
+	tests := []struct {
+		name  string
+		class models.ClientClass
+		match bool
+	}{
+		{"vendor class prefix", models.ClientClass{VendorClass: "PXEClient"}, true},
+		{"wrong vendor class", models.ClientClass{VendorClass: "Cumulus"}, false},
+		{"missing user class", models.ClientClass{UserClass: "iPXE"}, false},
+		{"arch", models.ClientClass{Arches: []uint16{7, 9}}, true},
+		{"wrong arch", models.ClientClass{Arches: []uint16{0}}, false},
+		{"mac prefix", models.ClientClass{MacPrefix: "00:25:90"}, true},
+		{"wrong mac prefix", models.ClientClass{MacPrefix: "52:54:00"}, false},
+		{"circuit id", models.ClientClass{CircuitID: "eth1/17"}, true},
+		{"missing remote id", models.ClientClass{RemoteID: "sw1"}, false},
+		{"all fields must match", models.ClientClass{MacPrefix: "00:25:90", Arches: []uint16{0}}, false},
+	}
+	for _, tt := range tests {
+		if res := dhr.inClass(&tt.class); res != tt.match {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.match, res)
+		}
+	}
+}
+
+func TestClientClassNextServer(t *testing.T) {
+	class := &models.ClientClass{
+		BootFileName: "class.efi",
+		NextServer:   net.IPv4(10, 0, 0, 2),
+	}
+	reservation := net.IPv4(10, 0, 0, 3)
+	tests := []struct {
+		name       string
+		reserved   map[byte]bool
+		nextServer net.IP
+		bootFile   string
+	}{
+		{"class sets next server", map[byte]bool{}, class.NextServer, "class.efi"},
+		{"reservation next server wins",
+			map[byte]bool{byte(dhcp.OptionTFTPServerName): true}, reservation, "class.efi"},
+		{"reservation boot file wins",
+			map[byte]bool{byte(dhcp.OptionBootFileName): true}, class.NextServer, "reserved.efi"},
+	}
+	for _, tt := range tests {
+		dhr := &DhcpRequest{
+			outOpts:    dhcp.Options{dhcp.OptionBootFileName: []byte("reserved.efi")},
+			nextServer: reservation,
+		}
+		dhr.applyClass(class, tt.reserved, func(models.DhcpOption) {})
+		if !dhr.nextServer.Equal(tt.nextServer) {
+			t.Errorf("%s: expected next server %s, got %s", tt.name, tt.nextServer, dhr.nextServer)
+		}
+		if bf := string(dhr.outOpts[dhcp.OptionBootFileName]); bf != tt.bootFile {
+			t.Errorf("%s: expected boot file %s, got %s", tt.name, tt.bootFile, bf)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package midlayer
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	"github.com/miekg/dns"
+)
+
+// DnsHandler is an authoritative DNS server for a single zone.  It
+// answers A, AAAA, and PTR queries from the Machines, Reservations,
+// and active Leases dr-provision knows about.  Everything else is
+// forwarded to another DNS server for local clients, or refused if
+// there is none.
+//
+// Queries are answered from a dnsIndex, which is rebuilt on the next
+// query after a Machine, Reservation, or Lease changes.
+type DnsHandler struct {
+	logger.Logger
+	bk        *backend.DataTracker
+	pubs      *backend.Publishers
+	zone      string
+	forwarder string
+	servers   []*dns.Server
+	mux       *sync.Mutex
+	index     *dnsIndex
+	stale     int32
+}
+
+// dnsName qualifies name with zone.  Names that are already in the
+// zone are left alone, and names in some other domain are reduced to
+// their first label.
+func dnsName(name, zone string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return ""
+	}
+	z := strings.TrimSuffix(zone, ".")
+	if name == z || strings.HasSuffix(name, "."+z) {
+		return dns.Fqdn(name)
+	}
+	return dns.Fqdn(strings.SplitN(name, ".", 2)[0] + "." + z)
+}
+
+// dnsEntry is a name and address pair.  Pairs that come from a Lease
+// stop being served when it expires; a zero expires never does.
+type dnsEntry struct {
+	name    string
+	addr    net.IP
+	expires time.Time
+}
+
+func (e *dnsEntry) live(now time.Time) bool {
+	return e.expires.IsZero() || now.Before(e.expires)
+}
+
+// dnsIndex holds every name and address pair we know about, keyed by
+// name and by reverse lookup name.  Each pair is only held once, no
+// matter how many Machines, Reservations, and Leases it comes from.
+type dnsIndex struct {
+	pairs map[string]*dnsEntry
+	names map[string][]*dnsEntry
+	addrs map[string][]*dnsEntry
+}
+
+func newDnsIndex() *dnsIndex {
+	return &dnsIndex{
+		pairs: map[string]*dnsEntry{},
+		names: map[string][]*dnsEntry{},
+		addrs: map[string][]*dnsEntry{},
+	}
+}
+
+func (idx *dnsIndex) add(name string, addr net.IP, expires time.Time) {
+	key := name + " " + addr.String()
+	if e := idx.pairs[key]; e != nil {
+		if !e.expires.IsZero() && (expires.IsZero() || expires.After(e.expires)) {
+			e.expires = expires
+		}
+		return
+	}
+	e := &dnsEntry{name: name, addr: addr, expires: expires}
+	idx.pairs[key] = e
+	idx.names[name] = append(idx.names[name], e)
+	if arpa, err := dns.ReverseAddr(addr.String()); err == nil {
+		idx.addrs[arpa] = append(idx.addrs[arpa], e)
+	}
+}
+
+// buildIndex collects every name and address we know about from
+// Machines, Reservations with a hostname option (12), and active
+// Leases that belong to a Machine.
+func (h *DnsHandler) buildIndex() *dnsIndex {
+	idx := newDnsIndex()
+	rt := h.bk.Request(h.Logger, "machines", "reservations", "leases")
+	rt.Do(func(d backend.Stores) {
+		for _, i := range d("machines").Items() {
+			m := backend.AsMachine(i)
+			if m.Address != nil && !m.Address.IsUnspecified() {
+				idx.add(dnsName(m.Name, h.zone), m.Address, time.Time{})
+			}
+		}
+		for _, i := range d("reservations").Items() {
+			r := backend.AsReservation(i)
+			for _, opt := range r.Options {
+				if opt.Code == 12 && !strings.Contains(opt.Value, "{{") {
+					idx.add(dnsName(opt.Value, h.zone), r.Addr, time.Time{})
+				}
+			}
+		}
+		for _, i := range d("leases").Items() {
+			l := backend.AsLease(i)
+			if l.State != "ACK" || l.Expired() || strings.ToUpper(l.Strategy) != "MAC" {
+				continue
+			}
+			if m := rt.MachineForMac(l.Token); m != nil {
+				idx.add(dnsName(m.Name, h.zone), l.Addr, l.ExpireTime)
+			}
+		}
+	})
+	return idx
+}
+
+// lookup returns the dnsIndex, rebuilding it if anything has changed
+// since it was last built.
+func (h *DnsHandler) lookup() *dnsIndex {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if atomic.SwapInt32(&h.stale, 0) == 1 || h.index == nil {
+		h.index = h.buildIndex()
+	}
+	return h.index
+}
+
+// Publish marks the dnsIndex as stale when a Machine, Reservation, or
+// Lease changes.  It never blocks.
+func (h *DnsHandler) Publish(e *models.Event) error {
+	switch e.Type {
+	case "machines", "reservations", "leases":
+		atomic.StoreInt32(&h.stale, 1)
+	}
+	return nil
+}
+
+func (h *DnsHandler) Reserve() error { return nil }
+func (h *DnsHandler) Release()       {}
+func (h *DnsHandler) Unload()        {}
+
+func (h *DnsHandler) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: h.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:      "ns." + h.zone,
+		Mbox:    "hostmaster." + h.zone,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+// answer fills in m from our own data.  It returns false if the
+// question is not one we are authoritative for.
+func (h *DnsHandler) answer(q dns.Question, m *dns.Msg) bool {
+	name := strings.ToLower(q.Name)
+	reverse := strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+	if !reverse && !dns.IsSubDomain(h.zone, name) {
+		return false
+	}
+	found := false
+	idx, now := h.lookup(), time.Now()
+	ents := idx.names[name]
+	if reverse {
+		ents = idx.addrs[name]
+	}
+	for _, e := range ents {
+		if !e.live(now) {
+			continue
+		}
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: 60}
+		if reverse {
+			found = true
+			if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+				hdr.Rrtype = dns.TypePTR
+				m.Answer = append(m.Answer, &dns.PTR{Hdr: hdr, Ptr: e.name})
+			}
+			continue
+		}
+		found = true
+		if v4 := e.addr.To4(); v4 != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY) {
+			hdr.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: v4})
+		} else if v4 == nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY) {
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: e.addr})
+		}
+	}
+	if reverse && !found {
+		// We do not own the reverse zones, so someone else may know.
+		return false
+	}
+	m.Authoritative = true
+	if name == h.zone && (q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY) {
+		m.Answer = append(m.Answer, h.soa())
+		found = true
+	}
+	if !found && name != h.zone {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, h.soa())
+	}
+	return true
+}
+
+// mayForward returns whether queries from addr may be sent on to the
+// forwarder.  Only clients on loopback, in one of our Subnets, or on a
+// network one of our interfaces is on are allowed, so that we are not
+// an open resolver for anyone who can reach us.
+func (h *DnsHandler) mayForward(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	found := false
+	rt := h.bk.Request(h.Logger, "subnets")
+	rt.Do(func(d backend.Stores) {
+		for _, i := range d("subnets").Items() {
+			_, cidr, err := net.ParseCIDR(backend.AsSubnet(i).Subnet)
+			if err == nil && cidr.Contains(ip) {
+				found = true
+				return
+			}
+		}
+	})
+	if found {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		h.Warnf("DNS: cannot list interface addresses: %v", err)
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeDNS handles a single DNS query.
+func (h *DnsHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(r)
+	if len(r.Question) != 1 || r.Opcode != dns.OpcodeQuery {
+		m.Rcode = dns.RcodeNotImplemented
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	if h.answer(q, m) {
+		h.Debugf("DNS: %s %s from %s: %d answers", dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr(), len(m.Answer))
+		w.WriteMsg(m)
+		return
+	}
+	if h.forwarder == "" || !h.mayForward(w.RemoteAddr()) {
+		h.Debugf("DNS: refusing %s %s from %s", dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr())
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+	res, err := dns.Exchange(r, h.forwarder)
+	if err != nil {
+		h.Warnf("DNS: forwarding %s %s to %s failed: %v", dns.TypeToString[q.Qtype], q.Name, h.forwarder, err)
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	w.WriteMsg(res)
+}
+
+func (h *DnsHandler) Shutdown(ctx context.Context) error {
+	h.pubs.Remove(h)
+	for _, srv := range h.servers {
+		srv.Shutdown()
+	}
+	return nil
+}
+
+// ServeDns starts an authoritative DNS server for zone on listen,
+// over both UDP and TCP.  Queries outside of zone from local clients
+// are sent to forwarder, and all others are refused.
+func ServeDns(listen, zone, forwarder string,
+	dt *backend.DataTracker,
+	pubs *backend.Publishers,
+	log logger.Logger) (Service, error) {
+	if _, _, err := net.SplitHostPort(forwarder); forwarder != "" && err != nil {
+		forwarder = net.JoinHostPort(forwarder, "53")
+	}
+	h := &DnsHandler{
+		Logger:    log,
+		bk:        dt,
+		pubs:      pubs,
+		zone:      dns.Fqdn(strings.ToLower(zone)),
+		forwarder: forwarder,
+		mux:       &sync.Mutex{},
+	}
+	conn, err := net.ListenPacket(OsUdpProtoCheck(), listen)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	h.servers = []*dns.Server{
+		{PacketConn: conn, Handler: h},
+		{Listener: l, Handler: h},
+	}
+	pubs.Add(h)
+	for _, srv := range h.servers {
+		go srv.ActivateAndServe()
+	}
+	return h, nil
+}
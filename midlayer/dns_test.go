@@ -0,0 +1,125 @@
+package midlayer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+	"github.com/miekg/dns"
+	"github.com/pborman/uuid"
+)
+
+func TestDnsServer(t *testing.T) {
+	l := logger.New(nil).Log("dhcp")
+	rt := dataTracker.Request(l, "reservations", "subnets")
+	resv := &models.Reservation{
+		Addr:     net.ParseIP("172.17.0.50"),
+		Token:    "de:ad:be:ef:00:50",
+		Strategy: "MAC",
+		Options:  []models.DhcpOption{{Code: 12, Value: "dnstest"}},
+	}
+	rt.Do(func(d backend.Stores) {
+		if _, err := rt.Create(resv); err != nil {
+			t.Fatalf("Failed to create reservation: %v", err)
+		}
+	})
+	defer rt.Do(func(d backend.Stores) { rt.Remove(resv) })
+	svc, err := ServeDns("127.0.0.1:15353", "lab.example.com", "", dataTracker, backend.NewPublishers(nil), l)
+	if err != nil {
+		t.Fatalf("Failed to start DNS server: %v", err)
+	}
+	defer svc.Shutdown(context.Background())
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := &dns.Msg{}
+		m.SetQuestion(name, qtype)
+		res, err := dns.Exchange(m, "127.0.0.1:15353")
+		if err != nil {
+			t.Fatalf("Query for %s failed: %v", name, err)
+		}
+		return res
+	}
+	res := query("dnstest.lab.example.com.", dns.TypeA)
+	if len(res.Answer) != 1 || !res.Authoritative {
+		t.Errorf("Expected one authoritative answer:\n%s", res)
+	} else if a, ok := res.Answer[0].(*dns.A); !ok || !a.A.Equal(resv.Addr) {
+		t.Errorf("Wrong answer:\n%s", res)
+	}
+	res = query("50.0.17.172.in-addr.arpa.", dns.TypePTR)
+	if len(res.Answer) != 1 {
+		t.Errorf("Expected one PTR answer:\n%s", res)
+	} else if ptr, ok := res.Answer[0].(*dns.PTR); !ok || ptr.Ptr != "dnstest.lab.example.com." {
+		t.Errorf("Wrong answer:\n%s", res)
+	}
+	if res = query("missing.lab.example.com.", dns.TypeA); res.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN for an unknown name:\n%s", res)
+	}
+	if res = query("www.example.org.", dns.TypeA); res.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected queries outside the zone to be refused:\n%s", res)
+	}
+}
+
+func TestDnsMayForward(t *testing.T) {
+	h := &DnsHandler{Logger: logger.New(nil).Log("dhcp"), bk: dataTracker}
+	tests := []struct {
+		addr  net.Addr
+		allow bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.124.50"), Port: 5353}, true},
+		{&net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 5353}, false},
+	}
+	for _, tt := range tests {
+		if res := h.mayForward(tt.addr); res != tt.allow {
+			t.Errorf("Forwarding for %s: expected %v, got %v", tt.addr, tt.allow, res)
+		}
+	}
+}
+
+func TestDnsMachineLease(t *testing.T) {
+	l := logger.New(nil).Log("dhcp")
+	rt := dataTracker.Request(l, "machines", "bootenvs", "leases", "stages", "profiles", "workflows", "tasks", "templates")
+	addr := net.ParseIP("172.17.0.60")
+	machine := &models.Machine{
+		Uuid:          uuid.NewRandom(),
+		Name:          "dnsmachine",
+		Address:       addr,
+		HardwareAddrs: []string{"de:ad:be:ef:00:60"},
+	}
+	lease := &models.Lease{
+		Addr:       addr,
+		Token:      "de:ad:be:ef:00:60",
+		Strategy:   "MAC",
+		State:      "ACK",
+		ExpireTime: time.Now().Add(time.Hour),
+	}
+	rt.Do(func(d backend.Stores) {
+		for _, obj := range []models.Model{machine, lease} {
+			if _, err := rt.Create(obj); err != nil {
+				t.Fatalf("Failed to create %s: %v", obj.Prefix(), err)
+			}
+		}
+	})
+	defer rt.Do(func(d backend.Stores) { rt.Remove(lease) })
+	h := &DnsHandler{Logger: l, bk: dataTracker, zone: "lab.example.com.", mux: &sync.Mutex{}}
+	answer := func(name string, qtype uint16) *dns.Msg {
+		m := &dns.Msg{}
+		h.answer(dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}, m)
+		return m
+	}
+	if res := answer("dnsmachine.lab.example.com.", dns.TypeA); len(res.Answer) != 1 {
+		t.Errorf("Expected one A record for a Machine with a Lease on its address:\n%s", res)
+	}
+	if res := answer("60.0.17.172.in-addr.arpa.", dns.TypePTR); len(res.Answer) != 1 {
+		t.Errorf("Expected one PTR record for a Machine with a Lease on its address:\n%s", res)
+	}
+	rt.Do(func(d backend.Stores) { rt.Remove(machine) })
+	h.Publish(&models.Event{Type: "machines", Action: "delete", Key: machine.Key()})
+	if res := answer("dnsmachine.lab.example.com.", dns.TypeA); res.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN once the Machine is gone:\n%s", res)
+	}
+}
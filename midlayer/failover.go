@@ -0,0 +1,305 @@
+package midlayer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/api"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/models"
+)
+
+const (
+	failoverHeartbeat = 5 * time.Second
+	failoverBatch     = 100
+)
+
+// DhcpPeer replicates lease changes to a DHCP failover peer, and
+// keeps the backend.Failover up to date with whether the peer can
+// be reached.  Leases the peer sends us arrive via the API.
+type DhcpPeer struct {
+	logger.Logger
+	dt                 *backend.DataTracker
+	fo                 *backend.Failover
+	pubs               *backend.Publishers
+	username, password string
+	client             *api.Client
+	pending            chan *models.Event
+	mux                *sync.Mutex
+	resync             bool
+	tombstones         map[string]*models.Lease
+	done               chan struct{}
+	finished           chan struct{}
+}
+
+// eventLease decodes the Lease an event is about.
+func eventLease(e *models.Event) (*models.Lease, error) {
+	lease := &models.Lease{}
+	err := models.Remarshal(e.Object, lease)
+	return lease, err
+}
+
+// Publish queues lease events to be sent to the peer.  It never
+// blocks: if the queue is full, the peer gets a full resync once it
+// drains.
+func (p *DhcpPeer) Publish(e *models.Event) error {
+	if e.Type != "leases" {
+		return nil
+	}
+	switch e.Action {
+	case "create", "save", "update", "delete":
+	default:
+		return nil
+	}
+	select {
+	case p.pending <- e:
+	default:
+		if e.Action == "delete" {
+			if lease, err := eventLease(e); err == nil {
+				p.bury(lease)
+			}
+		}
+		p.mux.Lock()
+		p.resync = true
+		p.mux.Unlock()
+	}
+	return nil
+}
+
+func (p *DhcpPeer) Reserve() error { return nil }
+func (p *DhcpPeer) Release()       {}
+func (p *DhcpPeer) Unload()        {}
+
+// bury remembers that a lease was deleted without the peer being
+// told about it, so that the delete is sent along with everything
+// else the next time the peer is resynced.  Resending our leases
+// cannot do that on its own, since the peer may have leases of its
+// own that we do not know about yet.
+func (p *DhcpPeer) bury(lease *models.Lease) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.tombstones[lease.Key()] = lease
+}
+
+func (p *DhcpPeer) needResync(b bool) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	res := p.resync
+	p.resync = b
+	return res
+}
+
+func (p *DhcpPeer) connect() error {
+	if p.client != nil {
+		return nil
+	}
+	c, err := api.UserSession(p.fo.Peer, p.username, p.password)
+	if err != nil {
+		return err
+	}
+	p.client = c
+	return nil
+}
+
+// failed marks the peer as down.  Everything will be resent when it
+// comes back.
+func (p *DhcpPeer) failed(err error) {
+	p.Warnf("Failover peer %s: %v", p.fo.Peer, err)
+	p.fo.Contact(false)
+	p.needResync(true)
+}
+
+func (p *DhcpPeer) heartbeat() {
+	if err := p.connect(); err != nil {
+		p.failed(err)
+		return
+	}
+	status := &models.FailoverStatus{}
+	if err := p.client.Req().UrlFor("failover").Do(status); err != nil {
+		p.failed(err)
+		return
+	}
+	if status.Mode != p.fo.Mode || status.Primary == p.fo.Primary {
+		p.Errorf("Failover peer %s is misconfigured: mode %s primary %v, we are mode %s primary %v",
+			p.fo.Peer, status.Mode, status.Primary, p.fo.Mode, p.fo.Primary)
+		p.fo.Contact(false)
+		return
+	}
+	if p.fo.Contact(true) {
+		p.Infof("Failover peer %s is up", p.fo.Peer)
+		p.needResync(true)
+	}
+	if p.needResync(false) {
+		p.sendAll()
+	}
+}
+
+func (p *DhcpPeer) send(leases []*models.Lease) bool {
+	if err := p.connect(); err != nil {
+		p.failed(err)
+		return false
+	}
+	res := []*models.Lease{}
+	if err := p.client.Req().Post(leases).UrlFor("failover", "leases").Do(&res); err != nil {
+		p.failed(err)
+		return false
+	}
+	for _, lease := range res {
+		p.fo.Ack(lease.Key(), lease.ExpireTime)
+	}
+	return true
+}
+
+// remove deletes the lease from the peer.  If that fails, the lease
+// is buried so that the delete is retried on the next resync.
+func (p *DhcpPeer) remove(lease *models.Lease) bool {
+	if err := p.connect(); err != nil {
+		p.bury(lease)
+		p.failed(err)
+		return false
+	}
+	res := &models.Lease{}
+	err := p.client.Req().Del().UrlFor("leases", lease.Key()).Do(res)
+	if e, ok := err.(*models.Error); ok && e.Code == http.StatusNotFound {
+		err = nil
+	}
+	if err != nil {
+		p.bury(lease)
+		p.failed(err)
+		return false
+	}
+	p.fo.Ack(lease.Key(), time.Time{})
+	return true
+}
+
+// sendAll sends the peer all of our leases, and then replays the
+// deletes of any leases that were buried while it could not be told.
+func (p *DhcpPeer) sendAll() {
+	leases := []*models.Lease{}
+	live := map[string]struct{}{}
+	rt := p.dt.Request(p.Logger, "leases")
+	rt.Do(func(d backend.Stores) {
+		for _, i := range d("leases").Items() {
+			leases = append(leases, models.Clone(i).(*models.Lease))
+			live[i.Key()] = struct{}{}
+		}
+	})
+	p.Infof("Sending %d leases to failover peer %s", len(leases), p.fo.Peer)
+	for len(leases) > 0 {
+		n := failoverBatch
+		if n > len(leases) {
+			n = len(leases)
+		}
+		if !p.send(leases[:n]) {
+			return
+		}
+		leases = leases[n:]
+	}
+	p.mux.Lock()
+	dead := make([]*models.Lease, 0, len(p.tombstones))
+	for key, lease := range p.tombstones {
+		delete(p.tombstones, key)
+		// A lease that has been created again was just sent.
+		if _, ok := live[key]; !ok {
+			dead = append(dead, lease)
+		}
+	}
+	p.mux.Unlock()
+	if len(dead) > 0 {
+		p.Infof("Removing %d deleted leases from failover peer %s", len(dead), p.fo.Peer)
+	}
+	for i, lease := range dead {
+		if !p.remove(lease) {
+			for _, rest := range dead[i+1:] {
+				p.bury(rest)
+			}
+			return
+		}
+	}
+}
+
+func (p *DhcpPeer) push(e *models.Event) {
+	lease, err := eventLease(e)
+	if err != nil {
+		p.Errorf("Failover: cannot decode lease for %s: %v", e.Key, err)
+		return
+	}
+	// No point in trying while the peer is down, it will get
+	// everything when it comes back.
+	p.mux.Lock()
+	skip := p.resync
+	p.mux.Unlock()
+	if skip {
+		if e.Action == "delete" {
+			p.bury(lease)
+		}
+		return
+	}
+	if e.Action == "delete" {
+		p.remove(lease)
+	} else {
+		p.send([]*models.Lease{lease})
+	}
+}
+
+func (p *DhcpPeer) run() {
+	defer close(p.finished)
+	ticker := time.NewTicker(failoverHeartbeat)
+	defer ticker.Stop()
+	p.heartbeat()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.heartbeat()
+		case e := <-p.pending:
+			p.push(e)
+		}
+	}
+}
+
+// Shutdown stops replicating leases to the peer.
+func (p *DhcpPeer) Shutdown(ctx context.Context) error {
+	p.pubs.Remove(p)
+	close(p.done)
+	select {
+	case <-p.finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if p.client != nil {
+		p.client.Close()
+	}
+	return nil
+}
+
+// StartDhcpPeer enables DHCP failover on the DataTracker, and starts
+// replicating leases to the peer the Failover points at.
+func StartDhcpPeer(dt *backend.DataTracker,
+	log logger.Logger,
+	fo *backend.Failover,
+	username, password string,
+	pubs *backend.Publishers) (Service, error) {
+	p := &DhcpPeer{
+		Logger:     log,
+		dt:         dt,
+		fo:         fo,
+		pubs:       pubs,
+		username:   username,
+		password:   password,
+		pending:    make(chan *models.Event, 1000),
+		mux:        &sync.Mutex{},
+		resync:     true,
+		tombstones: map[string]*models.Lease{},
+		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+	dt.SetFailover(fo)
+	pubs.Add(p)
+	go p.run()
+	return p, nil
+}
@@ -107,6 +107,21 @@ func fakeServer() error {
 					{Code: 15, Value: "sub1.com"},
 				},
 			},
+			// DHCPv6 network.
+			{
+				Name:              "sub6",
+				Enabled:           true,
+				Subnet:            "fd00:124::/64",
+				ActiveStart:       net.ParseIP("fd00:124::10"),
+				ActiveEnd:         net.ParseIP("fd00:124::15"),
+				ReservedLeaseTime: 7200,
+				ActiveLeaseTime:   60,
+				Strategy:          "DUID",
+				Options: []models.DhcpOption{
+					{Code: 23, Value: "fd00:124::1"},
+					{Code: 24, Value: "sub6.com"},
+				},
+			},
 		}
 		for _, sub := range subs {
 			_, err := rt.Create(sub)
@@ -1,6 +1,7 @@
 package midlayer
 
 import (
+	"fmt"
 	"net"
 	"strings"
 
@@ -207,12 +208,39 @@ func (dhr *DhcpRequest) offerPXE() bool {
 	return false
 }
 
+// offerHttpBoot returns true if the client is UEFI firmware that wants
+// to HTTP Boot directly, without going through TFTP.
+func (dhr *DhcpRequest) offerHttpBoot() bool {
+	if val, ok := dhr.pktOpts[dhcp.OptionVendorClassIdentifier]; ok &&
+		strings.HasPrefix(string(val), "HTTPClient") {
+		return true
+	}
+	return false
+}
+
+// httpBootURL turns fname into a URL on our static file server, unless
+// it is already a URL.
+func (dhr *DhcpRequest) httpBootURL(l *backend.Lease, fname string) string {
+	if strings.Contains(fname, "://") {
+		return fname
+	}
+	host := dhr.nextServer
+	if host == nil {
+		host = dhr.respondFrom(l.Addr)
+	}
+	return fmt.Sprintf("http://%s:%d/%s", host, dhr.handler.bk.StaticPort, strings.TrimLeft(fname, "/"))
+}
+
 // fillForPXE is responsible for determining whether we should handle
 // this options as a PXE request, and adding any required out options
 // based
 func (dhr *DhcpRequest) fillForPXE(l *backend.Lease) {
+	httpBoot := dhr.offerHttpBoot()
 	// The reservation already populated a BootFileName, use it.
-	if _, ok := dhr.outOpts[dhcp.OptionBootFileName]; ok {
+	if val, ok := dhr.outOpts[dhcp.OptionBootFileName]; ok {
+		if httpBoot {
+			dhr.outOpts[dhcp.OptionBootFileName] = []byte(dhr.httpBootURL(l, string(val)))
+		}
 		return
 	}
 	// No BootFileName, fill out some sane defaults
@@ -226,44 +254,38 @@ func (dhr *DhcpRequest) fillForPXE(l *backend.Lease) {
 		string(val) == "iPXE" {
 		inIPxe = true
 	}
+	loader := backend.PxeLoaderFor(uint16(arch))
 	if inIPxe && dhr.ipxeIsSane(arch) {
 		fname = "default.ipxe"
-	} else if dhr.bootEnv != nil {
-		var archInfo models.ArchInfo
-		switch arch {
-		case 7, 9:
-			archInfo = dhr.bootEnv.RealArch("amd64")
-		case 11:
-			archInfo = dhr.bootEnv.RealArch("arm64")
-		}
-		if archInfo.Loader != "" {
+	} else if dhr.bootEnv != nil && loader != nil && loader.Arch != "" {
+		archInfo := dhr.bootEnv.RealArch(loader.Arch)
+		if httpBoot && archInfo.HttpLoader != "" {
+			fname = archInfo.HttpLoader
+		} else if archInfo.Loader != "" {
 			fname = archInfo.Loader
 		}
 	}
 	if fname == "" {
-		switch arch {
-		case 0:
-			if inIPxe {
-				fname = "ipxe.pxe"
-			} else {
-				fname = "lpxelinux.0"
-			}
-		case 7, 9:
-			fname = "ipxe.efi"
-		case 6:
+		switch {
+		case arch == 6 || arch == 15:
 			dhr.Errorf("dr-provision does not support 32 bit EFI systems")
-		case 10:
+		case arch == 10 || arch == 18:
 			dhr.Errorf("dr-provision does not support 32 bit ARM EFI systems")
-		case 11:
-			fname = "ipxe-arm64.efi"
-		default:
+		case loader == nil:
 			dhr.Errorf("Unknown client arch %d: cannot PXE boot it remotely", arch)
+		case arch == 0 && inIPxe:
+			fname = "ipxe.pxe"
+		default:
+			fname = loader.File
 		}
 	}
 	if fname == "" {
 		dhr.offerNetBoot = false
 		return
 	}
+	if httpBoot {
+		fname = dhr.httpBootURL(l, fname)
+	}
 	dhr.outOpts[dhcp.OptionBootFileName] = []byte(fname)
 }
 
@@ -276,7 +298,11 @@ func (dhr *DhcpRequest) buildBinlOptions(l *backend.Lease, serverID net.IP) {
 	if !dhr.offerNetBoot {
 		return
 	}
-	opts := dhcp.Options{dhcp.OptionVendorClassIdentifier: []byte("PXEClient")}
+	vendorClass := "PXEClient"
+	if dhr.offerHttpBoot() {
+		vendorClass = "HTTPClient"
+	}
+	opts := dhcp.Options{dhcp.OptionVendorClassIdentifier: []byte(vendorClass)}
 	if arch, ok := dhr.pktOpts[dhcp.OptionClientArchitecture]; ok {
 		opt := &models.DhcpOption{Code: byte(dhcp.OptionClientArchitecture)}
 		opt.FillFromPacketOpt(arch)
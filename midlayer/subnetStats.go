@@ -0,0 +1,158 @@
+package midlayer
+
+import (
+	"context"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/digitalrebar/provision/backend"
+	"github.com/digitalrebar/provision/utils"
+)
+
+// SubnetMonitor periodically computes the SubnetStats of every Subnet,
+// exports them as Prometheus gauges, and publishes a "subnets" event
+// when a Subnet's utilization crosses Threshold percent.
+type SubnetMonitor struct {
+	logger.Logger
+	dt        *backend.DataTracker
+	pubs      *backend.Publishers
+	p         *utils.Prometheus
+	threshold float64
+	over      map[string]bool
+	reported  map[string]bool
+	done      chan struct{}
+	finished  chan struct{}
+}
+
+func subnetMetrics(l logger.Logger) *utils.Prometheus {
+	gauges := []struct{ id, name, desc string }{
+		{"size", "addresses", "How many usable addresses are in the subnet."},
+		{"active", "active_addresses", "How many addresses are in the subnet's active range and pools."},
+		{"leased", "leased_addresses", "How many addresses in the subnet have unexpired leases."},
+		{"reserved", "reserved_addresses", "How many addresses in the subnet are reserved."},
+		{"expired", "expired_leases", "How many expired leases in the subnet have not been reused."},
+		{"free", "free_addresses", "How many addresses in the subnet's active range and pools are free."},
+		{"used", "used_percent", "The percentage of the subnet's active range and pools in use."},
+		{"exhaustion", "exhaustion_seconds", "Estimated seconds until the subnet runs out of free addresses, 0 if usage is not growing."},
+	}
+	mets := make([]*utils.Metric, len(gauges))
+	for i, g := range gauges {
+		mets[i] = &utils.Metric{
+			ID:          g.id,
+			Name:        g.name,
+			Description: g.desc,
+			Type:        "gauge_vec",
+			Args:        []string{"subnet"},
+		}
+	}
+	return utils.NewPrometheus(l, "drp_subnet", mets)
+}
+
+func (sm *SubnetMonitor) sample() {
+	rt := sm.dt.Request(sm.Logger, "subnets", "leases", "reservations")
+	stats, err := backend.RecordSubnetStats(rt)
+	if err != nil {
+		sm.Errorf("Error computing subnet stats: %v", err)
+		return
+	}
+	seen := map[string]bool{}
+	for _, st := range stats {
+		seen[st.Name] = true
+		for id, val := range map[string]float64{
+			"size":       float64(st.Size),
+			"active":     float64(st.ActiveSize),
+			"leased":     float64(st.Leased),
+			"reserved":   float64(st.Reserved),
+			"expired":    float64(st.Expired),
+			"free":       float64(st.Free),
+			"used":       st.PercentUsed,
+			"exhaustion": float64(st.SecondsToExhaustion),
+		} {
+			if g := sm.p.GaugeWithLabelValues(id, st.Name); g != nil {
+				g.Set(val)
+			}
+		}
+		if sm.threshold <= 0 || st.ActiveSize == 0 {
+			continue
+		}
+		over := st.PercentUsed >= sm.threshold
+		if over == sm.over[st.Name] {
+			continue
+		}
+		sm.over[st.Name] = over
+		action := "normal"
+		if over {
+			action = "threshold"
+			sm.Warnf("Subnet %s is %.1f%% used, at or above the %.1f%% limit", st.Name, st.PercentUsed, sm.threshold)
+		} else {
+			sm.Infof("Subnet %s is %.1f%% used, below the %.1f%% limit", st.Name, st.PercentUsed, sm.threshold)
+		}
+		sm.pubs.Publish("subnets", action, st.Name, "dhcp", st)
+	}
+	for _, name := range sm.stale(seen) {
+		delete(sm.over, name)
+		for _, id := range []string{"size", "active", "leased", "reserved", "expired", "free", "used", "exhaustion"} {
+			sm.p.DeleteLabelValues(id, name)
+		}
+	}
+}
+
+// stale returns the Subnets that were reported last time but no
+// longer exist, and remembers the ones in seen for next time.
+func (sm *SubnetMonitor) stale(seen map[string]bool) []string {
+	res := []string{}
+	for name := range sm.reported {
+		if !seen[name] {
+			res = append(res, name)
+		}
+	}
+	sm.reported = seen
+	return res
+}
+
+func (sm *SubnetMonitor) run(interval time.Duration) {
+	defer close(sm.finished)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	sm.sample()
+	for {
+		select {
+		case <-sm.done:
+			return
+		case <-ticker.C:
+			sm.sample()
+		}
+	}
+}
+
+// Shutdown stops monitoring Subnets.
+func (sm *SubnetMonitor) Shutdown(ctx context.Context) error {
+	close(sm.done)
+	select {
+	case <-sm.finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// StartSubnetMonitor starts computing SubnetStats every interval.  A
+// threshold of 0 turns off utilization events.
+func StartSubnetMonitor(dt *backend.DataTracker, log logger.Logger, pubs *backend.Publishers, interval time.Duration, threshold float64) *SubnetMonitor {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	sm := &SubnetMonitor{
+		Logger:    log,
+		dt:        dt,
+		pubs:      pubs,
+		p:         subnetMetrics(log),
+		threshold: threshold,
+		over:      map[string]bool{},
+		reported:  map[string]bool{},
+		done:      make(chan struct{}),
+		finished:  make(chan struct{}),
+	}
+	go sm.run(interval)
+	return sm
+}
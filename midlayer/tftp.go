@@ -11,15 +11,23 @@ import (
 	"github.com/digitalrebar/logger"
 	"github.com/digitalrebar/provision/backend"
 	"github.com/digitalrebar/provision/utils"
-	"github.com/pin/tftp"
 )
 
 type TftpHandler struct {
-	srv *tftp.Server
+	srv *tftpServer
 }
 
 func (h *TftpHandler) Shutdown(ctx context.Context) error {
-	h.srv.Shutdown()
+	done := make(chan struct{})
+	go func() {
+		h.srv.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	return nil
 }
 
@@ -30,8 +38,64 @@ func OsUdpProtoCheck() string {
 	return "udp"
 }
 
+var tftpTransferMetrics = []*utils.Metric{
+	{
+		ID:          "xferCnt",
+		Name:        "transfers_total",
+		Description: "How many TFTP transfers were attempted, partitioned by file and status.",
+		Type:        "counter_vec",
+		Args:        []string{"file", "status"},
+	},
+	{
+		ID:          "xferBytes",
+		Name:        "transferred_bytes_total",
+		Description: "How many bytes were sent over TFTP, partitioned by file.",
+		Type:        "counter_vec",
+		Args:        []string{"file"},
+	},
+	{
+		ID:          "xferDur",
+		Name:        "transfer_duration_seconds",
+		Description: "How long TFTP transfers took in seconds, partitioned by file.",
+		Type:        "histogram_vec",
+		Args:        []string{"file"},
+	},
+	{
+		ID:          "xferFail",
+		Name:        "transfer_failures_total",
+		Description: "How many TFTP transfers failed, partitioned by file and reason.",
+		Type:        "counter_vec",
+		Args:        []string{"file", "reason"},
+	},
+	{
+		ID:          "xferResent",
+		Name:        "retransmitted_packets_total",
+		Description: "How many TFTP packets had to be sent again, partitioned by file.",
+		Type:        "counter_vec",
+		Args:        []string{"file"},
+	},
+}
+
+// tftpFailReason sorts transfer errors into a few buckets for the
+// transfer_failures_total metric.
+func tftpFailReason(err error) string {
+	switch err.(type) {
+	case *tftpClientError:
+		return "aborted"
+	}
+	switch {
+	case err == errTftpTimeout:
+		return "timeout"
+	case os.IsNotExist(err):
+		return "not_found"
+	case os.IsPermission(err):
+		return "permission"
+	}
+	return "error"
+}
+
 func ServeTftp(listen string, responder func(string, net.IP) (io.Reader, error),
-	log logger.Logger, pubs *backend.Publishers) (Service, error) {
+	log logger.Logger, pubs *backend.Publishers, opts TftpOptions) (Service, error) {
 	a, err := net.ResolveUDPAddr(OsUdpProtoCheck(), listen)
 	if err != nil {
 		return nil, err
@@ -41,76 +105,95 @@ func ServeTftp(listen string, responder func(string, net.IP) (io.Reader, error),
 		return nil, err
 	}
 
-	p := utils.NewPromGin(log, "drp_tftp", nil)
+	p := utils.NewPromGin(log, "drp_tftp", nil, tftpTransferMetrics)
 
-	readHandler := func(filename string, rf io.ReaderFrom) error {
+	readHandler := func(t *tftpTransfer) {
 		start := time.Now()
 		recorded := false
-		method := "INFO"
+		method := "GET"
 		status := "CRASH"
+		filename := t.filename
+		remote := t.remote.IP
+		var size int64
+		var err error
 
-		var local net.IP
-		var remote net.UDPAddr
 		l := log.Fork().SetPrincipal("tftp")
-		t, outgoing := rf.(tftp.OutgoingTransfer)
-		rpi, haveRPI := rf.(tftp.RequestPacketInfo)
-		if outgoing && haveRPI {
-			local = rpi.LocalIP()
-		}
-		if outgoing {
-			method = "GET"
-			remote = t.RemoteAddr()
-		}
-		if outgoing && haveRPI {
-			backend.AddToCache(l, local, remote.IP)
+		if t.local != nil {
+			backend.AddToCache(l, t.local, remote)
 		} else {
 			l.Errorf("TFTP: Failed to get remote and local IP address information")
 		}
+		record := func() {
+			recorded = true
+			elapsed := float64(time.Since(start)) / float64(time.Second)
+			p.Observe("reqDur", elapsed)
+			p.Observe("resSz", float64(size))
+			p.CounterWithLabelValues("reqCnt", status, method, remote.String(), filename).Inc()
+			if c := p.CounterWithLabelValues("xferCnt", filename, status); c != nil {
+				c.Inc()
+			}
+			if c := p.CounterWithLabelValues("xferBytes", filename); c != nil {
+				c.Add(float64(t.sent))
+			}
+			if o := p.ObserverWithLabelValues("xferDur", filename); o != nil {
+				o.Observe(elapsed)
+			}
+			if c := p.CounterWithLabelValues("xferResent", filename); c != nil {
+				c.Add(float64(t.resent))
+			}
+			if status != "SUCCESS" {
+				reason := "crash"
+				if err != nil {
+					reason = tftpFailReason(err)
+				}
+				if c := p.CounterWithLabelValues("xferFail", filename, reason); c != nil {
+					c.Inc()
+				}
+			}
+		}
 		l.Debugf("TFTP: attempting to send %s", filename)
 		defer func() {
 			if r := recover(); r != nil {
 				l.Errorf("TFTP: Recovered from panic:\n%v", r)
 				if !recorded {
-					elapsed := float64(time.Since(start)) / float64(time.Second)
-					p.Observe("reqDur", elapsed)
-					p.Observe("resSz", 0)
-					p.CounterWithLabelValues("reqCnt", status, method, remote.IP.String(), filename).Inc()
+					record()
 				}
 			}
 		}()
-		source, err := responder(filename, remote.IP)
+		source, err := responder(filename, remote)
 		if err != nil {
-			return err
+			t.abort(tftpErrNotFound, err)
+			status = "FAILED"
+			record()
+			return
 		}
 		if cl, ok := source.(io.ReadCloser); ok {
 			defer cl.Close()
 		}
-		var size int64
-		if outgoing {
-			switch src := source.(type) {
-			case *os.File:
-				defer src.Close()
-				if fi, err := src.Stat(); err == nil {
-					size = fi.Size()
-				}
-			case backend.Sizer:
-				size = src.Size()
+		size = -1
+		switch src := source.(type) {
+		case *os.File:
+			if fi, err := src.Stat(); err == nil {
+				size = fi.Size()
 			}
-			t.SetSize(size)
-			l.Debugf("TFTP: %s: size: %d", filename, size)
+		case backend.Sizer:
+			size = src.Size()
 		}
-		_, err = rf.ReadFrom(source)
+		l.Debugf("TFTP: %s: size: %d", filename, size)
+		err = t.send(source, size)
 		if err != nil {
 			l.Infof("TFTP: %s: transfer error: %v", filename, err)
+			t.abort(tftpErrUndefined, err)
 			status = "FAILED"
 		} else {
 			status = "SUCCESS"
+			l.Debugf("TFTP: %s: sent %d bytes with blksize %d and windowsize %d, %d packets resent",
+				filename, t.sent, t.blockSize, t.windowSize, t.resent)
+		}
+		if size < 0 {
+			size = t.sent
 		}
-		recorded = true
-		elapsed := float64(time.Since(start)) / float64(time.Second)
-		p.Observe("reqDur", elapsed)
-		p.Observe("resSz", float64(size))
-		p.CounterWithLabelValues("reqCnt", status, method, remote.IP.String(), filename).Inc()
+		record()
 
 		data := &fileData{
 			Start:        start,
@@ -118,20 +201,15 @@ func ServeTftp(listen string, responder func(string, net.IP) (io.Reader, error),
 			RequestSize:  0,
 			ResponseSize: size,
 			Status:       status,
-			Requestor:    remote.IP.String(),
+			Requestor:    remote.String(),
 			Url:          filename,
 		}
 		if err := pubs.Publish("tftp", "serve", filename, "tftp", data); err != nil {
 			l.Errorf("Failed to publish event: %v", err)
 		}
-
-		return err
 	}
-	svr := tftp.NewServer(readHandler, nil)
-
-	th := &TftpHandler{srv: svr}
-
-	go svr.Serve(conn)
+	svr := newTftpServer(conn, log, opts, readHandler)
+	svr.start()
 
-	return th, nil
+	return &TftpHandler{srv: svr}, nil
 }
@@ -0,0 +1,450 @@
+package midlayer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalrebar/logger"
+	"github.com/pin/tftp/netascii"
+	"golang.org/x/net/ipv4"
+)
+
+// TFTP opcodes (RFC 1350 and RFC 2347)
+const (
+	tftpRRQ   uint16 = 1
+	tftpWRQ   uint16 = 2
+	tftpDATA  uint16 = 3
+	tftpACK   uint16 = 4
+	tftpERROR uint16 = 5
+	tftpOACK  uint16 = 6
+)
+
+// TFTP error codes (RFC 1350 and RFC 2347)
+const (
+	tftpErrUndefined  uint16 = 0
+	tftpErrNotFound   uint16 = 1
+	tftpErrAccess     uint16 = 2
+	tftpErrUnknownTID uint16 = 5
+)
+
+const (
+	tftpDefaultBlockSize = 512
+	tftpMinBlockSize     = 8
+	tftpMaxBlockSize     = 65464
+	tftpMaxWindowSize    = 65535
+	// The largest block that fits in a 1500 byte Ethernet frame
+	// without being fragmented.
+	tftpDefaultMaxBlockSize = 1468
+)
+
+// TftpOptions controls how the TFTP server sends files.  Clients
+// can ask for bigger blocks (blksize, RFC 2348), for several blocks
+// to be sent before each ACK (windowsize, RFC 7440), for the size of
+// the file (tsize, RFC 2349), and for a different retransmit timeout
+// (timeout, RFC 2349).  MaxBlockSize and MaxWindowSize cap what they
+// get.  Blocks that are not acknowledged within Timeout are sent
+// again up to Retries times, and transfers that take longer than
+// TransferTimeout are aborted.  Zero values pick the defaults.
+type TftpOptions struct {
+	MaxBlockSize    int
+	MaxWindowSize   int
+	Timeout         time.Duration
+	Retries         int
+	TransferTimeout time.Duration
+}
+
+func (o TftpOptions) withDefaults() TftpOptions {
+	if o.MaxBlockSize < tftpMinBlockSize {
+		o.MaxBlockSize = tftpDefaultMaxBlockSize
+	} else if o.MaxBlockSize > tftpMaxBlockSize {
+		o.MaxBlockSize = tftpMaxBlockSize
+	}
+	if o.MaxWindowSize < 1 || o.MaxWindowSize > tftpMaxWindowSize {
+		o.MaxWindowSize = 16
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Second
+	}
+	if o.Retries < 1 {
+		o.Retries = 5
+	}
+	if o.TransferTimeout <= 0 {
+		o.TransferTimeout = 10 * time.Minute
+	}
+	return o
+}
+
+// errTftpTimeout is returned when a client stops acknowledging
+// blocks, or when a transfer runs past TransferTimeout.
+var errTftpTimeout = errors.New("timed out")
+
+// tftpClientError is returned when the client sends us an ERROR
+// packet in the middle of a transfer.
+type tftpClientError struct {
+	code uint16
+	msg  string
+}
+
+func (e *tftpClientError) Error() string {
+	return fmt.Sprintf("client aborted the transfer: code %d: %s", e.code, e.msg)
+}
+
+func tftpErrorPacket(code uint16, msg string) []byte {
+	pkt := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(pkt, tftpERROR)
+	binary.BigEndian.PutUint16(pkt[2:], code)
+	pkt = append(pkt, msg...)
+	return append(pkt, 0)
+}
+
+// parseTftpRequest splits a RRQ or WRQ packet into the filename,
+// the transfer mode, and the options the client asked for.
+func parseTftpRequest(pkt []byte) (filename, mode string, opts map[string]string, err error) {
+	fields := strings.Split(string(pkt[2:]), "\x00")
+	// Every field ends with a NUL, so the last one is empty.
+	if len(fields) < 3 || fields[len(fields)-1] != "" || fields[0] == "" {
+		err = errors.New("malformed request")
+		return
+	}
+	fields = fields[:len(fields)-1]
+	filename, mode = fields[0], strings.ToLower(fields[1])
+	if mode != "octet" && mode != "netascii" {
+		err = fmt.Errorf("unsupported mode %s", mode)
+		return
+	}
+	opts = map[string]string{}
+	for i := 2; i+1 < len(fields); i += 2 {
+		opts[strings.ToLower(fields[i])] = fields[i+1]
+	}
+	return
+}
+
+// tftpTransfer is a single file being sent to a client.  Each one
+// gets its own socket, and so its own transfer ID.
+type tftpTransfer struct {
+	limits     TftpOptions
+	conn       *net.UDPConn
+	remote     *net.UDPAddr
+	local      net.IP
+	filename   string
+	mode       string
+	requested  map[string]string
+	blockSize  int
+	windowSize int
+	timeout    time.Duration
+	deadline   time.Time
+	buf        []byte
+	// sent is the number of bytes of the file the client has acknowledged.
+	sent int64
+	// resent is the number of packets that had to be sent again.
+	resent int
+}
+
+// negotiate picks the options to use for a file that is size bytes
+// long, or -1 if that is not known, and returns the ones to put in an
+// OACK.  Options we do not know or that have unusable values are left
+// out, and the client falls back to the RFC 1350 behaviour for them.
+func (t *tftpTransfer) negotiate(size int64) map[string]string {
+	res := map[string]string{}
+	for name, val := range t.requested {
+		switch name {
+		case "blksize":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < tftpMinBlockSize {
+				continue
+			}
+			if n > t.limits.MaxBlockSize {
+				n = t.limits.MaxBlockSize
+			}
+			t.blockSize = n
+			res[name] = strconv.Itoa(n)
+		case "windowsize":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				continue
+			}
+			if n > t.limits.MaxWindowSize {
+				n = t.limits.MaxWindowSize
+			}
+			t.windowSize = n
+			res[name] = strconv.Itoa(n)
+		case "timeout":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 || n > 255 {
+				continue
+			}
+			t.timeout = time.Duration(n) * time.Second
+			res[name] = val
+		case "tsize":
+			// netascii translation changes the size of the file.
+			if size < 0 || t.mode == "netascii" {
+				continue
+			}
+			res[name] = strconv.FormatInt(size, 10)
+		}
+	}
+	return res
+}
+
+// waitAck waits for the client to acknowledge one of the count
+// blocks starting at first, and returns how many of them it has.  It
+// returns 0 if nothing useful arrived before the timeout.
+func (t *tftpTransfer) waitAck(first uint16, count int) (int, error) {
+	wait := time.Now().Add(t.timeout)
+	if wait.After(t.deadline) {
+		wait = t.deadline
+	}
+	t.conn.SetReadDeadline(wait)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(t.buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if !time.Now().Before(t.deadline) {
+					return 0, errTftpTimeout
+				}
+				return 0, nil
+			}
+			return 0, err
+		}
+		if !addr.IP.Equal(t.remote.IP) || addr.Port != t.remote.Port {
+			t.conn.WriteToUDP(tftpErrorPacket(tftpErrUnknownTID, "unknown transfer ID"), addr)
+			continue
+		}
+		if n < 4 {
+			continue
+		}
+		switch binary.BigEndian.Uint16(t.buf) {
+		case tftpACK:
+			// Block numbers wrap around, so do the math in uint16.
+			// ACKs for blocks before first are duplicates, and
+			// answering them would start Sorcerer's Apprentice
+			// syndrome.
+			block := binary.BigEndian.Uint16(t.buf[2:])
+			if k := int(block-first) + 1; k <= count {
+				return k, nil
+			}
+		case tftpERROR:
+			return 0, &tftpClientError{
+				code: binary.BigEndian.Uint16(t.buf[2:]),
+				msg:  strings.TrimRight(string(t.buf[4:n]), "\x00"),
+			}
+		}
+	}
+}
+
+// transmit sends pkts, which hold consecutive blocks starting at
+// first, and returns how many of them the client acknowledged.  The
+// client wants the rest sent again.  If no ACK shows up in time, all
+// of pkts are sent again.
+func (t *tftpTransfer) transmit(pkts [][]byte, first uint16) (int, error) {
+	for try := 0; try <= t.limits.Retries; try++ {
+		if try > 0 {
+			t.resent += len(pkts)
+		}
+		for _, pkt := range pkts {
+			if _, err := t.conn.WriteToUDP(pkt, t.remote); err != nil {
+				return 0, err
+			}
+		}
+		acked, err := t.waitAck(first, len(pkts))
+		if err != nil || acked > 0 {
+			return acked, err
+		}
+	}
+	return 0, errTftpTimeout
+}
+
+// sendOACK tells the client which options we agreed to, and waits for
+// it to acknowledge them with an ACK of block 0.
+func (t *tftpTransfer) sendOACK(opts map[string]string) error {
+	pkt := make([]byte, 2, 512)
+	binary.BigEndian.PutUint16(pkt, tftpOACK)
+	for name, val := range opts {
+		pkt = append(pkt, name...)
+		pkt = append(pkt, 0)
+		pkt = append(pkt, val...)
+		pkt = append(pkt, 0)
+	}
+	_, err := t.transmit([][]byte{pkt}, 0)
+	return err
+}
+
+// sendData sends everything in src to the client, windowSize blocks
+// at a time.
+func (t *tftpTransfer) sendData(src io.Reader) error {
+	pending := [][]byte{}
+	first := uint16(1)
+	done := false
+	for {
+		for !done && len(pending) < t.windowSize {
+			pkt := make([]byte, 4+t.blockSize)
+			n, err := io.ReadFull(src, pkt[4:])
+			switch err {
+			case nil:
+			case io.EOF, io.ErrUnexpectedEOF:
+				// A short (possibly empty) block ends the transfer.
+				done = true
+			default:
+				return err
+			}
+			binary.BigEndian.PutUint16(pkt, tftpDATA)
+			binary.BigEndian.PutUint16(pkt[2:], first+uint16(len(pending)))
+			pending = append(pending, pkt[:4+n])
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		acked, err := t.transmit(pending, first)
+		if err != nil {
+			return err
+		}
+		for _, pkt := range pending[:acked] {
+			t.sent += int64(len(pkt) - 4)
+		}
+		pending = pending[acked:]
+		first += uint16(acked)
+	}
+}
+
+// send negotiates options with the client and sends it everything in
+// src.  size is how many bytes src holds, or -1 if that is not known.
+func (t *tftpTransfer) send(src io.Reader, size int64) error {
+	if t.mode == "netascii" {
+		src = netascii.ToReader(src)
+	}
+	if opts := t.negotiate(size); len(opts) > 0 {
+		if err := t.sendOACK(opts); err != nil {
+			return err
+		}
+	}
+	return t.sendData(src)
+}
+
+// abort tells the client that the transfer failed because of err,
+// unless it was the client that gave up.
+func (t *tftpTransfer) abort(code uint16, err error) {
+	if _, ok := err.(*tftpClientError); ok {
+		return
+	}
+	t.conn.WriteToUDP(tftpErrorPacket(code, err.Error()), t.remote)
+}
+
+// tftpServer answers read requests on a single UDP socket, and hands
+// each one off to handler on its own socket.
+type tftpServer struct {
+	logger.Logger
+	TftpOptions
+	conn    *net.UDPConn
+	pc      *ipv4.PacketConn
+	handler func(*tftpTransfer)
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newTftpServer(conn *net.UDPConn, log logger.Logger, opts TftpOptions, handler func(*tftpTransfer)) *tftpServer {
+	s := &tftpServer{
+		Logger:      log,
+		TftpOptions: opts.withDefaults(),
+		conn:        conn,
+		pc:          ipv4.NewPacketConn(conn),
+		handler:     handler,
+		closing:     make(chan struct{}),
+	}
+	// We want to know which of our addresses each request was sent
+	// to, so that we can answer from it.
+	if err := s.pc.SetControlMessage(ipv4.FlagDst, true); err != nil {
+		s.Infof("TFTP: cannot get destination addresses of requests: %v", err)
+	}
+	return s
+}
+
+func (s *tftpServer) handle(pkt []byte, local net.IP, remote *net.UDPAddr) {
+	defer s.wg.Done()
+	op := binary.BigEndian.Uint16(pkt)
+	if op != tftpRRQ && op != tftpWRQ {
+		return
+	}
+	conn, err := net.ListenUDP(OsUdpProtoCheck(), &net.UDPAddr{IP: local})
+	if err != nil {
+		if conn, err = net.ListenUDP(OsUdpProtoCheck(), &net.UDPAddr{}); err != nil {
+			s.Errorf("TFTP: cannot open a socket for %s: %v", remote, err)
+			return
+		}
+	}
+	defer conn.Close()
+	if op == tftpWRQ {
+		conn.WriteToUDP(tftpErrorPacket(tftpErrAccess, "server does not support write requests"), remote)
+		return
+	}
+	filename, mode, opts, err := parseTftpRequest(pkt)
+	if err != nil {
+		conn.WriteToUDP(tftpErrorPacket(tftpErrUndefined, err.Error()), remote)
+		return
+	}
+	s.handler(&tftpTransfer{
+		limits:     s.TftpOptions,
+		conn:       conn,
+		remote:     remote,
+		local:      local,
+		filename:   filename,
+		mode:       mode,
+		requested:  opts,
+		blockSize:  tftpDefaultBlockSize,
+		windowSize: 1,
+		timeout:    s.Timeout,
+		deadline:   time.Now().Add(s.TransferTimeout),
+		buf:        make([]byte, 1024),
+	})
+}
+
+func (s *tftpServer) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, cm, src, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closing:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.Errorf("TFTP: server stopped: %v", err)
+			return
+		}
+		remote, ok := src.(*net.UDPAddr)
+		if !ok || n < 2 {
+			continue
+		}
+		var local net.IP
+		if cm != nil {
+			local = cm.Dst
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		s.wg.Add(1)
+		go s.handle(pkt, local, remote)
+	}
+}
+
+func (s *tftpServer) start() {
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// shutdown stops answering new requests, and waits for the transfers
+// in progress to finish.
+func (s *tftpServer) shutdown() {
+	close(s.closing)
+	s.conn.Close()
+	s.wg.Wait()
+}
@@ -9,11 +9,15 @@ package midlayer
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/digitalrebar/logger"
 	"github.com/digitalrebar/provision/backend"
@@ -24,7 +28,7 @@ func TestTftpFiles(t *testing.T) {
 	locallogger := log.New(os.Stderr, "", log.LstdFlags)
 	l := logger.New(locallogger).Log("static")
 	fs := backend.NewFS(".", l)
-	_, hh := ServeTftp(":3235235", fs.TftpResponder(), l, backend.NewPublishers(locallogger))
+	_, hh := ServeTftp(":3235235", fs.TftpResponder(), l, backend.NewPublishers(locallogger), TftpOptions{})
 	if hh != nil {
 		if hh.Error() != "address 3235235: invalid port" {
 			t.Errorf("Expected a different error: %v", hh.Error())
@@ -33,7 +37,7 @@ func TestTftpFiles(t *testing.T) {
 		t.Errorf("Should have returned an error")
 	}
 
-	_, hh = ServeTftp("1.1.1.1:11112", fs.TftpResponder(), l, backend.NewPublishers(locallogger))
+	_, hh = ServeTftp("1.1.1.1:11112", fs.TftpResponder(), l, backend.NewPublishers(locallogger), TftpOptions{})
 	if hh != nil {
 		if !strings.Contains(hh.Error(), "1.1.1.1:11112: bind: ") {
 			t.Errorf("Expected a different error: %v", hh.Error())
@@ -47,7 +51,7 @@ func TestTftpFiles(t *testing.T) {
 		panic(err)
 	}
 	fs = backend.NewFS(dir, l)
-	srv, hh := ServeTftp("127.0.0.1:11112", fs.TftpResponder(), l, backend.NewPublishers(locallogger))
+	srv, hh := ServeTftp("127.0.0.1:11112", fs.TftpResponder(), l, backend.NewPublishers(locallogger), TftpOptions{})
 	if hh != nil {
 		t.Errorf("Should not return an error: %v", hh)
 	} else {
@@ -125,3 +129,97 @@ func TestTftpFiles(t *testing.T) {
 	}
 
 }
+
+func TestTftpOptions(t *testing.T) {
+	locallogger := log.New(os.Stderr, "", log.LstdFlags)
+	l := logger.New(locallogger).Log("static")
+	dir, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	want, err := ioutil.ReadFile("dhcp.go")
+	if err != nil {
+		t.Fatalf("Cannot read dhcp.go: %v", err)
+	}
+	fs := backend.NewFS(dir, l)
+	srv, err := ServeTftp("127.0.0.1:11113", fs.TftpResponder(), l, backend.NewPublishers(locallogger),
+		TftpOptions{MaxBlockSize: 1024, MaxWindowSize: 4})
+	if err != nil {
+		t.Fatalf("Should not return an error: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Cannot open client socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	rrq := []byte{0, 1}
+	for _, field := range []string{"dhcp.go", "octet", "blksize", "1468", "windowsize", "8", "tsize", "0", "bogus", "1"} {
+		rrq = append(append(rrq, field...), 0)
+	}
+	if _, err := conn.WriteToUDP(rrq, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11113}); err != nil {
+		t.Fatalf("Cannot send request: %v", err)
+	}
+	buf := make([]byte, 2048)
+	n, server, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("No OACK: %v", err)
+	}
+	if binary.BigEndian.Uint16(buf) != 6 {
+		t.Fatalf("Expected an OACK, got opcode %d", binary.BigEndian.Uint16(buf))
+	}
+	fields := strings.Split(strings.TrimSuffix(string(buf[2:n]), "\x00"), "\x00")
+	opts := map[string]string{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		opts[fields[i]] = fields[i+1]
+	}
+	if len(opts) != 3 || opts["blksize"] != "1024" || opts["windowsize"] != "4" || opts["tsize"] != fmt.Sprintf("%d", len(want)) {
+		t.Errorf("Unexpected options in OACK: %v", opts)
+	}
+	ack := func(block uint16) {
+		pkt := []byte{0, 4, 0, 0}
+		binary.BigEndian.PutUint16(pkt[2:], block)
+		if _, err := conn.WriteToUDP(pkt, server); err != nil {
+			t.Fatalf("Cannot send ACK %d: %v", block, err)
+		}
+	}
+	ack(0)
+	got := []byte{}
+	next := uint16(1)
+	inWindow := 0
+	partial := true
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Transfer stalled at block %d: %v", next, err)
+		}
+		if binary.BigEndian.Uint16(buf) != 3 {
+			t.Fatalf("Expected DATA, got opcode %d", binary.BigEndian.Uint16(buf))
+		}
+		if binary.BigEndian.Uint16(buf[2:]) != next {
+			continue
+		}
+		got = append(got, buf[4:n]...)
+		next++
+		inWindow++
+		if n-4 < 1024 {
+			ack(next - 1)
+			break
+		}
+		if inWindow == 4 {
+			inWindow = 0
+			if partial {
+				// Pretend the last two blocks of the first window
+				// were lost, so that they have to be sent again.
+				partial = false
+				next -= 2
+				got = got[:len(got)-2048]
+			}
+			ack(next - 1)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Received %d bytes that do not match the %d bytes of dhcp.go", len(got), len(want))
+	}
+}
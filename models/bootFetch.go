@@ -0,0 +1,43 @@
+package models
+
+import (
+	"net"
+	"time"
+)
+
+// BootFetch records a file that a Machine fetched from the TFTP or
+// static HTTP server.  The most recent ones are kept for each
+// Machine, and each one is also published as the Object of a
+// "machines" event with the "bootprogress" action and the Machine's
+// UUID as the key.
+//
+// swagger:model
+type BootFetch struct {
+	// Time is when the fetch started.
+	Time time.Time
+	// Machine is the UUID of the Machine that fetched the file.
+	Machine string
+	// BootEnv is the BootEnv the Machine was in at the time.
+	BootEnv string
+	// Source is the server the file came from, either "tftp" or
+	// "http".
+	Source string
+	// Address is the IP address the request came from.
+	Address net.IP
+	// Path is the path of the file that was fetched.
+	Path string
+	// Stage is the part of the boot process the file belongs to:
+	// "bootloader" for network bootloaders and their configs,
+	// "kernel" and "initrd" for the BootEnv's kernel and initrds,
+	// "config" for the templates rendered for the Machine (such as
+	// kickstarts and preseeds), "repo" for the rest of the BootEnv's
+	// install tree, and "other" for anything else.
+	Stage string
+	// Status is SUCCESS or FAILED for TFTP, and the HTTP status code
+	// for HTTP.
+	Status string
+	// Size is the number of bytes sent.
+	Size int64
+	// Seconds is how long the fetch took.
+	Seconds float64
+}
@@ -57,6 +57,13 @@ type ArchInfo struct {
 	// options, and it will also only be in effect when dr-provison is
 	// the DHCP server of record.
 	Loader string
+	// HttpLoader is the bootloader that should be used for UEFI
+	// firmware that HTTP Boots directly instead of using TFTP.  It
+	// can be a path on the static file server or a full http or
+	// https URL.  If left unspecified, Loader is used instead, and
+	// if that is also unspecified ipxe.efi or ipxe-arm64.efi will be
+	// used.
+	HttpLoader string `json:",omitempty"`
 }
 
 func (a *ArchInfo) Fill() {
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"net"
+	"strings"
+)
+
+// ClientClass is a named group of DHCP clients on a Subnet that get
+// their own options, next server, and boot file.  A client is in the
+// class when it matches every match field that is set, and a class
+// must set at least one of them.  Classes are evaluated in order, and
+// the first match wins.
+//
+// swagger:model
+type ClientClass struct {
+	// Name is the name of the class.  It must be unique within the
+	// Subnet.
+	//
+	// required: true
+	Name string
+	// VendorClass matches clients whose vendor class identifier
+	// (option 60) starts with this value.
+	VendorClass string `json:",omitempty"`
+	// UserClass matches clients whose user class (option 77) starts
+	// with this value.
+	UserClass string `json:",omitempty"`
+	// Arches matches clients whose client system architecture
+	// (option 93) is one of these values.
+	Arches []uint16 `json:",omitempty"`
+	// MacPrefix matches clients whose hardware address starts with
+	// these colon-separated hex bytes, such as "00:25:90".
+	MacPrefix string `json:",omitempty"`
+	// CircuitID matches the circuit-id sub-option of the relay agent
+	// information (option 82).
+	CircuitID string `json:",omitempty"`
+	// RemoteID matches the remote-id sub-option of the relay agent
+	// information (option 82).
+	RemoteID string `json:",omitempty"`
+	// Options are handed out to members of the class.  They take
+	// priority over the Subnet Options, but not over Options from a
+	// Reservation.
+	Options []DhcpOption `json:",omitempty"`
+	// NextServer overrides the Subnet NextServer for members of the
+	// class.
+	//
+	// swagger:strfmt ipv4
+	NextServer net.IP `json:",omitempty"`
+	// BootFileName is the boot file handed out to members of the
+	// class in place of the one dr-provision would pick.
+	BootFileName string `json:",omitempty"`
+}
+
+// MatchesMac returns true if the hardware address mac starts with
+// MacPrefix.
+func (c *ClientClass) MatchesMac(mac string) bool {
+	return strings.HasPrefix(strings.ToLower(mac), strings.ToLower(c.MacPrefix))
+}
+
+// Validate records any errors in the class against e.
+func (c *ClientClass) Validate(e ErrorAdder) {
+	if c.Name == "" {
+		e.Errorf("ClientClass must have a Name")
+	}
+	if c.VendorClass == "" && c.UserClass == "" && len(c.Arches) == 0 &&
+		c.MacPrefix == "" && c.CircuitID == "" && c.RemoteID == "" {
+		e.Errorf("ClientClass %s must match on something", c.Name)
+	}
+	if c.MacPrefix != "" {
+		for _, b := range strings.Split(c.MacPrefix, ":") {
+			if len(b) != 2 || strings.Trim(strings.ToLower(b), "0123456789abcdef") != "" {
+				e.Errorf("ClientClass %s: invalid MacPrefix %s", c.Name, c.MacPrefix)
+				break
+			}
+		}
+	}
+	if c.NextServer != nil {
+		ValidateMaybeZeroIP4(e, c.NextServer)
+	}
+}
@@ -0,0 +1,29 @@
+package models
+
+import "net"
+
+// DdnsResult is the outcome of a dynamic DNS update.  One is
+// published as the Object of a "ddns" event for every update that is
+// sent to a DNS server.
+//
+// swagger:model
+type DdnsResult struct {
+	// Action is either "add" or "remove".
+	Action string
+	// Name is the fully qualified name that was updated.
+	Name string
+	// Address is the address the name points to.
+	//
+	// swagger:strfmt ip
+	Address net.IP
+	// Server is the DNS server the update was sent to.
+	Server string
+	// Zone is the forward zone that was updated.
+	Zone string
+	// ReverseZone is the reverse zone that was updated, if any.
+	ReverseZone string
+	// Reason is the type and key of the object that triggered the update.
+	Reason string
+	// Error is empty if the update succeeded.
+	Error string
+}
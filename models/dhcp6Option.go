@@ -0,0 +1,153 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// DHCPv6 option codes that dr-provision knows how to render.  These
+// are used in place of the DHCPv4 codes in the Options of IPv6
+// Subnets and Reservations.
+const (
+	DHCP6OptionPreference    = 7
+	DHCP6OptionSIPDomains    = 21
+	DHCP6OptionSIPServers    = 22
+	DHCP6OptionDNSServers    = 23
+	DHCP6OptionDomainList    = 24
+	DHCP6OptionSNTPServers   = 31
+	DHCP6OptionNTPServer     = 56
+	DHCP6OptionBootFileURL   = 59
+	DHCP6OptionBootFileParam = 60
+)
+
+func encodeDomainList(s string) ([]byte, error) {
+	buf := []byte{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+		if name == "" {
+			continue
+		}
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("Invalid domain name %s", name)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, []byte(label)...)
+		}
+		buf = append(buf, 0)
+	}
+	return buf, nil
+}
+
+func decodeDomainList(buf []byte) string {
+	names := []string{}
+	labels := []string{}
+	for len(buf) > 0 {
+		l := int(buf[0])
+		buf = buf[1:]
+		if l == 0 {
+			names = append(names, strings.Join(labels, "."))
+			labels = []string{}
+			continue
+		}
+		if l > len(buf) {
+			break
+		}
+		labels = append(labels, string(buf[:l]))
+		buf = buf[l:]
+	}
+	return strings.Join(names, ",")
+}
+
+// DHCP6OptionParser returns functions to convert the string form of a
+// DHCPv6 option to its wire format and back again.  Options that are
+// not known are treated as plain strings.
+func DHCP6OptionParser(code uint16) (func(string) ([]byte, error), func([]byte) string) {
+	switch code {
+	case DHCP6OptionPreference:
+		return func(s string) ([]byte, error) {
+				v, err := strconv.ParseUint(s, 10, 8)
+				return []byte{byte(v)}, err
+			}, func(buf []byte) string {
+				if len(buf) != 1 {
+					return ""
+				}
+				return strconv.FormatUint(uint64(buf[0]), 10)
+			}
+	case DHCP6OptionSIPServers,
+		DHCP6OptionDNSServers,
+		DHCP6OptionSNTPServers:
+		return func(s string) ([]byte, error) {
+				buf := []byte{}
+				for _, a := range strings.Split(s, ",") {
+					addr := net.ParseIP(strings.TrimSpace(a))
+					if addr == nil || addr.To4() != nil {
+						return nil, fmt.Errorf("Invalid IPv6 address %s", a)
+					}
+					buf = append(buf, addr.To16()...)
+				}
+				return buf, nil
+			}, func(buf []byte) string {
+				addrs := []string{}
+				for len(buf) >= net.IPv6len {
+					addrs = append(addrs, net.IP(buf[:net.IPv6len]).String())
+					buf = buf[net.IPv6len:]
+				}
+				return strings.Join(addrs, ",")
+			}
+	case DHCP6OptionSIPDomains,
+		DHCP6OptionDomainList:
+		return encodeDomainList, decodeDomainList
+	case DHCP6OptionBootFileParam:
+		return func(s string) ([]byte, error) {
+				buf := []byte{}
+				for _, p := range strings.Split(s, ",") {
+					l := make([]byte, 2)
+					binary.BigEndian.PutUint16(l, uint16(len(p)))
+					buf = append(buf, l...)
+					buf = append(buf, []byte(p)...)
+				}
+				return buf, nil
+			}, func(buf []byte) string {
+				params := []string{}
+				for len(buf) >= 2 {
+					l := int(binary.BigEndian.Uint16(buf))
+					buf = buf[2:]
+					if l > len(buf) {
+						break
+					}
+					params = append(params, string(buf[:l]))
+					buf = buf[l:]
+				}
+				return strings.Join(params, ",")
+			}
+	default:
+		return func(s string) ([]byte, error) {
+				return []byte(s), nil
+			}, func(buf []byte) string {
+				return string(buf)
+			}
+	}
+}
+
+// RenderToDHCP6 expands the option Value template and converts it into
+// the wire format for the DHCPv6 option with the same code.
+func (o DhcpOption) RenderToDHCP6(srcOpts map[int]string) (code uint16, val []byte, err error) {
+	code = uint16(o.Code)
+	tmpl, err := template.New("dhcp6_option").Funcs(DrpSafeFuncMap()).Parse(o.Value)
+	if err != nil {
+		return code, nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, srcOpts); err != nil {
+		return code, nil, err
+	}
+	fn, _ := DHCP6OptionParser(code)
+	val, err = fn(buf.String())
+	return code, val, err
+}
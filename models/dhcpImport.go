@@ -0,0 +1,53 @@
+package models
+
+// DhcpImport describes the configuration and lease database of
+// another DHCP server to turn into Subnets, Reservations, and Leases,
+// and what came of it.
+//
+// swagger:model
+type DhcpImport struct {
+	// Format is the DHCP server the files come from.  It is one of
+	// "isc", "kea", or "dnsmasq".
+	//
+	// required: true
+	Format string
+	// Config is the server configuration: dhcpd.conf for "isc",
+	// kea-dhcp4.conf for "kea", or the dnsmasq configuration for
+	// "dnsmasq".
+	Config string `json:",omitempty"`
+	// LeaseData is the lease database: dhcpd.leases for "isc", the
+	// memfile lease CSV for "kea", or dnsmasq.leases for "dnsmasq".
+	LeaseData string `json:",omitempty"`
+	// Enabled marks the imported Subnets as enabled.  Subnets are
+	// imported disabled by default so that they do not compete with
+	// the server being migrated from.
+	Enabled bool `json:",omitempty"`
+	// DryRun reports what would be imported and what conflicts with
+	// existing objects without creating anything.
+	DryRun bool `json:",omitempty"`
+
+	// Subnets are the Subnets found in Config.
+	Subnets []*Subnet
+	// Reservations are the Reservations found in Config.
+	Reservations []*Reservation
+	// Leases are the active Leases found in LeaseData.
+	Leases []*Lease
+	// Conflicts are the objects that were not (or would not be)
+	// created, and why.
+	Conflicts []DhcpImportConflict
+	// Warnings are the parts of the files that could not be
+	// imported.
+	Warnings []string
+}
+
+// DhcpImportConflict is an imported object that could not be created.
+//
+// swagger:model
+type DhcpImportConflict struct {
+	// Prefix is the type of the object, such as "subnets".
+	Prefix string
+	// Key is the key of the object.
+	Key string
+	// Reason is why the object could not be created.
+	Reason string
+}
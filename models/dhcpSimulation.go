@@ -0,0 +1,73 @@
+package models
+
+import "net"
+
+// DhcpSimulation describes a DHCP packet to run through the DHCP
+// server without changing anything, and what the server did with it.
+// The packet is either a captured one in Packet, or is built from the
+// other request fields.
+//
+// swagger:model
+type DhcpSimulation struct {
+	// Packet is a captured DHCP packet, in the text format the DHCP
+	// server logs packets in at debug level.  If it is set, the
+	// other request fields are ignored.
+	Packet string `json:",omitempty"`
+	// Mac is the hardware address of the client.
+	Mac string `json:",omitempty"`
+	// MessageType is the DHCP message type to send.  It defaults to
+	// "discover".
+	MessageType string `json:",omitempty"`
+	// Arch is the client system architecture (option 93), if any.
+	Arch *uint16 `json:",omitempty"`
+	// VendorClass is the vendor class identifier (option 60).
+	VendorClass string `json:",omitempty"`
+	// UserClass is the user class (option 77).  iPXE sends "iPXE".
+	UserClass string `json:",omitempty"`
+	// Relay is the address of the relay agent the packet came
+	// through, if any.
+	//
+	// swagger:strfmt ipv4
+	Relay net.IP `json:",omitempty"`
+	// CircuitID and RemoteID are the relay agent information
+	// sub-options (option 82), if any.
+	CircuitID string `json:",omitempty"`
+	RemoteID  string `json:",omitempty"`
+	// RequestedAddr is the address the client asks for (option 50).
+	//
+	// swagger:strfmt ipv4
+	RequestedAddr net.IP `json:",omitempty"`
+	// Interface is the name of the interface the packet arrives on.
+	// It defaults to the first interface with an IPv4 address.
+	Interface string `json:",omitempty"`
+	// Binl sends the packet to the PXE/BINL server instead of the
+	// DHCP server.
+	Binl bool `json:",omitempty"`
+
+	// Request is the packet that was simulated, in text form.
+	Request string
+	// Result is how the server handled the packet, such as "Offer",
+	// "ACK", "NAK", or "NoLease".
+	Result string
+	// Replies are the packets the server would have sent, in text form.
+	Replies []string
+	// Address is the address the client would have been given.
+	//
+	// swagger:strfmt ipv4
+	Address net.IP `json:",omitempty"`
+	// Subnet is the name of the Subnet the address came from.
+	Subnet string `json:",omitempty"`
+	// Reservation is the address of the Reservation that was used.
+	//
+	// swagger:strfmt ipv4
+	Reservation net.IP `json:",omitempty"`
+	// Machine is the UUID of the Machine the client is.
+	Machine string `json:",omitempty"`
+	// BootEnv is the BootEnv the client would boot into.
+	BootEnv string `json:",omitempty"`
+	// FileName is the boot file the client would be told to load.
+	FileName string `json:",omitempty"`
+	// Logs are the messages the DHCP server logged while handling
+	// the packet.
+	Logs []string
+}
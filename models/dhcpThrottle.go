@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// DhcpThrottle records a DHCP client or relay that sent packets too
+// quickly and is being ignored.  One is published as the Object of a
+// "dhcp" event with the "throttle" action each time a client or relay
+// starts being ignored.
+//
+// swagger:model
+type DhcpThrottle struct {
+	// Kind is either "mac" or "relay".
+	Kind string
+	// Key is the MAC address of the client or the address of the relay.
+	Key string
+	// Count is the number of packets seen in the rate window.
+	Count int
+	// Until is when packets will be processed again.
+	//
+	// swagger:strfmt date-time
+	Until time.Time
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// FailoverStatus describes the state of DHCP lease synchronization
+// with a peer dr-provision endpoint.
+//
+// swagger:model
+type FailoverStatus struct {
+	// Peer is the API endpoint of the failover peer.
+	Peer string
+	// Mode is either "split" or "standby".
+	Mode string
+	// Primary is true if this endpoint is the primary peer.
+	Primary bool
+	// MCLT is the Maximum Client Lead Time in seconds.
+	MCLT int
+	// PeerUp is true if the last attempt to contact the peer succeeded.
+	PeerUp bool
+	// PartnerDown is true if the peer has been out of contact for
+	// longer than the MCLT, and this endpoint has taken over the
+	// whole of every subnet.
+	PartnerDown bool
+	// LastContact is the last time the peer was successfully contacted.
+	//
+	// swagger:strfmt date-time
+	LastContact time.Time
+}
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// IsoDownload tracks the download of an ISO that a BootEnv needs but
+// that is not in the isos directory yet.  It is published as the
+// Object of "isos" events keyed by the ISO's file name.  The action is
+// the new State when the State changes, and "progress" while the ISO
+// is being downloaded.
+//
+// swagger:model
+type IsoDownload struct {
+	// File is the name the ISO will have in the isos directory.
+	File string
+	// Url is where the ISO is being downloaded from.
+	Url string
+	// Sha256 is the checksum the ISO must have, if any.
+	Sha256 string
+	// State is one of "queued", "downloading", "verifying",
+	// "complete", or "failed".
+	State string
+	// Size is the size of the ISO in bytes, or 0 if the server did
+	// not say.
+	Size int64
+	// Downloaded is how many bytes of the ISO have been downloaded,
+	// including any that were downloaded before an interruption.
+	Downloaded int64
+	// Attempts is how many times the download has been tried.
+	Attempts int
+	// Started is when the download was first tried.
+	Started time.Time
+	// Error is why the last attempt failed, if it did.
+	Error string
+}
@@ -0,0 +1,31 @@
+package models
+
+// IsoExtract tracks an ISO being extracted into the file server for a
+// BootEnv.  It is published as the Object of "isos" events keyed by
+// the ISO's file name, with the "extracting" action when the
+// extraction starts and periodically while it runs, and the
+// "extracted" or "extractfailed" action when it is done.
+//
+// swagger:model
+type IsoExtract struct {
+	// File is the name of the ISO in the isos directory.
+	File string
+	// BootEnv is the BootEnv the ISO is being extracted for.
+	BootEnv string
+	// Dest is where the ISO is being extracted to, relative to the
+	// root of the file server.
+	Dest string
+	// Format is the file system the ISO is being read through, one of
+	// "rockridge", "joliet", "iso9660", or "udf".
+	Format string
+	// Partial is true when only the kernel and initrds are being
+	// extracted, because the BootEnv installs from a package
+	// repository instead of the ISO.
+	Partial bool
+	// Size is how many bytes will be extracted in total.
+	Size int64
+	// Extracted is how many bytes have been extracted so far.
+	Extracted int64
+	// Error is why the extraction failed, if it did.
+	Error string
+}
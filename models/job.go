@@ -88,9 +88,11 @@ type Job struct {
 	// required: true
 	State string
 	// The final disposition of the job.
-	// Can be one of "reboot","poweroff","stop", or "complete"
+	// Can be one of "reboot","poweroff","stop", "complete", "failed", or "cancelled"
 	// Other substates may be added as time goes on
 	ExitState string
+	// The exit code of the last script the job ran.
+	ExitCode int `json:",omitempty"`
 	// The time the job entered running.
 	StartTime time.Time
 	// The time the job entered failed or finished.
@@ -119,6 +121,12 @@ type Job struct {
 	// The bootenv that the task was created in.
 	// read only: true
 	BootEnv string
+	// The job for the task group that this job runs one of the tasks
+	// of, if any.  Jobs in a group run at the same time, and the
+	// group job finishes when all of them have.
+	// read only: true
+	// swagger:strfmt uuid
+	Group uuid.UUID `json:",omitempty"`
 }
 
 func (j *Job) GetMeta() Meta {
@@ -142,7 +150,7 @@ func (j *Job) Validate() {
 	}
 	if j.ExitState != "" {
 		switch j.ExitState {
-		case "reboot", "poweroff", "stop", "complete", "failed":
+		case "reboot", "poweroff", "stop", "complete", "failed", "cancelled":
 		default:
 			j.AddError(fmt.Errorf("Invalid ExitState `%s`", j.ExitState))
 		}
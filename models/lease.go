@@ -8,8 +8,14 @@ import (
 
 var hexDigit = []byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'A', 'B', 'C', 'D', 'E', 'F'}
 
+// Hexaddr returns the hex encoding of an IP address, which is used
+// as the key for Leases and Reservations.  IPv4 addresses are encoded
+// using their 4 byte form, IPv6 addresses using their 16 byte form.
 func Hexaddr(addr net.IP) string {
 	b := addr.To4()
+	if b == nil {
+		b = addr.To16()
+	}
 	s := make([]byte, len(b)*2)
 	for i, tn := range b {
 		s[i*2], s[i*2+1] = hexDigit[tn>>4], hexDigit[tn&0xf]
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"net"
+	"time"
+)
+
+// LeaseHistoryEntry records a single DHCP transaction that changed,
+// or was refused a change to, the state of the Lease for an address.
+//
+// swagger:model
+type LeaseHistoryEntry struct {
+	// Time is when the transaction happened.
+	//
+	// swagger:strfmt date-time
+	Time time.Time
+	// Addr is the IP address of the Lease.
+	//
+	// swagger:strfmt ip
+	Addr net.IP
+	// State is one of OFFER, ACK, NAK, RELEASE, DECLINE, or EXPIRE.
+	// EXPIRE is recorded when a Lease's ExpireTime passes without it
+	// being renewed or released, and records the Token that had it.
+	State string
+	// Strategy is the leasing strategy of the Token.
+	Strategy string
+	// Token is the client the transaction was for.
+	Token string
+	// Via is the relay or local address the request arrived via.
+	//
+	// swagger:strfmt ip
+	Via net.IP
+	// Interface is the network interface the request arrived on.
+	Interface string
+	// Xid is the DHCP transaction ID.
+	Xid string
+	// ExpireTime is the expiry time of the Lease after the transaction.
+	//
+	// swagger:strfmt date-time
+	ExpireTime time.Time
+	// Message explains NAKs and other refusals.
+	Message string
+}
@@ -159,6 +159,8 @@ func (n *Machine) Validate() {
 			case "bootenv":
 				n.AddError(ValidName("Invalid BootEnv", parts[1]))
 			case "chroot":
+			case "group":
+				n.AddError(validTaskGroup(parts[1]))
 			case "action":
 				pparts := strings.SplitN(parts[1], ":", 2)
 				if len(pparts) == 2 {
@@ -0,0 +1,46 @@
+package models
+
+// RenderPreview asks for the templates of a BootEnv, Stage, or Task to
+// be rendered for a Machine without moving the Machine into it, and
+// holds what they rendered to.  Exactly one of BootEnv, Stage, or Task
+// must be set.  Nothing about the Machine is changed, and the rendered
+// templates are not made available from the file server.
+//
+// swagger:model
+type RenderPreview struct {
+	// BootEnv is the name of the BootEnv to render.
+	BootEnv string `json:",omitempty"`
+	// Stage is the name of the Stage to render.
+	Stage string `json:",omitempty"`
+	// Task is the name of the Task to render.
+	Task string `json:",omitempty"`
+	// Params override the values the templates see for those
+	// parameters, as if they were set on the Machine.
+	Params map[string]interface{} `json:",omitempty"`
+	// Templates are the rendered templates, in the order the BootEnv,
+	// Stage, or Task lists them.
+	Templates []*RenderedTemplate
+	// Errors are any required parameters that are missing, and any
+	// template paths that could not be rendered.
+	Errors []string
+}
+
+// RenderedTemplate is a single template rendered by a RenderPreview.
+//
+// swagger:model
+type RenderedTemplate struct {
+	// Name is the ID of the template.
+	Name string
+	// Path is where the rendered template would be served from by
+	// the file server, or for Tasks, where it would be written to on
+	// the Machine.  It is empty for Task templates that are run as
+	// scripts.
+	Path string
+	// Meta is the metadata of the template.
+	Meta map[string]string `json:",omitempty"`
+	// Content is what the template rendered to.
+	Content string
+	// Error is why the template could not be rendered, if it could
+	// not.
+	Error string `json:",omitempty"`
+}
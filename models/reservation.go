@@ -25,6 +25,7 @@ type Reservation struct {
 	// should be taken into account when using it, etc. in rich structured text (rst).
 	Documentation string
 	// Token is the unique identifier that the strategy for this Reservation should use.
+	// For the "DUID" strategy, this is the client DUID as colon-separated hex bytes.
 	//
 	// required: true
 	Token string
@@ -42,7 +43,16 @@ type Reservation struct {
 	// Options is the list of DHCP options that apply to this Reservation
 	Options []DhcpOption
 	// Strategy is the leasing strategy that will be used determine what to use from
-	// the DHCP packet to handle lease management.
+	// the DHCP packet to handle lease management.  For IPv4, this is one of:
+	//
+	// * "MAC": the client hardware address.
+	// * "ClientID": the client identifier (option 61) as colon-separated hex.
+	// * "CircuitID": the relay agent circuit-id (option 82 sub-option 1).
+	// * "RemoteID": the relay agent remote-id (option 82 sub-option 2).
+	// * "RelayAgent": the remote-id and circuit-id, as remote-id/circuit-id.
+	//
+	// Relay agent values are used as-is if they are printable ASCII,
+	// and as colon-separated hex otherwise.
 	//
 	// required: true
 	Strategy string
@@ -35,7 +35,7 @@ var (
 
 	addedActions = map[string]string{
 		"users":    "token, password",
-		"jobs":     "log",
+		"jobs":     "log, cancel",
 		"machines": "getSecure, updateSecure",
 		"plugins":  "getSecure, updateSecure",
 		"profiles": "getSecure, updateSecure",
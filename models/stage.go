@@ -1,6 +1,35 @@
 package models
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
+
+// TaskGroup returns the names of the Tasks in a "group:" entry in a
+// task list.  The Tasks in a group are handed out to the machine agent
+// all at once to be run at the same time, and the task list only moves
+// past the group once all of them have finished.  ok is false if the
+// entry is not a task group.
+func TaskGroup(entry string) (tasks []string, ok bool) {
+	if !strings.HasPrefix(entry, "group:") {
+		return nil, false
+	}
+	return strings.Split(strings.TrimPrefix(entry, "group:"), ","), true
+}
+
+func validTaskGroup(group string) error {
+	seen := map[string]bool{}
+	for _, t := range strings.Split(group, ",") {
+		if err := ValidName("Invalid Task in group", t); err != nil {
+			return err
+		}
+		if seen[t] {
+			return fmt.Errorf("Task %s is in group %s more than once", t, group)
+		}
+		seen[t] = true
+	}
+	return nil
+}
 
 // Stage encapsulates a set of tasks and profiles to apply
 // to a Machine in a BootEnv.
@@ -48,7 +77,9 @@ type Stage struct {
 	//
 	// required: true
 	BootEnv string
-	// The list of initial machine tasks that the stage should run
+	// The list of initial machine tasks that the stage should run.
+	// An entry of the form group:task1,task2 runs the Tasks in it at
+	// the same time.
 	Tasks []string
 	// The list of profiles a machine should use while in this stage.
 	// These are used after machine profiles, but before global.
@@ -111,6 +142,8 @@ func (s *Stage) Validate() {
 				}
 				s.AddError(ValidName("Invalid Plugin", pparts[0]))
 				s.AddError(ValidName("Invalid Action", pparts[1]))
+			case "group":
+				s.AddError(validTaskGroup(parts[1]))
 			default:
 				s.Errorf("Invalid Task: %s", t)
 			}
@@ -1,10 +1,45 @@
 package models
 
 import (
+	"bytes"
 	"math/big"
 	"net"
 )
 
+// SubnetRange is an inclusive range of addresses in a Subnet.
+//
+// swagger:model
+type SubnetRange struct {
+	// Start is the first address in the range.
+	//
+	// required: true
+	// swagger:strfmt ip
+	Start net.IP
+	// End is the last address in the range.
+	//
+	// required: true
+	// swagger:strfmt ip
+	End net.IP
+}
+
+// Contains returns true if ip is in the range.
+func (r SubnetRange) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	return ip != nil &&
+		bytes.Compare(ip, r.Start.To16()) >= 0 &&
+		bytes.Compare(ip, r.End.To16()) <= 0
+}
+
+// Overlaps returns true if any address is in both ranges.
+func (r SubnetRange) Overlaps(o SubnetRange) bool {
+	return bytes.Compare(r.Start.To16(), o.End.To16()) <= 0 &&
+		bytes.Compare(o.Start.To16(), r.End.To16()) <= 0
+}
+
+func (r SubnetRange) String() string {
+	return r.Start.String() + "-" + r.End.String()
+}
+
 // Subnet represents a DHCP Subnet
 //
 // swagger:model
@@ -49,10 +84,10 @@ type Subnet struct {
 	Unmanaged bool
 	// Subnet is the network address in CIDR form that all leases
 	// acquired in its range will use for options, lease times, and NextServer settings
-	// by default
+	// by default.  It may be either an IPv4 or an IPv6 network.  IPv6
+	// subnets are served by the DHCPv6 server.
 	//
 	// required: true
-	// pattern: ^([0-9]+\.){3}[0-9]+/[0-9]+$
 	Subnet string
 	// NextServer is the address of the next server in the DHCP/TFTP/PXE
 	// chain.  You should only set this if you want to transfer control
@@ -73,6 +108,14 @@ type Subnet struct {
 	// required: true
 	// swagger:strfmt ipv4
 	ActiveEnd net.IP
+	// Pools are additional address ranges we will hand non-reserved
+	// leases from, on top of ActiveStart through ActiveEnd.  Pools
+	// must be inside the subnet and must not overlap each other or the
+	// active range.
+	Pools []SubnetRange `json:",omitempty"`
+	// Exclusions are address ranges inside the active range or Pools
+	// that will never be handed out to non-reserved leases.
+	Exclusions []SubnetRange `json:",omitempty"`
 	// ActiveLeaseTime is the default lease duration in seconds
 	// we will hand out to leases that do not have a reservation.
 	//
@@ -88,9 +131,20 @@ type Subnet struct {
 	//
 	// required: true
 	OnlyReservations bool
-	Options          []DhcpOption
+	// Options are the DHCP options that will be handed out to leases
+	// from this subnet.  For IPv6 subnets, the option codes are
+	// DHCPv6 option codes.
+	Options []DhcpOption
+	// ClientClasses give clients on this subnet that match them
+	// their own options, next server, and boot file.  The first class
+	// a client matches is used.
+	ClientClasses []ClientClass `json:",omitempty"`
 	// Strategy is the leasing strategy that will be used determine what to use from
-	// the DHCP packet to handle lease management.
+	// the DHCP packet to handle lease management.  IPv4 subnets default
+	// to "MAC", and may also use "ClientID", "CircuitID", "RemoteID",
+	// or "RelayAgent".  IPv6 subnets default to "DUID", and may also
+	// use "MAC" when the client DUID or relay agent provides a
+	// link-layer address.
 	//
 	// required: true
 	Strategy string
@@ -152,6 +206,14 @@ func (s *Subnet) Validate() {
 	if s.Strategy == "" {
 		s.Errorf("Strategy must have a value")
 	}
+	if subnet.IP.To4() == nil {
+		if s.Proxy {
+			s.Errorf("IPv6 subnets cannot be Proxy subnets")
+		}
+		if s.Strategy != "" && s.Strategy != "DUID" && s.Strategy != "MAC" {
+			s.Errorf("IPv6 subnets must use the DUID or MAC strategy, not %s", s.Strategy)
+		}
+	}
 	if s.NextServer != nil {
 		ValidateMaybeZeroIP4(s, s.NextServer)
 	}
@@ -174,16 +236,59 @@ func (s *Subnet) Validate() {
 		if startBytes.Cmp(endBytes) != -1 {
 			s.Errorf("ActiveStart %s must be less than ActiveEnd %s", s.ActiveStart, s.ActiveEnd)
 		}
+		ranges := []SubnetRange{{Start: s.ActiveStart, End: s.ActiveEnd}}
+		for _, p := range s.Pools {
+			if !s.validateRange("Pool", p, subnet) {
+				continue
+			}
+			for _, o := range ranges {
+				if p.Overlaps(o) {
+					s.Errorf("Pool %s overlaps %s", p, o)
+				}
+			}
+			ranges = append(ranges, p)
+		}
+		for _, e := range s.Exclusions {
+			s.validateRange("Exclusion", e, subnet)
+		}
 		if s.ActiveLeaseTime < 60 {
 			s.Errorf("ActiveLeaseTime must be greater than or equal to 60 seconds, not %d", s.ActiveLeaseTime)
 		}
 	}
+	classNames := map[string]struct{}{}
+	for i := range s.ClientClasses {
+		c := &s.ClientClasses[i]
+		c.Validate(s)
+		if _, ok := classNames[c.Name]; ok {
+			s.Errorf("ClientClass %s is defined more than once", c.Name)
+		}
+		classNames[c.Name] = struct{}{}
+	}
 	if s.ReservedLeaseTime < 7200 {
 		s.Errorf("ReservedLeaseTime must be greater than or equal to 7200 seconds, not %d", s.ReservedLeaseTime)
 	}
 
 }
 
+func (s *Subnet) validateRange(kind string, r SubnetRange, subnet *net.IPNet) bool {
+	if r.Start == nil || r.End == nil {
+		s.Errorf("%s %s must have a Start and an End", kind, r)
+		return false
+	}
+	ok := true
+	for _, ip := range []net.IP{r.Start, r.End} {
+		if !subnet.Contains(ip) {
+			s.Errorf("%s %s: %s not in subnet range %s", kind, r, ip, subnet)
+			ok = false
+		}
+	}
+	if ok && bytes.Compare(r.Start.To16(), r.End.To16()) > 0 {
+		s.Errorf("%s %s: Start must not be greater than End", kind, r)
+		ok = false
+	}
+	return ok
+}
+
 func (s *Subnet) Prefix() string {
 	return "subnets"
 }
@@ -206,6 +311,9 @@ func (s *Subnet) Fill() {
 	}
 	if s.Strategy == "" {
 		s.Strategy = "MAC"
+		if s.IsV6() {
+			s.Strategy = "DUID"
+		}
 	}
 	if s.Pickers == nil || len(s.Pickers) == 0 {
 		if s.OnlyReservations {
@@ -222,6 +330,12 @@ func (s *Subnet) Fill() {
 	}
 }
 
+// IsV6 returns true if the Subnet is an IPv6 network.
+func (s *Subnet) IsV6() bool {
+	ip, _, err := net.ParseCIDR(s.Subnet)
+	return err == nil && ip.To4() == nil
+}
+
 func (s *Subnet) AuthKey() string {
 	return s.Key()
 }
@@ -0,0 +1,39 @@
+package models
+
+// SubnetStats reports how much of a Subnet's address space is in
+// use.  One is also published as the Object of a "subnets" event with
+// the "threshold" action when a Subnet's PercentUsed rises to the
+// configured limit, and with the "normal" action when it drops back
+// below it.
+//
+// swagger:model
+type SubnetStats struct {
+	// Name is the name of the Subnet.
+	Name string
+	// Subnet is the network address of the Subnet in CIDR form.
+	Subnet string
+	// Size is the number of usable addresses in the Subnet.  It is
+	// capped at the largest int64 for large IPv6 Subnets.
+	Size int64
+	// ActiveSize is the number of addresses in the active range and
+	// Pools, minus the Exclusions.  It is 0 for Subnets that only
+	// hand out Reservations.
+	ActiveSize int64
+	// Leased is the number of unexpired Leases in the Subnet.
+	Leased int64
+	// Reserved is the number of Reservations in the Subnet.
+	Reserved int64
+	// Expired is the number of expired Leases in the Subnet that
+	// have not been reused yet.
+	Expired int64
+	// Free is the number of addresses in the active range and Pools
+	// that are neither leased nor reserved.
+	Free int64
+	// PercentUsed is the percentage of ActiveSize that is leased or
+	// reserved.
+	PercentUsed float64
+	// SecondsToExhaustion estimates how long it will be until there
+	// are no Free addresses, based on how fast addresses were used
+	// up over the last hour.  It is 0 if usage is not growing.
+	SecondsToExhaustion int64 `json:",omitempty"`
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"sort"
 	"strings"
+	"time"
 )
 
 // Task is a thing that can run on a Machine.
@@ -36,6 +37,63 @@ type Task struct {
 	//
 	// required: true
 	OptionalParams []string
+	// Retry is how Jobs for this Task that fail are retried.  If it
+	// is not set, a failed Job leaves the Machine not runnable until
+	// someone retries it.
+	Retry *TaskRetry `json:",omitempty"`
+	// Timeout is how long in seconds a Job for this Task can run
+	// before it is marked as failed.  If it is 0, the jobTimeout
+	// preference is used instead.
+	Timeout int32 `json:",omitempty"`
+}
+
+// TaskRetry is a policy for automatically retrying a Task that
+// failed.  Every attempt gets a Job of its own, linked to the Job
+// for the attempt before it via Previous.
+//
+// swagger:model
+type TaskRetry struct {
+	// MaxAttempts is the most times the Task will be run in a row,
+	// counting the first attempt.
+	//
+	// required: true
+	MaxAttempts int
+	// Backoff is how long in seconds to wait before the first retry.
+	// Every retry after that waits twice as long as the one before.
+	Backoff int32
+	// MaxBackoff is the longest in seconds to wait between attempts.
+	// If it is 0, there is no limit.
+	MaxBackoff int32
+	// ExitCodes are the exit codes of the Task's scripts that will
+	// be retried.  If it is empty, every failure will be.
+	ExitCodes []int `json:",omitempty"`
+}
+
+// Retryable returns whether a failure with the passed exit code
+// should be retried.
+func (r *TaskRetry) Retryable(exitCode int) bool {
+	if len(r.ExitCodes) == 0 {
+		return true
+	}
+	for _, c := range r.ExitCodes {
+		if c == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait after the passed number of failed
+// attempts before trying again.
+func (r *TaskRetry) Delay(attempts int) time.Duration {
+	secs, max := int64(r.Backoff), int64(r.MaxBackoff)
+	for i := 1; i < attempts && secs < 1<<32; i++ {
+		secs *= 2
+	}
+	if max > 0 && secs > max {
+		secs = max
+	}
+	return time.Duration(secs) * time.Second
 }
 
 var (
@@ -110,6 +168,25 @@ func (t *Task) Validate() {
 			}
 		}
 	}
+	if t.Retry != nil {
+		if t.Retry.MaxAttempts < 1 {
+			t.Errorf("Retry MaxAttempts must be at least 1, not %d", t.Retry.MaxAttempts)
+		}
+		if t.Retry.Backoff < 0 {
+			t.Errorf("Retry Backoff cannot be negative")
+		}
+		if t.Retry.MaxBackoff < 0 {
+			t.Errorf("Retry MaxBackoff cannot be negative")
+		}
+		for _, c := range t.Retry.ExitCodes {
+			if c < 1 || c > 255 {
+				t.Errorf("Retry ExitCode %d is not a failing exit code", c)
+			}
+		}
+	}
+	if t.Timeout < 0 {
+		t.Errorf("Timeout cannot be negative")
+	}
 	if osMetaCount != 0 && osMetaCount != len(tmplNames) {
 		t.Errorf("Cannot mix templates with OS metadata and templates without OS metadata")
 		for i := range t.Templates {
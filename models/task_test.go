@@ -0,0 +1,32 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTaskRetry(t *testing.T) {
+	r := &TaskRetry{MaxAttempts: 5, Backoff: 10, MaxBackoff: 60}
+	for attempts, want := range map[int]time.Duration{
+		1: 10 * time.Second,
+		2: 20 * time.Second,
+		3: 40 * time.Second,
+		4: 60 * time.Second,
+		9: 60 * time.Second,
+	} {
+		if got := r.Delay(attempts); got != want {
+			t.Errorf("Delay after %d attempts: expected %s, got %s", attempts, want, got)
+		}
+	}
+	r.MaxBackoff = 0
+	if got := r.Delay(100); got <= 0 {
+		t.Errorf("Delay without MaxBackoff overflowed to %s", got)
+	}
+	if !r.Retryable(1) || !r.Retryable(255) {
+		t.Errorf("Retry without ExitCodes should retry every failure")
+	}
+	r.ExitCodes = []int{3, 4}
+	if !r.Retryable(4) || r.Retryable(1) {
+		t.Errorf("Retry with ExitCodes %v retried the wrong exit codes", r.ExitCodes)
+	}
+}
@@ -1,5 +1,36 @@
 package models
 
+import "fmt"
+
+// WorkflowTransition moves a Machine running a Workflow from one of
+// its Stages to another one when the Machine leaves the first Stage
+// and the conditions of the transition match.  Tasks can steer a
+// Workflow by setting params on the Machine that transitions test.
+//
+// swagger:model
+type WorkflowTransition struct {
+	// From is the Stage the Machine is leaving.
+	//
+	// required: true
+	From string
+	// To is the Stage the Machine goes to.  If it is empty, the
+	// Workflow ends instead.
+	To string
+	// ExitState is "complete" (the default) to take the transition
+	// when every Task in the From Stage has finished, or "failed" to
+	// take it when one of them fails.
+	ExitState string `json:",omitempty"`
+	// Params are the values that params on the Machine must have for
+	// the transition to be taken.
+	Params map[string]interface{} `json:",omitempty"`
+}
+
+// Unconditional returns whether the transition is always taken when
+// every Task in its From Stage has finished.
+func (t *WorkflowTransition) Unconditional() bool {
+	return (t.ExitState == "" || t.ExitState == "complete") && len(t.Params) == 0
+}
+
 type Workflow struct {
 	Validation
 	Access
@@ -10,6 +41,12 @@ type Workflow struct {
 	Description   string
 	Documentation string
 	Stages        []string
+	// Transitions are checked in order whenever a Machine leaves one
+	// of the Stages, and the first one that matches picks the Stage
+	// it goes to next.  If none match, a Machine that finished the
+	// Stage goes on to the next one in Stages, and a Machine that
+	// failed in it stops.
+	Transitions []WorkflowTransition `json:",omitempty"`
 }
 
 func (w *Workflow) GetMeta() Meta {
@@ -68,6 +105,20 @@ func (w *Workflow) Validate() {
 	for _, stageName := range w.Stages {
 		w.AddError(ValidName("Invalid Stage Name", stageName))
 	}
+	for i, t := range w.Transitions {
+		w.AddError(ValidName(fmt.Sprintf("Invalid From Stage in transition %d", i), t.From))
+		if t.To != "" {
+			w.AddError(ValidName(fmt.Sprintf("Invalid To Stage in transition %d", i), t.To))
+		}
+		switch t.ExitState {
+		case "", "complete", "failed":
+		default:
+			w.Errorf("Invalid ExitState `%s` in transition %d", t.ExitState, i)
+		}
+		for k := range t.Params {
+			w.AddError(ValidParamName(fmt.Sprintf("Invalid Param in transition %d", i), k))
+		}
+	}
 }
 
 func (w *Workflow) CanHaveActions() bool {
@@ -63,12 +63,34 @@ type ProgOpts struct {
 	DisableProvisioner  bool   `long:"disable-provisioner" description:"Disable provisioner" env:"RS_DISABLE_PROVISIONER"`
 	DisableDHCP         bool   `long:"disable-dhcp" description:"Disable DHCP server" env:"RS_DISABLE_DHCP"`
 	DisableBINL         bool   `long:"disable-pxe" description:"Disable PXE/BINL server" env:"RS_DISABLE_BINL"`
+	DisableDDNS         bool   `long:"disable-ddns" description:"Disable dynamic DNS updates" env:"RS_DISABLE_DDNS"`
+	DisableIsoDownload  bool   `long:"disable-iso-download" description:"Disable downloading missing BootEnv ISOs from their IsoUrl" env:"RS_DISABLE_ISO_DOWNLOAD"`
+	IsoDownloadRetries  int    `long:"iso-download-retries" description:"Number of times to try a failed ISO download again" default:"5" env:"RS_ISO_DOWNLOAD_RETRIES"`
 	MetricsPort         int    `long:"metrics-port" description:"Port the metrics HTTP server should listen on" default:"8080" env:"RS_METRICS_PORT"`
 	StaticPort          int    `long:"static-port" description:"Port the static HTTP file server should listen on" default:"8091" env:"RS_STATIC_PORT"`
 	TftpPort            int    `long:"tftp-port" description:"Port for the TFTP server to listen on" default:"69" env:"RS_TFTP_PORT"`
+	TftpMaxBlockSize    int    `long:"tftp-max-blksize" description:"Largest TFTP block size clients may negotiate" default:"1468" env:"RS_TFTP_MAX_BLKSIZE"`
+	TftpMaxWindowSize   int    `long:"tftp-max-windowsize" description:"Largest number of TFTP blocks clients may ask to be sent per ACK" default:"16" env:"RS_TFTP_MAX_WINDOWSIZE"`
+	TftpTimeout         int    `long:"tftp-timeout" description:"Number of seconds to wait for a TFTP ACK before sending again" default:"5" env:"RS_TFTP_TIMEOUT"`
+	TftpRetries         int    `long:"tftp-retries" description:"Number of times to send a TFTP packet again before giving up" default:"5" env:"RS_TFTP_RETRIES"`
+	TftpTransferTimeout int    `long:"tftp-transfer-timeout" description:"Number of seconds a TFTP transfer may take before it is aborted" default:"600" env:"RS_TFTP_TRANSFER_TIMEOUT"`
 	ApiPort             int    `long:"api-port" description:"Port for the API server to listen on" default:"8092" env:"RS_API_PORT"`
 	DhcpPort            int    `long:"dhcp-port" description:"Port for the DHCP server to listen on" default:"67" env:"RS_DHCP_PORT"`
 	BinlPort            int    `long:"binl-port" description:"Port for the PXE/BINL server to listen on" default:"4011" env:"RS_BINL_PORT"`
+	DhcpMacBurst        int    `long:"dhcp-mac-burst" description:"Number of DHCP packets a client MAC address may send in the rate window before it is ignored.  0 disables the limit" default:"20" env:"RS_DHCP_MAC_BURST"`
+	DhcpRelayBurst      int    `long:"dhcp-relay-burst" description:"Number of DHCP packets a relay may forward in the rate window before it is ignored.  0 disables the limit" default:"0" env:"RS_DHCP_RELAY_BURST"`
+	DhcpRateWindow      int    `long:"dhcp-rate-window" description:"Length in seconds of the DHCP rate limiting window" default:"10" env:"RS_DHCP_RATE_WINDOW"`
+	DhcpIgnoreTime      int    `long:"dhcp-ignore-time" description:"Number of seconds to ignore a DHCP client or relay that exceeds its rate limit" default:"60" env:"RS_DHCP_IGNORE_TIME"`
+	Dhcp6Enabled        bool   `long:"dhcp6-enabled" description:"Enable the DHCPv6 server" env:"RS_DHCP6_ENABLED"`
+	Dhcp6Port           int    `long:"dhcp6-port" description:"Port for the DHCPv6 server to listen on" default:"547" env:"RS_DHCP6_PORT"`
+	DnsEnabled          bool   `long:"dns-enabled" description:"Enable the DNS server" env:"RS_DNS_ENABLED"`
+	DnsPort             int    `long:"dns-port" description:"Port for the DNS server to listen on" default:"53" env:"RS_DNS_PORT"`
+	DnsZone             string `long:"dns-zone" description:"Zone the DNS server answers for" default:"" env:"RS_DNS_ZONE"`
+	DnsForwarder        string `long:"dns-forwarder" description:"DNS server to forward queries outside the zone from local clients to.  They are refused if empty" default:"" env:"RS_DNS_FORWARDER"`
+	LeaseHistoryEntries int    `long:"lease-history-entries" description:"Number of DHCP transactions to keep in the history of each address.  0 disables lease history" default:"1000" env:"RS_LEASE_HISTORY_ENTRIES"`
+	LeaseHistoryDays    int    `long:"lease-history-days" description:"Number of days to keep DHCP transactions in the lease history" default:"30" env:"RS_LEASE_HISTORY_DAYS"`
+	SubnetStatsInterval int    `long:"subnet-stats-interval" description:"Number of seconds between subnet utilization updates" default:"60" env:"RS_SUBNET_STATS_INTERVAL"`
+	SubnetUsageLimit    int    `long:"subnet-usage-limit" description:"Percentage of a subnet's active range in use that triggers a subnet utilization event.  0 disables the events" default:"90" env:"RS_SUBNET_USAGE_LIMIT"`
 	UnknownTokenTimeout int    `long:"unknown-token-timeout" description:"The default timeout in seconds for the machine create authorization token" default:"600" env:"RS_UNKNOWN_TOKEN_TIMEOUT"`
 	KnownTokenTimeout   int    `long:"known-token-timeout" description:"The default timeout in seconds for the machine update authorization token" default:"3600" env:"RS_KNOWN_TOKEN_TIMEOUT"`
 	OurAddress          string `long:"static-ip" description:"IP address to advertise for the static HTTP file server" default:"" env:"RS_STATIC_IP"`
@@ -117,6 +139,13 @@ type ProgOpts struct {
 	HaAddress   string `long:"ha-address" description:"IP address to advertise as our HA address" default:"" env:"RS_HA_ADDRESS"`
 	HaInterface string `long:"ha-interface" description:"Interface to put the VIP on for HA" default:"" env:"RS_HA_INTERFACE"`
 
+	DhcpPeer         string `long:"dhcp-peer" description:"API endpoint of the DHCP failover peer to synchronize leases with" default:"" env:"RS_DHCP_PEER"`
+	DhcpPeerUsername string `long:"dhcp-peer-username" description:"Username to use when talking to the DHCP failover peer" default:"rocketskates" env:"RS_DHCP_PEER_USERNAME"`
+	DhcpPeerPassword string `long:"dhcp-peer-password" description:"Password to use when talking to the DHCP failover peer" default:"r0cketsk8ts" env:"RS_DHCP_PEER_PASSWORD"`
+	DhcpPeerMode     string `long:"dhcp-peer-mode" description:"DHCP failover mode.  Either 'split' or 'standby'" default:"split" env:"RS_DHCP_PEER_MODE"`
+	DhcpPeerPrimary  bool   `long:"dhcp-peer-primary" description:"This endpoint is the primary DHCP failover peer" env:"RS_DHCP_PEER_PRIMARY"`
+	DhcpPeerMCLT     int    `long:"dhcp-peer-mclt" description:"Maximum Client Lead Time in seconds for DHCP failover" default:"3600" env:"RS_DHCP_PEER_MCLT"`
+
 	PromGwUrl      string `long:"prometheus-gateway-url" description:"URL to push metrics to" default:"" env:"RS_PROM_GW_URL"`
 	PromInterval   int    `long:"prometheus-interval" description:"Duration in seconds to push metrics" default:"5" env:"RS_PROM_INTERVAL"`
 	CleanupCorrupt bool   `long:"cleanup" description:"Clean up corrupted writable data.  Only use when directed." env:"RS_CLEANUP_CORRUPT"`
@@ -373,6 +402,12 @@ func server(localLogger *log.Logger, cOpts *ProgOpts) string {
 	if cOpts.CleanupCorrupt {
 		dt.Cleanup = true
 	}
+	dt.LeaseHistory.MaxEntries = cOpts.LeaseHistoryEntries
+	dt.LeaseHistory.MaxAge = time.Duration(cOpts.LeaseHistoryDays) * 24 * time.Hour
+	if !cOpts.DisableIsoDownload {
+		services = append(services, dt.StartIsoDownloads(cOpts.IsoDownloadRetries))
+	}
+	services = append(services, dt.StartJobWatchdog())
 
 	pc, err := midlayer.InitPluginController(cOpts.PluginRoot, cOpts.PluginCommRoot, dt, publishers)
 	if err != nil {
@@ -408,7 +443,14 @@ func server(localLogger *log.Logger, cOpts *ProgOpts) string {
 			fmt.Sprintf(":%d", cOpts.TftpPort),
 			dt.FS.TftpResponder(),
 			buf.Log("static"),
-			publishers)
+			publishers,
+			midlayer.TftpOptions{
+				MaxBlockSize:    cOpts.TftpMaxBlockSize,
+				MaxWindowSize:   cOpts.TftpMaxWindowSize,
+				Timeout:         time.Duration(cOpts.TftpTimeout) * time.Second,
+				Retries:         cOpts.TftpRetries,
+				TransferTimeout: time.Duration(cOpts.TftpTransferTimeout) * time.Second,
+			})
 		if err != nil {
 			return fmt.Sprintf("Error starting TFTP server: %v", err)
 		}
@@ -428,6 +470,12 @@ func server(localLogger *log.Logger, cOpts *ProgOpts) string {
 	}
 
 	if !cOpts.DisableDHCP {
+		dhcpLimits := midlayer.DhcpRateLimit{
+			MacBurst:   cOpts.DhcpMacBurst,
+			RelayBurst: cOpts.DhcpRelayBurst,
+			Window:     time.Duration(cOpts.DhcpRateWindow) * time.Second,
+			IgnoreFor:  time.Duration(cOpts.DhcpIgnoreTime) * time.Second,
+		}
 		localLogger.Printf("Starting DHCP server")
 		svc, err := midlayer.StartDhcpHandler(
 			dt,
@@ -436,7 +484,8 @@ func server(localLogger *log.Logger, cOpts *ProgOpts) string {
 			cOpts.DhcpPort,
 			publishers,
 			false,
-			cOpts.FakePinger)
+			cOpts.FakePinger,
+			dhcpLimits)
 		if err != nil {
 			return fmt.Sprintf("Error starting DHCP server: %v", err)
 		}
@@ -451,12 +500,81 @@ func server(localLogger *log.Logger, cOpts *ProgOpts) string {
 				cOpts.BinlPort,
 				publishers,
 				true,
-				cOpts.FakePinger)
+				cOpts.FakePinger,
+				dhcpLimits)
 			if err != nil {
 				return fmt.Sprintf("Error starting PXE/BINL server: %v", err)
 			}
 			services = append(services, svc)
 		}
+
+		if cOpts.DhcpPeer != "" {
+			localLogger.Printf("Starting DHCP failover with %s", cOpts.DhcpPeer)
+			fo, err := backend.NewFailover(cOpts.DhcpPeer,
+				cOpts.DhcpPeerMode,
+				cOpts.DhcpPeerPrimary,
+				time.Duration(cOpts.DhcpPeerMCLT)*time.Second)
+			if err != nil {
+				return fmt.Sprintf("Error starting DHCP failover: %v", err)
+			}
+			svc, err := midlayer.StartDhcpPeer(dt,
+				buf.Log("dhcp"),
+				fo,
+				cOpts.DhcpPeerUsername,
+				cOpts.DhcpPeerPassword,
+				publishers)
+			if err != nil {
+				return fmt.Sprintf("Error starting DHCP failover: %v", err)
+			}
+			services = append(services, svc)
+		}
+
+		if cOpts.Dhcp6Enabled {
+			localLogger.Printf("Starting DHCPv6 server")
+			svc, err := midlayer.StartDhcp6Handler(
+				dt,
+				buf.Log("dhcp"),
+				cOpts.DhcpInterfaces,
+				cOpts.Dhcp6Port,
+				publishers)
+			if err != nil {
+				return fmt.Sprintf("Error starting DHCPv6 server: %v", err)
+			}
+			services = append(services, svc)
+		}
+	}
+
+	if cOpts.DnsEnabled {
+		if cOpts.DnsZone == "" {
+			return "Error starting DNS server: --dns-zone must be set"
+		}
+		localLogger.Printf("Starting DNS server for %s", cOpts.DnsZone)
+		svc, err := midlayer.ServeDns(
+			fmt.Sprintf(":%d", cOpts.DnsPort),
+			cOpts.DnsZone,
+			cOpts.DnsForwarder,
+			dt,
+			publishers,
+			buf.Log("dhcp"))
+		if err != nil {
+			return fmt.Sprintf("Error starting DNS server: %v", err)
+		}
+		services = append(services, svc)
+	}
+
+	localLogger.Printf("Starting subnet utilization monitor")
+	services = append(services, midlayer.StartSubnetMonitor(dt, buf.Log("dhcp"), publishers,
+		time.Duration(cOpts.SubnetStatsInterval)*time.Second,
+		float64(cOpts.SubnetUsageLimit)))
+
+	if !cOpts.DisableDDNS {
+		localLogger.Printf("Starting dynamic DNS updater")
+		services = append(services, backend.StartDDNS(dt, buf.Log("dhcp"), publishers))
+	}
+
+	if !cOpts.DisableTftpServer || !cOpts.DisableProvisioner {
+		localLogger.Printf("Starting boot progress tracker")
+		services = append(services, midlayer.StartBootProgress(dt, buf.Log("static"), publishers))
 	}
 
 	var cfg *tls.Config
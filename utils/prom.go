@@ -54,3 +54,54 @@ func (p *Prometheus) CounterWithLabelValues(id string, args ...string) prometheu
 	}
 	return o.WithLabelValues(args...)
 }
+
+// GaugeWithLabelValues returns the Gauge for the passed label values
+// from a gauge vector metric.
+func (p *Prometheus) GaugeWithLabelValues(id string, args ...string) prometheus.Gauge {
+	m, ok := p.metrics[id]
+	if !ok {
+		p.l.Errorf("Failed to lookup metric with labels: %s", id)
+		return nil
+	}
+	o, ok := m.MetricCollector.(*prometheus.GaugeVec)
+	if !ok {
+		p.l.Errorf("metric, %s, is not an GaugeVec, %+v", id, m.MetricCollector)
+		return nil
+	}
+	return o.WithLabelValues(args...)
+}
+
+// ObserverWithLabelValues returns the Observer for the passed label
+// values from a histogram or summary vector metric.
+func (p *Prometheus) ObserverWithLabelValues(id string, args ...string) prometheus.Observer {
+	m, ok := p.metrics[id]
+	if !ok {
+		p.l.Errorf("Failed to lookup metric with labels: %s", id)
+		return nil
+	}
+	o, ok := m.MetricCollector.(prometheus.ObserverVec)
+	if !ok {
+		p.l.Errorf("metric, %s, is not an ObserverVec, %+v", id, m.MetricCollector)
+		return nil
+	}
+	return o.WithLabelValues(args...)
+}
+
+// DeleteLabelValues removes the metric with the passed label values
+// from a vector metric, so that things that no longer exist stop
+// being reported.
+func (p *Prometheus) DeleteLabelValues(id string, args ...string) {
+	m, ok := p.metrics[id]
+	if !ok {
+		p.l.Errorf("Failed to lookup metric with labels: %s", id)
+		return
+	}
+	switch o := m.MetricCollector.(type) {
+	case *prometheus.GaugeVec:
+		o.DeleteLabelValues(args...)
+	case *prometheus.CounterVec:
+		o.DeleteLabelValues(args...)
+	default:
+		p.l.Errorf("metric, %s, is not a vector, %+v", id, m.MetricCollector)
+	}
+}